@@ -1,205 +1,303 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"package-to-image-placer/pkg/batch"
 	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/diff"
 	"package-to-image-placer/pkg/helper"
-	"package-to-image-placer/pkg/image"
+	"package-to-image-placer/pkg/logging"
+	"package-to-image-placer/pkg/placer"
 	"package-to-image-placer/pkg/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
+// exitCodeInterrupted is the exit code of the program interrupted by SIGINT or SIGTERM
+const exitCodeInterrupted = 130
+
+// diffCommand is the subcommand comparing two images
+const diffCommand = "diff"
+
 func main() {
-	err := parseArguments(os.Args[1:])
+	if len(os.Args) > 1 && os.Args[1] == diffCommand {
+		runDiff(os.Args[2:])
+		return
+	}
+
+	config, err := parseArguments(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Error parsing arguments: %v", err)
 	}
-	err = configuration.ValidateConfiguration()
+
+	runID := logging.NewRunID()
+	ctx, stop := signal.NotifyContext(logging.WithRunID(context.Background(), runID), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// After the first signal the default behaviour is restored, so a second signal terminates the program immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	if config.BatchFile != "" {
+		runBatch(ctx, config, runID)
+		return
+	}
+	err = config.Validate()
 	if err != nil {
 		log.Fatalf("Configuration validation error: %v", err)
 	}
-	logFile, err := setupLogFile(configuration.Config.LogPath)
+	logFile, err := setupLogger(config, runID)
 	if err != nil {
-		log.Fatalf("Error setting up log file: %v", err)
+		log.Fatalf("Error setting up logging: %v", err)
 	}
 	defer closeLogFile(logFile)
 
-	err = helper.AllDepsInstalled()
+	err = placer.NewPlacer(config, user.NewTerminalPrompter(ctx), slog.Default()).Run(ctx)
 	if err != nil {
-		log.Printf("Error: %s\n", err)
-		os.Exit(1)
+		exitWithError(ctx, logFile, err)
 	}
+}
 
-	newConfigFilePath := ""
-	if configuration.Config.InteractiveRun {
-		log.Printf("Selecting standard packages.\n")
-		header_base := "Choose standard package to copy."
-		packages, err := user.SelectFilesInDir(configuration.Config.PackageDir, header_base)
-		log.Printf("Selected standard packages: %v\n", packages)
-		if err != nil {
-			log.Printf("Error: %s\n", err)
-			return
-		}
-		for _, pkg := range packages {
-			packageConfig := configuration.PackageConfig{PackagePath: pkg}
-			configuration.Config.Packages = append(configuration.Config.Packages, packageConfig)
-		}
-
-		log.Printf("Selecting configuration packages.\n")
-		header_base = "Choose configuration package to copy."
-		packages, err = user.SelectFilesInDir(configuration.Config.PackageDir, header_base)
-		log.Printf("Selected configuration packages: %v\n", packages)
-		if err != nil {
-			log.Printf("Error: %s\n", err)
-			return
-		}
-		for _, pkg := range packages {
-			packageConfig := configuration.ConfigurationPackage{PackagePath: pkg}
-			configuration.Config.ConfigurationPackages = append(configuration.Config.ConfigurationPackages, packageConfig)
-		}
-
-		if len(configuration.Config.Packages) == 0 && len(configuration.Config.ConfigurationPackages) == 0 {
-			log.Printf("No packages selected. Exiting...\n")
-			return
-		}
-
-		imagePath := ""
-		if configuration.Config.NoClone {
-			imagePath = configuration.Config.Target
-		} else {
-			imagePath = configuration.Config.Source
-		}
-
-		err = helper.ValidSourceImage(imagePath)
-		if err != nil {
-			helper.RemoveInvalidOutputImage(configuration.Config.Target, configuration.Config.NoClone)
-			log.Fatalf("Error: %s\n", err)
-		}
-
-		configuration.Config.PartitionNumbers, err = user.SelectPartitions(imagePath)
-		if err != nil {
-			helper.RemoveInvalidOutputImage(configuration.Config.Target, configuration.Config.NoClone)
-			log.Fatalf("Error while selecting partitions: %s\n", err)
-		}
+// exitWithError logs the error and exits the program.
+// If the program was interrupted, it exits with exitCodeInterrupted.
+func exitWithError(ctx context.Context, logFile *os.File, err error) {
+	exitCode := 1
+	if ctx.Err() != nil {
+		slog.Error("Interrupted", "error", err)
+		exitCode = exitCodeInterrupted
+	} else {
+		slog.Error("Failed", "error", err)
+	}
+	closeLogFile(logFile)
+	os.Exit(exitCode)
+}
 
-		if user.GetUserConfirmation("Do you want to save the configuration?") {
-			newConfigFilePath, err = configuration.CreateConfigurationFile(configuration.Config)
-			if err != nil {
-				log.Printf("Error: %s\n", err)
-			}
-		}
+// runBatch creates all device images defined in the batch file. Exits the program on failure.
+func runBatch(ctx context.Context, config *configuration.Configuration, runID string) {
+	logFile, err := setupLogger(config, runID)
+	if err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
+	}
+	defer closeLogFile(logFile)
 
+	err = helper.AllDepsInstalled()
+	if err != nil {
+		exitWithError(ctx, logFile, err)
+	}
+	err = batch.Run(ctx, config.BatchFile, config, slog.Default())
+	if err != nil {
+		exitWithError(ctx, logFile, err)
 	}
+	slog.Info("All device images created successfully")
+}
 
-	// Create a slice of package paths from configuration.Config.Packages and configuration.Config.ConfigurationPackages
-	var standardPackagePaths []string
-	var configurationPackagePaths []string
+// diffArguments holds the arguments of the diff subcommand
+type diffArguments struct {
+	source   string
+	target   string
+	format   string
+	logLevel string
+	options  diff.Options
+}
 
-	for _, pkg := range configuration.Config.Packages {
-		standardPackagePaths = append(standardPackagePaths, pkg.PackagePath)
+// runDiff compares two images and writes the differences to the standard output. Logs are written to the standard error.
+func runDiff(args []string) {
+	arguments, err := parseDiffArguments(args)
+	if err != nil {
+		log.Fatalf("Error parsing arguments: %v", err)
 	}
-	for _, pkg := range configuration.Config.ConfigurationPackages {
-		configurationPackagePaths = append(configurationPackagePaths, pkg.PackagePath)
+	logger, err := logging.NewLogger(os.Stderr, arguments.logLevel, logging.FormatText)
+	if err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
 	}
-	log.Printf("\n%d standard packages: \n\t%v\n%d configuration packages: \n\t%v\nwill be copied to partitions: %v\n", len(standardPackagePaths), strings.Join(standardPackagePaths, "\n\t"), len(configurationPackagePaths), strings.Join(configurationPackagePaths, "\n\t"), configuration.Config.PartitionNumbers)
+	slog.SetDefault(logger)
 
-	if configuration.Config.InteractiveRun && !user.GetUserConfirmation("Do you want to continue?") {
-		log.Printf("Operation cancelled by user\n")
-		return
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	if !configuration.Config.NoClone {
-		if helper.DoesFileExists(configuration.Config.Target) {
-			askUser := fmt.Sprintf("File %s already exists. Do you want to delete it?", configuration.Config.Target)
-			if configuration.Config.InteractiveRun && !user.GetUserConfirmation(askUser) {
-				log.Fatalf("file already exists and user chose not to delete it")
-			}
-			if err := os.Remove(configuration.Config.Target); err != nil {
-				log.Fatalf("unable to delete existing file: %s", err)
-			}
-		}
-		err := image.CloneImage(configuration.Config.Source, configuration.Config.Target)
+	if arguments.options.Backend != diff.BackendDiskfs {
+		err = helper.AllDepsInstalled()
 		if err != nil {
-			helper.RemoveInvalidOutputImage(configuration.Config.Target, configuration.Config.NoClone)
-			log.Fatalf("Error: %s\n", err)
+			exitWithError(ctx, nil, err)
 		}
 	}
-
-	err = image.CopyPackagesToImagePartitions()
+	result, err := diff.Compare(ctx, arguments.source, arguments.target, arguments.options, logger)
 	if err != nil {
-		helper.RemoveInvalidOutputImage(configuration.Config.Target, configuration.Config.NoClone)
-		log.Fatalf("Error: %s\n", err)
-		return
+		exitWithError(ctx, nil, err)
+	}
+	err = result.Write(os.Stdout, arguments.format)
+	if err != nil {
+		exitWithError(ctx, nil, err)
 	}
+}
 
-	log.Printf("All packages copied successfully\n")
+func parseDiffArguments(args []string) (*diffArguments, error) {
+	flags := flag.NewFlagSet("package-to-image-placer diff", flag.ContinueOnError)
+	format := flags.String("format", diff.FormatText, "Output format: text or json")
+	content := flags.Bool("content", false, "Show line diff of modified text files")
+	backend := flags.String("backend", diff.BackendAuto, "Backend reading the partitions: auto, guestmount or diskfs")
+	partitions := flags.String("partitions", "", "Comma separated numbers of partitions to compare, all partitions if empty")
+	logLevel := flags.String("log-level", logging.DefaultLevel, "Log level: debug, info, warn or error")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\npackage-to-image-placer diff [ opts... ] <source_image> <target_image>\n")
+		flags.PrintDefaults()
+	}
 
-	if newConfigFilePath != "" {
-		err = configuration.UpdateConfigurationFile(configuration.Config, newConfigFilePath)
-		if err != nil {
-			log.Fatalf("Error: %s\n", err)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return nil, fmt.Errorf("diff requires source and target image")
+	}
+	if *format != diff.FormatText && *format != diff.FormatJSON {
+		return nil, fmt.Errorf("unknown format '%s', must be %s or %s", *format, diff.FormatText, diff.FormatJSON)
+	}
+	if *backend != diff.BackendAuto && *backend != diff.BackendGuestmount && *backend != diff.BackendDiskfs {
+		return nil, fmt.Errorf("unknown backend '%s', must be one of %s, %s, %s", *backend, diff.BackendAuto, diff.BackendGuestmount, diff.BackendDiskfs)
+	}
+	arguments := &diffArguments{
+		source:   flags.Arg(0),
+		target:   flags.Arg(1),
+		format:   *format,
+		logLevel: *logLevel,
+		options:  diff.Options{Backend: *backend, ContentDiff: *content},
+	}
+	for _, partition := range strings.Split(*partitions, ",") {
+		if strings.TrimSpace(partition) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSpace(partition))
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid partition number '%s'", partition)
 		}
+		arguments.options.Partitions = append(arguments.options.Partitions, number)
 	}
+	return arguments, nil
 }
 
-func parseArguments(args []string) error {
+func parseArguments(args []string) (*configuration.Configuration, error) {
 	flags := flag.NewFlagSet("package-to-image-placer", flag.ContinueOnError)
 	configFile := flags.String("config", "", "Path to configuration file (non-interactive mode)")
+	batchFile := flags.String("batch", "", "Path to batch file. Creates image for every device in the batch file (non-interactive mode)")
+	jobs := flags.Int("jobs", 0, "Maximal number of device images created in parallel (batch mode)")
 	targetImage := flags.String("target", "", "Target image path (will be created).")
 	sourceImage := flags.String("source", "", "Source image")
 	noClone := flags.Bool("no-clone", false, "Do not clone source image. Target image must exist. If operation is not successful, may cause damage the image")
 	packageDir := flags.String("package-dir", "./", "Default package directory, from which package finder starts (interactive mode)")
 	logPath := flags.String("log-path", "./", "Path to log file")
+	logLevel := flags.String("log-level", logging.DefaultLevel, "Log level: debug (per-file events), info, warn or error")
+	logFormat := flags.String("log-format", logging.FormatText, "Log format: text or json")
+	reportPath := flags.String("report", "", "Path to JSON report of the run, written also when the run fails")
+	reproducible := flags.Bool("reproducible", false, "Create images with deterministic file content and metadata from identical inputs. Timestamps are taken from SOURCE_DATE_EPOCH (0 if unset), which also enables this mode")
+	keyring := flags.String("keyring", "", "Directory with public keys (minisign *.pub, GPG *.gpg). Every package must have a valid signature made by one of them")
+	requireIntegrity := flags.Bool("require-integrity", false, "Every package must have a SHA256 checksum or a signature, implied by -keyring")
+	selinuxMode := flags.String("selinux", "", "SELinux labeling of placed files: off (default), auto (if the image has a policy) or required")
+	backup := flags.Bool("backup", false, "Keep the files overwritten in the image as <file>.orig, unless the backup is set in the config file")
+	dryRun := flags.Bool("dry-run", false, "Only print the plan of all changes, no image is created or modified (non-interactive mode)")
+	parallelPartitions := flags.Int("parallel-partitions", 0, "Maximal number of partitions populated in parallel")
+	variables := variablesFlag{}
+	flags.Var(&variables, "var", "Template variable for configuration packages in form key=value. Can be used multiple times")
 	showUsage := flags.Bool("h", false, "Show usage")
 
 	err := flags.Parse(args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if *showUsage {
 		fmt.Printf("Usage:\n" +
 			"Interactive: \t\tpackage-to-image-placer -target <target_image> [ -source <src_image> | -no-clone ] [ opts... ]\n" +
-			"Non-interactive: \tpackage-to-image-placer -config <config_file> [ <override-opts> ]\n")
+			"Non-interactive: \tpackage-to-image-placer -config <config_file> [ <override-opts> ]\n" +
+			"Batch: \t\t\tpackage-to-image-placer -batch <batch_file> [ -jobs <n> ] [ -var <key=value> ... ]\n" +
+			"Diff: \t\t\tpackage-to-image-placer diff [ opts... ] <source_image> <target_image>\n")
 		flags.PrintDefaults()
 		os.Exit(0)
 	}
 
+	config := configuration.NewConfiguration()
 	if *configFile != "" {
-		file, err := os.Open(*configFile)
+		err = config.LoadConfigurationFile(*configFile)
 		if err != nil {
-			return fmt.Errorf("error opening configuration.Config file: %v", err)
+			return nil, err
 		}
-		defer file.Close()
+	}
 
-		decoder := json.NewDecoder(file)
-		err = decoder.Decode(&configuration.Config)
-		if err != nil {
-			return fmt.Errorf("error decoding configuration.Config file: %v", err)
+	if *batchFile != "" {
+		if *configFile != "" {
+			return nil, fmt.Errorf("config and batch are mutually exclusive")
 		}
-
-		configuration.Config.InteractiveRun = false
-		configuration.Config.ConfigFile = *configFile
-		configuration.ConvertRelativePathsToWorkingDir()
+		if *reportPath != "" {
+			return nil, fmt.Errorf("report is not supported in batch mode")
+		}
+		if *dryRun {
+			return nil, fmt.Errorf("dry run is not supported in batch mode")
+		}
+		config.BatchFile = *batchFile
+		config.Jobs = *jobs
+		config.InteractiveRun = false
 	}
 
 	if *sourceImage != "" {
-		configuration.Config.Source = *sourceImage
+		config.Source = *sourceImage
 	}
 	if *targetImage != "" {
-		configuration.Config.Target = *targetImage
+		config.Target = *targetImage
 	}
 	if *packageDir != "" {
-		configuration.Config.PackageDir = *packageDir
+		config.PackageDir = *packageDir
 	}
 	if *logPath != "./" {
-		configuration.Config.LogPath = *logPath
+		config.LogPath = *logPath
+	}
+	if *reportPath != "" {
+		config.ReportPath = *reportPath
+	}
+	if *keyring != "" {
+		config.Keyring = *keyring
+	}
+	if *requireIntegrity {
+		config.RequireIntegrity = true
+	}
+	if *selinuxMode != "" {
+		config.SELinux = *selinuxMode
+	}
+	if *backup && config.Backup == nil {
+		config.Backup = &configuration.BackupConfig{}
+	}
+	config.DryRun = *dryRun
+	if *reproducible {
+		config.Reproducible = true
+	}
+	err = config.LoadSourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+	config.LogLevel = *logLevel
+	config.LogFormat = *logFormat
+	if *parallelPartitions != 0 {
+		config.ParallelPartitions = *parallelPartitions
+	}
+	if config.Variables == nil {
+		config.Variables = map[string]string{}
+	}
+	for key, value := range variables {
+		config.Variables[key] = value
 	}
 
 	// Check if the overwrite flag has been set
@@ -210,18 +308,45 @@ func parseArguments(args []string) error {
 		}
 	})
 	if noCloneSet {
-		configuration.Config.NoClone = *noClone
+		config.NoClone = *noClone
+	}
+	return config, nil
+}
+
+// variablesFlag collects template variables given by repeated -var key=value arguments
+type variablesFlag map[string]string
+
+func (v variablesFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
 	}
+	return strings.Join(pairs, ",")
+}
+
+func (v variablesFlag) Set(value string) error {
+	key, val, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("variable must be in form key=value, got '%s'", value)
+	}
+	v[key] = val
 	return nil
 }
 
-func setupLogFile(path string) (*os.File, error) {
-	logFile, err := os.OpenFile(filepath.Join(path, "package_to_image_placer.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// setupLogger sets the default logger to write to stdout and to the log file in the log path.
+// All records carry the run ID.
+func setupLogger(config *configuration.Configuration, runID string) (*os.File, error) {
+	logFile, err := os.OpenFile(filepath.Join(config.LogPath, "package_to_image_placer.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
 	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
+	logger, err := logging.NewLogger(mw, config.LogLevel, config.LogFormat)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	slog.SetDefault(logger.With(logging.RunIDKey, runID))
 	return logFile, nil
 }
 
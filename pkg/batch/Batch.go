@@ -0,0 +1,338 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/image"
+	"package-to-image-placer/pkg/logging"
+	"package-to-image-placer/pkg/placer"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxParallel = 2
+
+// DeviceConfig holds the per-device overrides applied on top of the prepared base image.
+type DeviceConfig struct {
+	Name                  string                               `json:"name"`
+	Target                string                               `json:"target"`
+	ConfigurationPackages []configuration.ConfigurationPackage `json:"configuration-packages"`
+	Variables             map[string]string                    `json:"variables"`
+}
+
+// BatchConfig describes a batch run. The standard packages of the base configuration are placed once
+// to the base target image, from which all device images are derived. The configuration packages
+// of the base are placed to every device image together with the device configuration packages.
+type BatchConfig struct {
+	Base        configuration.Configuration `json:"base"`
+	Devices     []DeviceConfig              `json:"devices"`
+	MaxParallel int                         `json:"max-parallel"`
+}
+
+// DeviceResult holds the result of creating one device image.
+type DeviceResult struct {
+	Name     string
+	Target   string
+	Duration time.Duration
+	Err      error
+}
+
+// LoadBatchConfiguration loads the batch configuration from the given path.
+// Relative paths are resolved against the location of the batch file to absolute paths.
+func LoadBatchConfiguration(path string) (*BatchConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening batch file: %v", err)
+	}
+	defer file.Close()
+
+	batchConfig := &BatchConfig{}
+	err = json.NewDecoder(file).Decode(batchConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding batch file: %v", err)
+	}
+
+	baseDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve batch file directory: %v", err)
+	}
+	for i := range batchConfig.Devices {
+		device := &batchConfig.Devices[i]
+		device.Target = resolvePath(baseDir, device.Target)
+		for j := range device.ConfigurationPackages {
+			pkg := &device.ConfigurationPackages[j]
+			pkg.PackagePath = resolvePath(baseDir, pkg.PackagePath)
+			pkg.Signature = resolvePath(baseDir, pkg.Signature)
+			if pkg.PostInstallHook != nil {
+				pkg.PostInstallHook.Script = resolvePath(baseDir, pkg.PostInstallHook.Script)
+			}
+		}
+		if device.Name == "" {
+			device.Name = strings.TrimSuffix(filepath.Base(device.Target), filepath.Ext(device.Target))
+		}
+	}
+	if batchConfig.MaxParallel <= 0 {
+		batchConfig.MaxParallel = defaultMaxParallel
+	}
+	return batchConfig, nil
+}
+
+// validateDevices checks that every device has a unique name and target and that all its packages exist.
+func (batchConfig *BatchConfig) validateDevices() error {
+	if len(batchConfig.Devices) == 0 {
+		return fmt.Errorf("no devices defined in batch file")
+	}
+	names := make(map[string]bool)
+	targets := make(map[string]bool)
+	for _, device := range batchConfig.Devices {
+		if device.Target == "" {
+			return fmt.Errorf("device %s has no target", device.Name)
+		}
+		if device.Target == batchConfig.Base.Target || device.Target == batchConfig.Base.Source {
+			return fmt.Errorf("target of device %s is the same as the base source or target image", device.Name)
+		}
+		if names[device.Name] {
+			return fmt.Errorf("device name %s is not unique", device.Name)
+		}
+		if targets[device.Target] {
+			return fmt.Errorf("target %s is used by multiple devices", device.Target)
+		}
+		names[device.Name] = true
+		targets[device.Target] = true
+		for _, pkg := range device.ConfigurationPackages {
+			if !helper.DoesFileExists(pkg.PackagePath) {
+				return fmt.Errorf("configuration package %s of device %s does not exist", pkg.PackagePath, device.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Run validates the batch configuration, prepares the base image and creates all device images.
+// The template variables, log path and number of jobs given on the command line (in commandLine) override the batch file.
+// Devices are processed in parallel, at most MaxParallel at once. A summary is logged at the end.
+// Returns an error if the base image could not be prepared or any of the devices failed. Dry run and report are not supported.
+// When the context is cancelled, devices not yet started are skipped and images of the interrupted ones are removed.
+func Run(ctx context.Context, batchFile string, commandLine *configuration.Configuration, logger *slog.Logger) error {
+	// The device images are copies of the prepared base image, which can't be planned without being written
+	if commandLine.DryRun {
+		return fmt.Errorf("dry run is not supported in batch mode")
+	}
+	// The report describes a single image, the device images have their log files instead
+	if commandLine.ReportPath != "" {
+		return fmt.Errorf("report is not supported in batch mode")
+	}
+	// The base paths are resolved against the absolute batch file path, so they don't depend on the working directory
+	batchFile, err := filepath.Abs(batchFile)
+	if err != nil {
+		return fmt.Errorf("unable to resolve batch file path: %v", err)
+	}
+	batchConfig, err := LoadBatchConfiguration(batchFile)
+	if err != nil {
+		return err
+	}
+	if commandLine.Jobs > 0 {
+		batchConfig.MaxParallel = commandLine.Jobs
+	}
+
+	base := &batchConfig.Base
+	base.InteractiveRun = false
+	base.ConfigFile = batchFile
+	base.ConvertRelativePathsToWorkingDir()
+	base.Variables = commandLine.Variables
+	if commandLine.LogPath != "" {
+		base.LogPath = commandLine.LogPath
+	}
+	base.LogLevel = commandLine.LogLevel
+	base.LogFormat = commandLine.LogFormat
+	base.Reproducible = base.Reproducible || commandLine.Reproducible
+	base.SourceDateEpoch = commandLine.SourceDateEpoch
+	if commandLine.Keyring != "" {
+		base.Keyring = commandLine.Keyring
+	}
+	base.RequireIntegrity = base.RequireIntegrity || commandLine.RequireIntegrity
+	if commandLine.SELinux != "" {
+		base.SELinux = commandLine.SELinux
+	}
+	if commandLine.Backup != nil && base.Backup == nil {
+		base.Backup = commandLine.Backup
+	}
+	err = base.Validate()
+	if err != nil {
+		return fmt.Errorf("base configuration validation error: %v", err)
+	}
+	err = batchConfig.validateDevices()
+	if err != nil {
+		return err
+	}
+
+	err = prepareBase(ctx, *base, logger)
+	if err != nil {
+		helper.RemoveInvalidOutputImage(base.Target, base.NoClone)
+		return fmt.Errorf("failed to prepare base image: %v", err)
+	}
+
+	results := make([]DeviceResult, len(batchConfig.Devices))
+	semaphore := make(chan struct{}, batchConfig.MaxParallel)
+	var wg sync.WaitGroup
+	for i, device := range batchConfig.Devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = DeviceResult{Name: device.Name, Target: device.Target, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-semaphore }()
+
+			start := time.Now()
+			logger.Info("Creating device image", "device", device.Name, "target", device.Target)
+			err := createDeviceImage(ctx, *base, device)
+			if err != nil {
+				os.Remove(device.Target)
+			}
+			results[i] = DeviceResult{Name: device.Name, Target: device.Target, Duration: time.Since(start), Err: err}
+		}()
+	}
+	wg.Wait()
+
+	return summarize(results, logger)
+}
+
+// prepareBase creates the base image from which the device images are derived.
+// The source image is cloned and the standard packages of the base configuration are placed to it and verified.
+func prepareBase(ctx context.Context, base configuration.Configuration, logger *slog.Logger) error {
+	base.ConfigurationPackages = nil
+	basePlacer := placer.NewPlacer(&base, nil, logger)
+	err := basePlacer.Clone(ctx)
+	if err != nil {
+		return err
+	}
+	if len(base.Packages) == 0 {
+		return nil
+	}
+	err = basePlacer.Place(ctx)
+	if err != nil {
+		return err
+	}
+	err = basePlacer.VerifyPlacement(ctx)
+	if err != nil {
+		return fmt.Errorf("base placement verification failed: %v", err)
+	}
+	logger.Info("Base placement verified", "target", base.Target)
+	return nil
+}
+
+// createDeviceImage copies the base image to the device target, places the configuration packages to it and verifies them.
+// Device variables override the variables given on the command line of the batch run.
+// The log of the device is written to a log file named after the device in the log path of the base configuration.
+// Its records carry the device name and the run ID from the context, so they can be correlated with the batch log.
+func createDeviceImage(ctx context.Context, base configuration.Configuration, device DeviceConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := helper.CopyFile(device.Target, base.Target, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to copy base image: %v", err)
+	}
+	err = image.RegenerateGUIDs(device.Target, base.Reproducible)
+	if err != nil {
+		return fmt.Errorf("failed to regenerate partition table GUIDs: %v", err)
+	}
+
+	deviceConfig := configuration.Configuration{
+		Target:                device.Target,
+		NoClone:               true,
+		Packages:              []configuration.PackageConfig{},
+		ConfigurationPackages: append(append([]configuration.ConfigurationPackage{}, base.ConfigurationPackages...), device.ConfigurationPackages...),
+		PartitionNumbers:      base.PartitionNumbers,
+		Partitions:            base.Partitions,
+		Volumes:               base.Volumes,
+		ParallelPartitions:    base.ParallelPartitions,
+		Reproducible:          base.Reproducible,
+		SourceDateEpoch:       base.SourceDateEpoch,
+		Keyring:               base.Keyring,
+		RequireIntegrity:      base.RequireIntegrity,
+		Extraction:            base.Extraction,
+		SELinux:               base.SELinux,
+		Backup:                base.Backup,
+		AllowXattrLoss:        base.AllowXattrLoss,
+		Variables:             map[string]string{},
+		InteractiveRun:        false,
+	}
+	if len(deviceConfig.ConfigurationPackages) == 0 {
+		return nil
+	}
+	for key, value := range base.Variables {
+		deviceConfig.Variables[key] = value
+	}
+	for key, value := range device.Variables {
+		deviceConfig.Variables[key] = value
+	}
+	err = deviceConfig.Validate()
+	if err != nil {
+		return err
+	}
+
+	deviceLog, err := os.Create(filepath.Join(base.LogPath, "batch-"+device.Name+".log"))
+	if err != nil {
+		return fmt.Errorf("failed to create device log file: %v", err)
+	}
+	defer deviceLog.Close()
+
+	logger, err := logging.NewLogger(deviceLog, base.LogLevel, base.LogFormat)
+	if err != nil {
+		return err
+	}
+	logger = logger.With("device", device.Name)
+	if runID := logging.RunID(ctx); runID != "" {
+		logger = logger.With(logging.RunIDKey, runID)
+	}
+	devicePlacer := placer.NewPlacer(&deviceConfig, nil, logger)
+	err = devicePlacer.Place(ctx)
+	if err != nil {
+		logger.Error("Placement failed", "error", err)
+		return fmt.Errorf("placement failed (see %s): %v", deviceLog.Name(), err)
+	}
+	err = devicePlacer.VerifyPlacement(ctx)
+	if err != nil {
+		logger.Error("Placement verification failed", "error", err)
+		return fmt.Errorf("placement verification failed (see %s): %v", deviceLog.Name(), err)
+	}
+	logger.Info("Placement verified", "target", device.Target)
+	return nil
+}
+
+// summarize logs the result of every device and returns an error if any of them failed.
+func summarize(results []DeviceResult, logger *slog.Logger) error {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			logger.Error("Device failed", "device", result.Name, "duration", result.Duration.Round(time.Second), "error", result.Err)
+			continue
+		}
+		logger.Info("Device succeeded", "device", result.Name, "target", result.Target, "duration", result.Duration.Round(time.Second))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices failed", failed, len(results))
+	}
+	return nil
+}
+
+// resolvePath converts a path relative to the absolute baseDir to an absolute path.
+func resolvePath(baseDir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -0,0 +1,242 @@
+package batch
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const configurationPackage = "../../testdata/archives/configuration_package.zip"
+
+func writeBatchFile(t *testing.T, content string) string {
+	batchFile := filepath.Join(t.TempDir(), "batch.json")
+	err := os.WriteFile(batchFile, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return batchFile
+}
+
+func TestLoadBatchConfiguration_ResolvesPathsAndNames(t *testing.T) {
+	batchFile := writeBatchFile(t, `{
+		"base": {"source": "source.img", "target": "base.img", "partition-numbers": [1]},
+		"devices": [
+			{"target": "images/device-01.img", "variables": {"hostname": "device-01"}},
+			{"name": "second", "target": "/abs/device-02.img"}
+		]
+	}`)
+
+	batchConfig, err := LoadBatchConfiguration(batchFile)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expectedTarget := filepath.Join(filepath.Dir(batchFile), "images/device-01.img")
+	if batchConfig.Devices[0].Target != expectedTarget {
+		t.Errorf("expected target %s, got %s", expectedTarget, batchConfig.Devices[0].Target)
+	}
+	if batchConfig.Devices[0].Name != "device-01" {
+		t.Errorf("expected name device-01, got %s", batchConfig.Devices[0].Name)
+	}
+	if batchConfig.Devices[1].Target != "/abs/device-02.img" || batchConfig.Devices[1].Name != "second" {
+		t.Errorf("expected absolute target and explicit name to be kept, got %s and %s", batchConfig.Devices[1].Target, batchConfig.Devices[1].Name)
+	}
+	if batchConfig.MaxParallel != defaultMaxParallel {
+		t.Errorf("expected default max parallel %d, got %d", defaultMaxParallel, batchConfig.MaxParallel)
+	}
+}
+
+func TestValidateDevices_DuplicateTarget(t *testing.T) {
+	batchConfig := BatchConfig{Devices: []DeviceConfig{
+		{Name: "a", Target: "device.img"},
+		{Name: "b", Target: "device.img"},
+	}}
+	if err := batchConfig.validateDevices(); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateDevices_TargetSameAsBase(t *testing.T) {
+	batchConfig := BatchConfig{Devices: []DeviceConfig{{Name: "a", Target: "base.img"}}}
+	batchConfig.Base.Target = "base.img"
+	if err := batchConfig.validateDevices(); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateDevices_Success(t *testing.T) {
+	batchConfig := BatchConfig{Devices: []DeviceConfig{{Name: "a", Target: "device-a.img"}, {Name: "b", Target: "device-b.img"}}}
+	batchConfig.Base.Target = "base.img"
+	batchConfig.Devices[0].ConfigurationPackages = append(batchConfig.Devices[0].ConfigurationPackages, configuration.ConfigurationPackage{PackagePath: configurationPackage})
+	if err := batchConfig.validateDevices(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestLoadBatchConfiguration_RelativeBatchFile(t *testing.T) {
+	batchFile := writeBatchFile(t, `{
+		"base": {"source": "source.img", "target": "base.img", "partition-numbers": [1]},
+		"devices": [
+			{"target": "device-01.img", "configuration-packages": [
+				{"package-path": "device.zip", "post-install-hook": {"script": "hooks/device.sh"}}
+			]}
+		]
+	}`)
+	workingDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	relativeBatchFile, err := filepath.Rel(workingDir, batchFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	batchConfig, err := LoadBatchConfiguration(relativeBatchFile)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	batchDir := filepath.Dir(batchFile)
+	device := batchConfig.Devices[0]
+	if device.Target != filepath.Join(batchDir, "device-01.img") {
+		t.Errorf("expected absolute target, got %s", device.Target)
+	}
+	if device.ConfigurationPackages[0].PackagePath != filepath.Join(batchDir, "device.zip") {
+		t.Errorf("expected absolute package path, got %s", device.ConfigurationPackages[0].PackagePath)
+	}
+	if device.ConfigurationPackages[0].PostInstallHook.Script != filepath.Join(batchDir, "hooks/device.sh") {
+		t.Errorf("expected hook script resolved against the batch file, got %s", device.ConfigurationPackages[0].PostInstallHook.Script)
+	}
+}
+
+func createBaseImage(t *testing.T, imagePath string) {
+	imageDisk, err := diskfs.Create(imagePath, 4*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem, Name: "rootfs"},
+	}}
+	err = imageDisk.Partition(table)
+	imageDisk.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func readGUIDs(t *testing.T, imagePath string) (string, string) {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer imageDisk.Close()
+	partitionTable, err := imageDisk.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := partitionTable.(*gpt.Table)
+	return table.GUID, table.Partitions[0].GUID
+}
+
+func TestCreateDeviceImage_DifferentGUIDs(t *testing.T) {
+	for _, reproducible := range []bool{false, true} {
+		dir := t.TempDir()
+		base := configuration.Configuration{Target: filepath.Join(dir, "base.img"), Reproducible: reproducible}
+		createBaseImage(t, base.Target)
+		baseDiskGUID, basePartitionGUID := readGUIDs(t, base.Target)
+
+		devices := []DeviceConfig{{Name: "first", Target: filepath.Join(dir, "first.img")}, {Name: "second", Target: filepath.Join(dir, "second.img")}}
+		var diskGUIDs, partitionGUIDs []string
+		for _, device := range devices {
+			err := createDeviceImage(context.Background(), base, device)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			diskGUID, partitionGUID := readGUIDs(t, device.Target)
+			diskGUIDs = append(diskGUIDs, diskGUID)
+			partitionGUIDs = append(partitionGUIDs, partitionGUID)
+		}
+
+		if diskGUIDs[0] == diskGUIDs[1] || diskGUIDs[0] == baseDiskGUID {
+			t.Errorf("reproducible %v: expected different disk GUIDs, got base %s and devices %v", reproducible, baseDiskGUID, diskGUIDs)
+		}
+		if partitionGUIDs[0] == partitionGUIDs[1] || partitionGUIDs[0] == basePartitionGUID {
+			t.Errorf("reproducible %v: expected different partition GUIDs, got base %s and devices %v", reproducible, basePartitionGUID, partitionGUIDs)
+		}
+	}
+}
+
+func TestCreateDeviceImage_ReproducibleGUIDs(t *testing.T) {
+	dir := t.TempDir()
+	base := configuration.Configuration{Target: filepath.Join(dir, "base.img"), Reproducible: true}
+	createBaseImage(t, base.Target)
+	device := DeviceConfig{Name: "device", Target: filepath.Join(dir, "device.img")}
+
+	var diskGUIDs []string
+	for range 2 {
+		err := createDeviceImage(context.Background(), base, device)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		diskGUID, _ := readGUIDs(t, device.Target)
+		diskGUIDs = append(diskGUIDs, diskGUID)
+	}
+	if diskGUIDs[0] != diskGUIDs[1] {
+		t.Errorf("expected the same disk GUID for the same device, got %v", diskGUIDs)
+	}
+}
+
+func TestRun_DryRunRejected(t *testing.T) {
+	dir := t.TempDir()
+	createBaseImage(t, filepath.Join(dir, "source.img"))
+	batchFile := filepath.Join(dir, "batch.json")
+	err := os.WriteFile(batchFile, []byte(`{
+		"base": {"source": "source.img", "target": "base.img", "partition-numbers": [1]},
+		"devices": [{"target": "device.img"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	commandLine := configuration.NewConfiguration()
+	commandLine.DryRun = true
+
+	err = Run(context.Background(), batchFile, commandLine, slog.Default())
+	if err == nil || !strings.Contains(err.Error(), "dry run is not supported") {
+		t.Fatalf("expected dry run error, got %v", err)
+	}
+	for _, target := range []string{"base.img", "device.img"} {
+		if _, err := os.Stat(filepath.Join(dir, target)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be created, got %v", target, err)
+		}
+	}
+}
+
+func TestRun_ReportRejected(t *testing.T) {
+	dir := t.TempDir()
+	createBaseImage(t, filepath.Join(dir, "source.img"))
+	batchFile := filepath.Join(dir, "batch.json")
+	err := os.WriteFile(batchFile, []byte(`{
+		"base": {"source": "source.img", "target": "base.img", "partition-numbers": [1]},
+		"devices": [{"target": "device.img"}]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	commandLine := configuration.NewConfiguration()
+	commandLine.ReportPath = filepath.Join(dir, "report.json")
+
+	err = Run(context.Background(), batchFile, commandLine, slog.Default())
+	if err == nil || !strings.Contains(err.Error(), "report is not supported") {
+		t.Fatalf("expected report error, got %v", err)
+	}
+	for _, target := range []string{"base.img", "device.img", "report.json"} {
+		if _, err := os.Stat(filepath.Join(dir, target)); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to be created, got %v", target, err)
+		}
+	}
+}
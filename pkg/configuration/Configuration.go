@@ -3,25 +3,199 @@ package configuration
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/integrity"
+	"package-to-image-placer/pkg/permissions"
 	"package-to-image-placer/pkg/user"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 )
 
+// HookConfig describes a script which is run on the host after the package is extracted to the image.
+// Exactly one of Script (path on the host) and PackageScript (path inside the package) must be set.
+type HookConfig struct {
+	Script         string `json:"script,omitempty"`
+	PackageScript  string `json:"package-script,omitempty"`
+	TimeoutSeconds int    `json:"timeout-seconds,omitempty"`
+}
+
+// PermissionsConfig sets the ownership and permissions of the files extracted from a package.
+// Owners and groups are names from the image or numeric IDs, modes are octal numbers in strings (e.g. "0755").
+type PermissionsConfig struct {
+	Owner         string           `json:"owner,omitempty"`
+	Group         string           `json:"group,omitempty"`
+	DirectoryMode string           `json:"directory-mode,omitempty"`
+	Rules         []PermissionRule `json:"rules,omitempty"`
+}
+
+// PermissionRule overrides the permissions of the extracted files matching the pattern.
+// Patterns are matched like template patterns. When more rules match, the later ones take precedence.
+type PermissionRule struct {
+	Pattern      string            `json:"pattern"`
+	Owner        string            `json:"owner,omitempty"`
+	Group        string            `json:"group,omitempty"`
+	Mode         string            `json:"mode,omitempty"`
+	Capabilities string            `json:"capabilities,omitempty"`
+	Xattrs       map[string]string `json:"xattrs,omitempty"`
+}
+
 type PackageConfig struct {
-	PackagePath       string   `json:"package-path"`
-	EnableServices    bool     `json:"enable-services"`
-	ServiceNameSuffix string   `json:"service-name-suffix"`
-	TargetDirectory   string   `json:"target-directory"`
-	OverwriteFiles    []string `json:"overwrite-files"`
-	IsStandardPackage bool     `json:"-"`
+	PackagePath       string             `json:"package-path"`
+	EnableServices    bool               `json:"enable-services"`
+	ServiceNameSuffix string             `json:"service-name-suffix"`
+	TargetDirectory   string             `json:"target-directory"`
+	OverwriteFiles    []string           `json:"overwrite-files"`
+	OverwritePolicy   string             `json:"overwrite-policy,omitempty"`
+	PostInstallHook   *HookConfig        `json:"post-install-hook,omitempty"`
+	SHA256            string             `json:"sha256,omitempty"`
+	Signature         string             `json:"signature,omitempty"`
+	Permissions       *PermissionsConfig `json:"permissions,omitempty"`
+	// PartitionNumbers and Partitions are the partitions the package is copied to, the partitions of the configuration if both are empty
+	PartitionNumbers  []int              `json:"partition-numbers,omitempty"`
+	Partitions        PartitionSelectors `json:"partitions,omitempty"`
+	IsStandardPackage bool               `json:"-"`
+	// Template settings of configuration packages, filled when the package is copied
+	TemplatePatterns  []string          `json:"-"`
+	TemplateVariables map[string]string `json:"-"`
+	// Merge rules and operations of configuration packages, filled when the package is copied
+	MergeRules []MergeRule `json:"-"`
+	Operations []Operation `json:"-"`
 }
 
 type ConfigurationPackage struct {
-	PackagePath    string   `json:"package-path"`
-	OverwriteFiles []string `json:"overwrite-files"`
+	PackagePath     string             `json:"package-path"`
+	OverwriteFiles  []string           `json:"overwrite-files"`
+	OverwritePolicy string             `json:"overwrite-policy,omitempty"`
+	PostInstallHook *HookConfig        `json:"post-install-hook,omitempty"`
+	SHA256          string             `json:"sha256,omitempty"`
+	Signature       string             `json:"signature,omitempty"`
+	Permissions     *PermissionsConfig `json:"permissions,omitempty"`
+	Templates       []string           `json:"templates,omitempty"`
+	Variables       map[string]string  `json:"variables,omitempty"`
+	Merge           []MergeRule        `json:"merge,omitempty"`
+	Operations      []Operation        `json:"operations,omitempty"`
+	// PartitionNumbers and Partitions are the partitions the package is copied to, the partitions of the configuration if both are empty
+	PartitionNumbers []int              `json:"partition-numbers,omitempty"`
+	Partitions       PartitionSelectors `json:"partitions,omitempty"`
+}
+
+const (
+	// OperationDelete deletes the file, symlink or directory at the path, if it exists
+	OperationDelete = "delete"
+	// OperationMove moves the path to the target path
+	OperationMove = "move"
+	// OperationSymlink creates a symlink at the path pointing to the target
+	OperationSymlink = "symlink"
+	// OperationMkdir creates the directory at the path with its parents
+	OperationMkdir = "mkdir"
+)
+
+// Operation changes the image before the files of the configuration package are extracted. Paths are absolute paths in the image.
+type Operation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Target is the new path of move and the target of symlink
+	Target string `json:"target,omitempty"`
+	// Mode is the mode of the directory created by mkdir, 0755 if not set
+	Mode string `json:"mode,omitempty"`
+	// Recursive allows delete to delete non-empty directories
+	Recursive bool `json:"recursive,omitempty"`
+}
+
+// MergeRule merges the files of a configuration package matching the pattern into the existing files of the image instead of overwriting them.
+// Patterns are matched like overwrite files. When more rules match, the later ones take precedence.
+type MergeRule struct {
+	Pattern  string `json:"pattern"`
+	Strategy string `json:"strategy"`
+	// Marker and Comment are used by the block strategy, the marker defaults to the package name
+	Marker  string `json:"marker,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// ExtractionConfig limits the content of the package archives. Zero values are replaced by the defaults.
+type ExtractionConfig struct {
+	MaxEntries          int    `json:"max-entries,omitempty"`
+	MaxFileSize         uint64 `json:"max-file-size,omitempty"`
+	MaxTotalSize        uint64 `json:"max-total-size,omitempty"`
+	MaxCompressionRatio uint64 `json:"max-compression-ratio,omitempty"`
+	SymlinkPolicy       string `json:"symlink-policy,omitempty"`
+	AllowDeviceFiles    bool   `json:"allow-device-files,omitempty"`
+	AllowSetuid         bool   `json:"allow-setuid,omitempty"`
+}
+
+const (
+	// SymlinkPolicyContained allows symlinks whose target stays within the partition. Absolute targets are resolved from the partition root.
+	SymlinkPolicyContained = "contained"
+	// SymlinkPolicyRelative allows only relative symlinks whose target stays within the package directory
+	SymlinkPolicyRelative = "relative"
+)
+
+const (
+	// SELinuxOff doesn't label the placed files, it is the default
+	SELinuxOff = "off"
+	// SELinuxAuto labels the placed files if the partition has a SELinux policy
+	SELinuxAuto = "auto"
+	// SELinuxRequired labels the placed files and fails if the partition has no SELinux policy
+	SELinuxRequired = "required"
+)
+
+// Default limits of the extraction, used if not set in the configuration
+const (
+	DefaultMaxEntries          = 100000
+	DefaultMaxFileSize         = 4 << 30
+	DefaultMaxTotalSize        = 16 << 30
+	DefaultMaxCompressionRatio = 1000
+)
+
+// WithDefaults returns the extraction config with the unset limits and policy replaced by the defaults.
+func (extraction ExtractionConfig) WithDefaults() ExtractionConfig {
+	if extraction.MaxEntries == 0 {
+		extraction.MaxEntries = DefaultMaxEntries
+	}
+	if extraction.MaxFileSize == 0 {
+		extraction.MaxFileSize = DefaultMaxFileSize
+	}
+	if extraction.MaxTotalSize == 0 {
+		extraction.MaxTotalSize = DefaultMaxTotalSize
+	}
+	if extraction.MaxCompressionRatio == 0 {
+		extraction.MaxCompressionRatio = DefaultMaxCompressionRatio
+	}
+	if extraction.SymlinkPolicy == "" {
+		extraction.SymlinkPolicy = SymlinkPolicyContained
+	}
+	return extraction
+}
+
+// DefaultBackupSuffix is appended to the backups of overwritten files kept next to them
+const DefaultBackupSuffix = ".orig"
+
+// BackupConfig keeps the files of the image overwritten or merged by the packages. The backups are kept next to the files
+// with the suffix, or, if the directory is set, in the directory of the partition under the path of the file.
+type BackupConfig struct {
+	Suffix    string `json:"suffix,omitempty"`
+	Directory string `json:"directory,omitempty"`
+}
+
+// validate checks that only one of the suffix and the directory is set and the directory is an absolute path in the partition.
+func (backup *BackupConfig) validate() error {
+	if backup == nil {
+		return nil
+	}
+	if backup.Suffix != "" && backup.Directory != "" {
+		return fmt.Errorf("backup suffix and directory are mutually exclusive")
+	}
+	if strings.Contains(backup.Suffix, "/") {
+		return fmt.Errorf("backup suffix '%s' must not contain a slash", backup.Suffix)
+	}
+	if backup.Directory != "" && (!filepath.IsAbs(backup.Directory) || filepath.Clean(backup.Directory) == "/") {
+		return fmt.Errorf("backup directory '%s' must be an absolute path in the partition other than the root", backup.Directory)
+	}
+	return nil
 }
 
 type Configuration struct {
@@ -31,35 +205,83 @@ type Configuration struct {
 	Packages              []PackageConfig        `json:"packages"`
 	ConfigurationPackages []ConfigurationPackage `json:"configuration-packages"`
 	PartitionNumbers      []int                  `json:"partition-numbers"`
+	Partitions            PartitionSelectors     `json:"partitions,omitempty"`
+	Volumes               []Volume               `json:"volumes,omitempty"`
+	ParallelPartitions    int                    `json:"parallel-partitions,omitempty"`
+	Reproducible          bool                   `json:"reproducible,omitempty"`
+	Keyring               string                 `json:"keyring,omitempty"`
+	RequireIntegrity      bool                   `json:"require-integrity,omitempty"` // Every package must have a checksum or a signature, implied by the keyring
+	Extraction            ExtractionConfig       `json:"extraction,omitempty"`
+	SELinux               string                 `json:"selinux,omitempty"`
+	Backup                *BackupConfig          `json:"backup,omitempty"`
+	AllowXattrLoss        bool                   `json:"allow-xattr-loss,omitempty"` // Unpack squashfs partitions with extended attributes without root
 	LogPath               string                 `json:"log-path"`
+	Variables             map[string]string      `json:"-"` // Template variables from the command line
 	InteractiveRun        bool                   `json:"-"` // Ignored by JSON
 	PackageDir            string                 `json:"-"` // Ignored by JSON
 	ConfigFile            string                 `json:"-"` // Ignored by JSON
+	BatchFile             string                 `json:"-"` // Ignored by JSON
+	Jobs                  int                    `json:"-"` // Ignored by JSON
+	ReportPath            string                 `json:"-"` // Path of the JSON report of the run, no report if empty
+	LogLevel              string                 `json:"-"` // Log level from the command line
+	LogFormat             string                 `json:"-"` // Log format from the command line
+	DryRun                bool                   `json:"-"` // Only plan the placement, no image is modified
+	SourceDateEpoch       int64                  `json:"-"` // Timestamp in seconds given to created files in reproducible mode
 }
 
-// Global variable to hold the configuration
-// This is a workaround to avoid passing the configuration around
-var Config = Configuration{
-	Source:                "",
-	Target:                "",
-	NoClone:               false,
-	Packages:              []PackageConfig{},
-	ConfigurationPackages: []ConfigurationPackage{},
-	PartitionNumbers:      []int{},
-	LogPath:               "",
-	InteractiveRun:        true,
-	PackageDir:            "./",
-	ConfigFile:            "",
+// SourceDateEpochEnv is the environment variable holding the timestamp used in reproducible mode, see https://reproducible-builds.org/specs/source-date-epoch/
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// TemplateVariableEnvPrefix is the prefix of environment variables used as template variables
+const TemplateVariableEnvPrefix = "PLACER_VAR_"
+
+// NewConfiguration returns the default configuration, which is used for interactive runs.
+func NewConfiguration() *Configuration {
+	return &Configuration{
+		Source:                "",
+		Target:                "",
+		NoClone:               false,
+		Packages:              []PackageConfig{},
+		ConfigurationPackages: []ConfigurationPackage{},
+		PartitionNumbers:      []int{},
+		LogPath:               "",
+		Variables:             map[string]string{},
+		InteractiveRun:        true,
+		PackageDir:            "./",
+		ConfigFile:            "",
+	}
+}
+
+// LoadConfigurationFile loads the configuration file from the given path into the configuration.
+// It sets non-interactive mode and converts relative paths to be relative to the working directory.
+func (config *Configuration) LoadConfigurationFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening configuration file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("error decoding configuration file: %v", err)
+	}
+
+	config.InteractiveRun = false
+	config.ConfigFile = path
+	config.ConvertRelativePathsToWorkingDir()
+	return nil
 }
 
 // CreateConfigurationFile Creates a file and places the configuration in form of a JSON string
-func CreateConfigurationFile(config Configuration) (string, error) {
+// The path of the file is read from the user using the prompter.
+func CreateConfigurationFile(config Configuration, prompter user.Prompter) (string, error) {
 	var file *os.File
 	var path string
 	var err error
 
 	for {
-		path, err = user.ReadStringFromUser("Enter path to save configuration file: ")
+		path, err = prompter.ReadString("Enter path to save configuration file: ")
 		if err != nil {
 			return "", err
 		}
@@ -89,7 +311,6 @@ func CreateConfigurationFile(config Configuration) (string, error) {
 
 // UpdateConfigurationFile Updates the configuration file with the given path
 func UpdateConfigurationFile(config Configuration, path string) error {
-	log.Printf("Updating configuration file %s\n", path)
 	file, err := os.Create(path)
 	if err != nil {
 		return err
@@ -105,105 +326,422 @@ func UpdateConfigurationFile(config Configuration, path string) error {
 	return nil
 }
 
-// LoadConfigurationFile Loads the configuration file from the given path
-func ValidateConfiguration() error {
-	if err := validatePaths(); err != nil {
+// Validate checks that the configuration is complete and that all referenced files exist.
+func (config *Configuration) Validate() error {
+	if err := config.validatePaths(); err != nil {
 		return err
 	}
-	if err := validateSourceAndTarget(); err != nil {
+	if err := config.validateSourceAndTarget(); err != nil {
 		return err
 	}
-	if err := validatePackagesAndPartitions(); err != nil {
+	if err := config.validatePackagesAndPartitions(); err != nil {
 		return err
 	}
-	if err := validateLogPath(); err != nil {
+	if err := config.validateLogPath(); err != nil {
 		return err
 	}
+	if config.DryRun && config.InteractiveRun {
+		return fmt.Errorf("dry run is not supported in interactive mode")
+	}
 	return nil
 }
 
-// LoadConfigurationFile Loads the configuration file from the given path
-func validatePaths() error {
-	if Config.Target == "" {
+// validatePaths validates that the target is set and differs from the source
+func (config *Configuration) validatePaths() error {
+	if config.Target == "" {
 		return fmt.Errorf("target image path is missing, start with -h to see arguments")
 	}
-	if Config.Target == Config.Source {
+	if config.Target == config.Source {
 		return fmt.Errorf("source and target image paths are the same")
 	}
 	return nil
 }
 
 // validateSourceAndTarget validates the source and target paths
-func validateSourceAndTarget() error {
-	if Config.Source != "" && Config.NoClone {
+func (config *Configuration) validateSourceAndTarget() error {
+	if config.Source != "" && config.NoClone {
 		return fmt.Errorf("source image and no-clone are mutually exclusive")
 	}
-	if Config.Source == "" && !Config.NoClone {
+	if config.Source == "" && !config.NoClone {
 		return fmt.Errorf("either 'source' or 'no-clone' must be defined, start with -h to see arguments")
 	}
-	if Config.Source != "" && !helper.DoesFileExists(Config.Source) {
-		return fmt.Errorf("source image path: %s does not exist", Config.Source)
+	if config.Source != "" && !helper.DoesFileExists(config.Source) {
+		return fmt.Errorf("source image path: %s does not exist", config.Source)
 	}
-	if Config.NoClone && !helper.DoesFileExists(Config.Target) {
-		return fmt.Errorf("target image path: %s does not exist", Config.Target)
+	if config.NoClone && !helper.DoesFileExists(config.Target) {
+		return fmt.Errorf("target image path: %s does not exist", config.Target)
 	}
 	return nil
 }
 
 // validatePackagesAndPartitions validates the packages and partitions
-func validatePackagesAndPartitions() error {
-	if !Config.InteractiveRun {
-		if len(Config.Packages) == 0 && len(Config.ConfigurationPackages) == 0 {
+func (config *Configuration) validatePackagesAndPartitions() error {
+	if !config.InteractiveRun {
+		if len(config.Packages) == 0 && len(config.ConfigurationPackages) == 0 {
 			return fmt.Errorf("no packages defined in configuration")
 		}
-		for _, pkg := range Config.Packages {
+		for _, pkg := range config.Packages {
 			if !helper.DoesFileExists(pkg.PackagePath) {
 				return fmt.Errorf("package %s does not exist", pkg.PackagePath)
 			}
+			if err := config.validatePackagePartitions(pkg.PartitionNumbers, pkg.Partitions); err != nil {
+				return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateHook(pkg.PostInstallHook); err != nil {
+				return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+			}
+			if err := config.validatePackageIntegrity(pkg.PackagePath, pkg.SHA256, pkg.Signature); err != nil {
+				return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validatePermissions(pkg.Permissions); err != nil {
+				return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateOverwrite(pkg.OverwritePolicy, pkg.OverwriteFiles); err != nil {
+				return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+			}
 		}
-		for _, pkg := range Config.ConfigurationPackages {
+		for _, pkg := range config.ConfigurationPackages {
 			if !helper.DoesFileExists(pkg.PackagePath) {
 				return fmt.Errorf("configuration package %s does not exist", pkg.PackagePath)
 			}
+			if err := config.validatePackagePartitions(pkg.PartitionNumbers, pkg.Partitions); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateHook(pkg.PostInstallHook); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateTemplatePatterns(pkg.Templates); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateMergeRules(pkg.Merge); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateOperations(pkg.Operations); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := config.validatePackageIntegrity(pkg.PackagePath, pkg.SHA256, pkg.Signature); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validatePermissions(pkg.Permissions); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
+			if err := validateOverwrite(pkg.OverwritePolicy, pkg.OverwriteFiles); err != nil {
+				return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+			}
 		}
 
-		if len(Config.PartitionNumbers) == 0 {
+		if len(config.TargetPartitions()) == 0 && !config.HasPartitionSelectors() {
 			return fmt.Errorf("no partition numbers defined in configuration")
 		}
 	}
+	if err := validateVolumes(config.Volumes); err != nil {
+		return err
+	}
+	if err := validatePartitionSelectors(config.Partitions); err != nil {
+		return err
+	}
+	if err := config.validatePartitionNumbers(config.PartitionNumbers); err != nil {
+		return err
+	}
+	if config.ParallelPartitions < 0 {
+		return fmt.Errorf("number of parallel partitions must not be negative")
+	}
+	if config.Keyring != "" && !helper.DoesFileExists(config.Keyring) {
+		return fmt.Errorf("keyring %s does not exist", config.Keyring)
+	}
+	switch config.SELinux {
+	case "", SELinuxOff, SELinuxAuto, SELinuxRequired:
+	default:
+		return fmt.Errorf("invalid SELinux mode '%s', must be %s, %s or %s", config.SELinux, SELinuxOff, SELinuxAuto, SELinuxRequired)
+	}
+	if err := config.Backup.validate(); err != nil {
+		return err
+	}
+	return config.Extraction.validate()
+}
+
+// validatePackagePartitions validates the partition numbers and selectors of a package. A package without partitions is copied
+// to the partitions of the configuration, so they must be defined.
+func (config *Configuration) validatePackagePartitions(partitionNumbers []int, selectors PartitionSelectors) error {
+	if len(partitionNumbers) == 0 && len(selectors) == 0 && len(config.PartitionNumbers) == 0 && len(config.Partitions) == 0 {
+		return fmt.Errorf("no partitions defined for the package or in configuration")
+	}
+	if err := validatePartitionSelectors(selectors); err != nil {
+		return err
+	}
+	return config.validatePartitionNumbers(partitionNumbers)
+}
+
+// validatePartitionNumbers checks that the partition numbers start at 1 and the numbers of volumes refer to defined volumes.
+func (config *Configuration) validatePartitionNumbers(partitionNumbers []int) error {
+	for _, partitionNumber := range partitionNumbers {
+		if partitionNumber < 1 {
+			return fmt.Errorf("invalid partition number %d, partition numbers start at 1", partitionNumber)
+		}
+		if partitionNumber >= FirstVolumeNumber && config.Volume(partitionNumber) == nil {
+			return fmt.Errorf("invalid partition number %d, there is no volume with this number", partitionNumber)
+		}
+	}
+	return nil
+}
+
+// PackagePartitions returns the partitions a package with the given partitions is copied to.
+// Packages without partitions are copied to the partitions of the configuration. The partition selectors must be resolved before.
+func (config *Configuration) PackagePartitions(packagePartitions []int) []int {
+	if len(packagePartitions) == 0 {
+		return config.PartitionNumbers
+	}
+	return packagePartitions
+}
+
+// TargetPartitions returns the partitions at least one package is copied to, each of them once.
+// The partitions of the configuration come first in their order, the other partitions of the packages follow in the order they are listed.
+func (config *Configuration) TargetPartitions() []int {
+	var packagePartitions [][]int
+	for _, pkg := range config.Packages {
+		packagePartitions = append(packagePartitions, config.PackagePartitions(pkg.PartitionNumbers))
+	}
+	for _, pkg := range config.ConfigurationPackages {
+		packagePartitions = append(packagePartitions, config.PackagePartitions(pkg.PartitionNumbers))
+	}
+	used := map[int]bool{}
+	for _, partitions := range packagePartitions {
+		for _, partitionNumber := range partitions {
+			used[partitionNumber] = true
+		}
+	}
+	var partitionNumbers []int
+	for _, partitionNumber := range slices.Concat(append([][]int{config.PartitionNumbers}, packagePartitions...)...) {
+		if used[partitionNumber] {
+			partitionNumbers = append(partitionNumbers, partitionNumber)
+			delete(used, partitionNumber)
+		}
+	}
+	return partitionNumbers
+}
+
+// validatePermissions validates the modes, patterns, capabilities and extended attributes of the permissions. Nil permissions are valid.
+// Owners and groups are checked only when the package is placed, as they are resolved from the image.
+func validatePermissions(config *PermissionsConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.DirectoryMode != "" {
+		if _, err := permissions.ParseMode(config.DirectoryMode); err != nil {
+			return fmt.Errorf("directory mode: %v", err)
+		}
+	}
+	for _, rule := range config.Rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("invalid permission rule pattern '%s'", rule.Pattern)
+		}
+		if rule.Mode != "" {
+			if _, err := permissions.ParseMode(rule.Mode); err != nil {
+				return fmt.Errorf("permission rule %s: %v", rule.Pattern, err)
+			}
+		}
+		if rule.Capabilities != "" {
+			if _, err := permissions.EncodeCapabilities(rule.Capabilities); err != nil {
+				return fmt.Errorf("permission rule %s: %v", rule.Pattern, err)
+			}
+		}
+		for name := range rule.Xattrs {
+			if name == permissions.CapabilityXattr {
+				return fmt.Errorf("permission rule %s: use capabilities instead of the %s extended attribute", rule.Pattern, name)
+			}
+			if !strings.Contains(name, ".") {
+				return fmt.Errorf("permission rule %s: extended attribute %s has no namespace (e.g. user.)", rule.Pattern, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validate validates the limits and the symlink policy of the extraction config
+func (extraction ExtractionConfig) validate() error {
+	if extraction.MaxEntries < 0 {
+		return fmt.Errorf("maximal number of archive entries must not be negative")
+	}
+	switch extraction.SymlinkPolicy {
+	case "", SymlinkPolicyContained, SymlinkPolicyRelative:
+		return nil
+	default:
+		return fmt.Errorf("invalid symlink policy '%s', must be %s or %s", extraction.SymlinkPolicy, SymlinkPolicyContained, SymlinkPolicyRelative)
+	}
+}
+
+// IntegrityRequired returns true if every package must have a SHA256 checksum or a signature, which is required
+// explicitly or by setting a keyring.
+func (config *Configuration) IntegrityRequired() bool {
+	return config.RequireIntegrity || config.Keyring != ""
+}
+
+// validatePackageIntegrity validates the expected SHA256 checksum and the signature of a package.
+// A signature can be checked only with a keyring. If integrity is required, the package must have a checksum,
+// a signature or a signature next to it.
+func (config *Configuration) validatePackageIntegrity(packagePath string, checksum string, signature string) error {
+	if config.IntegrityRequired() && checksum == "" && signature == "" && integrity.FindSignature(packagePath) == "" {
+		return fmt.Errorf("package has neither a SHA256 checksum nor a signature, but integrity is required")
+	}
+	if checksum != "" {
+		if err := integrity.ValidateSHA256(checksum); err != nil {
+			return err
+		}
+	}
+	if signature != "" {
+		if !helper.DoesFileExists(signature) {
+			return fmt.Errorf("signature %s does not exist", signature)
+		}
+		if config.Keyring == "" {
+			return fmt.Errorf("signature is set, but no keyring is configured")
+		}
+	}
+	return nil
+}
+
+// validateHook validates the post-install hook of a package. A nil hook is valid.
+func validateHook(hook *HookConfig) error {
+	if hook == nil {
+		return nil
+	}
+	if (hook.Script == "") == (hook.PackageScript == "") {
+		return fmt.Errorf("post-install hook must define exactly one of 'script' and 'package-script'")
+	}
+	if hook.Script != "" && !helper.DoesFileExists(hook.Script) {
+		return fmt.Errorf("post-install hook script %s does not exist", hook.Script)
+	}
+	if hook.TimeoutSeconds < 0 {
+		return fmt.Errorf("post-install hook timeout must not be negative")
+	}
+	return nil
+}
+
+// validateOperations checks that the operations are known and have the required fields. The paths must be absolute paths
+// in the image other than the root directory, the containment in the partition is checked when they are run.
+func validateOperations(operations []Operation) error {
+	for _, operation := range operations {
+		if !filepath.IsAbs(operation.Path) || filepath.Clean(operation.Path) == "/" {
+			return fmt.Errorf("%s operation: path '%s' must be an absolute path other than the root directory", operation.Op, operation.Path)
+		}
+		if operation.Recursive && operation.Op != OperationDelete {
+			return fmt.Errorf("%s operation on %s: recursive is allowed only for delete", operation.Op, operation.Path)
+		}
+		if operation.Mode != "" && operation.Op != OperationMkdir {
+			return fmt.Errorf("%s operation on %s: mode is allowed only for mkdir", operation.Op, operation.Path)
+		}
+		switch operation.Op {
+		case OperationDelete, OperationMkdir:
+			if operation.Target != "" {
+				return fmt.Errorf("%s operation on %s has no target", operation.Op, operation.Path)
+			}
+			if operation.Mode != "" {
+				if _, err := permissions.ParseMode(operation.Mode); err != nil {
+					return fmt.Errorf("mkdir operation on %s: %v", operation.Path, err)
+				}
+			}
+		case OperationMove:
+			if !filepath.IsAbs(operation.Target) || filepath.Clean(operation.Target) == "/" {
+				return fmt.Errorf("move operation on %s: target '%s' must be an absolute path other than the root directory", operation.Path, operation.Target)
+			}
+		case OperationSymlink:
+			if operation.Target == "" {
+				return fmt.Errorf("symlink operation on %s requires a target", operation.Path)
+			}
+		default:
+			return fmt.Errorf("unknown operation '%s', must be %s, %s, %s or %s", operation.Op, OperationDelete, OperationMove, OperationSymlink, OperationMkdir)
+		}
+	}
 	return nil
 }
 
+// validateTemplatePatterns checks that all template patterns are valid glob patterns.
+func validateTemplatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid template pattern '%s': %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// LoadSourceDateEpoch reads the SourceDateEpochEnv environment variable.
+// If it is set, reproducible mode is enabled and the variable is used as the timestamp of all created files.
+func (config *Configuration) LoadSourceDateEpoch() error {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return nil
+	}
+	epoch, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || epoch < 0 {
+		return fmt.Errorf("invalid %s '%s', must be a non-negative number of seconds", SourceDateEpochEnv, value)
+	}
+	config.Reproducible = true
+	config.SourceDateEpoch = epoch
+	return nil
+}
+
+// ResolveTemplateVariables returns the variables used to render templates of a configuration package.
+// Package variables are overridden by environment variables with the TemplateVariableEnvPrefix prefix,
+// which are overridden by the variables of the configuration (given on the command line).
+func (config *Configuration) ResolveTemplateVariables(packageVariables map[string]string) map[string]string {
+	variables := make(map[string]string, len(packageVariables))
+	for key, value := range packageVariables {
+		variables[key] = value
+	}
+	for _, env := range os.Environ() {
+		key, value, found := strings.Cut(env, "=")
+		if found && strings.HasPrefix(key, TemplateVariableEnvPrefix) && key != TemplateVariableEnvPrefix {
+			variables[strings.TrimPrefix(key, TemplateVariableEnvPrefix)] = value
+		}
+	}
+	for key, value := range config.Variables {
+		variables[key] = value
+	}
+	return variables
+}
+
 // validateLogPath validates the log path
-func validateLogPath() error {
-	if Config.LogPath != "" && !helper.DoesFileExists(Config.LogPath) {
+func (config *Configuration) validateLogPath() error {
+	if config.LogPath != "" && !helper.DoesFileExists(config.LogPath) {
 		return fmt.Errorf("log path does not exist")
 	}
 	return nil
 }
 
 // convertOneRelativePathToWorkingDir converts a relative path to an absolute path
-func convertOneRelativePathToWorkingDir(path string) string {
+func (config *Configuration) convertOneRelativePathToWorkingDir(path string) string {
 	// Add location of configuration file to the path
 	if path == "" || filepath.IsAbs(path) {
 		return path
 	}
-	configFileBasePath := filepath.Dir(Config.ConfigFile)
+	configFileBasePath := filepath.Dir(config.ConfigFile)
 
 	return filepath.Join(configFileBasePath, path)
 
 }
 
 // ConvertRelativePathsToWorkingDir converts all relative paths in the configuration to absolute paths
-func ConvertRelativePathsToWorkingDir() {
+func (config *Configuration) ConvertRelativePathsToWorkingDir() {
 	// Convert relative paths from configuration to relative paths to the working directory
-	Config.Source = convertOneRelativePathToWorkingDir(Config.Source)
-	Config.Target = convertOneRelativePathToWorkingDir(Config.Target)
-	Config.LogPath = convertOneRelativePathToWorkingDir(Config.LogPath)
-	for i, pkg := range Config.Packages {
-		Config.Packages[i].PackagePath = convertOneRelativePathToWorkingDir(pkg.PackagePath)
-	}
-	for i, pkg := range Config.ConfigurationPackages {
-		Config.ConfigurationPackages[i].PackagePath = convertOneRelativePathToWorkingDir(pkg.PackagePath)
+	config.Source = config.convertOneRelativePathToWorkingDir(config.Source)
+	config.Target = config.convertOneRelativePathToWorkingDir(config.Target)
+	config.LogPath = config.convertOneRelativePathToWorkingDir(config.LogPath)
+	config.Keyring = config.convertOneRelativePathToWorkingDir(config.Keyring)
+	for i, volume := range config.Volumes {
+		config.Volumes[i].LUKSKeyFile = config.convertOneRelativePathToWorkingDir(volume.LUKSKeyFile)
+	}
+	for i, pkg := range config.Packages {
+		config.Packages[i].PackagePath = config.convertOneRelativePathToWorkingDir(pkg.PackagePath)
+		config.Packages[i].Signature = config.convertOneRelativePathToWorkingDir(pkg.Signature)
+		if pkg.PostInstallHook != nil {
+			pkg.PostInstallHook.Script = config.convertOneRelativePathToWorkingDir(pkg.PostInstallHook.Script)
+		}
+	}
+	for i, pkg := range config.ConfigurationPackages {
+		config.ConfigurationPackages[i].PackagePath = config.convertOneRelativePathToWorkingDir(pkg.PackagePath)
+		config.ConfigurationPackages[i].Signature = config.convertOneRelativePathToWorkingDir(pkg.Signature)
+		if pkg.PostInstallHook != nil {
+			pkg.PostInstallHook.Script = config.convertOneRelativePathToWorkingDir(pkg.PostInstallHook.Script)
+		}
 	}
 }
@@ -3,6 +3,8 @@ package configuration
 import (
 	"os"
 	"package-to-image-placer/pkg/helper"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -50,7 +52,7 @@ func cleanup() {
 }
 
 func TestValidateConfiguration_Success(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Source:           sourceImg,
 		Target:           "target.img",
 		NoClone:          false,
@@ -61,7 +63,7 @@ func TestValidateConfiguration_Success(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -76,7 +78,7 @@ func TestValidateConfiguration_PackageNotExist(t *testing.T) {
 		OverwriteFiles:    []string{"file1.txt", "file2.txt"},
 	}
 
-	Config = Configuration{
+	config := Configuration{
 		Source:           sourceImg,
 		Target:           "target.img",
 		NoClone:          false,
@@ -87,14 +89,14 @@ func TestValidateConfiguration_PackageNotExist(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestValidateConfiguration_MissingTarget(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Source:           sourceImg,
 		NoClone:          false,
 		Packages:         []PackageConfig{package1, package2},
@@ -104,14 +106,14 @@ func TestValidateConfiguration_MissingTarget(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestValidateConfiguration_SameSourceAndTarget(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Source:           sourceImg,
 		Target:           sourceImg,
 		NoClone:          false,
@@ -122,14 +124,14 @@ func TestValidateConfiguration_SameSourceAndTarget(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestValidateConfiguration_NoSourceAndNoClone(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Target:           "target.img",
 		NoClone:          false,
 		Packages:         []PackageConfig{package1, package2},
@@ -139,14 +141,14 @@ func TestValidateConfiguration_NoSourceAndNoClone(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestValidateConfiguration_NoCloneTargetDoesNotExist(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Target:           "nonexistent.img",
 		NoClone:          true,
 		Packages:         []PackageConfig{package1, package2},
@@ -156,14 +158,14 @@ func TestValidateConfiguration_NoCloneTargetDoesNotExist(t *testing.T) {
 		LogPath:          "./",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestValidateConfiguration_InvalidLogPath(t *testing.T) {
-	Config = Configuration{
+	config := Configuration{
 		Source:           sourceImg,
 		Target:           "target.img",
 		NoClone:          false,
@@ -174,8 +176,305 @@ func TestValidateConfiguration_InvalidLogPath(t *testing.T) {
 		LogPath:          "/invalid/log/path",
 	}
 
-	err := ValidateConfiguration()
+	err := config.Validate()
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
+
+func TestValidateConfiguration_InvalidPostInstallHook(t *testing.T) {
+	hookPackage := package1
+	hookPackage.PostInstallHook = &HookConfig{Script: "hook.sh", PackageScript: "/hook.sh"}
+
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		NoClone:          false,
+		Packages:         []PackageConfig{hookPackage},
+		PartitionNumbers: []int{1, 2},
+		InteractiveRun:   false,
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_DryRunInteractive(t *testing.T) {
+	config := Configuration{
+		Source:         sourceImg,
+		Target:         "target.img",
+		InteractiveRun: true,
+		DryRun:         true,
+		PackageDir:     "package/dir",
+		LogPath:        "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestResolveTemplateVariables_Precedence(t *testing.T) {
+	config := Configuration{Variables: map[string]string{"serial": "cli"}}
+	t.Setenv(TemplateVariableEnvPrefix+"ip", "env")
+	t.Setenv(TemplateVariableEnvPrefix+"serial", "env")
+
+	variables := config.ResolveTemplateVariables(map[string]string{"hostname": "package", "ip": "package", "serial": "package"})
+	if variables["hostname"] != "package" {
+		t.Errorf("expected hostname from package, got %s", variables["hostname"])
+	}
+	if variables["ip"] != "env" {
+		t.Errorf("expected ip from environment, got %s", variables["ip"])
+	}
+	if variables["serial"] != "cli" {
+		t.Errorf("expected serial from command line, got %s", variables["serial"])
+	}
+}
+
+func TestValidateConfiguration_NegativeParallelPartitions(t *testing.T) {
+	config := Configuration{
+		Source:             sourceImg,
+		Target:             "target.img",
+		NoClone:            false,
+		Packages:           []PackageConfig{package1, package2},
+		PartitionNumbers:   []int{1, 2},
+		ParallelPartitions: -1,
+		InteractiveRun:     false,
+		PackageDir:         "package/dir",
+		LogPath:            "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestLoadSourceDateEpoch_EnablesReproducible(t *testing.T) {
+	config := Configuration{}
+	t.Setenv(SourceDateEpochEnv, "1700000000")
+
+	err := config.LoadSourceDateEpoch()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !config.Reproducible || config.SourceDateEpoch != 1700000000 {
+		t.Errorf("expected reproducible mode with epoch 1700000000, got %v and %d", config.Reproducible, config.SourceDateEpoch)
+	}
+}
+
+func TestLoadSourceDateEpoch_Invalid(t *testing.T) {
+	config := Configuration{}
+	t.Setenv(SourceDateEpochEnv, "yesterday")
+
+	err := config.LoadSourceDateEpoch()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_SignatureWithoutKeyring(t *testing.T) {
+	signedPackage := package1
+	signedPackage.Signature = package2.PackagePath
+
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{signedPackage},
+		PartitionNumbers: []int{1},
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_IntegrityRequired(t *testing.T) {
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{package1},
+		PartitionNumbers: []int{1},
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+		RequireIntegrity: true,
+	}
+
+	err := config.Validate()
+	if err == nil || !strings.Contains(err.Error(), "integrity is required") {
+		t.Fatalf("expected package without checksum and signature to be rejected, got %v", err)
+	}
+
+	config.Packages[0].SHA256 = strings.Repeat("0", 64)
+	err = config.Validate()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestValidateConfiguration_InvalidSHA256(t *testing.T) {
+	checksumPackage := package1
+	checksumPackage.SHA256 = "abc"
+
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{checksumPackage},
+		PartitionNumbers: []int{1},
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_InvalidSymlinkPolicy(t *testing.T) {
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{package1},
+		PartitionNumbers: []int{1},
+		Extraction:       ExtractionConfig{SymlinkPolicy: "any"},
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_InvalidPermissions(t *testing.T) {
+	permissionsPackage := package1
+	permissionsPackage.Permissions = &PermissionsConfig{Rules: []PermissionRule{{Pattern: "bin/*", Capabilities: "cap_net_raw"}}}
+
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{permissionsPackage},
+		PartitionNumbers: []int{1},
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_InvalidSELinux(t *testing.T) {
+	config := Configuration{
+		Source:           sourceImg,
+		Target:           "target.img",
+		Packages:         []PackageConfig{package1},
+		PartitionNumbers: []int{1},
+		SELinux:          "enforcing",
+		PackageDir:       "package/dir",
+		LogPath:          "./",
+	}
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestValidateConfiguration_InvalidBackup(t *testing.T) {
+	for _, backup := range []*BackupConfig{{Suffix: ".orig", Directory: "/var/backups"}, {Directory: "var/backups"}, {Directory: "/"}, {Suffix: "/orig"}} {
+		config := Configuration{
+			Source:           sourceImg,
+			Target:           "target.img",
+			Packages:         []PackageConfig{package1},
+			PartitionNumbers: []int{1},
+			Backup:           backup,
+			PackageDir:       "package/dir",
+			LogPath:          "./",
+		}
+		if err := config.Validate(); err == nil {
+			t.Errorf("expected error for backup %+v, got nil", *backup)
+		}
+	}
+}
+
+func TestValidateConfiguration_PackagePartitions(t *testing.T) {
+	boot := package1
+	boot.PartitionNumbers = []int{1}
+	config := Configuration{
+		Source:         sourceImg,
+		Target:         "target.img",
+		Packages:       []PackageConfig{boot, package2},
+		InteractiveRun: false,
+		PackageDir:     "package/dir",
+		LogPath:        "./",
+	}
+	// package2 has no partitions and there are no partitions in the configuration
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	config.Packages = []PackageConfig{boot}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	config.Packages[0].PartitionNumbers = []int{0}
+	if err := config.Validate(); err == nil {
+		t.Fatalf("expected error for partition 0, got nil")
+	}
+}
+
+func TestTargetPartitions_Order(t *testing.T) {
+	boot := package1
+	boot.PartitionNumbers = []int{1}
+	data := ConfigurationPackage{PackagePath: "data.zip", PartitionNumbers: []int{5, 4}}
+	config := Configuration{
+		Packages:              []PackageConfig{package2, boot},
+		ConfigurationPackages: []ConfigurationPackage{data},
+		PartitionNumbers:      []int{3, 2},
+	}
+	partitions := config.TargetPartitions()
+	if !slices.Equal(partitions, []int{3, 2, 1, 5, 4}) {
+		t.Errorf("expected partitions [3 2 1 5 4], got %v", partitions)
+	}
+	if !slices.Equal(config.PackagePartitions(nil), []int{3, 2}) || !slices.Equal(config.PackagePartitions([]int{1}), []int{1}) {
+		t.Errorf("expected packages without partitions to fall back to the configuration")
+	}
+
+	// Partitions of the configuration no package is copied to are left out
+	config.Packages = []PackageConfig{boot}
+	partitions = config.TargetPartitions()
+	if !slices.Equal(partitions, []int{1, 5, 4}) {
+		t.Errorf("expected partitions [1 5 4], got %v", partitions)
+	}
+}
+
+func TestValidateOperations_Invalid(t *testing.T) {
+	tests := [][]Operation{
+		{{Op: "copy", Path: "/etc/a"}},
+		{{Op: "delete", Path: "etc/a"}},
+		{{Op: "delete", Path: "/"}},
+		{{Op: "move", Path: "/etc/a"}},
+		{{Op: "symlink", Path: "/etc/a"}},
+		{{Op: "mkdir", Path: "/etc/a", Mode: "999"}},
+		{{Op: "mkdir", Path: "/etc/a", Recursive: true}},
+	}
+	for _, operations := range tests {
+		if err := validateOperations(operations); err == nil {
+			t.Errorf("expected error for %+v, got nil", operations[0])
+		}
+	}
+	if err := validateOperations([]Operation{{Op: "delete", Path: "/etc/nginx", Recursive: true}, {Op: "symlink", Path: "/etc/a", Target: "b"}}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
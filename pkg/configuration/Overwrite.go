@@ -0,0 +1,137 @@
+package configuration
+
+import (
+	"fmt"
+	"package-to-image-placer/pkg/merge"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// OverwritePolicyListed overwrites the existing files matched by the overwrite files, other existing files fail the placement. It is the default.
+	OverwritePolicyListed = "listed"
+	// OverwritePolicyAll overwrites all existing files except the ones excluded by negated overwrite files
+	OverwritePolicyAll = "all"
+	// OverwritePolicySkipExisting keeps the existing files not matched by the overwrite files, the archive entries are skipped
+	OverwritePolicySkipExisting = "skip-existing"
+)
+
+// OverwriteAction is the action taken when a file of the package already exists in the image
+type OverwriteAction int
+
+const (
+	// OverwriteFail fails the placement
+	OverwriteFail OverwriteAction = iota
+	// OverwriteReplace replaces the existing file by the file of the package
+	OverwriteReplace
+	// OverwriteSkip keeps the existing file and skips the file of the package
+	OverwriteSkip
+)
+
+// OverwriteActionFor returns the action taken when the file with the path in the package (starting with '/') already exists in the image.
+// The overwrite files are matched in order and the last matching one decides, a negated entry ('!' prefix) excludes the file from overwriting.
+// Files not matched are overwritten with the all policy. Files not overwritten are skipped with the skip-existing policy, otherwise they fail.
+func (packageConfig *PackageConfig) OverwriteActionFor(pathInPackage string) OverwriteAction {
+	overwrite := packageConfig.OverwritePolicy == OverwritePolicyAll
+	for _, entry := range packageConfig.OverwriteFiles {
+		pattern, negated := strings.CutPrefix(entry, "!")
+		if matchesPathPattern(pathInPackage, pattern) {
+			overwrite = !negated
+		}
+	}
+	switch {
+	case overwrite:
+		return OverwriteReplace
+	case packageConfig.OverwritePolicy == OverwritePolicySkipExisting:
+		return OverwriteSkip
+	default:
+		return OverwriteFail
+	}
+}
+
+// IsExactOverwritePath checks if the overwrite file is an exact path in the package, which must exist in the package archive.
+// Negated entries, directory prefixes and glob patterns are not exact paths.
+func IsExactOverwritePath(entry string) bool {
+	return strings.HasPrefix(entry, "/") && !strings.HasSuffix(entry, "/") && !strings.ContainsAny(entry, `*?[\`)
+}
+
+// matchesPathPattern checks if the path in the package matches the pattern of overwrite files or merge rules.
+// A pattern ending with a slash matches all files in the directory and its subdirectories. Patterns containing a slash
+// are matched against the whole path, where '**' matches any number of directories, other patterns against the file name only.
+func matchesPathPattern(pathInPackage string, pattern string) bool {
+	pathInPackage = "/" + strings.Trim(pathInPackage, "/")
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(pathInPackage))
+		return matched
+	}
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(strings.TrimPrefix(pathInPackage, "/"), "/"))
+}
+
+// matchSegments matches the path segments against the pattern segments, a '**' segment matches zero or more path segments.
+func matchSegments(patternSegments []string, pathSegments []string) bool {
+	if len(patternSegments) == 0 {
+		return len(pathSegments) == 0
+	}
+	if patternSegments[0] == "**" {
+		for i := 0; i <= len(pathSegments); i++ {
+			if matchSegments(patternSegments[1:], pathSegments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(pathSegments) == 0 {
+		return false
+	}
+	matched, _ := path.Match(patternSegments[0], pathSegments[0])
+	return matched && matchSegments(patternSegments[1:], pathSegments[1:])
+}
+
+// MergeRuleFor returns the last merge rule matching the file with the path in the package (starting with '/'), or nil if no rule matches.
+func (packageConfig *PackageConfig) MergeRuleFor(pathInPackage string) *MergeRule {
+	for i := len(packageConfig.MergeRules) - 1; i >= 0; i-- {
+		if matchesPathPattern(pathInPackage, packageConfig.MergeRules[i].Pattern) {
+			return &packageConfig.MergeRules[i]
+		}
+	}
+	return nil
+}
+
+// validateMergeRules checks the patterns and strategies of the merge rules.
+func validateMergeRules(rules []MergeRule) error {
+	for _, rule := range rules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("merge rule without pattern")
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid merge pattern '%s': %v", rule.Pattern, err)
+		}
+		if !slices.Contains(merge.Strategies, rule.Strategy) {
+			return fmt.Errorf("invalid merge strategy '%s' of pattern '%s', must be one of %s", rule.Strategy, rule.Pattern, strings.Join(merge.Strategies, ", "))
+		}
+	}
+	return nil
+}
+
+// validateOverwrite checks the overwrite policy and that all overwrite files are valid glob patterns.
+func validateOverwrite(policy string, overwriteFiles []string) error {
+	switch policy {
+	case "", OverwritePolicyListed, OverwritePolicyAll, OverwritePolicySkipExisting:
+	default:
+		return fmt.Errorf("invalid overwrite policy '%s', must be %s, %s or %s", policy, OverwritePolicyListed, OverwritePolicyAll, OverwritePolicySkipExisting)
+	}
+	for _, entry := range overwriteFiles {
+		pattern := strings.TrimPrefix(entry, "!")
+		if pattern == "" {
+			return fmt.Errorf("empty overwrite file")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid overwrite pattern '%s': %v", entry, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package configuration
+
+import "testing"
+
+func TestOverwriteActionFor_Patterns(t *testing.T) {
+	packageConfig := PackageConfig{OverwriteFiles: []string{"/etc/nginx/**", "!/etc/nginx/keep.conf", "/etc/ssh/", "*.service", "/etc/hostname"}}
+	tests := []struct {
+		path     string
+		expected OverwriteAction
+	}{
+		{"/etc/nginx/nginx.conf", OverwriteReplace},
+		{"/etc/nginx/sites/default", OverwriteReplace},
+		{"/etc/nginx/keep.conf", OverwriteFail},
+		{"/etc/ssh/sshd_config.d/local.conf", OverwriteReplace},
+		{"/lib/systemd/system/app.service", OverwriteReplace},
+		{"/etc/hostname", OverwriteReplace},
+		{"/etc/hosts", OverwriteFail},
+	}
+	for _, test := range tests {
+		if action := packageConfig.OverwriteActionFor(test.path); action != test.expected {
+			t.Errorf("expected action %d for %s, got %d", test.expected, test.path, action)
+		}
+	}
+}
+
+func TestOverwriteActionFor_Policies(t *testing.T) {
+	allConfig := PackageConfig{OverwritePolicy: OverwritePolicyAll, OverwriteFiles: []string{"!/etc/fstab"}}
+	if action := allConfig.OverwriteActionFor("/etc/hosts"); action != OverwriteReplace {
+		t.Errorf("expected /etc/hosts to be overwritten, got %d", action)
+	}
+	if action := allConfig.OverwriteActionFor("/etc/fstab"); action != OverwriteFail {
+		t.Errorf("expected /etc/fstab to fail, got %d", action)
+	}
+
+	skipConfig := PackageConfig{OverwritePolicy: OverwritePolicySkipExisting, OverwriteFiles: []string{"/etc/app/"}}
+	if action := skipConfig.OverwriteActionFor("/etc/app/app.conf"); action != OverwriteReplace {
+		t.Errorf("expected /etc/app/app.conf to be overwritten, got %d", action)
+	}
+	if action := skipConfig.OverwriteActionFor("/etc/hosts"); action != OverwriteSkip {
+		t.Errorf("expected /etc/hosts to be skipped, got %d", action)
+	}
+}
+
+func TestIsExactOverwritePath(t *testing.T) {
+	for entry, expected := range map[string]bool{"/etc/app.conf": true, "/etc/app/": false, "/etc/*.conf": false, "!/etc/app.conf": false, "app.conf": false} {
+		if IsExactOverwritePath(entry) != expected {
+			t.Errorf("expected IsExactOverwritePath(%s) to be %v", entry, expected)
+		}
+	}
+}
+
+func TestValidateOverwrite_Invalid(t *testing.T) {
+	if err := validateOverwrite("never", nil); err == nil {
+		t.Errorf("expected error for invalid policy, got nil")
+	}
+	if err := validateOverwrite("", []string{"/etc/[a"}); err == nil {
+		t.Errorf("expected error for invalid pattern, got nil")
+	}
+	if err := validateOverwrite(OverwritePolicyAll, []string{"/etc/**", "!/etc/fstab"}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestMergeRuleFor_LastMatchingRule(t *testing.T) {
+	packageConfig := PackageConfig{MergeRules: []MergeRule{{Pattern: "/etc/**", Strategy: "append-lines"}, {Pattern: "*.ini", Strategy: "ini"}}}
+	if rule := packageConfig.MergeRuleFor("/etc/app/app.ini"); rule == nil || rule.Strategy != "ini" {
+		t.Errorf("expected ini strategy, got %v", rule)
+	}
+	if rule := packageConfig.MergeRuleFor("/etc/fstab"); rule == nil || rule.Strategy != "append-lines" {
+		t.Errorf("expected append-lines strategy, got %v", rule)
+	}
+	if rule := packageConfig.MergeRuleFor("/opt/app.conf"); rule != nil {
+		t.Errorf("expected no rule, got %v", rule)
+	}
+}
+
+func TestValidateMergeRules_Invalid(t *testing.T) {
+	if err := validateMergeRules([]MergeRule{{Pattern: "/etc/fstab", Strategy: "replace"}}); err == nil {
+		t.Errorf("expected error for invalid strategy, got nil")
+	}
+	if err := validateMergeRules([]MergeRule{{Strategy: "ini"}}); err == nil {
+		t.Errorf("expected error for missing pattern, got nil")
+	}
+}
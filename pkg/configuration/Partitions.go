@@ -0,0 +1,208 @@
+package configuration
+
+import (
+	"encoding/json"
+	"fmt"
+	"package-to-image-placer/pkg/user"
+	"slices"
+	"strings"
+)
+
+// allPartitionsOfRolePrefix is the prefix of the shorthand selecting all partitions of a role, e.g. all-rootfs
+const allPartitionsOfRolePrefix = "all-"
+
+// PartitionSelectors select partitions of the image. In JSON, they are a list of selectors or a string selecting all partitions
+// of a role, e.g. "all-rootfs", which is the same as [{"role": "rootfs"}].
+type PartitionSelectors []PartitionSelector
+
+// UnmarshalJSON decodes the list of selectors or the shorthand selecting all partitions of a role.
+func (selectors *PartitionSelectors) UnmarshalJSON(data []byte) error {
+	var shorthand string
+	if err := json.Unmarshal(data, &shorthand); err == nil {
+		role, found := strings.CutPrefix(shorthand, allPartitionsOfRolePrefix)
+		if !found {
+			return fmt.Errorf("invalid partitions '%s', must be a list of selectors or all-<role>", shorthand)
+		}
+		*selectors = PartitionSelectors{{Role: role}}
+		return nil
+	}
+	var list []PartitionSelector
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*selectors = list
+	return nil
+}
+
+// PartitionSelector selects a partition of the image by one of its properties instead of its number.
+// Exactly one of the fields must be set. Type GUIDs and UUIDs are compared case-insensitively.
+// A role selector selects all partitions of the role detected from their content, the other selectors select exactly one partition.
+type PartitionSelector struct {
+	// Name is the GPT partition name, e.g. rootfs_a
+	Name string `json:"name,omitempty"`
+	// Label is the label of the filesystem of the partition
+	Label string `json:"label,omitempty"`
+	// TypeGUID is the GPT partition type GUID
+	TypeGUID string `json:"type-guid,omitempty"`
+	// UUID is the GPT partition UUID (PARTUUID)
+	UUID string `json:"uuid,omitempty"`
+	// Role is the role of the partition detected from its content, one of rootfs, boot and data
+	Role string `json:"role,omitempty"`
+	// Volume is the name of a volume of the configuration nested in a partition
+	Volume string `json:"volume,omitempty"`
+}
+
+// String returns the selector in the form used in messages, e.g. name=rootfs_a
+func (selector PartitionSelector) String() string {
+	switch {
+	case selector.Name != "":
+		return "name=" + selector.Name
+	case selector.Label != "":
+		return "label=" + selector.Label
+	case selector.TypeGUID != "":
+		return "type-guid=" + selector.TypeGUID
+	case selector.Role != "":
+		return "role=" + selector.Role
+	case selector.Volume != "":
+		return "volume=" + selector.Volume
+	default:
+		return "uuid=" + selector.UUID
+	}
+}
+
+// matches checks if the partition has the property of the selector
+func (selector PartitionSelector) matches(partition user.PartitionInfo) bool {
+	switch {
+	case selector.Name != "":
+		return partition.Name == selector.Name
+	case selector.Label != "":
+		return partition.FilesystemType != user.UnknownFilesystem && partition.FilesystemLabel == selector.Label
+	case selector.TypeGUID != "":
+		return strings.EqualFold(partition.TypeGUID, selector.TypeGUID)
+	case selector.Role != "":
+		return partition.Role == selector.Role
+	default:
+		return strings.EqualFold(partition.UUID, selector.UUID)
+	}
+}
+
+// validatePartitionSelectors checks that exactly one property is set in every selector and the roles are known.
+func validatePartitionSelectors(selectors []PartitionSelector) error {
+	for _, selector := range selectors {
+		set := 0
+		for _, value := range []string{selector.Name, selector.Label, selector.TypeGUID, selector.UUID, selector.Role, selector.Volume} {
+			if value != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("partition selector must set exactly one of 'name', 'label', 'type-guid', 'uuid', 'role' and 'volume'")
+		}
+		switch selector.Role {
+		case "", user.PartitionRoleRootfs, user.PartitionRoleBoot, user.PartitionRoleData:
+		default:
+			return fmt.Errorf("invalid partition role '%s', must be %s, %s or %s", selector.Role, user.PartitionRoleRootfs, user.PartitionRoleBoot, user.PartitionRoleData)
+		}
+	}
+	return nil
+}
+
+// resolvePartitionSelectors returns the partition numbers with the numbers of the partitions selected by the selectors added.
+// A role selector must match at least one partition, other selectors exactly one partition. A volume selector adds the number of the volume.
+func (config *Configuration) resolvePartitionSelectors(selectors []PartitionSelector, partitions []user.PartitionInfo, partitionNumbers []int) ([]int, error) {
+	for _, selector := range selectors {
+		if selector.Volume != "" {
+			volumeNumber, found := config.VolumeNumber(selector.Volume)
+			if !found {
+				return nil, fmt.Errorf("partition selector %s matches no volume of the configuration", selector)
+			}
+			if !slices.Contains(partitionNumbers, volumeNumber) {
+				partitionNumbers = append(partitionNumbers, volumeNumber)
+			}
+			continue
+		}
+		var matched []int
+		for _, partition := range partitions {
+			if selector.matches(partition) {
+				matched = append(matched, partition.Number)
+			}
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("partition selector %s matches no partition", selector)
+		}
+		if len(matched) > 1 && selector.Role == "" {
+			return nil, fmt.Errorf("partition selector %s matches several partitions %v", selector, matched)
+		}
+		for _, partitionNumber := range matched {
+			if !slices.Contains(partitionNumbers, partitionNumber) {
+				partitionNumbers = append(partitionNumbers, partitionNumber)
+			}
+		}
+	}
+	return partitionNumbers, nil
+}
+
+// HasRoleSelectors checks if the configuration or any of its packages selects partitions by their role,
+// which needs the partitions to be detected from their content.
+func (config *Configuration) HasRoleSelectors() bool {
+	hasRole := func(selector PartitionSelector) bool { return selector.Role != "" }
+	if slices.ContainsFunc(config.Partitions, hasRole) {
+		return true
+	}
+	for _, pkg := range config.Packages {
+		if slices.ContainsFunc(pkg.Partitions, hasRole) {
+			return true
+		}
+	}
+	for _, pkg := range config.ConfigurationPackages {
+		if slices.ContainsFunc(pkg.Partitions, hasRole) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPartitionSelectors checks if the configuration or any of its packages selects partitions by selectors.
+func (config *Configuration) HasPartitionSelectors() bool {
+	if len(config.Partitions) > 0 {
+		return true
+	}
+	for _, pkg := range config.Packages {
+		if len(pkg.Partitions) > 0 {
+			return true
+		}
+	}
+	for _, pkg := range config.ConfigurationPackages {
+		if len(pkg.Partitions) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvePartitionSelectors replaces the selectors of the configuration and of its packages by the numbers of the partitions
+// they select, which are added to the partition numbers. The partitions are the partitions of the image the packages are placed to,
+// with their roles detected if any selector selects partitions by their role.
+func (config *Configuration) ResolvePartitionSelectors(partitions []user.PartitionInfo) error {
+	var err error
+	config.PartitionNumbers, err = config.resolvePartitionSelectors(config.Partitions, partitions, config.PartitionNumbers)
+	if err != nil {
+		return err
+	}
+	config.Partitions = nil
+	for i, pkg := range config.Packages {
+		config.Packages[i].PartitionNumbers, err = config.resolvePartitionSelectors(pkg.Partitions, partitions, pkg.PartitionNumbers)
+		if err != nil {
+			return fmt.Errorf("package %s: %v", pkg.PackagePath, err)
+		}
+		config.Packages[i].Partitions = nil
+	}
+	for i, pkg := range config.ConfigurationPackages {
+		config.ConfigurationPackages[i].PartitionNumbers, err = config.resolvePartitionSelectors(pkg.Partitions, partitions, pkg.PartitionNumbers)
+		if err != nil {
+			return fmt.Errorf("configuration package %s: %v", pkg.PackagePath, err)
+		}
+		config.ConfigurationPackages[i].Partitions = nil
+	}
+	return nil
+}
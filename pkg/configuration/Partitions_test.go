@@ -0,0 +1,114 @@
+package configuration
+
+import (
+	"encoding/json"
+	"package-to-image-placer/pkg/user"
+	"slices"
+	"testing"
+)
+
+const linuxFilesystemType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+var imagePartitions = []user.PartitionInfo{
+	{Number: 1, UUID: "8C9F5E2A-0000-4000-8000-000000000001", Name: "boot", TypeGUID: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", FilesystemType: "FAT32", FilesystemLabel: "BOOT"},
+	{Number: 2, UUID: "8C9F5E2A-0000-4000-8000-000000000002", Name: "rootfs_a", TypeGUID: linuxFilesystemType, FilesystemType: "Ext4", FilesystemLabel: "rootfs"},
+	{Number: 3, UUID: "8C9F5E2A-0000-4000-8000-000000000003", Name: "rootfs_b", TypeGUID: linuxFilesystemType, FilesystemType: "Ext4", FilesystemLabel: "rootfs"},
+	{Number: 5, UUID: "8C9F5E2A-0000-4000-8000-000000000005", Name: "data", TypeGUID: linuxFilesystemType, FilesystemType: "Ext4", FilesystemLabel: "data"},
+	{Number: 6, UUID: "8C9F5E2A-0000-4000-8000-000000000006", Name: "unknown", TypeGUID: linuxFilesystemType, FilesystemType: user.UnknownFilesystem, FilesystemLabel: user.UnknownFilesystem},
+}
+
+func TestResolvePartitionSelectors_Success(t *testing.T) {
+	config := Configuration{
+		PartitionNumbers: []int{2},
+		Partitions:       []PartitionSelector{{Name: "rootfs_a"}, {Name: "rootfs_b"}},
+		Packages:         []PackageConfig{{PackagePath: "app.zip"}},
+		ConfigurationPackages: []ConfigurationPackage{
+			{PackagePath: "boot-overlay.zip", Partitions: []PartitionSelector{{TypeGUID: "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"}}},
+			{PackagePath: "data.zip", Partitions: []PartitionSelector{{Label: "data"}, {UUID: "8c9f5e2a-0000-4000-8000-000000000005"}}},
+		},
+	}
+	for range 2 {
+		if err := config.ResolvePartitionSelectors(imagePartitions); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if !slices.Equal(config.PartitionNumbers, []int{2, 3}) {
+		t.Errorf("expected partitions [2 3], got %v", config.PartitionNumbers)
+	}
+	if len(config.Packages[0].PartitionNumbers) != 0 {
+		t.Errorf("expected the package without selectors to keep no partitions, got %v", config.Packages[0].PartitionNumbers)
+	}
+	if !slices.Equal(config.ConfigurationPackages[0].PartitionNumbers, []int{1}) {
+		t.Errorf("expected partitions [1], got %v", config.ConfigurationPackages[0].PartitionNumbers)
+	}
+	if !slices.Equal(config.ConfigurationPackages[1].PartitionNumbers, []int{5}) {
+		t.Errorf("expected partitions [5], got %v", config.ConfigurationPackages[1].PartitionNumbers)
+	}
+	if !slices.Equal(config.TargetPartitions(), []int{2, 3, 1, 5}) {
+		t.Errorf("expected target partitions [2 3 1 5], got %v", config.TargetPartitions())
+	}
+}
+
+func TestResolvePartitionSelectors_NoOrSeveralMatches(t *testing.T) {
+	for _, selector := range []PartitionSelector{{Name: "rootfs_c"}, {Label: "rootfs"}, {TypeGUID: linuxFilesystemType}, {Label: user.UnknownFilesystem}} {
+		config := Configuration{Partitions: []PartitionSelector{selector}}
+		if err := config.ResolvePartitionSelectors(imagePartitions); err == nil {
+			t.Errorf("expected error for selector %s, got nil", selector)
+		}
+	}
+}
+
+func TestValidatePartitionSelectors_Invalid(t *testing.T) {
+	for _, selector := range []PartitionSelector{{}, {Name: "rootfs_a", Label: "rootfs"}} {
+		if err := validatePartitionSelectors([]PartitionSelector{selector}); err == nil {
+			t.Errorf("expected error for selector %+v, got nil", selector)
+		}
+	}
+	config := Configuration{
+		Source:     sourceImg,
+		Target:     "target.img",
+		Packages:   []PackageConfig{package1},
+		Partitions: []PartitionSelector{{Name: "rootfs_a"}},
+		PackageDir: "package/dir",
+		LogPath:    "./",
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestPartitionSelectors_AllOfRole(t *testing.T) {
+	var config Configuration
+	err := json.Unmarshal([]byte(`{"partitions": "all-rootfs", "configuration-packages": [{"package-path": "data.zip", "partitions": [{"role": "data"}]}]}`), &config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !config.HasRoleSelectors() {
+		t.Fatalf("expected role selectors, got %+v", config.Partitions)
+	}
+	partitions := slices.Clone(imagePartitions)
+	for i := range partitions {
+		partitions[i].Role = user.PartitionRoleData
+	}
+	partitions[1].Role = user.PartitionRoleRootfs
+	partitions[2].Role = user.PartitionRoleRootfs
+	if err := config.ResolvePartitionSelectors(partitions); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(config.PartitionNumbers, []int{2, 3}) {
+		t.Errorf("expected partitions [2 3], got %v", config.PartitionNumbers)
+	}
+	if !slices.Equal(config.ConfigurationPackages[0].PartitionNumbers, []int{1, 5, 6}) {
+		t.Errorf("expected partitions [1 5 6], got %v", config.ConfigurationPackages[0].PartitionNumbers)
+	}
+	if config.HasPartitionSelectors() {
+		t.Errorf("expected the selectors to be replaced by the partition numbers")
+	}
+
+	if err := json.Unmarshal([]byte(`{"partitions": "rootfs"}`), &config); err == nil {
+		t.Errorf("expected error for partitions without the all- prefix, got nil")
+	}
+	if err := validatePartitionSelectors([]PartitionSelector{{Role: "swap"}}); err == nil {
+		t.Errorf("expected error for unknown role, got nil")
+	}
+}
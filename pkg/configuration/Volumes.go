@@ -0,0 +1,113 @@
+package configuration
+
+import (
+	"fmt"
+	"package-to-image-placer/pkg/helper"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// FirstVolumeNumber is the number of the first volume. Volumes are numbered in their order after all possible partition numbers,
+// so they can be listed in partition numbers and are told apart from partitions in logs and reports.
+const FirstVolumeNumber = 1000
+
+// lvmNamePattern matches the names of LVM volume groups and logical volumes
+var lvmNamePattern = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.-]*$`)
+
+// Volume is a filesystem nested in the image the packages can be placed to: an LVM logical volume, a LUKS volume
+// opened by a key file or a filesystem image file stored in a partition. Exactly one of LVM, LUKSKeyFile and ImageFile must be set.
+type Volume struct {
+	// Name identifies the volume in volume selectors
+	Name string `json:"name"`
+	// LVM is the logical volume in the form vg/lv
+	LVM string `json:"lvm,omitempty"`
+	// Partition is the partition holding the LUKS volume or the image file
+	Partition int `json:"partition,omitempty"`
+	// LUKSKeyFile is the file holding the passphrase of the LUKS volume in the partition
+	LUKSKeyFile string `json:"luks-key-file,omitempty"`
+	// ImageFile is the absolute path of the filesystem image file in the partition, e.g. /images/rootfs.ext4
+	ImageFile string `json:"image-file,omitempty"`
+}
+
+// String returns the volume in the form used in messages, e.g. lvm=vg/root
+func (volume Volume) String() string {
+	switch {
+	case volume.LVM != "":
+		return "lvm=" + volume.LVM
+	case volume.LUKSKeyFile != "":
+		return fmt.Sprintf("luks=partition %d", volume.Partition)
+	default:
+		return fmt.Sprintf("image-file=partition %d:%s", volume.Partition, volume.ImageFile)
+	}
+}
+
+// validate checks that the volume is of exactly one kind and the fields of its kind are valid.
+func (volume Volume) validate() error {
+	set := 0
+	for _, value := range []string{volume.LVM, volume.LUKSKeyFile, volume.ImageFile} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("volume must set exactly one of 'lvm', 'luks-key-file' and 'image-file'")
+	}
+	if volume.LVM != "" {
+		group, logicalVolume, found := strings.Cut(volume.LVM, "/")
+		if !found || !lvmNamePattern.MatchString(group) || !lvmNamePattern.MatchString(logicalVolume) {
+			return fmt.Errorf("invalid LVM logical volume '%s', must be in the form vg/lv", volume.LVM)
+		}
+		if volume.Partition != 0 {
+			return fmt.Errorf("LVM volume must not set partition, logical volumes are found in all partitions")
+		}
+		return nil
+	}
+	if volume.Partition < 1 || volume.Partition >= FirstVolumeNumber {
+		return fmt.Errorf("invalid partition number %d of the volume", volume.Partition)
+	}
+	if volume.LUKSKeyFile != "" && !helper.DoesFileExists(volume.LUKSKeyFile) {
+		return fmt.Errorf("LUKS key file %s does not exist", volume.LUKSKeyFile)
+	}
+	if volume.ImageFile != "" && (!path.IsAbs(volume.ImageFile) || path.Clean(volume.ImageFile) == "/") {
+		return fmt.Errorf("image file '%s' must be an absolute path of a file in the partition", volume.ImageFile)
+	}
+	return nil
+}
+
+// validateVolumes checks the volumes and that their names are set and unique.
+func validateVolumes(volumes []Volume) error {
+	var names []string
+	for _, volume := range volumes {
+		if volume.Name == "" {
+			return fmt.Errorf("volume %s has no name", volume)
+		}
+		if slices.Contains(names, volume.Name) {
+			return fmt.Errorf("volume name '%s' is used more than once", volume.Name)
+		}
+		names = append(names, volume.Name)
+		if err := volume.validate(); err != nil {
+			return fmt.Errorf("volume %s: %v", volume.Name, err)
+		}
+	}
+	return nil
+}
+
+// VolumeNumber returns the number of the volume with the name, or false if there is no such volume.
+func (config *Configuration) VolumeNumber(name string) (int, bool) {
+	index := slices.IndexFunc(config.Volumes, func(volume Volume) bool { return volume.Name == name })
+	if index == -1 {
+		return 0, false
+	}
+	return FirstVolumeNumber + index, true
+}
+
+// Volume returns the volume with the number, or nil if the number is a partition number.
+func (config *Configuration) Volume(number int) *Volume {
+	index := number - FirstVolumeNumber
+	if index < 0 || index >= len(config.Volumes) {
+		return nil
+	}
+	return &config.Volumes[index]
+}
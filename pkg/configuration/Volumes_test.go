@@ -0,0 +1,83 @@
+package configuration
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateVolumes_Success(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "secure.key")
+	if err := os.WriteFile(keyFile, []byte("passphrase\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	volumes := []Volume{
+		{Name: "root", LVM: "vg0/root"},
+		{Name: "secure", Partition: 3, LUKSKeyFile: keyFile},
+		{Name: "app", Partition: 4, ImageFile: "/images/rootfs.ext4"},
+	}
+	if err := validateVolumes(volumes); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestValidateVolumes_Invalid(t *testing.T) {
+	invalid := [][]Volume{
+		{{LVM: "vg0/root"}},
+		{{Name: "root", LVM: "vg0/root"}, {Name: "root", LVM: "vg0/home"}},
+		{{Name: "none"}},
+		{{Name: "both", LVM: "vg0/root", ImageFile: "/rootfs.ext4", Partition: 1}},
+		{{Name: "no-lv", LVM: "vg0"}},
+		{{Name: "bad-lv", LVM: "vg0/../root"}},
+		{{Name: "lvm-partition", LVM: "vg0/root", Partition: 2}},
+		{{Name: "no-partition", ImageFile: "/rootfs.ext4"}},
+		{{Name: "relative", Partition: 2, ImageFile: "rootfs.ext4"}},
+		{{Name: "root-dir", Partition: 2, ImageFile: "/"}},
+		{{Name: "missing-key", Partition: 2, LUKSKeyFile: "/nonexistent/secure.key"}},
+	}
+	for _, volumes := range invalid {
+		if err := validateVolumes(volumes); err == nil {
+			t.Errorf("expected error for volumes %+v, got nil", volumes)
+		}
+	}
+}
+
+func TestVolumeNumbers(t *testing.T) {
+	config := Configuration{Volumes: []Volume{{Name: "root", LVM: "vg0/root"}, {Name: "app", Partition: 4, ImageFile: "/rootfs.ext4"}}}
+	number, found := config.VolumeNumber("app")
+	if !found || number != FirstVolumeNumber+1 {
+		t.Fatalf("expected volume number %d, got %d (found %t)", FirstVolumeNumber+1, number, found)
+	}
+	if volume := config.Volume(number); volume == nil || volume.Name != "app" {
+		t.Errorf("expected volume app, got %+v", volume)
+	}
+	if _, found := config.VolumeNumber("missing"); found {
+		t.Errorf("expected no volume named missing")
+	}
+	if volume := config.Volume(2); volume != nil {
+		t.Errorf("expected no volume for partition 2, got %+v", volume)
+	}
+	if err := config.validatePartitionNumbers([]int{2, FirstVolumeNumber + 2}); err == nil {
+		t.Errorf("expected error for a volume number without volume, got nil")
+	}
+}
+
+func TestResolvePartitionSelectors_Volume(t *testing.T) {
+	config := Configuration{
+		PartitionNumbers: []int{2},
+		Volumes:          []Volume{{Name: "root", LVM: "vg0/root"}},
+		Packages:         []PackageConfig{{PackagePath: "app.zip", Partitions: []PartitionSelector{{Volume: "root"}}}},
+	}
+	if err := config.ResolvePartitionSelectors(imagePartitions); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(config.Packages[0].PartitionNumbers, []int{FirstVolumeNumber}) {
+		t.Errorf("expected partitions [%d], got %v", FirstVolumeNumber, config.Packages[0].PartitionNumbers)
+	}
+
+	config.Packages[0].Partitions = []PartitionSelector{{Volume: "missing"}}
+	if err := config.ResolvePartitionSelectors(imagePartitions); err == nil {
+		t.Errorf("expected error for unknown volume, got nil")
+	}
+}
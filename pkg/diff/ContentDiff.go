@@ -0,0 +1,155 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxContentDiffSize is the maximal size of a file whose content diff is made
+const maxContentDiffSize = 1024 * 1024
+
+// maxContentDiffCells limits the size of the table used to compute the content diff (lines of old times lines of new file)
+const maxContentDiffCells = 16 * 1024 * 1024
+
+// contextLines is the number of unchanged lines shown around the changes
+const contextLines = 3
+
+// diffOperation is one line of the content diff: ' ' for unchanged, '-' for removed and '+' for added line
+type diffOperation struct {
+	kind byte
+	line string
+}
+
+// isText reports whether the content looks like text, i.e. it is valid UTF-8 without NUL bytes.
+func isText(content []byte) bool {
+	return !bytes.Contains(content, []byte{0}) && utf8.Valid(content)
+}
+
+// unifiedDiff returns the diff of the lines of the contents in the unified format.
+// If the contents are too large, only a note is returned.
+func unifiedDiff(filePath string, oldContent []byte, newContent []byte) string {
+	oldLines := splitLines(string(oldContent))
+	newLines := splitLines(string(newContent))
+	if (len(oldLines)+1)*(len(newLines)+1) > maxContentDiffCells {
+		return "content diff omitted, files have too many lines\n"
+	}
+
+	operations := diffLines(oldLines, newLines)
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- a%s\n+++ b%s\n", filePath, filePath)
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(operations); {
+		// Skip unchanged lines up to the next change
+		change := i
+		for change < len(operations) && operations[change].kind == ' ' {
+			change++
+		}
+		if change == len(operations) {
+			break
+		}
+		start := max(change-contextLines, i)
+		for _, operation := range operations[i:start] {
+			oldLine, newLine = advance(operation, oldLine, newLine)
+		}
+
+		// Extend the hunk while the next change is close enough to share the context
+		end := change
+		for {
+			for end < len(operations) && operations[end].kind != ' ' {
+				end++
+			}
+			unchanged := end
+			for unchanged < len(operations) && operations[unchanged].kind == ' ' {
+				unchanged++
+			}
+			if unchanged < len(operations) && unchanged-end <= 2*contextLines {
+				end = unchanged
+				continue
+			}
+			end = min(end+contextLines, len(operations))
+			break
+		}
+
+		oldCount, newCount := 0, 0
+		for _, operation := range operations[start:end] {
+			oldCount, newCount = advance(operation, oldCount, newCount)
+		}
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, operation := range operations[start:end] {
+			fmt.Fprintf(&builder, "%c%s\n", operation.kind, operation.line)
+		}
+		oldLine += oldCount
+		newLine += newCount
+		i = end
+	}
+	return builder.String()
+}
+
+// diffLines computes the shortest edit script turning the old lines to the new lines using the longest common subsequence.
+func diffLines(oldLines []string, newLines []string) []diffOperation {
+	columns := len(newLines) + 1
+	// common[i*columns+j] is the length of the longest common subsequence of oldLines[i:] and newLines[j:]
+	common := make([]int32, (len(oldLines)+1)*columns)
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				common[i*columns+j] = common[(i+1)*columns+j+1] + 1
+			} else {
+				common[i*columns+j] = max(common[(i+1)*columns+j], common[i*columns+j+1])
+			}
+		}
+	}
+
+	operations := make([]diffOperation, 0, max(len(oldLines), len(newLines)))
+	i, j := 0, 0
+	for i < len(oldLines) && j < len(newLines) {
+		switch {
+		case oldLines[i] == newLines[j]:
+			operations = append(operations, diffOperation{' ', oldLines[i]})
+			i++
+			j++
+		case common[(i+1)*columns+j] >= common[i*columns+j+1]:
+			operations = append(operations, diffOperation{'-', oldLines[i]})
+			i++
+		default:
+			operations = append(operations, diffOperation{'+', newLines[j]})
+			j++
+		}
+	}
+	for ; i < len(oldLines); i++ {
+		operations = append(operations, diffOperation{'-', oldLines[i]})
+	}
+	for ; j < len(newLines); j++ {
+		operations = append(operations, diffOperation{'+', newLines[j]})
+	}
+	return operations
+}
+
+// advance counts the operation to the lines of the old and of the new file
+func advance(operation diffOperation, oldLine int, newLine int) (int, int) {
+	if operation.kind != '+' {
+		oldLine++
+	}
+	if operation.kind != '-' {
+		newLine++
+	}
+	return oldLine, newLine
+}
+
+// hunkRange formats the range of lines of a hunk. Lines before the hunk are counted from 0, as in the unified format.
+func hunkRange(linesBefore int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", linesBefore)
+	}
+	return fmt.Sprintf("%d,%d", linesBefore+1, count)
+}
+
+// splitLines splits the text to lines without the line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,34 @@
+package diff
+
+import (
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	oldContent := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	newContent := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"
+	expected := "--- a/file\n+++ b/file\n" +
+		"@@ -1,6 +1,6 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n" +
+		"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n"
+	diff := unifiedDiff("/file", []byte(oldContent), []byte(newContent))
+	if diff != expected {
+		t.Fatalf("expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+}
+
+func TestUnifiedDiff_NewFileContent(t *testing.T) {
+	expected := "--- a/file\n+++ b/file\n@@ -0,0 +1,2 @@\n+a\n+b\n"
+	diff := unifiedDiff("/file", nil, []byte("a\nb\n"))
+	if diff != expected {
+		t.Fatalf("expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+}
+
+func TestIsText(t *testing.T) {
+	if !isText([]byte("key=value\n")) {
+		t.Fatalf("expected text")
+	}
+	if isText([]byte{0x7f, 'E', 'L', 'F', 0}) {
+		t.Fatalf("expected binary")
+	}
+}
@@ -0,0 +1,363 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/user"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options configures the comparison of two images
+type Options struct {
+	// Backend used to read the partitions, one of BackendAuto, BackendGuestmount and BackendDiskfs
+	Backend string
+	// Partitions to compare, all partitions of both images if empty
+	Partitions []int
+	// ContentDiff adds the line diff of modified text files
+	ContentDiff bool
+}
+
+// Result holds the differences between the source and the target image
+type Result struct {
+	Source     string           `json:"source"`
+	Target     string           `json:"target"`
+	Partitions []*PartitionDiff `json:"partitions"`
+}
+
+// PartitionDiff holds the differences on one partition. Paths are absolute paths inside the partition.
+// If the partition exists only in one of the images, OnlyIn is "source" or "target" and no files are compared.
+type PartitionDiff struct {
+	Number           int      `json:"number"`
+	OnlyIn           string   `json:"only-in,omitempty"`
+	SourceFilesystem string   `json:"source-filesystem,omitempty"`
+	TargetFilesystem string   `json:"target-filesystem,omitempty"`
+	Added            []string `json:"added"`
+	Removed          []string `json:"removed"`
+	Modified         []Change `json:"modified"`
+	MetadataChanged  []Change `json:"metadata-changed"`
+}
+
+// Change describes how a file present in both images differs.
+// ContentDiff is set for modified text files if requested.
+type Change struct {
+	Path        string   `json:"path"`
+	Changes     []string `json:"changes"`
+	ContentDiff string   `json:"content-diff,omitempty"`
+}
+
+// Compare compares the images partition by partition. Partitions are matched by their number.
+// Both images are only read; partitions read by guestmount are mounted read-only.
+func Compare(ctx context.Context, sourcePath string, targetPath string, options Options, logger *slog.Logger) (*Result, error) {
+	sourcePartitions, err := user.GetPartitionInfo(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partitions of %s: %v", sourcePath, err)
+	}
+	targetPartitions, err := user.GetPartitionInfo(targetPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partitions of %s: %v", targetPath, err)
+	}
+
+	partitionNumbers := options.Partitions
+	if len(partitionNumbers) == 0 {
+		for _, partition := range append(sourcePartitions, targetPartitions...) {
+			partitionNumbers = append(partitionNumbers, partition.Number)
+		}
+	}
+	partitionNumbers = slices.Clone(partitionNumbers)
+	slices.Sort(partitionNumbers)
+	partitionNumbers = slices.Compact(partitionNumbers)
+
+	result := &Result{Source: sourcePath, Target: targetPath, Partitions: []*PartitionDiff{}}
+	for _, partitionNumber := range partitionNumbers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		source, inSource := findPartition(sourcePartitions, partitionNumber)
+		target, inTarget := findPartition(targetPartitions, partitionNumber)
+		if !inSource && !inTarget {
+			return nil, fmt.Errorf("partition %d does not exist in any of the images", partitionNumber)
+		}
+		partitionDiff := &PartitionDiff{
+			Number:           partitionNumber,
+			SourceFilesystem: source.FilesystemType,
+			TargetFilesystem: target.FilesystemType,
+			Added:            []string{},
+			Removed:          []string{},
+			Modified:         []Change{},
+			MetadataChanged:  []Change{},
+		}
+		result.Partitions = append(result.Partitions, partitionDiff)
+		if !inTarget {
+			partitionDiff.OnlyIn = "source"
+			continue
+		}
+		if !inSource {
+			partitionDiff.OnlyIn = "target"
+			continue
+		}
+
+		partitionLogger := logger.With("partition", partitionNumber)
+		partitionLogger.Info("Comparing partition")
+		err = comparePartition(ctx, partitionDiff, sourcePath, targetPath, options, partitionLogger)
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", partitionNumber, err)
+		}
+	}
+	return result, nil
+}
+
+// findPartition returns the partition with the number
+func findPartition(partitions []user.PartitionInfo, number int) (user.PartitionInfo, bool) {
+	for _, partition := range partitions {
+		if partition.Number == number {
+			return partition, true
+		}
+	}
+	return user.PartitionInfo{}, false
+}
+
+// comparePartition opens the partition of both images and compares their files
+func comparePartition(ctx context.Context, partitionDiff *PartitionDiff, sourcePath string, targetPath string, options Options, logger *slog.Logger) error {
+	sourceTree, err := OpenTree(ctx, sourcePath, partitionDiff.Number, options.Backend, partitionDiff.SourceFilesystem, logger)
+	if err != nil {
+		return fmt.Errorf("failed to open source partition: %w", err)
+	}
+	defer sourceTree.Close()
+	targetTree, err := OpenTree(ctx, targetPath, partitionDiff.Number, options.Backend, partitionDiff.TargetFilesystem, logger)
+	if err != nil {
+		return fmt.Errorf("failed to open target partition: %w", err)
+	}
+	defer targetTree.Close()
+	return compareTrees(ctx, partitionDiff, sourceTree, targetTree, options.ContentDiff)
+}
+
+// compareTrees adds the differences between the source and the target tree to the partition diff
+func compareTrees(ctx context.Context, partitionDiff *PartitionDiff, sourceTree Tree, targetTree Tree, contentDiff bool) error {
+	sourceEntries, err := sourceTree.Entries(ctx)
+	if err != nil {
+		return err
+	}
+	targetEntries, err := targetTree.Entries(ctx)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for entryPath := range sourceEntries {
+		paths = append(paths, entryPath)
+	}
+	for entryPath := range targetEntries {
+		if _, found := sourceEntries[entryPath]; !found {
+			paths = append(paths, entryPath)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, entryPath := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		source, inSource := sourceEntries[entryPath]
+		target, inTarget := targetEntries[entryPath]
+		if !inTarget {
+			partitionDiff.Removed = append(partitionDiff.Removed, entryPath)
+			continue
+		}
+		if !inSource {
+			partitionDiff.Added = append(partitionDiff.Added, entryPath)
+			continue
+		}
+
+		changes, err := contentChanges(entryPath, source, target, sourceTree, targetTree)
+		if err != nil {
+			return err
+		}
+		modified := len(changes) != 0
+		changes = append(changes, metadataChanges(source, target)...)
+		if len(changes) == 0 {
+			continue
+		}
+		change := Change{Path: entryPath, Changes: changes}
+		if !modified {
+			partitionDiff.MetadataChanged = append(partitionDiff.MetadataChanged, change)
+			continue
+		}
+		if contentDiff && source.Mode.IsRegular() && target.Mode.IsRegular() {
+			change.ContentDiff, err = textContentDiff(entryPath, sourceTree, targetTree)
+			if err != nil {
+				return err
+			}
+		}
+		partitionDiff.Modified = append(partitionDiff.Modified, change)
+	}
+	return nil
+}
+
+// contentChanges describes how the content of the entry changed: its type, symlink target, size or content.
+func contentChanges(entryPath string, source Entry, target Entry, sourceTree Tree, targetTree Tree) ([]string, error) {
+	if source.Mode.Type() != target.Mode.Type() {
+		return []string{fmt.Sprintf("type %s -> %s", typeName(source.Mode), typeName(target.Mode))}, nil
+	}
+	if source.LinkTarget != target.LinkTarget {
+		return []string{fmt.Sprintf("link %s -> %s", source.LinkTarget, target.LinkTarget)}, nil
+	}
+	if !source.Mode.IsRegular() {
+		return nil, nil
+	}
+	if source.Size != target.Size {
+		return []string{fmt.Sprintf("size %d -> %d", source.Size, target.Size)}, nil
+	}
+	sourceHash, err := hashFile(sourceTree, entryPath)
+	if err != nil {
+		return nil, err
+	}
+	targetHash, err := hashFile(targetTree, entryPath)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sourceHash, targetHash) {
+		return []string{"content"}, nil
+	}
+	return nil, nil
+}
+
+// metadataChanges describes how the permissions, ownership and modification time of the entry changed.
+// Ownership is compared only if both backends report it.
+func metadataChanges(source Entry, target Entry) []string {
+	var changes []string
+	permissions := os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	if source.Mode&permissions != target.Mode&permissions {
+		changes = append(changes, fmt.Sprintf("mode %s -> %s", source.Mode&permissions, target.Mode&permissions))
+	}
+	if source.UID >= 0 && target.UID >= 0 && (source.UID != target.UID || source.GID != target.GID) {
+		changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", source.UID, source.GID, target.UID, target.GID))
+	}
+	if !source.ModTime.Equal(target.ModTime) {
+		changes = append(changes, fmt.Sprintf("mtime %s -> %s", source.ModTime.UTC().Format(time.RFC3339), target.ModTime.UTC().Format(time.RFC3339)))
+	}
+	return changes
+}
+
+// typeName returns a readable name of the file type
+func typeName(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	default:
+		return "special file"
+	}
+}
+
+// hashFile returns the SHA256 hash of the file in the tree
+func hashFile(tree Tree, filePath string) ([]byte, error) {
+	reader, err := tree.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %v", filePath, err)
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", filePath, err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// textContentDiff returns the content diff of the file if both versions are text files of at most maxContentDiffSize bytes.
+func textContentDiff(filePath string, sourceTree Tree, targetTree Tree) (string, error) {
+	sourceContent, err := readFile(sourceTree, filePath)
+	if err != nil || sourceContent == nil {
+		return "", err
+	}
+	targetContent, err := readFile(targetTree, filePath)
+	if err != nil || targetContent == nil {
+		return "", err
+	}
+	if !isText(sourceContent) || !isText(targetContent) {
+		return "", nil
+	}
+	return unifiedDiff(filePath, sourceContent, targetContent), nil
+}
+
+// readFile reads the file from the tree. Returns nil if it is larger than maxContentDiffSize.
+func readFile(tree Tree, filePath string) ([]byte, error) {
+	reader, err := tree.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %v", filePath, err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(io.LimitReader(reader, maxContentDiffSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", filePath, err)
+	}
+	if len(content) > maxContentDiffSize {
+		return nil, nil
+	}
+	return content, nil
+}
+
+// Write writes the result in the format, FormatText or FormatJSON.
+func (result *Result) Write(writer io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode diff: %v", err)
+		}
+		_, err = writer.Write(append(data, '\n'))
+		return err
+	case FormatText, "":
+		return result.writeText(writer)
+	default:
+		return fmt.Errorf("unknown format '%s', must be %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// writeText writes the result in human-readable form
+func (result *Result) writeText(writer io.Writer) error {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Comparing %s and %s\n", result.Source, result.Target)
+	for _, partition := range result.Partitions {
+		if partition.OnlyIn != "" {
+			fmt.Fprintf(&builder, "\nPartition %d: only in %s image\n", partition.Number, partition.OnlyIn)
+			continue
+		}
+		fmt.Fprintf(&builder, "\nPartition %d (%s -> %s): %d added, %d removed, %d modified, %d metadata changed\n",
+			partition.Number, partition.SourceFilesystem, partition.TargetFilesystem,
+			len(partition.Added), len(partition.Removed), len(partition.Modified), len(partition.MetadataChanged))
+		for _, added := range partition.Added {
+			fmt.Fprintf(&builder, "\tadded %s\n", added)
+		}
+		for _, removed := range partition.Removed {
+			fmt.Fprintf(&builder, "\tremoved %s\n", removed)
+		}
+		for _, change := range partition.Modified {
+			fmt.Fprintf(&builder, "\tmodified %s: %s\n", change.Path, strings.Join(change.Changes, ", "))
+			for _, line := range splitLines(change.ContentDiff) {
+				fmt.Fprintf(&builder, "\t\t%s\n", line)
+			}
+		}
+		for _, change := range partition.MetadataChanged {
+			fmt.Fprintf(&builder, "\tmetadata %s: %s\n", change.Path, strings.Join(change.Changes, ", "))
+		}
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
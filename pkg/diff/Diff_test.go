@@ -0,0 +1,219 @@
+package diff
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/helper"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// createDirTree creates the files (name -> content) in a temporary directory and returns a tree reading it.
+// All files get the same modification time, so only the intended changes are reported.
+func createDirTree(t *testing.T, files map[string]string) *mountTree {
+	dir := t.TempDir()
+	modTime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, content := range files {
+		filePath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err := filepath.Walk(dir, func(filePath string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(filePath, modTime, modTime)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return &mountTree{dir: dir, unmount: func() {}}
+}
+
+func newPartitionDiff() *PartitionDiff {
+	return &PartitionDiff{Number: 1, Added: []string{}, Removed: []string{}, Modified: []Change{}, MetadataChanged: []Change{}}
+}
+
+func TestCompareTrees(t *testing.T) {
+	source := createDirTree(t, map[string]string{
+		"etc/app.conf":    "a\nb\nc\n",
+		"etc/same.conf":   "same\n",
+		"etc/removed":     "removed\n",
+		"usr/bin/tool":    "binary",
+		"etc/samesize.cf": "aaaa",
+	})
+	target := createDirTree(t, map[string]string{
+		"etc/app.conf":    "a\nB\nc\n",
+		"etc/same.conf":   "same\n",
+		"opt/new/file":    "new\n",
+		"usr/bin/tool":    "binary",
+		"etc/samesize.cf": "bbbb",
+	})
+	if err := os.Chmod(filepath.Join(target.dir, "usr/bin/tool"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	partitionDiff := newPartitionDiff()
+	err := compareTrees(context.Background(), partitionDiff, source, target, true)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !slices.Equal(partitionDiff.Added, []string{"/opt", "/opt/new", "/opt/new/file"}) {
+		t.Fatalf("unexpected added files %v", partitionDiff.Added)
+	}
+	if !slices.Equal(partitionDiff.Removed, []string{"/etc/removed"}) {
+		t.Fatalf("unexpected removed files %v", partitionDiff.Removed)
+	}
+	if len(partitionDiff.Modified) != 2 || partitionDiff.Modified[0].Path != "/etc/app.conf" || partitionDiff.Modified[1].Path != "/etc/samesize.cf" {
+		t.Fatalf("unexpected modified files %v", partitionDiff.Modified)
+	}
+	if !strings.Contains(partitionDiff.Modified[0].ContentDiff, "-b\n+B\n") {
+		t.Fatalf("expected content diff of /etc/app.conf, got %s", partitionDiff.Modified[0].ContentDiff)
+	}
+	if !slices.Equal(partitionDiff.Modified[1].Changes, []string{"content"}) {
+		t.Fatalf("expected content change of file with the same size, got %v", partitionDiff.Modified[1].Changes)
+	}
+	if len(partitionDiff.MetadataChanged) != 1 || partitionDiff.MetadataChanged[0].Path != "/usr/bin/tool" {
+		t.Fatalf("unexpected metadata changes %v", partitionDiff.MetadataChanged)
+	}
+}
+
+func TestCompareTrees_Cancelled(t *testing.T) {
+	tree := createDirTree(t, map[string]string{"file": "content"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := compareTrees(ctx, newPartitionDiff(), tree, tree, false)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestResult_Write(t *testing.T) {
+	partitionDiff := newPartitionDiff()
+	partitionDiff.Added = append(partitionDiff.Added, "/opt/new")
+	result := &Result{Source: "source.img", Target: "target.img", Partitions: []*PartitionDiff{partitionDiff, {Number: 2, OnlyIn: "target"}}}
+
+	var text bytes.Buffer
+	if err := result.Write(&text, FormatText); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.Contains(text.String(), "added /opt/new") || !strings.Contains(text.String(), "Partition 2: only in target image") {
+		t.Fatalf("unexpected text output:\n%s", text.String())
+	}
+
+	var jsonOutput bytes.Buffer
+	if err := result.Write(&jsonOutput, FormatJSON); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var decoded Result
+	if err := json.Unmarshal(jsonOutput.Bytes(), &decoded); err != nil {
+		t.Fatalf("expected valid JSON, got %v", err)
+	}
+	if len(decoded.Partitions) != 2 || decoded.Partitions[0].Added[0] != "/opt/new" {
+		t.Fatalf("unexpected decoded result %+v", decoded)
+	}
+
+	if err := result.Write(&text, "xml"); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+// createFat32Image creates an image with one FAT32 partition containing the files
+func createFat32Image(t *testing.T, files map[string]string) string {
+	imagePath := filepath.Join(t.TempDir(), "image.img")
+	size := int64(40 * 1024 * 1024)
+	imageDisk, err := diskfs.Create(imagePath, size, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer imageDisk.Close()
+	table := &mbr.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		Partitions:         []*mbr.Partition{{Type: mbr.Fat32LBA, Start: 2048, Size: uint32(size/512) - 2048}},
+	}
+	if err := imageDisk.Partition(table); err != nil {
+		t.Fatal(err.Error())
+	}
+	fs, err := imageDisk.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, content := range files {
+		writeFat32File(t, fs, name, content)
+	}
+	return imagePath
+}
+
+func writeFat32File(t *testing.T, fs filesystem.FileSystem, name string, content string) {
+	if err := fs.Mkdir(filepath.Dir(name)); err != nil {
+		t.Fatal(err.Error())
+	}
+	file, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte(content)); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestCompare_Diskfs(t *testing.T) {
+	source := createFat32Image(t, map[string]string{"/etc/app.conf": "old\n", "/etc/same.conf": "same\n"})
+	target := filepath.Join(t.TempDir(), "target.img")
+	if err := helper.CopyFile(target, source, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	targetDisk, err := diskfs.Open(target)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fs, err := targetDisk.GetFilesystem(1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writeFat32File(t, fs, "/opt/new.conf", "new\n")
+	targetDisk.Close()
+
+	result, err := Compare(context.Background(), source, target, Options{Backend: BackendAuto}, slog.Default())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(result.Partitions) != 1 {
+		t.Fatalf("expected one partition, got %d", len(result.Partitions))
+	}
+	partitionDiff := result.Partitions[0]
+	if partitionDiff.SourceFilesystem != "FAT32" {
+		t.Fatalf("expected FAT32 filesystem, got %s", partitionDiff.SourceFilesystem)
+	}
+	if !slices.Contains(partitionDiff.Added, "/opt/new.conf") {
+		t.Fatalf("expected /opt/new.conf to be added, got %v", partitionDiff.Added)
+	}
+	if len(partitionDiff.Removed) != 0 || len(partitionDiff.Modified) != 0 {
+		t.Fatalf("expected no removed or modified files, got %v %v", partitionDiff.Removed, partitionDiff.Modified)
+	}
+}
+
+func TestCompare_MissingPartition(t *testing.T) {
+	source := createFat32Image(t, map[string]string{"/etc/app.conf": "old\n"})
+	_, err := Compare(context.Background(), source, source, Options{Backend: BackendDiskfs, Partitions: []int{3}}, slog.Default())
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
@@ -0,0 +1,203 @@
+package diff
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/image"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+const (
+	// BackendAuto reads filesystems supported by go-diskfs directly and mounts the others
+	BackendAuto = "auto"
+	// BackendGuestmount mounts the partitions read-only by guestmount
+	BackendGuestmount = "guestmount"
+	// BackendDiskfs reads the partitions directly by go-diskfs, without mounting
+	BackendDiskfs = "diskfs"
+)
+
+// Entry describes one file, directory or symlink of a partition.
+// UID and GID are -1 if the backend doesn't report ownership.
+type Entry struct {
+	Mode       fs.FileMode
+	Size       int64
+	ModTime    time.Time
+	UID        int
+	GID        int
+	LinkTarget string
+}
+
+// Tree is a read-only view of the filesystem of one partition. Paths are absolute paths inside the partition.
+type Tree interface {
+	// Entries returns all entries of the filesystem by their path. The root directory is not included.
+	Entries(ctx context.Context) (map[string]Entry, error)
+	// Open opens the regular file for reading
+	Open(path string) (io.ReadCloser, error)
+	// Close releases the partition, e.g. unmounts it
+	Close() error
+}
+
+// OpenTree opens the filesystem of the partition of the image with the backend.
+// With BackendAuto, the backend is chosen by the filesystem type as reported by user.GetPartitionInfo.
+func OpenTree(ctx context.Context, imagePath string, partitionNumber int, backend string, filesystemType string, logger *slog.Logger) (Tree, error) {
+	switch resolveBackend(backend, filesystemType) {
+	case BackendGuestmount:
+		mountDir, unmount, err := image.MountReadOnly(ctx, imagePath, partitionNumber, logger)
+		if err != nil {
+			return nil, err
+		}
+		return &mountTree{dir: mountDir, unmount: unmount}, nil
+	case BackendDiskfs:
+		return openDiskfsTree(imagePath, partitionNumber)
+	default:
+		return nil, fmt.Errorf("unknown backend '%s', must be one of %s, %s, %s", backend, BackendAuto, BackendGuestmount, BackendDiskfs)
+	}
+}
+
+// resolveBackend returns the backend used for the filesystem type.
+// go-diskfs is used for the filesystems it reads completely, everything else is mounted.
+func resolveBackend(backend string, filesystemType string) string {
+	if backend != BackendAuto && backend != "" {
+		return backend
+	}
+	switch filesystemType {
+	case "FAT32", "ISO9660", "Squashfs":
+		return BackendDiskfs
+	default:
+		return BackendGuestmount
+	}
+}
+
+// mountTree reads the filesystem mounted to a directory
+type mountTree struct {
+	dir     string
+	unmount func()
+}
+
+func (tree *mountTree) Entries(ctx context.Context) (map[string]Entry, error) {
+	entries := map[string]Entry{}
+	err := filepath.WalkDir(tree.dir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if filePath == tree.dir {
+			return nil
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		entry := Entry{Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime(), UID: -1, GID: -1}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.UID = int(stat.Uid)
+			entry.GID = int(stat.Gid)
+		}
+		if info.IsDir() {
+			entry.Size = 0
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			entry.LinkTarget, err = os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+		}
+		relativePath, err := filepath.Rel(tree.dir, filePath)
+		if err != nil {
+			return err
+		}
+		entries["/"+filepath.ToSlash(relativePath)] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", tree.dir, err)
+	}
+	return entries, nil
+}
+
+func (tree *mountTree) Open(filePath string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(tree.dir, filePath))
+}
+
+func (tree *mountTree) Close() error {
+	tree.unmount()
+	return nil
+}
+
+// diskfsTree reads the filesystem directly from the image by go-diskfs
+type diskfsTree struct {
+	disk       *disk.Disk
+	filesystem filesystem.FileSystem
+}
+
+func openDiskfsTree(imagePath string, partitionNumber int) (*diskfsTree, error) {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", imagePath, err)
+	}
+	partitionFilesystem, err := imageDisk.GetFilesystem(partitionNumber)
+	if err != nil {
+		imageDisk.Close()
+		return nil, fmt.Errorf("failed to read filesystem of partition %d: %v", partitionNumber, err)
+	}
+	return &diskfsTree{disk: imageDisk, filesystem: partitionFilesystem}, nil
+}
+
+func (tree *diskfsTree) Entries(ctx context.Context) (map[string]Entry, error) {
+	entries := map[string]Entry{}
+	err := tree.readDir(ctx, "/", entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readDir adds the entries of the directory and all its subdirectories
+func (tree *diskfsTree) readDir(ctx context.Context, dir string, entries map[string]Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	infos, err := tree.filesystem.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %v", dir, err)
+	}
+	for _, info := range infos {
+		if info.Name() == "." || info.Name() == ".." {
+			continue
+		}
+		entryPath := path.Join(dir, info.Name())
+		entry := Entry{Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime(), UID: -1, GID: -1}
+		if info.IsDir() {
+			// Not all filesystems of go-diskfs set the directory bit of the mode
+			entry.Mode |= os.ModeDir
+			entry.Size = 0
+			err = tree.readDir(ctx, entryPath, entries)
+			if err != nil {
+				return err
+			}
+		}
+		entries[entryPath] = entry
+	}
+	return nil
+}
+
+func (tree *diskfsTree) Open(filePath string) (io.ReadCloser, error) {
+	return tree.filesystem.OpenFile(filePath, os.O_RDONLY)
+}
+
+func (tree *diskfsTree) Close() error {
+	return tree.disk.Close()
+}
@@ -3,9 +3,10 @@ package helper
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,12 +21,11 @@ func DoesFileExists(file string) bool {
 }
 
 // AllDepsInstalled checks if all required dependencies are installed.
-var dependencies = []string{"guestmount", "guestunmount", "stty"}
+var dependencies = []string{"guestmount", "guestunmount", "guestfish", "stty"}
 
 // AllDepsInstalled checks if all required dependencies are installed.
 // Returns true if all dependencies are installed, false otherwise.
 func AllDepsInstalled() error {
-	log.Printf("Checking if all dependencies installed...")
 	var notInstalled []string
 	allInstalled := true
 	for _, dep := range dependencies {
@@ -151,7 +151,13 @@ func IsWithinRootDir(rootDir, targetPath string) bool {
 }
 
 // RunCommand runs a command. Returns stdout. If error occurs, returns also stderr.
-func RunCommand(command string, verbose bool) (string, error) {
+// The command is killed when the context is cancelled.
+func RunCommand(ctx context.Context, command string, verbose bool) (string, error) {
+	return RunCommandWithInput(ctx, command, nil, verbose)
+}
+
+// RunCommandWithInput runs a command as RunCommand does, with the standard input read from the input, which may be nil.
+func RunCommandWithInput(ctx context.Context, command string, input io.Reader, verbose bool) (string, error) {
 	var errbuf bytes.Buffer
 	var outputString string
 
@@ -159,24 +165,28 @@ func RunCommand(command string, verbose bool) (string, error) {
 	program := split[0]
 	arguments := split[1:]
 
-	cmd := exec.Command(program, arguments...)
+	cmd := exec.CommandContext(ctx, program, arguments...)
+	cmd.Stdin = input
 
 	stdout, _ := cmd.StdoutPipe()
 	cmd.Stderr = &errbuf
 	err := cmd.Start()
 	if err != nil {
-		log.Printf("Error in RunCommand: %s", err.Error())
+		slog.Debug("Failed to start command", "command", command, "error", err)
+		return "", err
 	}
 
 	reader := bufio.NewReader(stdout)
-	line, err := reader.ReadString('\n')
-	for err == nil {
-		if verbose {
-			log.Println(line)
+	for {
+		line, err := reader.ReadString('\n')
+		if verbose && line != "" {
+			slog.Debug("Command output", "command", program, "line", strings.TrimRight(line, "\n"))
 		}
 		outputString += line
+		if err != nil {
+			break
+		}
 	}
-	outputString += line
 
 	err = cmd.Wait()
 
@@ -184,10 +194,11 @@ func RunCommand(command string, verbose bool) (string, error) {
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			if verbose {
-				log.Printf("Return code: %v, stderr: %v", exitError.ExitCode(), stderrString)
+				slog.Debug("Command failed", "command", program, "return-code", exitError.ExitCode(), "stderr", stderrString)
 			}
 			return outputString, fmt.Errorf("return code: %v, stderr: %v", exitError.ExitCode(), stderrString)
 		}
+		return outputString, err
 	}
 	return outputString, nil
 }
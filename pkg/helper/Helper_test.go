@@ -1,7 +1,9 @@
 package helper
 
 import (
+	"context"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -49,3 +51,32 @@ func TestRemoveMountDirAndPackageName_2(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, result)
 	}
 }
+
+func TestRunCommand_MultilineOutput(t *testing.T) {
+	output, err := RunCommand(context.Background(), "printf a\nb\n", false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if output != "a\nb\n" {
+		t.Errorf("Expected %q, got %q", "a\nb\n", output)
+	}
+}
+
+func TestRunCommand_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := RunCommand(ctx, "sleep 5", false)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestRunCommandWithInput(t *testing.T) {
+	output, err := RunCommandWithInput(context.Background(), "cat", strings.NewReader("secret\n"), false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if output != "secret\n" {
+		t.Errorf("Expected %q, got %q", "secret\n", output)
+	}
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// backupPath returns the path the existing file at the extract path is backed up to, or an empty string if backups are disabled.
+// The path is resolved within the partition, so the backup can't be written through a symlink out of it.
+func backupPath(mountDir string, extractPath string, backup *configuration.BackupConfig) (string, error) {
+	if backup == nil {
+		return "", nil
+	}
+	if backup.Directory == "" {
+		suffix := backup.Suffix
+		if suffix == "" {
+			suffix = configuration.DefaultBackupSuffix
+		}
+		return extractPath + suffix, nil
+	}
+	backupFile := filepath.Join(mountDir, backup.Directory, pathInImage(mountDir, extractPath))
+	backupDir, err := resolveInImage(mountDir, filepath.Dir(backupFile))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(backupDir, filepath.Base(backupFile)), nil
+}
+
+// backupOverwrittenFile moves the existing file at the extract path to its backup path before it is overwritten.
+// If backups are disabled, the file is removed. A backup made before, e.g. by an earlier package or run, is kept,
+// as it holds the original file of the image.
+func (copier *partitionCopier) backupOverwrittenFile(mountDir string, extractPath string) error {
+	target, err := copier.prepareBackup(mountDir, extractPath)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		os.Remove(extractPath)
+		return nil
+	}
+	err = os.Rename(extractPath, target)
+	if err != nil {
+		return fmt.Errorf("unable to back up %s: %v", pathInImage(mountDir, extractPath), err)
+	}
+	copier.recordBackup(mountDir, extractPath, target)
+	return nil
+}
+
+// backupMergedFile copies the existing file at the extract path to its backup path before it is merged.
+// The copy keeps the mode of the file, but not its owner, which is not visible through the mount. A backup made before is kept.
+func (copier *partitionCopier) backupMergedFile(mountDir string, extractPath string) error {
+	target, err := copier.prepareBackup(mountDir, extractPath)
+	if err != nil || target == "" {
+		return err
+	}
+	err = copyFileWithMode(extractPath, target)
+	if err != nil {
+		return fmt.Errorf("unable to back up %s: %v", pathInImage(mountDir, extractPath), err)
+	}
+	copier.recordBackup(mountDir, extractPath, target)
+	return nil
+}
+
+// prepareBackup returns the backup path of the file and creates its directory.
+// It returns an empty path if backups are disabled or the backup already exists.
+func (copier *partitionCopier) prepareBackup(mountDir string, extractPath string) (string, error) {
+	target, err := backupPath(mountDir, extractPath, copier.config.Backup)
+	if err != nil || target == "" {
+		return "", err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		copier.logger.Info("Backup already exists, keeping it", "file", pathInImage(mountDir, extractPath), "backup", pathInImage(mountDir, target))
+		return "", nil
+	}
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return "", fmt.Errorf("unable to create backup directory: %v", err)
+	}
+	return target, nil
+}
+
+// recordBackup logs the backup and adds it to the report
+func (copier *partitionCopier) recordBackup(mountDir string, extractPath string, target string) {
+	copier.logger.Info("Original file backed up", "file", pathInImage(mountDir, extractPath), "backup", pathInImage(mountDir, target))
+	copier.packageReport.AddBackup(pathInImage(mountDir, extractPath), pathInImage(mountDir, target))
+}
+
+// copyFileWithMode copies the regular file to the new target path with the same mode.
+func copyFileWithMode(source string, target string) error {
+	sourceFile, err := os.OpenFile(source, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+	targetFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL|unix.O_NOFOLLOW, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer targetFile.Close()
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		return err
+	}
+	return targetFile.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+}
@@ -0,0 +1,86 @@
+package image
+
+import (
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/report"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompressZipArchive_BackupTree(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/app.conf":   "new\n",
+		"etc/fstab":      "/dev/sdb1 /data ext4 defaults 0 2\n",
+		"etc/other.conf": "new\n",
+	})
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, content := range map[string]string{"etc/app.conf": "old\n", "etc/fstab": "UUID=1234 / ext4 defaults 0 1\n", "etc/other.conf": "old\n"} {
+		if err := os.WriteFile(filepath.Join(mountDir, name), []byte(content), 0640); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// The backup made by an earlier run holds the original file and is kept
+	if err := os.MkdirAll(filepath.Join(mountDir, "var/backups/etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "var/backups/etc/other.conf"), []byte("original\n"), 0640); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfig := configuration.PackageConfig{
+		PackagePath:    "package.zip",
+		OverwriteFiles: []string{"/etc/app.conf", "/etc/other.conf"},
+		MergeRules:     []configuration.MergeRule{{Pattern: "/etc/fstab", Strategy: "append-lines"}},
+	}
+
+	copier := testCopier()
+	copier.config.Backup = &configuration.BackupConfig{Directory: "/var/backups"}
+	copier.packageReport = report.NewReport().Partition(1).Package(packageConfig.PackagePath, true)
+	_, err := copier.decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := map[string]string{
+		"etc/app.conf":               "new\n",
+		"var/backups/etc/app.conf":   "old\n",
+		"var/backups/etc/fstab":      "UUID=1234 / ext4 defaults 0 1\n",
+		"var/backups/etc/other.conf": "original\n",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(mountDir, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(data) != content {
+			t.Errorf("expected %s to contain %q, got %q", name, content, data)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(mountDir, "var/backups/etc/fstab")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected the backup to keep the mode, got %v", info.Mode())
+	}
+	if len(copier.packageReport.Backups) != 2 {
+		t.Fatalf("expected 2 backups reported, got %v", copier.packageReport.Backups)
+	}
+}
+
+func TestBackupPath_Suffix(t *testing.T) {
+	mountDir := t.TempDir()
+	extractPath := filepath.Join(mountDir, "etc/app.conf")
+	tests := map[string]*configuration.BackupConfig{
+		"":                           nil,
+		extractPath + ".orig":        {},
+		extractPath + ".placer-orig": {Suffix: ".placer-orig"},
+	}
+	for expected, backup := range tests {
+		path, err := backupPath(mountDir, extractPath, backup)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if path != expected {
+			t.Errorf("expected backup path %s, got %s", expected, path)
+		}
+	}
+}
@@ -2,18 +2,22 @@ package image
 
 import (
 	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
-	"os/signal"
 	"package-to-image-placer/pkg/configuration"
 	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/integrity"
+	"package-to-image-placer/pkg/report"
 	"package-to-image-placer/pkg/service"
 	"package-to-image-placer/pkg/user"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,26 +28,160 @@ const timeout = 60 * time.Second
 const mountMaxRetries = 3
 const mountRetryDelay = 2 * time.Second
 
-// CopyPackagesToImagePartitions copies the specified packages to the specified partitions in the configuration.
-// It iterates over each partition and package, calling MountPartitionAndCopyPackages for each combination.
-func CopyPackagesToImagePartitions() error {
-	for _, partition := range configuration.Config.PartitionNumbers {
-		log.Printf("Copying to partition: %d\n", partition)
-		err := MountPartitionAndCopyPackages(partition, partition == configuration.Config.PartitionNumbers[0])
+// Copier copies the packages of the configuration to the partitions of the target image.
+type Copier struct {
+	config   *configuration.Configuration
+	prompter user.Prompter
+	logger   *slog.Logger
+	report   *report.Report
+	// configMutex guards the packages in config and the package digests against concurrent access of partitions copied in parallel
+	configMutex sync.Mutex
+	// packageDigests holds the SHA256 digests of the packages verified during the placement by the package path,
+	// the verification of the placement checks the packages still have them
+	packageDigests map[string]string
+}
+
+// partitionCopier holds the state of copying packages to one partition.
+// Each partition has its own logger tagging the records with the partition number, so the logs of partitions processed in parallel can be told apart.
+// The context lives only as long as the copying of the partition and cancels all its steps.
+type partitionCopier struct {
+	*Copier
+	ctx             context.Context
+	partitionNumber int
+	firstPartition  bool
+	// squashfs is set while a squashfs partition is unpacked for copying, it is repacked after the packages are copied
+	squashfs        *squashfsPartition
+	logger          *slog.Logger
+	partitionReport *report.PartitionReport
+	// packageReport is the report of the package being copied
+	packageReport *report.PackageReport
+}
+
+// NewCopier creates a Copier for the given configuration. The same Copier must place the packages and verify the placement,
+// because the verification checks the packages against the digests recorded during the placement.
+// The prompter is used only in interactive mode and may be nil otherwise.
+// User answers given on the first partition in interactive mode are stored to the configuration.
+// Results of the copying are recorded to the run report, which may be nil.
+func NewCopier(config *configuration.Configuration, prompter user.Prompter, logger *slog.Logger, runReport *report.Report) *Copier {
+	return &Copier{config: config, prompter: prompter, logger: logger, report: runReport, packageDigests: map[string]string{}}
+}
+
+// CopyPackagesToImagePartitions copies the packages of the configuration to their partitions. Every partition is mounted once
+// and only the packages targeting it are copied to it. The first partition is always processed alone, because in interactive mode the user answers are collected on it.
+// The other partitions are processed in parallel, at most ParallelPartitions from the configuration at once,
+// or one by one if any of them is a squashfs partition.
+// Errors of all partitions are returned together.
+// When the context is cancelled, partitions not yet started are skipped and the mounted ones are unmounted.
+func (copier *Copier) CopyPackagesToImagePartitions(ctx context.Context) error {
+	partitionNumbers := copier.config.TargetPartitions()
+	if len(partitionNumbers) == 0 {
+		return nil
+	}
+	err := copier.MountPartitionAndCopyPackages(ctx, partitionNumbers[0], true)
+	if err != nil {
+		return err
+	}
+
+	maxParallel := max(copier.config.ParallelPartitions, 1)
+	if maxParallel > 1 {
+		squashfsNumber, err := copier.squashfsPartition(partitionNumbers[1:])
 		if err != nil {
 			return err
 		}
+		if squashfsNumber != 0 {
+			copier.logger.Info("Partitions are processed sequentially, a squashfs partition rewrites the image", "partition", squashfsNumber)
+			maxParallel = 1
+		}
+	}
+	semaphore := make(chan struct{}, maxParallel)
+	errs := make([]error, len(partitionNumbers))
+	partitionReports := make([]*report.PartitionReport, len(partitionNumbers))
+	for i, partition := range partitionNumbers[1:] {
+		partitionReports[i+1] = copier.report.Partition(partition)
+	}
+	var wg sync.WaitGroup
+	for i, partition := range partitionNumbers[1:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				errs[i+1] = fmt.Errorf("partition %d: %v", partition, ctx.Err())
+				return
+			}
+			defer func() { <-semaphore }()
+
+			partitionCopier := copier.newPartitionCopier(ctx, partition, false, partitionReports[i+1])
+			err := partitionCopier.mountPartitionAndCopyPackages()
+			partitionCopier.partitionReport.Finish(err)
+			if err != nil {
+				errs[i+1] = fmt.Errorf("partition %d: %w", partition, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// squashfsPartition returns the number of the first squashfs partition among the partitions, or 0 if there is none.
+// Writing a squashfs partition rewrites the raw bytes and the partition table of the image, so no other partition may be mounted at the same time.
+func (copier *Copier) squashfsPartition(partitionNumbers []int) (int, error) {
+	for _, partitionNumber := range partitionNumbers {
+		if copier.config.Volume(partitionNumber) != nil {
+			continue
+		}
+		squashfs, err := readSquashfsPartition(copier.config.Target, partitionNumber)
+		if err != nil {
+			return 0, fmt.Errorf("partition %d: failed to read partition: %v", partitionNumber, err)
+		}
+		if squashfs != nil {
+			return partitionNumber, nil
+		}
+	}
+	return 0, nil
+}
+
+// MountPartitionAndCopyPackages mounts the specified partition, copies the package to it, and activates any service files found in the package.
+// It ensures the directory is populated before proceeding and unmounts the partition even if the context is cancelled.
+func (copier *Copier) MountPartitionAndCopyPackages(ctx context.Context, partitionNumber int, firstPartition bool) error {
+	partitionCopier := copier.newPartitionCopier(ctx, partitionNumber, firstPartition, copier.report.Partition(partitionNumber))
+	err := partitionCopier.mountPartitionAndCopyPackages()
+	partitionCopier.partitionReport.Finish(err)
+	return err
+}
+
+// newPartitionCopier creates a partitionCopier with a logger tagging the records with the partition number, and the name of the volume for volumes.
+func (copier *Copier) newPartitionCopier(ctx context.Context, partitionNumber int, firstPartition bool, partitionReport *report.PartitionReport) *partitionCopier {
+	logger := copier.logger.With("partition", partitionNumber)
+	if volume := copier.config.Volume(partitionNumber); volume != nil {
+		logger = logger.With("volume", volume.Name)
+	}
+	return &partitionCopier{
+		Copier:          copier,
+		ctx:             ctx,
+		partitionNumber: partitionNumber,
+		firstPartition:  firstPartition,
+		logger:          logger,
+		partitionReport: partitionReport,
+	}
+}
+
+// interactivePrompter returns the prompter in interactive mode and nil otherwise.
+func (copier *Copier) interactivePrompter() user.Prompter {
+	if copier.config.InteractiveRun {
+		return copier.prompter
 	}
 	return nil
 }
 
-// CopyPackageActivateService copies the package to the target directory and activates any service files found in the package.
+// copyPackageActivateService copies the package to the target directory and activates any service files found in the package.
 // It also handles user interaction for enabling services and setting service name suffixes.
-func CopyPackageActivateService(mountDir string, packageConfig *configuration.PackageConfig, firstPartition bool) error {
+func (copier *partitionCopier) copyPackageActivateService(mountDir string, packageConfig *configuration.PackageConfig) error {
 	var targetDirectoryFullPath string
 	var err error
-	if configuration.Config.InteractiveRun && packageConfig.IsStandardPackage && firstPartition {
-		targetDirectoryFullPath, err = user.SelectTargetDirectory(mountDir, mountDir, packageConfig.PackagePath)
+	if copier.config.InteractiveRun && packageConfig.IsStandardPackage && copier.firstPartition {
+		targetDirectoryFullPath, err = copier.prompter.SelectTargetDirectory(mountDir, mountDir, packageConfig.PackagePath)
 		if err != nil {
 			return err
 		}
@@ -59,12 +197,26 @@ func CopyPackageActivateService(mountDir string, packageConfig *configuration.Pa
 			return fmt.Errorf("failed to create target directory: %v", err)
 		}
 	}
-	log.Printf("Copying package to target directory: %s\n", targetDirectoryFullPath)
+	copier.logger.Info("Copying package", "package", packageConfig.PackagePath, "target-directory", targetDirectoryFullPath)
 	if !helper.IsWithinRootDir(mountDir, targetDirectoryFullPath) {
 		return fmt.Errorf("target directory is not within the mounted partition")
 	}
+	// Services are activated after the package is extracted, the partition is checked before, so it is not changed in vain
+	if packageConfig.IsStandardPackage && packageConfig.EnableServices {
+		if err := service.CheckSystemdRootfs(mountDir); err != nil {
+			return err
+		}
+	}
 
-	serviceFile, err := handleArchive(packageConfig, mountDir, targetDirectoryFullPath)
+	copier.partitionReport.SetStep("copy")
+	serviceFile, err := copier.handleArchive(packageConfig, mountDir, targetDirectoryFullPath)
+	if err != nil {
+		return err
+	}
+
+	copier.partitionReport.SetStep("post-install-hook")
+	packageDir := helper.GetTargetArchiveDirName(targetDirectoryFullPath, packageConfig.PackagePath, packageConfig.IsStandardPackage)
+	err = copier.runPostInstallHook(packageConfig.PostInstallHook, mountDir, packageDir, packageConfig.PackagePath)
 	if err != nil {
 		return err
 	}
@@ -75,7 +227,7 @@ func CopyPackageActivateService(mountDir string, packageConfig *configuration.Pa
 	}
 
 	if serviceFile == "" {
-		log.Printf("No service file found in the package: %s\n", packageConfig.PackagePath)
+		copier.logger.Debug("No service file found in the package", "package", packageConfig.PackagePath)
 
 		// check if the package has disabled services
 		if packageConfig.EnableServices {
@@ -84,10 +236,10 @@ func CopyPackageActivateService(mountDir string, packageConfig *configuration.Pa
 		return nil
 	}
 
-	if configuration.Config.InteractiveRun && firstPartition {
-		packageConfig.EnableServices = user.GetUserConfirmation("Do you want to enable services for package " + packageConfig.PackagePath + "?")
+	if copier.config.InteractiveRun && copier.firstPartition {
+		packageConfig.EnableServices = copier.prompter.Confirm("Do you want to enable services for package " + packageConfig.PackagePath + "?")
 		if packageConfig.EnableServices {
-			packageConfig.ServiceNameSuffix, err = user.ReadStringFromUser("Enter service name suffix (leave empty for none): ")
+			packageConfig.ServiceNameSuffix, err = copier.prompter.ReadString("Enter service name suffix (leave empty for none): ")
 			if err != nil {
 				return fmt.Errorf("error reading service name suffix: %v", err)
 			}
@@ -99,98 +251,264 @@ func CopyPackageActivateService(mountDir string, packageConfig *configuration.Pa
 		if strings.HasPrefix(packageConfig.ServiceNameSuffix, "-") {
 			return fmt.Errorf("service name suffix should not start with a hyphen")
 		}
-		err = service.AddService(serviceFile, mountDir, targetDirectoryFullPath, packageConfig)
+		// In interactive mode, services may be enabled only now
+		if err := service.CheckSystemdRootfs(mountDir); err != nil {
+			return err
+		}
+		copier.partitionReport.SetStep("service")
+		unitName, err := service.AddService(copier.ctx, serviceFile, mountDir, targetDirectoryFullPath, packageConfig, copier.interactivePrompter(), copier.logger)
 		if err != nil {
-			return fmt.Errorf("error while activating service: %v", err)
+			return fmt.Errorf("error while activating service: %w", err)
 		}
+		copier.packageReport.AddService(pathInImage(mountDir, serviceFile), unitName)
 	}
 	return nil
 }
 
-// MountPartitionAndCopyPackages mounts the specified partition, copies the package to it, and activates any service files found in the package.
-// It handles signals for unmounting the partition and ensures the directory is populated before proceeding.
-func MountPartitionAndCopyPackages(partitionNumber int, firstPartition bool) error {
-	mountDir, err := os.MkdirTemp("", "mount-dir-")
+// mountPartitionAndCopyPackages mounts the partition, copies the packages to it, and activates any service files found in the packages.
+// The packages are copied from the configuration, so partitions can be processed in parallel.
+// Changes of the packages made on the first partition (user answers in interactive mode) are written back to the configuration.
+func (copier *partitionCopier) mountPartitionAndCopyPackages() error {
+	mountDir, unmount, err := copier.mount(false)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary directory: %v", err)
+		return err
 	}
-	defer os.RemoveAll(mountDir)
+	defer unmount()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		fmt.Printf("Received signal: %s\n", sig)
-		unmount(mountDir)
-		os.Exit(1)
-	}()
+	defer copier.report.StartPhase("copy", copier.partitionNumber)()
+	// The entries written by the placement are found by comparing with the snapshot, only if they are labeled or normalized
+	var snapshot entrySnapshot
+	if copier.labelsFiles() || copier.config.Reproducible {
+		snapshot, err = snapshotEntries(copier.ctx, mountDir)
+		if err != nil {
+			return err
+		}
+	}
+	packages, configurationPackages := copier.copyPackagesFromConfig()
+	for i := range packages {
+		if !copier.targetsPartition(packages[i].PartitionNumbers) {
+			continue
+		}
+		packages[i].IsStandardPackage = true
+		copier.packageReport = copier.partitionReport.Package(packages[i].PackagePath, false)
+		err = copier.copyPackageActivateService(mountDir, &packages[i])
+		copier.packageReport.Finish(err)
+		if err != nil {
+			return fmt.Errorf("error while copying package: %w", err)
+		}
+	}
+	for i := range configurationPackages {
+		if !copier.targetsPartition(configurationPackages[i].PartitionNumbers) {
+			continue
+		}
+		tmpPackage := copier.configurationPackageConfig(&configurationPackages[i])
+		copier.packageReport = copier.partitionReport.Package(tmpPackage.PackagePath, true)
+		err = copier.copyPackageActivateService(mountDir, &tmpPackage)
+		copier.packageReport.Finish(err)
+		if err != nil {
+			return fmt.Errorf("error while copying configuration package: %w", err)
+		}
+		configurationPackages[i].OverwriteFiles = tmpPackage.OverwriteFiles
+	}
 
-	errChan := make(chan string)
-	go func() {
-		errChan = mountPartition(configuration.Config.Target, partitionNumber, mountDir, errChan)
-	}()
+	if copier.firstPartition {
+		copier.storePackagesToConfig(packages, configurationPackages)
+	}
+	err = copier.labelPlacedFiles(mountDir, snapshot)
+	if err != nil {
+		return err
+	}
+	if copier.config.Reproducible {
+		copier.partitionReport.SetStep("normalize-timestamps")
+		normalized, err := normalizeTimestamps(copier.ctx, mountDir, snapshot, time.Unix(copier.config.SourceDateEpoch, 0))
+		if err != nil {
+			return err
+		}
+		copier.logger.Info("Timestamps normalized", "entries", normalized, "source-date-epoch", copier.config.SourceDateEpoch)
+	}
+	if copier.squashfs != nil {
+		return copier.repackSquashfs(copier.squashfs, mountDir)
+	}
+	return nil
+}
 
-	populatedChan := make(chan error)
+// mount mounts the partition or the volume to a new temporary directory.
+// It ensures the directory is populated before returning. The returned function unmounts the partition and removes the directory.
+// A squashfs partition mounted for writing is unpacked to the directory instead, it must be repacked by repackSquashfs.
+func (copier *partitionCopier) mount(readOnly bool) (string, func(), error) {
+	volume := copier.config.Volume(copier.partitionNumber)
+	if volume != nil && volume.ImageFile != "" {
+		return copier.mountImageFileVolume(volume, readOnly)
+	}
+	if volume == nil && !readOnly {
+		squashfs, err := readSquashfsPartition(copier.config.Target, copier.partitionNumber)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read partition: %v", err)
+		}
+		if squashfs != nil {
+			unpackDir, cleanup, err := copier.unpackSquashfs(squashfs)
+			if err != nil {
+				return "", nil, err
+			}
+			copier.squashfs = squashfs
+			return unpackDir, cleanup, nil
+		}
+	}
+	return copier.mountImage(copier.config.Target, readOnly)
+}
+
+// mountImage mounts the filesystem of the copier from the image to a new temporary directory, see mount.
+func (copier *partitionCopier) mountImage(imagePath string, readOnly bool) (string, func(), error) {
+	mountDir, err := os.MkdirTemp("", "mount-dir-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+
+	copier.partitionReport.SetStep("mount")
+	endMountPhase := copier.report.StartPhase("mount", copier.partitionNumber)
+	errChan := make(chan string, 1)
+	go copier.mountPartition(imagePath, mountDir, readOnly, errChan)
+
+	populatedChan := make(chan error, 1)
 	go func() {
-		populatedChan <- waitUntilDirectoryIsPopulated(mountDir, timeout)
+		populatedChan <- waitUntilDirectoryIsPopulated(copier.ctx, mountDir, timeout)
 	}()
 
 	select {
 	case err := <-errChan:
 		if err != "" {
-			return fmt.Errorf("failed to mount partition: %v", err)
+			os.RemoveAll(mountDir)
+			return "", nil, fmt.Errorf("failed to mount partition: %v", err)
 		}
 	case err := <-populatedChan: // Wait until the directory is populated
-		log.Printf("Successfully mounted partition")
 		if err != nil {
-			return err
+			// guestmount may be already running, make sure it is stopped
+			copier.unmount(mountDir)
+			os.RemoveAll(mountDir)
+			return "", nil, err
 		}
+		copier.logger.Info("Partition mounted", "mount-dir", mountDir)
 	case <-time.After(timeout):
-		return fmt.Errorf("mount command timed out")
+		os.RemoveAll(mountDir)
+		return "", nil, fmt.Errorf("mount command timed out")
 	}
+	endMountPhase()
 
-	defer func() {
-		unmount(mountDir)
-	}()
+	return mountDir, func() {
+		copier.unmount(mountDir)
+		os.RemoveAll(mountDir)
+	}, nil
+}
 
-	for i := range configuration.Config.Packages {
-		configuration.Config.Packages[i].IsStandardPackage = true
-		err = CopyPackageActivateService(mountDir, &configuration.Config.Packages[i], firstPartition)
-		if err != nil {
-			return fmt.Errorf("error while copying package: %v", err)
-		}
+// MountReadOnly mounts the partition of the image read-only to a new temporary directory.
+// The returned function unmounts the partition and removes the directory.
+func MountReadOnly(ctx context.Context, imagePath string, partitionNumber int, logger *slog.Logger) (string, func(), error) {
+	copier := NewCopier(&configuration.Configuration{Target: imagePath}, nil, logger, nil)
+	return copier.newPartitionCopier(ctx, partitionNumber, false, nil).mount(true)
+}
+
+// configurationPackageConfig converts the configuration package to the package config used for copying.
+// Configuration packages are copied to the root of the image and have no services.
+func (copier *partitionCopier) configurationPackageConfig(configurationPackage *configuration.ConfigurationPackage) configuration.PackageConfig {
+	return configuration.PackageConfig{
+		PackagePath:       configurationPackage.PackagePath,
+		OverwriteFiles:    configurationPackage.OverwriteFiles,
+		OverwritePolicy:   configurationPackage.OverwritePolicy,
+		PostInstallHook:   configurationPackage.PostInstallHook,
+		SHA256:            configurationPackage.SHA256,
+		Signature:         configurationPackage.Signature,
+		Permissions:       configurationPackage.Permissions,
+		TemplatePatterns:  configurationPackage.Templates,
+		TemplateVariables: copier.config.ResolveTemplateVariables(configurationPackage.Variables),
+		MergeRules:        configurationPackage.Merge,
+		Operations:        configurationPackage.Operations,
+		PartitionNumbers:  configurationPackage.PartitionNumbers,
+		IsStandardPackage: false,
 	}
-	// tmpPackage := configuration.PackageConfig{EnableServices: false, ServiceNameSuffix: "", TargetDirectory: "", IsStandardPackage: false}
-	for i := range configuration.Config.ConfigurationPackages {
-		tmpPackage := configuration.PackageConfig{EnableServices: false, ServiceNameSuffix: "", TargetDirectory: "", IsStandardPackage: false}
-		tmpPackage.PackagePath = configuration.Config.ConfigurationPackages[i].PackagePath
-		tmpPackage.OverwriteFiles = configuration.Config.ConfigurationPackages[i].OverwriteFiles
-		err = CopyPackageActivateService(mountDir, &tmpPackage, firstPartition)
-		if err != nil {
-			return fmt.Errorf("error while copying configuration package: %v", err)
-		}
-		configuration.Config.ConfigurationPackages[i].OverwriteFiles = tmpPackage.OverwriteFiles
+}
+
+// copyPackagesFromConfig returns copies of the packages in the configuration.
+func (copier *Copier) copyPackagesFromConfig() ([]configuration.PackageConfig, []configuration.ConfigurationPackage) {
+	copier.configMutex.Lock()
+	defer copier.configMutex.Unlock()
+
+	packages := slices.Clone(copier.config.Packages)
+	for i := range packages {
+		packages[i].OverwriteFiles = slices.Clone(packages[i].OverwriteFiles)
 	}
-	return nil
+	configurationPackages := slices.Clone(copier.config.ConfigurationPackages)
+	for i := range configurationPackages {
+		configurationPackages[i].OverwriteFiles = slices.Clone(configurationPackages[i].OverwriteFiles)
+	}
+	return packages, configurationPackages
+}
+
+// packageConfigs returns copies of the packages of the configuration copied to the partition, in the order they are copied.
+// Configuration packages are converted to package configs.
+func (copier *partitionCopier) packageConfigs() []configuration.PackageConfig {
+	packages, configurationPackages := copier.copyPackagesFromConfig()
+	packageConfigs := make([]configuration.PackageConfig, 0, len(packages)+len(configurationPackages))
+	for _, pkg := range packages {
+		pkg.IsStandardPackage = true
+		packageConfigs = append(packageConfigs, pkg)
+	}
+	for i := range configurationPackages {
+		packageConfigs = append(packageConfigs, copier.configurationPackageConfig(&configurationPackages[i]))
+	}
+	return slices.DeleteFunc(packageConfigs, func(packageConfig configuration.PackageConfig) bool {
+		return !copier.targetsPartition(packageConfig.PartitionNumbers)
+	})
+}
+
+// targetsPartition checks if a package with the given partitions is copied to the partition
+func (copier *partitionCopier) targetsPartition(packagePartitions []int) bool {
+	return slices.Contains(copier.config.PackagePartitions(packagePartitions), copier.partitionNumber)
+}
+
+// storePackagesToConfig replaces the packages in the configuration.
+func (copier *Copier) storePackagesToConfig(packages []configuration.PackageConfig, configurationPackages []configuration.ConfigurationPackage) {
+	copier.configMutex.Lock()
+	defer copier.configMutex.Unlock()
+
+	copier.config.Packages = packages
+	copier.config.ConfigurationPackages = configurationPackages
 }
 
 // handleArchive handles the extraction of the archive file to the target directory.
-// It checks for sufficient free space and returns a service file if found.
-func handleArchive(packageConfig *configuration.PackageConfig, mountDir string, targetDir string) (string, error) {
+// It verifies the checksum and signature of the archive, checks for sufficient free space, runs the operations of configuration packages
+// and returns a service file if found.
+func (copier *partitionCopier) handleArchive(packageConfig *configuration.PackageConfig, mountDir string, targetDir string) (string, error) {
 	archivePath := packageConfig.PackagePath
-	zipReader, err := zip.OpenReader(archivePath)
+	// The package is verified and extracted through one descriptor, so a package replaced in between is not extracted unverified
+	packageFile, err := os.Open(archivePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open zip file: %v", err)
 	}
-	defer zipReader.Close()
+	defer packageFile.Close()
+	err = copier.verifyPackageIntegrity(packageConfig, packageFile)
+	if err != nil {
+		return "", err
+	}
+	zipReader, err := newZipReader(packageFile)
+	if err != nil {
+		return "", err
+	}
 
-	err = findAllFilesInZip(&zipReader.Reader, packageConfig.OverwriteFiles)
+	err = findAllFilesInZip(zipReader, packageConfig.OverwriteFiles, packageConfig.TemplatePatterns)
 	if err != nil {
 		return "", err
 	}
 
-	packageSize := getArchiveSize(zipReader)
-	err = checkFreeSize(mountDir, packageSize)
+	// The unpacked tree of a squashfs is on the host, the repacked squashfs is checked to fit the partition instead
+	if copier.squashfs == nil {
+		packageSize := getArchiveSize(zipReader)
+		err = copier.checkFreeSize(mountDir, packageSize)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = copier.runOperations(mountDir, packageConfig)
 	if err != nil {
 		return "", err
 	}
@@ -198,46 +516,84 @@ func handleArchive(packageConfig *configuration.PackageConfig, mountDir string,
 	targetArchiveDir := helper.GetTargetArchiveDirName(targetDir, archivePath, packageConfig.IsStandardPackage)
 
 	os.MkdirAll(targetArchiveDir, os.ModePerm)
-	serviceFile, err := decompressZipArchiveAndReturnService(zipReader, targetArchiveDir, mountDir, packageConfig)
+	serviceFile, err := copier.decompressZipArchiveAndReturnService(zipReader, targetArchiveDir, mountDir, packageConfig)
 	if err != nil {
 		return "", err
 	}
 	return serviceFile, nil
 }
 
-// mountPartition mounts the specified partition to the mount directory using guestmount.
+// verifyPackageIntegrity verifies the SHA256 checksum and the signature of the opened package against the keyring of the configuration.
+// The verified digest is logged and recorded. A package placed to several partitions must have the same digest for all of them.
+func (copier *partitionCopier) verifyPackageIntegrity(packageConfig *configuration.PackageConfig, packageFile *os.File) error {
+	digest, err := integrity.VerifyPackage(copier.ctx, packageFile, packageConfig.SHA256, packageConfig.Signature, copier.config.Keyring, copier.config.IntegrityRequired())
+	if err != nil {
+		return err
+	}
+	copier.configMutex.Lock()
+	recordedDigest, recorded := copier.packageDigests[packageConfig.PackagePath]
+	if !recorded {
+		copier.packageDigests[packageConfig.PackagePath] = digest
+	}
+	copier.configMutex.Unlock()
+	if recorded && recordedDigest != digest {
+		return fmt.Errorf("package %s has SHA256 %s, but %s was placed to another partition", packageConfig.PackagePath, digest, recordedDigest)
+	}
+	copier.logger.Info("Package verified", "package", packageConfig.PackagePath, "sha256", digest, "signed", copier.config.Keyring != "")
+	return nil
+}
+
+// newZipReader returns the reader of the zip archive of the opened package file.
+func newZipReader(packageFile *os.File) (*zip.Reader, error) {
+	info, err := packageFile.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip file: %v", err)
+	}
+	zipReader, err := zip.NewReader(packageFile, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip file: %v", err)
+	}
+	return zipReader, nil
+}
+
+// mountPartition mounts the partition or the volume to the mount directory using guestmount, or guestfish for LUKS volumes.
 // It sends any errors encountered to the provided error channel.
-func mountPartition(targetImageName string, partitionNumber int, mountDir string, errChan chan string) chan string {
-	log.Printf("Mounting partition to %s", mountDir)
+// The mount process is not killed on cancellation, the partition must be unmounted to stop it cleanly.
+func (copier *partitionCopier) mountPartition(targetImageName string, mountDir string, readOnly bool, errChan chan string) {
+	copier.logger.Debug("Mounting partition", "mount-dir", mountDir, "read-only", readOnly)
+	cmd, keyFile := copier.mountCommand(targetImageName, mountDir, readOnly)
 	var err error
 	for range mountMaxRetries {
-		cmd := fmt.Sprintf("guestmount -a %s -m /dev/sda%d -o uid=%d -o gid=%d --rw %s --no-fork", targetImageName, partitionNumber, unix.Getuid(), unix.Getgid(), mountDir)
-		_, err = helper.RunCommand(cmd, false)
-		if err == nil {
+		_, err = runMountCommand(context.WithoutCancel(copier.ctx), cmd, keyFile)
+		if err == nil || copier.ctx.Err() != nil {
 			break
 		}
-		log.Printf("Error mounting partition %d: %v. Retrying in %v...", partitionNumber, err, mountRetryDelay)
-		time.Sleep(mountRetryDelay)
+		copier.logger.Warn("Mounting partition failed, retrying", "error", err, "retry-delay", mountRetryDelay)
+		select {
+		case <-time.After(mountRetryDelay):
+		case <-copier.ctx.Done():
+		}
 	}
 
 	if err != nil {
 		errChan <- err.Error()
 	}
-	return errChan
 }
 
 // unmount unmounts the specified mount directory using guestunmount.
-func unmount(mountDir string) {
+// The partition is unmounted even if the context is already cancelled.
+func (copier *partitionCopier) unmount(mountDir string) {
+	defer copier.report.StartPhase("unmount", copier.partitionNumber)()
 	syscall.Sync()
-	log.Printf("Unmounting partition")
-	helper.RunCommand("guestunmount "+mountDir, true)
+	copier.logger.Info("Unmounting partition", "mount-dir", mountDir)
+	helper.RunCommand(context.WithoutCancel(copier.ctx), "guestunmount "+mountDir, true)
 
-	waitUntilDirectoryIsUnmounted(mountDir, timeout)
+	copier.waitUntilDirectoryIsUnmounted(mountDir, timeout)
 	time.Sleep(time.Second) // Give it a moment to clear
 }
 
 // getArchiveSize calculates the total uncompressed size of the files in the zip archive.
-func getArchiveSize(zipReader *zip.ReadCloser) uint64 {
+func getArchiveSize(zipReader *zip.Reader) uint64 {
 	packageSize := uint64(0)
 	for _, file := range zipReader.File {
 		packageSize += file.UncompressedSize64
@@ -247,32 +603,44 @@ func getArchiveSize(zipReader *zip.ReadCloser) uint64 {
 
 // checkFreeSize checks if there is enough free space in the mount directory to copy the package.
 // It returns an error if there is not enough space.
-func checkFreeSize(mountDir string, packageSize uint64) error {
-	var stat unix.Statfs_t
-	err := unix.Statfs(mountDir, &stat)
+func (copier *partitionCopier) checkFreeSize(mountDir string, packageSize uint64) error {
+	freeSpace, err := getFreeSpace(mountDir)
 	if err != nil {
-		return fmt.Errorf("error getting free space on filesystem: %s", err.Error())
+		return err
 	}
-
-	freeSpace := stat.Bfree * uint64(stat.Bsize)
 	if packageSize > freeSpace {
 		return fmt.Errorf("not enough space to copy package. Free space on partition: %dMB, package size: %dMB", freeSpace/1024/1024, packageSize/1024/1024)
 	}
-	log.Printf("Copying package of size %dMB to filesystem of size %dMB\n", packageSize/1024/1024, freeSpace/1024/1024)
+	copier.logger.Debug("Free space checked", "package-size-mb", packageSize/1024/1024, "free-space-mb", freeSpace/1024/1024)
 	return nil
 }
 
+// getFreeSpace returns the free space in bytes of the filesystem mounted to the mount directory.
+func getFreeSpace(mountDir string) (uint64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(mountDir, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("error getting free space on filesystem: %s", err.Error())
+	}
+	return stat.Bfree * uint64(stat.Bsize), nil
+}
+
 // findAllFilesInZip checks if all specified files exist in the zip archive.
+// Only exact paths are looked up, patterns may match no file. Templates are looked up by their name in the image, i.e. without the template suffix.
 // It returns an error if any of the files are not found.
-func findAllFilesInZip(zipReader *zip.Reader, targetFileNames []string) error {
+func findAllFilesInZip(zipReader *zip.Reader, targetFileNames []string, templatePatterns []string) error {
 	fileMap := make(map[string]*zip.File, len(zipReader.File))
 	for _, file := range zipReader.File {
 		if !file.FileInfo().IsDir() {
-			fileMap["/"+file.Name] = file
+			name, _ := templateTargetName(file.Name, templatePatterns)
+			fileMap["/"+name] = file
 		}
 	}
 
 	for _, targetFileName := range targetFileNames {
+		if !configuration.IsExactOverwritePath(targetFileName) {
+			continue
+		}
 		if _, exists := fileMap[targetFileName]; !exists {
 			return fmt.Errorf("file %s not found in the zip archive %s", targetFileName, zipReader.Comment)
 		}
@@ -281,31 +649,83 @@ func findAllFilesInZip(zipReader *zip.Reader, targetFileNames []string) error {
 }
 
 // decompressZipArchiveAndReturnService extracts the files from the zip archive to the target directory.
+// The archive is validated against the extraction limits first. Symlinks on the way to the entries are resolved within
+// the partition and no entry is written through a symlink out of the target directory.
 // It returns a list of service files found in the archive.
-func decompressZipArchiveAndReturnService(zipReader *zip.ReadCloser, targetDir string, mountDir string, packageConfig *configuration.PackageConfig) (string, error) {
+func (copier *partitionCopier) decompressZipArchiveAndReturnService(zipReader *zip.Reader, targetDir string, mountDir string, packageConfig *configuration.PackageConfig) (string, error) {
 	serviceFile := ""
+	extraction := copier.config.Extraction.WithDefaults()
+	err := validateArchive(zipReader, extraction)
+	if err != nil {
+		return "", err
+	}
+	packageDir, err := resolveInImage(mountDir, targetDir)
+	if err != nil {
+		return "", err
+	}
+	permissionResolver, err := newPermissionResolver(packageConfig.Permissions, mountDir)
+	if err != nil {
+		return "", err
+	}
+	if packageConfig.IsStandardPackage {
+		// The package directory belongs to the package, configuration packages are extracted to the partition root
+		if err := permissionResolver.apply(packageDir, "", true); err != nil {
+			return "", err
+		}
+	}
 
-	for _, file := range zipReader.File {
-		targetFilePath := filepath.Join(targetDir, file.Name)
+	files := zipReader.File
+	if copier.config.Reproducible {
+		// Entries are created in the order of their names, so the directories have the same layout however the archive was packed
+		files = slices.Clone(files)
+		slices.SortFunc(files, func(a, b *zip.File) int { return strings.Compare(a.Name, b.Name) })
+	}
+	for _, file := range files {
+		if err := copier.ctx.Err(); err != nil {
+			return "", err
+		}
+		name, _ := templateTargetName(file.Name, packageConfig.TemplatePatterns)
+		targetFilePath := filepath.Join(targetDir, name)
 
 		if !helper.IsWithinRootDir(targetDir, targetFilePath) {
 			return "", fmt.Errorf("invalid file path")
 		}
+		extractPath, err := resolveEntryPath(mountDir, packageDir, filepath.Join(packageDir, name), file.FileInfo().IsDir())
+		if err != nil {
+			return "", err
+		}
 		if file.FileInfo().IsDir() {
-			log.Printf("creating directory %s\n", targetFilePath)
-			if err := os.MkdirAll(targetFilePath, os.ModePerm); err != nil {
+			copier.logger.Debug("Creating directory", "path", targetFilePath)
+			if err := permissionResolver.makeDirectories(packageDir, extractPath); err != nil {
 				return "", err
 			}
 			continue
 		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := readZipFile(file)
+			if err != nil {
+				return "", err
+			}
+			err = checkSymlinkTarget(extractPath, string(linkTarget), packageDir, mountDir, extraction.SymlinkPolicy)
+			if err != nil {
+				return "", err
+			}
+		}
 
-		if err := os.MkdirAll(filepath.Dir(targetFilePath), os.ModePerm); err != nil {
+		if err := permissionResolver.makeDirectories(packageDir, filepath.Dir(extractPath)); err != nil {
 			return "", err
 		}
-		if err := decompressZipFile(targetFilePath, file, mountDir, packageConfig); err != nil {
+		err = copier.decompressZipFile(targetFilePath, extractPath, file, mountDir, packageConfig)
+		if errors.Is(err, errExistingFileKept) {
+			continue
+		}
+		if err != nil {
 			return "", err
 		}
-		if strings.HasSuffix(file.Name, ".service") {
+		if err := permissionResolver.apply(extractPath, name, false); err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(name, ".service") {
 			if serviceFile != "" {
 				return "", fmt.Errorf("multiple service files found in the package archive")
 			}
@@ -315,25 +735,55 @@ func decompressZipArchiveAndReturnService(zipReader *zip.ReadCloser, targetDir s
 	return serviceFile, nil
 }
 
+// errExistingFileKept is returned by decompressZipFile when the existing file is kept, i.e. skipped by the skip-existing
+// overwrite policy or merged with the file of the package. The permissions of the existing file are not changed.
+var errExistingFileKept = errors.New("existing file kept")
+
 // decompressZipFile extracts a single file from the zip archive to the destination path.
-// It returns an error if the file already exists and overwrite is false.
-func decompressZipFile(destFilePath string, srcZipFile *zip.File, mountDir string, packageConfig *configuration.PackageConfig) error {
-	log.Printf("Decompressing file %s to %s", srcZipFile.Name, destFilePath)
+// The file is written to the extract path, which is the destination path with the symlinks on the way resolved.
+// An existing symlink at the extract path is replaced, never followed.
+// An existing file matching a merge rule is merged with the file of the package.
+// It returns an error if the file already exists and overwrite is false, or errExistingFileKept if the existing file is kept.
+func (copier *partitionCopier) decompressZipFile(destFilePath string, extractPath string, srcZipFile *zip.File, mountDir string, packageConfig *configuration.PackageConfig) error {
+	copier.logger.Debug("Extracting file", "file", srcZipFile.Name, "destination", destFilePath)
 	// Check if the destination file already exists
-	_, err := os.Stat(destFilePath)
+	_, err := os.Lstat(extractPath)
 	if err == nil {
 		destFilePathInPackage := helper.RemoveMountDirAndPackageName(destFilePath, mountDir, packageConfig.TargetDirectory, packageConfig.PackagePath)
-		if configuration.Config.InteractiveRun {
-			if user.GetUserConfirmation("File: " + destFilePathInPackage + " already exists. Do you want to overwrite it?") {
+		if rule := packageConfig.MergeRuleFor(destFilePathInPackage); rule != nil && srcZipFile.Mode().IsRegular() {
+			err := copier.backupMergedFile(mountDir, extractPath)
+			if err != nil {
+				return err
+			}
+			err = copier.mergeFile(extractPath, srcZipFile, packageConfig, rule)
+			if err != nil {
+				return fmt.Errorf("failed to merge file %s: %v", destFilePathInPackage, err)
+			}
+			copier.logger.Info("Merging file", "file", destFilePathInPackage, "strategy", rule.Strategy)
+			copier.packageReport.AddFileMerged(pathInImage(mountDir, destFilePath))
+			return errExistingFileKept
+		}
+		action := packageConfig.OverwriteActionFor(destFilePathInPackage)
+		if copier.config.InteractiveRun && action != configuration.OverwriteReplace {
+			if copier.prompter.Confirm("File: " + destFilePathInPackage + " already exists. Do you want to overwrite it?") {
 				packageConfig.OverwriteFiles = append(packageConfig.OverwriteFiles, destFilePathInPackage)
+				action = configuration.OverwriteReplace
 			} else {
 				return fmt.Errorf("file %s already exists and user chose not to overwrite", destFilePathInPackage)
 			}
 		}
-		if slices.Contains(packageConfig.OverwriteFiles, destFilePathInPackage) {
-			os.Remove(destFilePath)
-			log.Printf("File %s already exists and is marked for overwrite", destFilePathInPackage)
-		} else {
+		switch action {
+		case configuration.OverwriteReplace:
+			if err := copier.backupOverwrittenFile(mountDir, extractPath); err != nil {
+				return err
+			}
+			copier.logger.Info("Overwriting file", "file", destFilePathInPackage)
+			copier.packageReport.AddFileOverwritten(pathInImage(mountDir, destFilePath))
+		case configuration.OverwriteSkip:
+			copier.logger.Info("Keeping existing file", "file", destFilePathInPackage)
+			copier.packageReport.AddFileSkipped(pathInImage(mountDir, destFilePath))
+			return errExistingFileKept
+		default:
 			return fmt.Errorf("file %s already exists and is not marked for overwrite", destFilePathInPackage)
 		}
 	}
@@ -342,36 +792,55 @@ func decompressZipFile(destFilePath string, srcZipFile *zip.File, mountDir strin
 		return fmt.Errorf("unable to open file %s: %v", srcZipFile.Name, err)
 	}
 	defer srcFile.Close()
+	copier.packageReport.AddFileWritten(pathInImage(mountDir, destFilePath))
+
+	if _, isTemplate := templateTargetName(srcZipFile.Name, packageConfig.TemplatePatterns); isTemplate && !srcZipFile.FileInfo().IsDir() && srcZipFile.Mode()&os.ModeSymlink == 0 {
+		copier.logger.Debug("Rendering template", "file", srcZipFile.Name)
+		return renderTemplate(extractPath, srcFile, srcZipFile.Name, packageConfig.TemplateVariables, srcZipFile.Mode())
+	}
 
 	if srcZipFile.FileInfo().Mode()&os.ModeSymlink != 0 {
 		linkTarget, err := io.ReadAll(srcFile)
 		if err != nil {
 			return fmt.Errorf("unable to read symlink target for %s: %v", srcZipFile.Name, err)
 		}
-		err = os.Symlink(string(linkTarget), destFilePath)
+		err = os.Symlink(string(linkTarget), extractPath)
 		if err != nil {
 			return fmt.Errorf("unable to create symlink %s: %v", destFilePath, err)
 		}
 	} else {
-		destFile, err := os.OpenFile(destFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, srcZipFile.Mode())
+		// O_EXCL and O_NOFOLLOW make sure no symlink created meanwhile is followed
+		destFile, err := os.OpenFile(extractPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL|unix.O_NOFOLLOW, srcZipFile.Mode()&^specialFileModes)
 		if err != nil {
 			return fmt.Errorf("unable to create file %s: %v", destFilePath, err)
 		}
 		defer destFile.Close()
 
-		_, err = io.Copy(destFile, srcFile)
+		// The zip reader fails on entries larger than declared, the limit is a second line of defence
+		written, err := io.Copy(destFile, io.LimitReader(&contextReader{ctx: copier.ctx, reader: srcFile}, int64(srcZipFile.UncompressedSize64)+1))
 		if err != nil {
 			return fmt.Errorf("unable to copy file %s: %v", srcZipFile.Name, err)
 		}
+		if uint64(written) > srcZipFile.UncompressedSize64 {
+			return fmt.Errorf("entry %s is larger than declared in the archive", srcZipFile.Name)
+		}
 	}
 	return nil
 }
 
-// waitUntilDirectoryIsPopulated waits until the directory is populated or the timeout is reached.
+// pathInImage returns the absolute path of the file inside the image mounted to the mount directory.
+func pathInImage(mountDir string, path string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, mountDir), "/")
+}
+
+// waitUntilDirectoryIsPopulated waits until the directory is populated, the timeout is reached or the context is cancelled.
 // It returns an error if the directory is not populated within the timeout period.
-func waitUntilDirectoryIsPopulated(dirPath string, timeout time.Duration) error {
+func waitUntilDirectoryIsPopulated(ctx context.Context, dirPath string, timeout time.Duration) error {
 	start := time.Now()
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		populated, err := isDirectoryPopulated(dirPath)
 		if err != nil {
 			return err
@@ -388,16 +857,16 @@ func waitUntilDirectoryIsPopulated(dirPath string, timeout time.Duration) error
 
 // waitUntilDirectoryIsUnmounted waits until the directory is empty or the timeout is reached.
 // Use to make sure directory is unmounted before proceeding.
-func waitUntilDirectoryIsUnmounted(mountDir string, timeout time.Duration) {
+func (copier *partitionCopier) waitUntilDirectoryIsUnmounted(mountDir string, timeout time.Duration) {
 	start := time.Now()
-	log.Print("Waiting for directory to be empty...")
+	copier.logger.Debug("Waiting for directory to be empty", "mount-dir", mountDir)
 	for {
 		// Check if the mount dir exists
 		if _, err := os.Stat(mountDir); os.IsNotExist(err) {
-			log.Printf("Directory %s does not exist, assuming unmounted", mountDir)
+			copier.logger.Debug("Directory does not exist, assuming unmounted", "mount-dir", mountDir)
 			return
 		}
-		ls_output, err := helper.RunCommand(fmt.Sprintf("ls %q", mountDir), false)
+		ls_output, err := helper.RunCommand(context.WithoutCancel(copier.ctx), fmt.Sprintf("ls %q", mountDir), false)
 		if err != nil {
 			return
 		}
@@ -407,10 +876,10 @@ func waitUntilDirectoryIsUnmounted(mountDir string, timeout time.Duration) {
 		}
 
 		if time.Since(start) > timeout {
-			log.Printf("directory %s is not empty within the timeout period. Continuing", mountDir)
+			copier.logger.Warn("Directory is not empty within the timeout period, continuing", "mount-dir", mountDir)
 			return
 		}
-		log.Print("Directory is not empty, waiting...")
+		copier.logger.Debug("Directory is not empty, waiting")
 		time.Sleep(1 * time.Second) // Adjust the sleep duration as needed
 	}
 }
@@ -434,3 +903,17 @@ func isDirectoryPopulated(dirPath string) (bool, error) {
 	}
 	return false, fmt.Errorf("error reading directory: %v", err)
 }
+
+// contextReader is a reader which stops reading when the context is cancelled.
+// It is used to interrupt copying of large files.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
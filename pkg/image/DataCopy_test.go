@@ -1,9 +1,14 @@
 package image
 
 import (
+	"context"
+	"log/slog"
 	"os"
 	"package-to-image-placer/pkg/configuration"
 	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/report"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -44,8 +49,8 @@ func cleanup() {
 	os.Remove(testImage)
 }
 
-func createDefaultConfig() {
-	configuration.Config = configuration.Configuration{
+func createDefaultConfig() *configuration.Configuration {
+	return &configuration.Configuration{
 		Target:           testImage,
 		NoClone:          true,
 		Packages:         []configuration.PackageConfig{package1},
@@ -58,9 +63,9 @@ func createDefaultConfig() {
 func TestMountPartitionAndCopyPackage_Success(t *testing.T) {
 	cleanup()
 	setup()
-	createDefaultConfig()
+	config := createDefaultConfig()
 
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -68,29 +73,29 @@ func TestMountPartitionAndCopyPackage_Success(t *testing.T) {
 
 func TestMountPartitionAndCopyPackage_ArchiveSizeTooBig(t *testing.T) {
 	packagePath := "../../testdata/archives/tooBig.zip"
-	createDefaultConfig()
-	configuration.Config.Packages[0].PackagePath = packagePath
+	config := createDefaultConfig()
+	config.Packages[0].PackagePath = packagePath
 
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestMountPartitionAndCopyPackage_InvalidPartition(t *testing.T) {
-	createDefaultConfig()
+	config := createDefaultConfig()
 
-	err := MountPartitionAndCopyPackages(-1, true)
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), -1, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestMountPartitionAndCopyPackage_InvalidPackagePath(t *testing.T) {
-	createDefaultConfig()
-	configuration.Config.Packages[0].PackagePath = "doesNotExist.zip"
+	config := createDefaultConfig()
+	config.Packages[0].PackagePath = "doesNotExist.zip"
 
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
@@ -99,10 +104,10 @@ func TestMountPartitionAndCopyPackage_InvalidPackagePath(t *testing.T) {
 func TestMountPartitionAndCopyPackage_NotAllServicesActivated(t *testing.T) {
 	cleanup()
 	setup()
-	createDefaultConfig()
-	configuration.Config.Packages[0].EnableServices = true
+	config := createDefaultConfig()
+	config.Packages[0].EnableServices = true
 
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
@@ -111,14 +116,14 @@ func TestMountPartitionAndCopyPackage_NotAllServicesActivated(t *testing.T) {
 func TestMountPartitionAndCopyPackage_FailExistNoOverwrite(t *testing.T) {
 	cleanup()
 	setup()
-	createDefaultConfig()
-	configuration.Config.Packages[0].OverwriteFiles = nil
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	config := createDefaultConfig()
+	config.Packages[0].OverwriteFiles = nil
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 
-	err = MountPartitionAndCopyPackages(partitionNumber, true)
+	err = NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
@@ -127,14 +132,14 @@ func TestMountPartitionAndCopyPackage_FailExistNoOverwrite(t *testing.T) {
 func TestMountPartitionAndCopyPackage_SuccessOverwrite(t *testing.T) {
 	cleanup()
 	setup()
-	createDefaultConfig()
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	config := createDefaultConfig()
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	configuration.Config.Packages[0].OverwriteFiles = []string{"/example/a/b/c/file"}
+	config.Packages[0].OverwriteFiles = []string{"/example/a/b/c/file"}
 
-	err = MountPartitionAndCopyPackages(partitionNumber, true)
+	err = NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -143,26 +148,162 @@ func TestMountPartitionAndCopyPackage_SuccessOverwrite(t *testing.T) {
 func TestMountPartitionAndCopyPackage_NonExistingOverwrite(t *testing.T) {
 	cleanup()
 	setup()
-	createDefaultConfig()
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	config := createDefaultConfig()
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	configuration.Config.Packages[0].OverwriteFiles = []string{"/example/a/b/c/file1"}
+	config.Packages[0].OverwriteFiles = []string{"/example/a/b/c/file1"}
 
-	err = MountPartitionAndCopyPackages(partitionNumber, true)
+	err = NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
 }
 
 func TestMountPartitionAndCopyPackage_TargetDirectoryOutOfMount(t *testing.T) {
-	createDefaultConfig()
-	configuration.Config.Packages[0].TargetDirectory = "../../"
-	err := MountPartitionAndCopyPackages(partitionNumber, true)
+	config := createDefaultConfig()
+	config.Packages[0].TargetDirectory = "../../"
+	err := NewCopier(config, nil, slog.Default(), nil).MountPartitionAndCopyPackages(context.Background(), partitionNumber, true)
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	} else if !strings.Contains(err.Error(), "target directory is not within the mounted partition") {
 		t.Fatalf("expected error message 'target directory is not within the mounted partition', got %v", err)
 	}
 }
+
+func TestDecompressZipArchive_ReportsFiles(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/app.conf": "new\n",
+		"etc/new.conf": "new\n",
+	})
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/app.conf"), []byte("old\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfig := configuration.PackageConfig{PackagePath: "package.zip", OverwriteFiles: []string{"/etc/app.conf"}}
+
+	copier := testCopier()
+	copier.packageReport = report.NewReport().Partition(1).Package(packageConfig.PackagePath, true)
+	_, err := copier.decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	slices.Sort(copier.packageReport.FilesWritten)
+	if !slices.Equal(copier.packageReport.FilesWritten, []string{"/etc/app.conf", "/etc/new.conf"}) {
+		t.Fatalf("expected both files reported as written, got %v", copier.packageReport.FilesWritten)
+	}
+	if !slices.Equal(copier.packageReport.FilesOverwritten, []string{"/etc/app.conf"}) {
+		t.Fatalf("expected /etc/app.conf reported as overwritten, got %v", copier.packageReport.FilesOverwritten)
+	}
+}
+
+func TestDecompressZipArchive_SkipExisting(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/app/app.conf": "new\n",
+		"etc/hosts":        "new\n",
+		"etc/new.conf":     "new\n",
+	})
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc/app"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"etc/app/app.conf", "etc/hosts"} {
+		if err := os.WriteFile(filepath.Join(mountDir, name), []byte("old\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	packageConfig := configuration.PackageConfig{PackagePath: "package.zip", OverwriteFiles: []string{"/etc/app/"}, OverwritePolicy: configuration.OverwritePolicySkipExisting}
+
+	copier := testCopier()
+	copier.packageReport = report.NewReport().Partition(1).Package(packageConfig.PackagePath, true)
+	_, err := copier.decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for name, expected := range map[string]string{"etc/app/app.conf": "new\n", "etc/hosts": "old\n", "etc/new.conf": "new\n"} {
+		content, err := os.ReadFile(filepath.Join(mountDir, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != expected {
+			t.Errorf("expected %s to contain %q, got %q", name, expected, content)
+		}
+	}
+	if !slices.Equal(copier.packageReport.FilesSkipped, []string{"/etc/hosts"}) {
+		t.Fatalf("expected /etc/hosts reported as skipped, got %v", copier.packageReport.FilesSkipped)
+	}
+}
+
+func TestDecompressZipArchive_MergesFiles(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/fstab":        "/dev/sdb1 /data ext4 defaults 0 2\n",
+		"etc/app/app.json": `{"level": "debug"}`,
+	})
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc/app"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/fstab"), []byte("UUID=1234 / ext4 defaults 0 1\n"), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/app/app.json"), []byte("{\n  \"level\": \"info\",\n  \"name\": \"app\"\n}\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfig := configuration.PackageConfig{PackagePath: "package.zip", MergeRules: []configuration.MergeRule{
+		{Pattern: "/etc/fstab", Strategy: "append-lines"},
+		{Pattern: "*.json", Strategy: "json"},
+	}}
+
+	copier := testCopier()
+	copier.packageReport = report.NewReport().Partition(1).Package(packageConfig.PackagePath, true)
+	_, err := copier.decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := map[string]string{
+		"etc/fstab":        "UUID=1234 / ext4 defaults 0 1\n/dev/sdb1 /data ext4 defaults 0 2\n",
+		"etc/app/app.json": "{\n  \"level\": \"debug\",\n  \"name\": \"app\"\n}\n",
+	}
+	for name, content := range expected {
+		merged, err := os.ReadFile(filepath.Join(mountDir, name))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(merged) != content {
+			t.Errorf("expected %s to contain %q, got %q", name, content, merged)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(mountDir, "etc/fstab")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the mode of the merged file to be kept, got %v", info.Mode())
+	}
+	slices.Sort(copier.packageReport.FilesMerged)
+	if !slices.Equal(copier.packageReport.FilesMerged, []string{"/etc/app/app.json", "/etc/fstab"}) {
+		t.Fatalf("expected both files reported as merged, got %v", copier.packageReport.FilesMerged)
+	}
+}
+
+func TestPackageConfigs_PartitionTargeting(t *testing.T) {
+	copier := testCopier()
+	copier.config.PartitionNumbers = []int{1, 2}
+	copier.config.Packages = []configuration.PackageConfig{
+		{PackagePath: "app.zip"},
+		{PackagePath: "data.zip", PartitionNumbers: []int{3}},
+	}
+	copier.config.ConfigurationPackages = []configuration.ConfigurationPackage{{PackagePath: "boot-overlay.zip", PartitionNumbers: []int{1}}}
+
+	expected := map[int][]string{1: {"app.zip", "boot-overlay.zip"}, 2: {"app.zip"}, 3: {"data.zip"}}
+	for partition, packagePaths := range expected {
+		copier.partitionNumber = partition
+		var paths []string
+		for _, packageConfig := range copier.packageConfigs() {
+			paths = append(paths, packageConfig.PackagePath)
+		}
+		if !slices.Equal(paths, packagePaths) {
+			t.Errorf("partition %d: expected packages %v, got %v", partition, packagePaths, paths)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// bootFileNames are files and directories found in the root of boot partitions (EFI system partitions, /boot, Raspberry Pi firmware, U-Boot)
+var bootFileNames = []string{"efi", "grub", "grub2", "loader", "extlinux", "syslinux", "overlays", "config.txt", "cmdline.txt", "boot.scr", "u-boot.bin"}
+
+// bootFilePrefixes are prefixes of kernel and initramfs images found in boot partitions
+var bootFilePrefixes = []string{"vmlinuz", "vmlinux", "zimage", "uimage", "image", "initrd", "initramfs"}
+
+// rolesByTypeGUID are the roles of the GPT partition types of the Discoverable Partitions Specification,
+// used if the content of the partition doesn't tell its role
+var rolesByTypeGUID = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": user.PartitionRoleBoot,   // EFI system partition
+	"BC13C2FF-59E6-4262-A352-B275FD6F7172": user.PartitionRoleBoot,   // Extended boot loader partition
+	"44479540-F297-41B2-9AF7-D131D5F0458A": user.PartitionRoleRootfs, // Root partition (x86)
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": user.PartitionRoleRootfs, // Root partition (x86-64)
+	"69DAD710-2CE4-4E3C-B16C-21A1D49ABED3": user.PartitionRoleRootfs, // Root partition (32-bit ARM)
+	"B921B045-1DF0-41C3-AF44-4C6F280D3FAE": user.PartitionRoleRootfs, // Root partition (64-bit ARM)
+	"933AC7E1-2EB4-4F13-B844-0E14E2AEF915": user.PartitionRoleData,   // Home partition
+	"3B8F8425-20E0-4F3B-907F-1A25A76F98E8": user.PartitionRoleData,   // Server data partition
+	"4D21B016-B534-45C2-A9FB-5C16E091FD2D": user.PartitionRoleData,   // Variable data partition
+}
+
+// partitionFiles is a read-only view of the files of a partition. Paths are absolute paths inside the partition.
+// Symlinks are never followed, so absolute symlinks of the image can't point to files of the host.
+type partitionFiles interface {
+	// isDir checks if the path is a directory
+	isDir(path string) bool
+	// exists checks if there is a file, directory or symlink at the path
+	exists(path string) bool
+	// readFile reads the regular file at the path
+	readFile(path string) ([]byte, error)
+	// names returns the names of the entries of the directory
+	names(dir string) []string
+}
+
+// DetectPartitions returns the partitions of the image with their role detected from their content.
+// Filesystems go-diskfs reads completely are read directly, the others are mounted read-only one after another.
+// The /etc/fstab files of the root filesystems assign the roles of the partitions they mount.
+// Partitions which can't be read get the unknown role, unless their GPT partition type tells it.
+func DetectPartitions(ctx context.Context, imagePath string, logger *slog.Logger) ([]user.PartitionInfo, error) {
+	partitions, err := user.GetPartitionInfo(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	var fstabEntries [][2]string
+	for i := range partitions {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		partitionLogger := logger.With("partition", partitions[i].Number)
+		files, closeFiles, err := openPartitionFiles(ctx, imagePath, partitions[i], partitionLogger)
+		if err != nil {
+			partitionLogger.Warn("Unable to read partition, its role is unknown", "error", err)
+			partitions[i].Role = roleByTypeGUID(partitions[i].TypeGUID, user.PartitionRoleUnknown)
+			continue
+		}
+		partitions[i].Role = classifyPartition(files, partitions[i].TypeGUID)
+		if partitions[i].Role == user.PartitionRoleRootfs {
+			if fstab, err := files.readFile("/etc/fstab"); err == nil {
+				fstabEntries = append(fstabEntries, parseFstab(fstab)...)
+			}
+		}
+		closeFiles()
+		partitionLogger.Debug("Partition role detected", "role", partitions[i].Role)
+	}
+	applyFstabRoles(partitions, fstabEntries)
+	return partitions, nil
+}
+
+// openPartitionFiles opens the filesystem of the partition as diff.OpenTree does with the auto backend.
+// The returned function closes the filesystem or unmounts the partition.
+func openPartitionFiles(ctx context.Context, imagePath string, partition user.PartitionInfo, logger *slog.Logger) (partitionFiles, func(), error) {
+	switch partition.FilesystemType {
+	case "FAT32", "ISO9660", "Squashfs":
+		imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+		if err != nil {
+			return nil, nil, err
+		}
+		partitionFilesystem, err := imageDisk.GetFilesystem(partition.Number)
+		if err != nil {
+			imageDisk.Close()
+			return nil, nil, err
+		}
+		return diskfsFiles{filesystem: partitionFilesystem}, func() { imageDisk.Close() }, nil
+	default:
+		mountDir, unmount, err := MountReadOnly(ctx, imagePath, partition.Number, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return mountedFiles{dir: mountDir}, unmount, nil
+	}
+}
+
+// classifyPartition returns the role of the partition from its content, or from its GPT partition type if the content doesn't tell it.
+// A partition is a root filesystem if it has the os-release file, the systemd unit directory or /etc/fstab with /usr,
+// a boot partition if its root directory has boot loader files or kernel images. Other partitions are data partitions.
+func classifyPartition(files partitionFiles, typeGUID string) string {
+	if files.exists("/etc/os-release") || files.exists("/usr/lib/os-release") || files.isDir("/etc/systemd/system") ||
+		(files.exists("/etc/fstab") && files.isDir("/usr")) {
+		return user.PartitionRoleRootfs
+	}
+	for _, name := range files.names("/") {
+		lowerName := strings.ToLower(name)
+		if slices.Contains(bootFileNames, lowerName) || strings.HasSuffix(lowerName, ".dtb") || strings.HasSuffix(lowerName, ".efi") {
+			return user.PartitionRoleBoot
+		}
+		// Kernel images are files, e.g. a directory named images is not a kernel image
+		isKernelImage := slices.ContainsFunc(bootFilePrefixes, func(prefix string) bool { return strings.HasPrefix(lowerName, prefix) })
+		if isKernelImage && !files.isDir("/"+name) {
+			return user.PartitionRoleBoot
+		}
+	}
+	return roleByTypeGUID(typeGUID, user.PartitionRoleData)
+}
+
+// roleByTypeGUID returns the role of the GPT partition type, or the default role if the type doesn't tell it
+func roleByTypeGUID(typeGUID string, defaultRole string) string {
+	if role, found := rolesByTypeGUID[strings.ToUpper(typeGUID)]; found {
+		return role
+	}
+	return defaultRole
+}
+
+// parseFstab returns the device and the mount point of every entry of the fstab
+func parseFstab(content []byte) [][2]string {
+	var entries [][2]string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		entries = append(entries, [2]string{fields[0], fields[1]})
+	}
+	return entries
+}
+
+// applyFstabRoles sets the roles of the partitions mounted by the fstab entries: partitions mounted to /boot, /boot/efi, /boot/firmware
+// or /efi are boot partitions, partitions mounted elsewhere are data partitions. The role of root filesystems is kept.
+// Partitions are matched by PARTUUID, PARTLABEL or LABEL.
+func applyFstabRoles(partitions []user.PartitionInfo, entries [][2]string) {
+	for _, entry := range entries {
+		device, mountPoint := entry[0], entry[1]
+		if !strings.HasPrefix(mountPoint, "/") || mountPoint == "/" {
+			continue
+		}
+		role := user.PartitionRoleData
+		if slices.Contains([]string{"/boot", "/boot/efi", "/boot/firmware", "/efi"}, path.Clean(mountPoint)) {
+			role = user.PartitionRoleBoot
+		}
+		for i := range partitions {
+			if partitions[i].Role != user.PartitionRoleRootfs && fstabDeviceMatches(device, partitions[i]) {
+				partitions[i].Role = role
+			}
+		}
+	}
+}
+
+// fstabDeviceMatches checks if the device of the fstab entry refers to the partition
+func fstabDeviceMatches(device string, partition user.PartitionInfo) bool {
+	key, value, found := strings.Cut(device, "=")
+	if !found {
+		dir, name := path.Split(device)
+		key, value = map[string]string{"/dev/disk/by-partuuid/": "PARTUUID", "/dev/disk/by-partlabel/": "PARTLABEL", "/dev/disk/by-label/": "LABEL"}[dir], name
+	}
+	value = strings.Trim(value, `"`)
+	switch key {
+	case "PARTUUID":
+		return value != "" && strings.EqualFold(value, partition.UUID)
+	case "PARTLABEL":
+		return value != "" && value == partition.Name
+	case "LABEL":
+		return value != "" && partition.FilesystemType != user.UnknownFilesystem && value == partition.FilesystemLabel
+	default:
+		return false
+	}
+}
+
+// mountedFiles reads the files of a partition mounted to a directory
+type mountedFiles struct {
+	dir string
+}
+
+func (files mountedFiles) isDir(filePath string) bool {
+	info, err := os.Lstat(filepath.Join(files.dir, filePath))
+	return err == nil && info.IsDir()
+}
+
+func (files mountedFiles) exists(filePath string) bool {
+	_, err := os.Lstat(filepath.Join(files.dir, filePath))
+	return err == nil
+}
+
+func (files mountedFiles) readFile(filePath string) ([]byte, error) {
+	fullPath := filepath.Join(files.dir, filePath)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(fullPath)
+}
+
+func (files mountedFiles) names(dir string) []string {
+	entries, _ := os.ReadDir(filepath.Join(files.dir, dir))
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// diskfsFiles reads the files of a partition directly from the image by go-diskfs
+type diskfsFiles struct {
+	filesystem filesystem.FileSystem
+}
+
+// stat returns the entry at the path from its parent directory, as go-diskfs has no stat
+func (files diskfsFiles) stat(filePath string) (os.FileInfo, bool) {
+	dir, name := path.Split(path.Clean(filePath))
+	infos, err := files.filesystem.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+	for _, info := range infos {
+		if info.Name() == name {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+func (files diskfsFiles) isDir(filePath string) bool {
+	info, found := files.stat(filePath)
+	return found && info.IsDir()
+}
+
+func (files diskfsFiles) exists(filePath string) bool {
+	_, found := files.stat(filePath)
+	return found
+}
+
+func (files diskfsFiles) readFile(filePath string) ([]byte, error) {
+	info, found := files.stat(filePath)
+	if !found || !info.Mode().IsRegular() {
+		return nil, os.ErrNotExist
+	}
+	file, err := files.filesystem.OpenFile(filePath, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (files diskfsFiles) names(dir string) []string {
+	infos, _ := files.filesystem.ReadDir(dir)
+	var names []string
+	for _, info := range infos {
+		if info.Name() != "." && info.Name() != ".." {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
@@ -0,0 +1,87 @@
+package image
+
+import (
+	"os"
+	"package-to-image-placer/pkg/user"
+	"path/filepath"
+	"testing"
+)
+
+// createPartitionFiles creates the files in a new directory, names ending with a slash are directories
+func createPartitionFiles(t *testing.T, names ...string) mountedFiles {
+	dir := t.TempDir()
+	for _, name := range names {
+		fullPath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if name[len(name)-1] == '/' {
+			if err := os.MkdirAll(fullPath, 0755); err != nil {
+				t.Fatal(err.Error())
+			}
+			continue
+		}
+		if err := os.WriteFile(fullPath, []byte{}, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return mountedFiles{dir: dir}
+}
+
+func TestClassifyPartition_Roles(t *testing.T) {
+	tests := []struct {
+		files    mountedFiles
+		typeGUID string
+		role     string
+	}{
+		{createPartitionFiles(t, "etc/os-release", "usr/bin/"), "", user.PartitionRoleRootfs},
+		{createPartitionFiles(t, "etc/systemd/system/multi-user.target.wants/"), "", user.PartitionRoleRootfs},
+		{createPartitionFiles(t, "EFI/BOOT/BOOTX64.EFI"), "", user.PartitionRoleBoot},
+		{createPartitionFiles(t, "vmlinuz-6.1.0", "config-6.1.0"), "", user.PartitionRoleBoot},
+		{createPartitionFiles(t, "bcm2711-rpi-4-b.dtb", "config.txt"), "", user.PartitionRoleBoot},
+		{createPartitionFiles(t, "images/app.img", "lost+found/"), "", user.PartitionRoleData},
+		{createPartitionFiles(t, "lost+found/"), "4f68bce3-e8cd-4db1-96e7-fbcaf984b709", user.PartitionRoleRootfs},
+	}
+	for i, test := range tests {
+		if role := classifyPartition(test.files, test.typeGUID); role != test.role {
+			t.Errorf("test %d: expected role %s, got %s", i, test.role, role)
+		}
+	}
+}
+
+func TestClassifyPartition_AbsoluteSymlinkNotFollowed(t *testing.T) {
+	files := createPartitionFiles(t, "usr/lib/os-release", "etc/")
+	if err := os.Symlink("/usr/lib/os-release", filepath.Join(files.dir, "etc/os-release")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := files.readFile("/etc/os-release"); err == nil {
+		t.Errorf("expected the symlink not to be read")
+	}
+	if role := classifyPartition(files, ""); role != user.PartitionRoleRootfs {
+		t.Errorf("expected role %s, got %s", user.PartitionRoleRootfs, role)
+	}
+}
+
+func TestApplyFstabRoles_MountedPartitions(t *testing.T) {
+	partitions := []user.PartitionInfo{
+		{Number: 1, UUID: "0A1B2C3D-01", Name: "boot", Role: user.PartitionRoleData},
+		{Number: 2, Name: "rootfs_a", FilesystemType: "Ext4", FilesystemLabel: "rootfs", Role: user.PartitionRoleRootfs},
+		{Number: 3, Name: "rootfs_b", FilesystemType: "Ext4", FilesystemLabel: "rootfs", Role: user.PartitionRoleRootfs},
+		{Number: 4, Name: "data", FilesystemType: "Ext4", FilesystemLabel: "data", Role: user.PartitionRoleUnknown},
+		{Number: 5, Name: "spare", Role: user.PartitionRoleUnknown},
+	}
+	fstab := []byte(`# <file system> <mount point> <type> <options> <dump> <pass>
+PARTLABEL=rootfs_a / ext4 defaults 0 1
+PARTUUID=0a1b2c3d-01 /boot/firmware vfat defaults 0 2
+LABEL=rootfs /mnt/other ext4 defaults 0 2
+/dev/disk/by-label/data /data ext4 defaults 0 2
+tmpfs /tmp tmpfs defaults 0 0
+`)
+	applyFstabRoles(partitions, parseFstab(fstab))
+	expected := []string{user.PartitionRoleBoot, user.PartitionRoleRootfs, user.PartitionRoleRootfs, user.PartitionRoleData, user.PartitionRoleUnknown}
+	for i, partition := range partitions {
+		if partition.Role != expected[i] {
+			t.Errorf("partition %d: expected role %s, got %s", partition.Number, expected[i], partition.Role)
+		}
+	}
+}
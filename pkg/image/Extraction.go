@@ -0,0 +1,166 @@
+package image
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxSymlinksFollowed limits the number of symlinks followed when resolving one path, as the kernel does
+	maxSymlinksFollowed = 40
+	// maxSymlinkTargetLength is the maximal length of a symlink target (PATH_MAX)
+	maxSymlinkTargetLength = 4096
+	// compressionRatioMinSize is the uncompressed size from which the compression ratio of an entry is checked.
+	// Small files may compress very well without being a zip bomb.
+	compressionRatioMinSize = 1 << 20
+)
+
+// specialFileModes are the mode bits of device files, named pipes and sockets
+const specialFileModes = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket
+
+// validateArchive checks the entries of the archive against the limits and policies of the extraction config before anything is extracted.
+// The sizes from the entry headers can be trusted, because reading an entry fails if it is larger than declared.
+func validateArchive(zipReader *zip.Reader, extraction configuration.ExtractionConfig) error {
+	extraction = extraction.WithDefaults()
+	if len(zipReader.File) > extraction.MaxEntries {
+		return fmt.Errorf("archive has %d entries, more than the limit of %d", len(zipReader.File), extraction.MaxEntries)
+	}
+	totalSize := uint64(0)
+	for _, file := range zipReader.File {
+		err := validateArchiveEntry(file, extraction)
+		if err != nil {
+			return err
+		}
+		totalSize += file.UncompressedSize64
+		if totalSize > extraction.MaxTotalSize {
+			return fmt.Errorf("archive is larger than the limit of %d bytes", extraction.MaxTotalSize)
+		}
+	}
+	return nil
+}
+
+// validateArchiveEntry checks the type, permissions, size and compression ratio of the archive entry.
+func validateArchiveEntry(file *zip.File, extraction configuration.ExtractionConfig) error {
+	mode := file.Mode()
+	if mode&specialFileModes != 0 && !extraction.AllowDeviceFiles {
+		return fmt.Errorf("entry %s is a device file, named pipe or socket, which are not allowed", file.Name)
+	}
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 && !extraction.AllowSetuid {
+		return fmt.Errorf("entry %s has the setuid or setgid bit, which is not allowed", file.Name)
+	}
+	if file.UncompressedSize64 > extraction.MaxFileSize {
+		return fmt.Errorf("entry %s has %d bytes, more than the limit of %d", file.Name, file.UncompressedSize64, extraction.MaxFileSize)
+	}
+	if mode&os.ModeSymlink != 0 && file.UncompressedSize64 > maxSymlinkTargetLength {
+		return fmt.Errorf("entry %s is a symlink with a target longer than %d bytes", file.Name, maxSymlinkTargetLength)
+	}
+	if file.UncompressedSize64 >= compressionRatioMinSize && file.UncompressedSize64/max(file.CompressedSize64, 1) > extraction.MaxCompressionRatio {
+		return fmt.Errorf("entry %s has compression ratio higher than the limit of %d", file.Name, extraction.MaxCompressionRatio)
+	}
+	return nil
+}
+
+// checkSymlinkTarget checks the target of the symlink which will be created at the link path against the symlink policy.
+// With SymlinkPolicyRelative, the target must be relative and stay within the package directory.
+// With SymlinkPolicyContained, a relative target must stay within the partition mounted to the mount directory.
+// Absolute targets always stay within the partition, as they are resolved from its root.
+func checkSymlinkTarget(linkPath string, linkTarget string, packageDir string, mountDir string, policy string) error {
+	resolvedTarget := filepath.Join(filepath.Dir(linkPath), linkTarget)
+	switch policy {
+	case configuration.SymlinkPolicyRelative:
+		if filepath.IsAbs(linkTarget) {
+			return fmt.Errorf("symlink %s has absolute target %s, only relative targets are allowed", pathInImage(mountDir, linkPath), linkTarget)
+		}
+		if !helper.IsWithinRootDir(packageDir, resolvedTarget) {
+			return fmt.Errorf("symlink %s points to %s out of the package directory", pathInImage(mountDir, linkPath), linkTarget)
+		}
+	default:
+		if !filepath.IsAbs(linkTarget) && !helper.IsWithinRootDir(mountDir, resolvedTarget) {
+			return fmt.Errorf("symlink %s points to %s out of the partition", pathInImage(mountDir, linkPath), linkTarget)
+		}
+	}
+	return nil
+}
+
+// resolveInImage resolves all symlinks of the path within the partition mounted to the mount directory,
+// as if the mount directory was the root directory: absolute symlink targets are resolved from the mount directory
+// and ".." never leaves it. The returned path doesn't contain any existing symlink, so it can be written to without
+// following a symlink out of the partition. Components which don't exist are kept as they are.
+func resolveInImage(mountDir string, path string) (string, error) {
+	if !helper.IsWithinRootDir(mountDir, path) {
+		return "", fmt.Errorf("path %s is not within the mounted partition", path)
+	}
+	relativePath, err := filepath.Rel(mountDir, path)
+	if err != nil {
+		return "", err
+	}
+	remaining := strings.Split(relativePath, string(os.PathSeparator))
+	var resolved []string
+	symlinksFollowed := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		current := filepath.Join(mountDir, filepath.Join(append(resolved, component)...))
+		info, err := os.Lstat(current)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			resolved = append(resolved, component)
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+		symlinksFollowed++
+		if symlinksFollowed > maxSymlinksFollowed {
+			return "", fmt.Errorf("too many levels of symlinks in %s", pathInImage(mountDir, path))
+		}
+		linkTarget, err := os.Readlink(current)
+		if err != nil {
+			return "", fmt.Errorf("unable to read symlink %s: %v", current, err)
+		}
+		if filepath.IsAbs(linkTarget) {
+			resolved = nil
+		}
+		remaining = append(strings.Split(linkTarget, string(os.PathSeparator)), remaining...)
+	}
+	return filepath.Join(mountDir, filepath.Join(resolved...)), nil
+}
+
+// resolveEntryPath returns the path the archive entry is extracted to. Symlinks on the way to the entry are resolved within
+// the partition, the entry itself is not followed if it is a symlink. The path must stay within the package directory,
+// so an entry can't be written through a symlink out of it.
+func resolveEntryPath(mountDir string, packageDir string, entryPath string, isDir bool) (string, error) {
+	var extractPath string
+	var err error
+	if isDir {
+		extractPath, err = resolveInImage(mountDir, entryPath)
+	} else {
+		var parentDir string
+		parentDir, err = resolveInImage(mountDir, filepath.Dir(entryPath))
+		extractPath = filepath.Join(parentDir, filepath.Base(entryPath))
+	}
+	if err != nil {
+		return "", err
+	}
+	if !helper.IsWithinRootDir(packageDir, extractPath) {
+		return "", fmt.Errorf("%s leads through a symlink out of the package directory", pathInImage(mountDir, entryPath))
+	}
+	return extractPath, nil
+}
@@ -0,0 +1,207 @@
+package image
+
+import (
+	"archive/zip"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// craftedEntry is an entry of a crafted archive, written in the given order
+type craftedEntry struct {
+	name    string
+	content string
+	mode    os.FileMode
+}
+
+// createCraftedZip creates a zip archive with the entries in their order and returns an opened reader.
+func createCraftedZip(t *testing.T, entries []craftedEntry) *zip.ReadCloser {
+	archivePath := filepath.Join(t.TempDir(), "crafted.zip")
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writer := zip.NewWriter(archiveFile)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+		fileWriter, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := fileWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	archiveFile.Close()
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { zipReader.Close() })
+	return zipReader
+}
+
+// extractCrafted extracts the archive as a standard package to /opt/crafted of a temporary partition and returns the mount directory.
+func extractCrafted(t *testing.T, extraction configuration.ExtractionConfig, entries []craftedEntry) (string, error) {
+	mountDir := t.TempDir()
+	packageDir := filepath.Join(mountDir, "opt/crafted")
+	if err := os.MkdirAll(packageDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	copier := testCopier()
+	copier.config.Extraction = extraction
+	packageConfig := configuration.PackageConfig{PackagePath: "crafted.zip", TargetDirectory: "opt", IsStandardPackage: true}
+	_, err := copier.decompressZipArchiveAndReturnService(&createCraftedZip(t, entries).Reader, packageDir, mountDir, &packageConfig)
+	return mountDir, err
+}
+
+func TestDecompressZipArchive_WriteThroughSymlink(t *testing.T) {
+	outsideDir := t.TempDir()
+	_, err := extractCrafted(t, configuration.ExtractionConfig{}, []craftedEntry{
+		{name: "link", content: outsideDir, mode: os.ModeSymlink | 0777},
+		{name: "link/evil", content: "evil", mode: 0644},
+	})
+	if err == nil || !strings.Contains(err.Error(), "out of the package directory") {
+		t.Fatalf("expected write through symlink rejected, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outsideDir, "evil")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file written out of the partition")
+	}
+}
+
+func TestDecompressZipArchive_SymlinkOutOfPartition(t *testing.T) {
+	_, err := extractCrafted(t, configuration.ExtractionConfig{}, []craftedEntry{
+		{name: "link", content: "../../../../../../etc/passwd", mode: os.ModeSymlink | 0777},
+	})
+	if err == nil || !strings.Contains(err.Error(), "out of the partition") {
+		t.Fatalf("expected symlink out of the partition rejected, got %v", err)
+	}
+}
+
+func TestDecompressZipArchive_SymlinkContained(t *testing.T) {
+	mountDir, err := extractCrafted(t, configuration.ExtractionConfig{}, []craftedEntry{
+		{name: "lib", content: "../../usr/lib", mode: os.ModeSymlink | 0777},
+		{name: "config", content: "/etc/crafted.conf", mode: os.ModeSymlink | 0777},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	linkTarget, err := os.Readlink(filepath.Join(mountDir, "opt/crafted/config"))
+	if err != nil || linkTarget != "/etc/crafted.conf" {
+		t.Fatalf("expected symlink to /etc/crafted.conf, got %s (%v)", linkTarget, err)
+	}
+}
+
+func TestDecompressZipArchive_SymlinkPolicyRelative(t *testing.T) {
+	extraction := configuration.ExtractionConfig{SymlinkPolicy: configuration.SymlinkPolicyRelative}
+	_, err := extractCrafted(t, extraction, []craftedEntry{
+		{name: "config", content: "/etc/crafted.conf", mode: os.ModeSymlink | 0777},
+	})
+	if err == nil || !strings.Contains(err.Error(), "only relative targets are allowed") {
+		t.Fatalf("expected absolute symlink rejected, got %v", err)
+	}
+	_, err = extractCrafted(t, extraction, []craftedEntry{
+		{name: "lib", content: "../../usr/lib", mode: os.ModeSymlink | 0777},
+	})
+	if err == nil || !strings.Contains(err.Error(), "out of the package directory") {
+		t.Fatalf("expected symlink out of the package directory rejected, got %v", err)
+	}
+	_, err = extractCrafted(t, extraction, []craftedEntry{
+		{name: "bin/tool", content: "tool", mode: 0755},
+		{name: "tool", content: "bin/tool", mode: os.ModeSymlink | 0777},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestDecompressZipArchive_ImageSymlinkResolved(t *testing.T) {
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "usr/lib"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink("usr/lib", filepath.Join(mountDir, "lib")); err != nil {
+		t.Fatal(err.Error())
+	}
+	zipReader := createCraftedZip(t, []craftedEntry{
+		{name: "lib/", mode: os.ModeDir | 0755},
+		{name: "lib/firmware/blob.bin", content: "firmware", mode: 0644},
+	})
+	packageConfig := configuration.PackageConfig{PackagePath: "crafted.zip"}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "usr/lib/firmware/blob.bin")); err != nil {
+		t.Fatalf("expected file extracted through the symlink of the image, got %v", err)
+	}
+}
+
+func TestDecompressZipArchive_OverwriteSymlinkNotFollowed(t *testing.T) {
+	mountDir := t.TempDir()
+	outsideFile := filepath.Join(t.TempDir(), "outside")
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink(outsideFile, filepath.Join(mountDir, "etc/app.conf")); err != nil {
+		t.Fatal(err.Error())
+	}
+	zipReader := createCraftedZip(t, []craftedEntry{{name: "etc/app.conf", content: "new", mode: 0644}})
+	packageConfig := configuration.PackageConfig{PackagePath: "crafted.zip", OverwriteFiles: []string{"/etc/app.conf"}}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Lstat(outsideFile); !os.IsNotExist(err) {
+		t.Fatalf("expected the symlink replaced, not followed")
+	}
+	info, err := os.Lstat(filepath.Join(mountDir, "etc/app.conf"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected regular file /etc/app.conf, got %v", err)
+	}
+}
+
+func TestValidateArchive_Limits(t *testing.T) {
+	zeros := strings.Repeat("\x00", 2<<20)
+	tests := []struct {
+		name       string
+		extraction configuration.ExtractionConfig
+		entries    []craftedEntry
+		expected   string
+	}{
+		{"entries", configuration.ExtractionConfig{MaxEntries: 1}, []craftedEntry{{name: "a", mode: 0644}, {name: "b", mode: 0644}}, "more than the limit of 1"},
+		{"file size", configuration.ExtractionConfig{MaxFileSize: 4}, []craftedEntry{{name: "a", content: "12345", mode: 0644}}, "has 5 bytes"},
+		{"total size", configuration.ExtractionConfig{MaxTotalSize: 6}, []craftedEntry{{name: "a", content: "1234", mode: 0644}, {name: "b", content: "1234", mode: 0644}}, "larger than the limit of 6"},
+		{"compression ratio", configuration.ExtractionConfig{MaxCompressionRatio: 100}, []craftedEntry{{name: "bomb", content: zeros, mode: 0644}}, "compression ratio"},
+		{"setuid", configuration.ExtractionConfig{}, []craftedEntry{{name: "su", content: "x", mode: os.ModeSetuid | 0755}}, "setuid"},
+		{"device", configuration.ExtractionConfig{}, []craftedEntry{{name: "sda", mode: os.ModeDevice | 0660}}, "device file"},
+		{"named pipe", configuration.ExtractionConfig{}, []craftedEntry{{name: "fifo", mode: os.ModeNamedPipe | 0644}}, "named pipe"},
+	}
+	for _, test := range tests {
+		zipReader := createCraftedZip(t, test.entries)
+		err := validateArchive(&zipReader.Reader, test.extraction)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestValidateArchive_Allowed(t *testing.T) {
+	zipReader := createCraftedZip(t, []craftedEntry{
+		{name: "su", content: "x", mode: os.ModeSetuid | 0755},
+		{name: "sda", mode: os.ModeDevice | 0660},
+		{name: "small", content: strings.Repeat("\x00", 1000), mode: 0644},
+	})
+	err := validateArchive(&zipReader.Reader, configuration.ExtractionConfig{AllowSetuid: true, AllowDeviceFiles: true, MaxCompressionRatio: 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
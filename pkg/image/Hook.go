@@ -0,0 +1,94 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 60 * time.Second
+
+// hookWaitDelay limits how long to wait for the output of processes spawned by a killed hook
+const hookWaitDelay = time.Second
+
+// runPostInstallHook runs the post-install hook of the package on the host.
+// The script is started in the package directory and gets the mount directory, the package directory
+// (on the host and inside the image) and the package path passed in environment variables.
+// The output of the script is logged and added to the returned error. It returns an error if the script fails or does not finish within the timeout.
+// The script is killed when the context of the copier is cancelled.
+func (copier *partitionCopier) runPostInstallHook(hook *configuration.HookConfig, mountDir string, packageDir string, packagePath string) error {
+	if hook == nil {
+		return nil
+	}
+	scriptPath, err := resolveHookScript(hook, packageDir)
+	if err != nil {
+		return err
+	}
+
+	timeout := defaultHookTimeout
+	if hook.TimeoutSeconds > 0 {
+		timeout = time.Duration(hook.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(copier.ctx, timeout)
+	defer cancel()
+
+	packageDirInImage := pathInImage(mountDir, packageDir)
+
+	copier.logger.Info("Running post-install hook", "script", scriptPath, "package", packagePath)
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, scriptPath)
+	cmd.Dir = packageDir
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = hookWaitDelay
+	cmd.Env = append(os.Environ(),
+		"PLACER_MOUNT_DIR="+mountDir,
+		"PLACER_TARGET_DIR="+packageDir,
+		"PLACER_TARGET_DIR_IN_IMAGE="+packageDirInImage,
+		"PLACER_PACKAGE_PATH="+packagePath,
+	)
+	err = cmd.Run()
+	hookOutput := strings.TrimSpace(output.String())
+	if hookOutput != "" {
+		copier.logger.Info("Post-install hook output", "script", scriptPath, "output", hookOutput)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("post-install hook %s timed out after %v%s", scriptPath, timeout, formatHookOutput(hookOutput))
+	}
+	if err != nil {
+		return fmt.Errorf("post-install hook %s failed: %w%s", scriptPath, err, formatHookOutput(hookOutput))
+	}
+	return nil
+}
+
+// formatHookOutput returns the output of a failed hook appended to its error, or an empty string if there is no output
+func formatHookOutput(output string) string {
+	if output == "" {
+		return ""
+	}
+	return ", output: " + output
+}
+
+// resolveHookScript returns the path of the hook script on the host.
+// Scripts shipped in the package are looked up in the extracted package directory and must not leave it.
+func resolveHookScript(hook *configuration.HookConfig, packageDir string) (string, error) {
+	if hook.Script != "" {
+		return filepath.Abs(hook.Script)
+	}
+	scriptPath := filepath.Join(packageDir, hook.PackageScript)
+	if !helper.IsWithinRootDir(packageDir, scriptPath) {
+		return "", fmt.Errorf("post-install hook script %s is not within the package directory", hook.PackageScript)
+	}
+	if !helper.DoesFileExists(scriptPath) {
+		return "", fmt.Errorf("post-install hook script %s not found in the package", hook.PackageScript)
+	}
+	return scriptPath, nil
+}
@@ -0,0 +1,112 @@
+package image
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCopier() *partitionCopier {
+	copier := NewCopier(createDefaultConfig(), nil, slog.Default(), nil)
+	return &partitionCopier{Copier: copier, ctx: context.Background(), partitionNumber: partitionNumber, firstPartition: true, logger: slog.Default()}
+}
+
+func writeHookScript(t *testing.T, dir string, name string, content string) string {
+	scriptPath := filepath.Join(dir, name)
+	err := os.WriteFile(scriptPath, []byte("#!/bin/sh\n"+content), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return scriptPath
+}
+
+func TestRunPostInstallHook_Success(t *testing.T) {
+	mountDir := t.TempDir()
+	packageDir := filepath.Join(mountDir, "opt/package")
+	if err := os.MkdirAll(packageDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	script := writeHookScript(t, t.TempDir(), "hook.sh", `echo "$PLACER_TARGET_DIR_IN_IMAGE" > "$PLACER_MOUNT_DIR/hook-output"`)
+
+	hook := &configuration.HookConfig{Script: script}
+	err := testCopier().runPostInstallHook(hook, mountDir, packageDir, "package.zip")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	output, err := os.ReadFile(filepath.Join(mountDir, "hook-output"))
+	if err != nil {
+		t.Fatalf("expected hook output file, got %v", err)
+	}
+	if strings.TrimSpace(string(output)) != "/opt/package" {
+		t.Fatalf("expected '/opt/package', got '%s'", strings.TrimSpace(string(output)))
+	}
+}
+
+func TestRunPostInstallHook_PackageScript(t *testing.T) {
+	mountDir := t.TempDir()
+	writeHookScript(t, mountDir, "hook.sh", `touch "$PLACER_TARGET_DIR/hook-done"`)
+
+	hook := &configuration.HookConfig{PackageScript: "/hook.sh"}
+	err := testCopier().runPostInstallHook(hook, mountDir, mountDir, "package.zip")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "hook-done")); err != nil {
+		t.Fatalf("expected hook to create file, got %v", err)
+	}
+}
+
+func TestRunPostInstallHook_PackageScriptOutsidePackage(t *testing.T) {
+	mountDir := t.TempDir()
+	hook := &configuration.HookConfig{PackageScript: "../hook.sh"}
+	err := testCopier().runPostInstallHook(hook, mountDir, filepath.Join(mountDir, "package"), "package.zip")
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestRunPostInstallHook_Failure(t *testing.T) {
+	mountDir := t.TempDir()
+	script := writeHookScript(t, t.TempDir(), "hook.sh", "echo 'missing dependency' >&2\nexit 3")
+
+	hook := &configuration.HookConfig{Script: script}
+	err := testCopier().runPostInstallHook(hook, mountDir, mountDir, "package.zip")
+	if err == nil || !strings.Contains(err.Error(), "output: missing dependency") {
+		t.Fatalf("expected error with the hook output, got %v", err)
+	}
+}
+
+func TestRunPostInstallHook_Timeout(t *testing.T) {
+	mountDir := t.TempDir()
+	script := writeHookScript(t, t.TempDir(), "hook.sh", "sleep 5")
+
+	hook := &configuration.HookConfig{Script: script, TimeoutSeconds: 1}
+	err := testCopier().runPostInstallHook(hook, mountDir, mountDir, "package.zip")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
+func TestRunPostInstallHook_Cancelled(t *testing.T) {
+	mountDir := t.TempDir()
+	script := writeHookScript(t, t.TempDir(), "hook.sh", "sleep 5")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	copier := testCopier()
+	copier.ctx = ctx
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := copier.runPostInstallHook(&configuration.HookConfig{Script: script}, mountDir, mountDir, "package.zip")
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Fatalf("expected hook to be killed on cancellation")
+	}
+}
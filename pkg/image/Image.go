@@ -1,30 +1,43 @@
 package image
 
 import (
+	"context"
 	"fmt"
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/partition/gpt"
-	"log"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 )
 
 type imageCreator struct {
+	ctx        context.Context
 	targetDisk *disk.Disk
 	sourceDisk *disk.Disk
+	logger     *slog.Logger
+	// guidSeed is set in reproducible mode, the GUIDs of the target partition table are derived from it
+	guidSeed string
 }
 
-// CloneImage creates new image and clones source image to it
-func CloneImage(source, target string) error {
-	log.Printf("Cloning image from %s to %s", source, target)
+// CloneImage creates new image and clones source image to it.
+// In reproducible mode, the GUIDs of the partition table are derived from the source table and the target file name instead of being random.
+// Cloning stops when the context is cancelled, the partially written target image is left to the caller.
+func CloneImage(ctx context.Context, source, target string, reproducible bool, logger *slog.Logger) error {
+	logger.Info("Cloning image", "source", source, "target", target)
 
-	imageCreator := new(imageCreator)
+	imageCreator := &imageCreator{ctx: ctx, logger: logger}
 	err := error(nil)
 	imageCreator.sourceDisk, err = diskfs.Open(source)
 	if err != nil {
 		return err
 	}
 	defer imageCreator.sourceDisk.Close()
+	if reproducible {
+		imageCreator.guidSeed = filepath.Base(target)
+	}
 
 	sourceImageSize := imageCreator.sourceDisk.Size
 	blockSize := imageCreator.sourceDisk.PhysicalBlocksize
@@ -48,6 +61,39 @@ func CloneImage(source, target string) error {
 	return nil
 }
 
+// RegenerateGUIDs gives the GPT partition table of a copied image and its partitions new GUIDs, so byte copies of one image
+// don't share them. In reproducible mode the GUIDs are derived from the copied GUIDs and the image file name instead of being random.
+func RegenerateGUIDs(imagePath string, reproducible bool) error {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		return err
+	}
+	defer imageDisk.Close()
+	partitionTable, err := imageDisk.GetPartitionTable()
+	if err != nil {
+		return err
+	}
+	table, ok := partitionTable.(*gpt.Table)
+	if !ok {
+		return fmt.Errorf("image partition table is not GPT. Only GPT is supported")
+	}
+	newGUID := func(string) string { return uuid.NewString() }
+	if reproducible {
+		seed, sourceGUID := filepath.Base(imagePath), table.GUID
+		newGUID = func(name string) string { return reproducibleGUID(sourceGUID, seed, name) }
+	}
+	for index, partition := range table.Partitions {
+		partition.GUID = newGUID(fmt.Sprintf("partition-%d", index+1))
+	}
+	table.GUID = newGUID("disk")
+
+	err = imageDisk.Partition(table)
+	if err != nil {
+		return fmt.Errorf("unable to write partition table: %v", err)
+	}
+	return nil
+}
+
 // copyPartitionTable copies partition table from source disk to target disk
 // Only GPT partition table is supported. Always sets protective MBR to true
 func (imageCreator imageCreator) copyPartitionTable() error {
@@ -59,7 +105,11 @@ func (imageCreator imageCreator) copyPartitionTable() error {
 	if sourcePartitionTable.Type() != "gpt" {
 		return fmt.Errorf("source disk partition table is not GPT. Only GPT is supported")
 	}
-	for _, p := range sourcePartitionTable.GetPartitions() {
+	sourceGPTTable, ok := sourcePartitionTable.(*gpt.Table)
+	if !ok {
+		return fmt.Errorf("failed to assert partition table type to gpt.Table")
+	}
+	for index, p := range sourcePartitionTable.GetPartitions() {
 		gptPartition, ok := p.(*gpt.Partition)
 		if !ok {
 			return fmt.Errorf("failed to assert partition type to gpt.Partition")
@@ -72,6 +122,9 @@ func (imageCreator imageCreator) copyPartitionTable() error {
 			Name:       gptPartition.Name,
 			Attributes: gptPartition.Attributes,
 		}
+		if imageCreator.guidSeed != "" {
+			newPartition.GUID = reproducibleGUID(sourceGPTTable.GUID, imageCreator.guidSeed, fmt.Sprintf("partition-%d", index+1))
+		}
 		partitions = append(partitions, newPartition)
 	}
 
@@ -81,6 +134,9 @@ func (imageCreator imageCreator) copyPartitionTable() error {
 		PhysicalSectorSize: int(imageCreator.sourceDisk.PhysicalBlocksize),
 		Partitions:         partitions,
 	}
+	if imageCreator.guidSeed != "" {
+		table.GUID = reproducibleGUID(sourceGPTTable.GUID, imageCreator.guidSeed, "disk")
+	}
 
 	err = imageCreator.targetDisk.Partition(table)
 	if err != nil {
@@ -104,15 +160,18 @@ func (imageCreator imageCreator) copyPartitionData() error {
 	}
 	defer os.RemoveAll(tmpDirPath)
 	for index, p := range sourcePartitionTable.GetPartitions() {
-		log.Printf("Writing to partition  %d: %s", index+1, p.UUID())
+		if err := imageCreator.ctx.Err(); err != nil {
+			return err
+		}
+		imageCreator.logger.Info("Cloning partition", "partition", index+1, "uuid", p.UUID())
 
 		tmpFile, err := os.CreateTemp(tmpDirPath, "partition_data_*.tmp")
 		if err != nil {
 			return err
 		}
 
-		bytesRead, err := imageCreator.sourceDisk.ReadPartitionContents(index+1, tmpFile)
-		println("bytes read: ", bytesRead)
+		bytesRead, err := imageCreator.sourceDisk.ReadPartitionContents(index+1, &contextWriter{ctx: imageCreator.ctx, writer: tmpFile})
+		imageCreator.logger.Debug("Partition data read", "partition", index+1, "bytes", bytesRead)
 		if err != nil || bytesRead == 0 {
 			return err
 		}
@@ -123,8 +182,8 @@ func (imageCreator imageCreator) copyPartitionData() error {
 		if err != nil {
 			return err
 		}
-		written, err := imageCreator.targetDisk.WritePartitionContents(index+1, reader)
-		println("written bytes: ", written)
+		written, err := imageCreator.targetDisk.WritePartitionContents(index+1, &contextReader{ctx: imageCreator.ctx, reader: reader})
+		imageCreator.logger.Debug("Partition data written", "partition", index+1, "bytes", written)
 		if err != nil {
 			reader.Close()
 			return err
@@ -135,3 +194,16 @@ func (imageCreator imageCreator) copyPartitionData() error {
 	}
 	return nil
 }
+
+// contextWriter is a writer which stops writing when the context is cancelled.
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.writer.Write(p)
+}
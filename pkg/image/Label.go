@@ -0,0 +1,78 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/selinux"
+
+	"golang.org/x/sys/unix"
+)
+
+// labelPlacedFiles sets the SELinux labels of the files placed to the partition mounted to the mount directory
+// according to the SELinux mode of the configuration. The labels are looked up in the file contexts of the image.
+func (copier *partitionCopier) labelPlacedFiles(mountDir string, snapshot entrySnapshot) error {
+	if !copier.labelsFiles() {
+		return nil
+	}
+	mode := copier.config.SELinux
+	copier.partitionReport.SetStep("selinux-label")
+	fileContexts, err := selinux.LoadFileContexts(mountDir)
+	if err != nil {
+		return fmt.Errorf("failed to load SELinux file contexts: %v", err)
+	}
+	if fileContexts == nil {
+		if mode == configuration.SELinuxRequired {
+			return fmt.Errorf("partition has no SELinux policy, but SELinux labels are required")
+		}
+		copier.logger.Info("Partition has no SELinux policy, placed files are not labeled")
+		return nil
+	}
+	if fileContexts.Skipped > 0 {
+		copier.logger.Warn("File contexts with unsupported regular expressions skipped", "entries", fileContexts.Skipped)
+	}
+	labeled, err := labelChangedEntries(copier.ctx, mountDir, snapshot, fileContexts)
+	if err != nil {
+		return err
+	}
+	copier.logger.Info("SELinux labels set", "entries", labeled)
+	return nil
+}
+
+// labelsFiles tells whether the SELinux mode of the configuration requires labeling of the placed files.
+func (copier *partitionCopier) labelsFiles() bool {
+	return copier.config.SELinux != "" && copier.config.SELinux != configuration.SELinuxOff
+}
+
+// labelChangedEntries sets the SELinux label to all entries created or changed since the snapshot was taken which have no label yet.
+// Labels set before, e.g. by the permission rules or present in the image, are kept. Entries without a matching file context are skipped.
+// It returns the number of labeled entries.
+func labelChangedEntries(ctx context.Context, mountDir string, snapshot entrySnapshot, fileContexts *selinux.FileContexts) (int, error) {
+	labeled := 0
+	err := walkChangedEntries(ctx, mountDir, snapshot, func(filePath string, info fs.FileInfo) error {
+		_, err := unix.Lgetxattr(filePath, selinux.LabelXattr, nil)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, unix.ENODATA) {
+			return fmt.Errorf("unable to read SELinux label of %s: %v", filePath, err)
+		}
+		context, found := fileContexts.Lookup(pathInImage(mountDir, filePath), info.Mode())
+		if !found {
+			return nil
+		}
+		// The label is stored null-terminated, as by setfiles
+		err = unix.Lsetxattr(filePath, selinux.LabelXattr, append([]byte(context), 0), 0)
+		if err != nil {
+			return fmt.Errorf("unable to set SELinux label of %s: %v", filePath, err)
+		}
+		labeled++
+		return nil
+	})
+	if err != nil {
+		return labeled, fmt.Errorf("failed to set SELinux labels: %w", err)
+	}
+	return labeled, nil
+}
@@ -0,0 +1,80 @@
+package image
+
+import (
+	"context"
+	"os"
+	"package-to-image-placer/pkg/selinux"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLabelChangedEntries_KeepsExistingLabels(t *testing.T) {
+	mountDir := t.TempDir()
+	contextsDir := filepath.Join(mountDir, "etc/selinux/targeted/contexts/files")
+	if err := os.MkdirAll(contextsDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/selinux/config"), []byte("SELINUXTYPE=targeted\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(contextsDir, "file_contexts"), []byte("/.*\tsystem_u:object_r:default_t:s0\n/usr/bin(/.*)?\tsystem_u:object_r:bin_t:s0\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	fileContexts, err := selinux.LoadFileContexts(mountDir)
+	if err != nil || fileContexts == nil {
+		t.Fatalf("expected file contexts, got %v", err)
+	}
+	// The root directory of the image is labeled, it changes by creating the files
+	if err := unix.Lsetxattr(mountDir, selinux.LabelXattr, []byte("system_u:object_r:root_t:s0\x00"), 0); err != nil {
+		t.Skipf("setting SELinux labels is not supported: %v", err)
+	}
+	snapshot, err := snapshotEntries(context.Background(), mountDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	binDir := filepath.Join(mountDir, "usr/bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	newFile := filepath.Join(binDir, "tool")
+	labeledFile := filepath.Join(binDir, "labeled")
+	for _, path := range []string{newFile, labeledFile} {
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := unix.Lsetxattr(labeledFile, selinux.LabelXattr, []byte("system_u:object_r:custom_t:s0\x00"), 0); err != nil {
+		t.Skipf("setting SELinux labels is not supported: %v", err)
+	}
+
+	labeled, err := labelChangedEntries(context.Background(), mountDir, snapshot, fileContexts)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if labeled != 3 {
+		t.Errorf("expected 3 labeled entries, got %d", labeled)
+	}
+	expected := map[string]string{
+		mountDir:                       "system_u:object_r:root_t:s0",
+		filepath.Join(mountDir, "usr"): "system_u:object_r:default_t:s0",
+		binDir:                         "system_u:object_r:bin_t:s0",
+		newFile:                        "system_u:object_r:bin_t:s0",
+		labeledFile:                    "system_u:object_r:custom_t:s0",
+	}
+	for path, label := range expected {
+		value := make([]byte, 256)
+		size, err := unix.Lgetxattr(path, selinux.LabelXattr, value)
+		if err != nil {
+			t.Fatalf("expected label of %s, got %v", path, err)
+		}
+		if string(value[:size]) != label+"\x00" {
+			t.Errorf("expected %s to have label %s, got %s", path, label, value[:size])
+		}
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(mountDir, "etc/selinux/config"), selinux.LabelXattr, nil); err == nil {
+		t.Errorf("expected unchanged file to stay unlabeled")
+	}
+}
@@ -0,0 +1,66 @@
+package image
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/merge"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mergeFile merges the file of the package into the existing regular file at the extract path using the strategy of the merge rule.
+// Templates are rendered before merging. The existing file is rewritten in place, so its owner, mode and extended attributes are kept.
+func (copier *partitionCopier) mergeFile(extractPath string, srcZipFile *zip.File, packageConfig *configuration.PackageConfig, rule *configuration.MergeRule) error {
+	info, err := os.Lstat(extractPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("existing file is not a regular file")
+	}
+	existing, err := os.ReadFile(extractPath)
+	if err != nil {
+		return err
+	}
+	incoming, err := packageFileContent(srcZipFile, packageConfig)
+	if err != nil {
+		return err
+	}
+	merged, err := merge.Merge(rule.Strategy, existing, incoming, mergeOptions(rule, packageConfig))
+	if err != nil {
+		return err
+	}
+	destFile, err := os.OpenFile(extractPath, os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+	_, err = destFile.Write(merged)
+	return err
+}
+
+// packageFileContent returns the content of the file of the package as placed to the image, i.e. templates are rendered.
+func packageFileContent(srcZipFile *zip.File, packageConfig *configuration.PackageConfig) ([]byte, error) {
+	if _, isTemplate := templateTargetName(srcZipFile.Name, packageConfig.TemplatePatterns); isTemplate {
+		reader, err := srcZipFile.Open()
+		if err != nil {
+			return nil, fmt.Errorf("unable to open file %s: %v", srcZipFile.Name, err)
+		}
+		defer reader.Close()
+		return renderTemplateContent(reader, srcZipFile.Name, packageConfig.TemplateVariables)
+	}
+	return readZipFile(srcZipFile)
+}
+
+// mergeOptions returns the options of the merge rule. The block marker defaults to the package name.
+func mergeOptions(rule *configuration.MergeRule, packageConfig *configuration.PackageConfig) merge.Options {
+	options := merge.Options{Marker: rule.Marker, Comment: rule.Comment}
+	if options.Marker == "" {
+		options.Marker = strings.TrimSuffix(filepath.Base(packageConfig.PackagePath), ".zip")
+	}
+	return options
+}
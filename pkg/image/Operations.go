@@ -0,0 +1,231 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/permissions"
+	"package-to-image-placer/pkg/plan"
+	"path/filepath"
+)
+
+// defaultOperationDirectoryMode is the mode of directories created by the mkdir operation without a mode
+const defaultOperationDirectoryMode = 0755
+
+// runOperations runs the operations of the configuration package in order on the partition mounted to the mount directory.
+func (copier *partitionCopier) runOperations(mountDir string, packageConfig *configuration.PackageConfig) error {
+	for _, operation := range packageConfig.Operations {
+		if err := copier.ctx.Err(); err != nil {
+			return err
+		}
+		err := copier.runOperation(mountDir, operation)
+		if err != nil {
+			return fmt.Errorf("%s operation on %s failed: %v", operation.Op, operation.Path, err)
+		}
+	}
+	return nil
+}
+
+// runOperation runs one operation. Deleting a missing path, creating an existing directory and creating an existing
+// symlink with the same target succeed, so the operations can be run on an image again.
+func (copier *partitionCopier) runOperation(mountDir string, operation configuration.Operation) error {
+	path, err := operationPath(mountDir, operation.Path)
+	if err != nil {
+		return err
+	}
+	info, statErr := os.Lstat(path)
+	exists := statErr == nil
+	switch operation.Op {
+	case configuration.OperationDelete:
+		if !exists {
+			copier.logger.Debug("Path to delete does not exist", "path", operation.Path)
+			return nil
+		}
+		if info.IsDir() && !operation.Recursive && !isDirectoryEmpty(path) {
+			return fmt.Errorf("directory is not empty, set recursive to delete it")
+		}
+		if err := copier.deletePath(mountDir, path); err != nil {
+			return err
+		}
+	case configuration.OperationMove:
+		target, err := operationPath(mountDir, operation.Target)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("target %s already exists", operation.Target)
+		}
+		if !exists {
+			return fmt.Errorf("path does not exist")
+		}
+		if err := os.MkdirAll(filepath.Dir(target), defaultOperationDirectoryMode); err != nil {
+			return fmt.Errorf("unable to create directory of %s: %v", operation.Target, err)
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+	case configuration.OperationSymlink:
+		extraction := copier.config.Extraction.WithDefaults()
+		if err := checkSymlinkTarget(path, operation.Target, mountDir, mountDir, extraction.SymlinkPolicy); err != nil {
+			return err
+		}
+		if exists {
+			if linkTarget, err := os.Readlink(path); err == nil && linkTarget == operation.Target {
+				return nil
+			}
+			return fmt.Errorf("path already exists")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), defaultOperationDirectoryMode); err != nil {
+			return fmt.Errorf("unable to create directory of %s: %v", operation.Path, err)
+		}
+		if err := os.Symlink(operation.Target, path); err != nil {
+			return err
+		}
+	case configuration.OperationMkdir:
+		if exists {
+			if !info.IsDir() {
+				return fmt.Errorf("path exists and is not a directory")
+			}
+			return nil
+		}
+		mode := os.FileMode(defaultOperationDirectoryMode)
+		if operation.Mode != "" {
+			if mode, err = permissions.ParseMode(operation.Mode); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(path, defaultOperationDirectoryMode); err != nil {
+			return err
+		}
+		// The mode is set explicitly, as MkdirAll applies the umask
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+	copier.logger.Info("Operation done", "op", operation.Op, "path", operation.Path, "target", operation.Target)
+	copier.packageReport.AddOperation(operationDescription(operation))
+	return nil
+}
+
+// deletePath deletes the path, directories recursively. With backups enabled, the path is moved to its backup instead.
+func (copier *partitionCopier) deletePath(mountDir string, path string) error {
+	target, err := copier.prepareBackup(mountDir, path)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("unable to back up %s: %v", pathInImage(mountDir, path), err)
+		}
+		copier.recordBackup(mountDir, path, target)
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// operationPath returns the path in the mount directory the operation path refers to. Symlinks on the way are resolved
+// within the partition, the last component is not followed. The path must stay within the partition and must not be its root.
+func operationPath(mountDir string, path string) (string, error) {
+	fullPath := filepath.Join(mountDir, path)
+	parentDir, err := resolveInImage(mountDir, filepath.Dir(fullPath))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(parentDir, filepath.Base(fullPath))
+	if !helper.IsWithinRootDir(mountDir, resolved) || resolved == filepath.Clean(mountDir) {
+		return "", fmt.Errorf("path %s is not within the mounted partition", path)
+	}
+	return resolved, nil
+}
+
+// isDirectoryEmpty checks if the directory has no entries
+func isDirectoryEmpty(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 0
+}
+
+// operationDescription describes the operation for the report and the plan, e.g. "move /etc/a -> /etc/b"
+func operationDescription(operation configuration.Operation) string {
+	if operation.Target == "" {
+		return operation.Op + " " + operation.Path
+	}
+	return operation.Op + " " + operation.Path + " -> " + operation.Target
+}
+
+// pathSet is a set of paths in the mount directory
+type pathSet map[string]bool
+
+// containsOrUnder checks if the path or any of its parent directories is in the set
+func (paths pathSet) containsOrUnder(path string) bool {
+	for ; ; path = filepath.Dir(path) {
+		if paths[path] {
+			return true
+		}
+		if path == filepath.Dir(path) {
+			return false
+		}
+	}
+}
+
+// planOperations adds the operations of the configuration package to the plan and checks them against the image without modifying it.
+// Problems which would make the operations fail are added as conflicts. It returns the paths deleted or moved away by the operations.
+func (copier *partitionCopier) planOperations(mountDir string, packageConfig *configuration.PackageConfig, packagePlan *plan.PackagePlan) pathSet {
+	removed := pathSet{}
+	created := pathSet{}
+	exists := func(path string) bool {
+		if created.containsOrUnder(path) {
+			return true
+		}
+		_, err := os.Lstat(path)
+		return err == nil && !removed.containsOrUnder(path)
+	}
+	for _, operation := range packageConfig.Operations {
+		packagePlan.Operations = append(packagePlan.Operations, operationDescription(operation))
+		path, err := operationPath(mountDir, operation.Path)
+		if err != nil {
+			packagePlan.AddConflict("%s operation on %s: %v", operation.Op, operation.Path, err)
+			continue
+		}
+		switch operation.Op {
+		case configuration.OperationDelete:
+			if info, err := os.Lstat(path); err == nil && info.IsDir() && !operation.Recursive && !isDirectoryEmpty(path) {
+				packagePlan.AddConflict("delete operation on %s: directory is not empty, set recursive to delete it", operation.Path)
+			}
+			removed[path] = true
+			delete(created, path)
+		case configuration.OperationMove:
+			target, err := operationPath(mountDir, operation.Target)
+			if err != nil {
+				packagePlan.AddConflict("move operation on %s: %v", operation.Path, err)
+				continue
+			}
+			if !exists(path) {
+				packagePlan.AddConflict("move operation on %s: path does not exist", operation.Path)
+			}
+			if exists(target) {
+				packagePlan.AddConflict("move operation on %s: target %s already exists", operation.Path, operation.Target)
+			}
+			removed[path] = true
+			delete(created, path)
+			created[target] = true
+		case configuration.OperationSymlink:
+			extraction := copier.config.Extraction.WithDefaults()
+			if err := checkSymlinkTarget(path, operation.Target, mountDir, mountDir, extraction.SymlinkPolicy); err != nil {
+				packagePlan.AddConflict("symlink operation on %s: %v", operation.Path, err)
+			}
+			if linkTarget, err := os.Readlink(path); exists(path) && (err != nil || linkTarget != operation.Target) {
+				packagePlan.AddConflict("symlink operation on %s: path already exists", operation.Path)
+			}
+			created[path] = true
+		case configuration.OperationMkdir:
+			if info, err := os.Lstat(path); err == nil && !removed.containsOrUnder(path) && !info.IsDir() {
+				packagePlan.AddConflict("mkdir operation on %s: path exists and is not a directory", operation.Path)
+			}
+			created[path] = true
+		}
+	}
+	return removed
+}
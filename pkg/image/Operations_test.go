@@ -0,0 +1,122 @@
+package image
+
+import (
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/plan"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// createOperationsImage creates a mount directory with a stock nginx site, an SSH host key and a sample config
+func createOperationsImage(t *testing.T) string {
+	mountDir := t.TempDir()
+	for _, dir := range []string{"etc/nginx/sites-enabled", "etc/ssh", "etc/app"} {
+		if err := os.MkdirAll(filepath.Join(mountDir, dir), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	for _, name := range []string{"etc/nginx/sites-enabled/default", "etc/ssh/ssh_host_ed25519_key", "etc/app/app.conf.sample"} {
+		if err := os.WriteFile(filepath.Join(mountDir, name), []byte("stock\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return mountDir
+}
+
+func TestRunOperations_AllOperations(t *testing.T) {
+	mountDir := createOperationsImage(t)
+	packageConfig := configuration.PackageConfig{Operations: []configuration.Operation{
+		{Op: "delete", Path: "/etc/nginx/sites-enabled/default"},
+		{Op: "delete", Path: "/etc/ssh/ssh_host_ed25519_key"},
+		{Op: "delete", Path: "/etc/missing"},
+		{Op: "move", Path: "/etc/app/app.conf.sample", Target: "/usr/share/app/app.conf.sample"},
+		{Op: "mkdir", Path: "/var/lib/app/data", Mode: "0750"},
+		{Op: "symlink", Path: "/etc/nginx/sites-enabled/app", Target: "../sites-available/app"},
+	}}
+
+	copier := testCopier()
+	if err := copier.runOperations(mountDir, &packageConfig); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, name := range []string{"etc/nginx/sites-enabled/default", "etc/ssh/ssh_host_ed25519_key", "etc/app/app.conf.sample"} {
+		if _, err := os.Lstat(filepath.Join(mountDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "usr/share/app/app.conf.sample")); err != nil {
+		t.Errorf("expected moved file, got %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(mountDir, "var/lib/app/data")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("expected directory with mode 0750, got %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(mountDir, "etc/nginx/sites-enabled/app")); err != nil || target != "../sites-available/app" {
+		t.Errorf("expected symlink to ../sites-available/app, got %s (%v)", target, err)
+	}
+
+	// Running the operations again fails only on the move, whose path is gone
+	packageConfig.Operations = slices.Delete(packageConfig.Operations, 3, 4)
+	if err := copier.runOperations(mountDir, &packageConfig); err != nil {
+		t.Fatalf("expected the operations to be repeatable, got %v", err)
+	}
+}
+
+func TestRunOperations_Containment(t *testing.T) {
+	mountDir := createOperationsImage(t)
+	outsideDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outsideDir, "host-file"), []byte("host\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	// An absolute symlink in the image is resolved within the image, not on the host
+	if err := os.Symlink(outsideDir, filepath.Join(mountDir, "escape")); err != nil {
+		t.Fatal(err.Error())
+	}
+	tests := []configuration.Operation{
+		{Op: "delete", Path: "/escape/host-file"},
+		{Op: "delete", Path: "/etc/.."},
+		{Op: "delete", Path: "/etc/nginx"},
+		{Op: "move", Path: "/etc/ssh/ssh_host_ed25519_key", Target: "/etc/app"},
+	}
+	copier := testCopier()
+	for _, operation := range tests {
+		packageConfig := configuration.PackageConfig{Operations: []configuration.Operation{operation}}
+		err := copier.runOperations(mountDir, &packageConfig)
+		if operation.Path == "/escape/host-file" {
+			// The path doesn't exist in the image, so there is nothing to delete
+			if err != nil {
+				t.Errorf("expected no error for %v, got %v", operation, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("expected error for %v, got nil", operation)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outsideDir, "host-file")); err != nil {
+		t.Fatalf("expected the host file to be kept, got %v", err)
+	}
+}
+
+func TestPlanOperations_RemovedFilesDontConflict(t *testing.T) {
+	mountDir := createOperationsImage(t)
+	packageConfig := configuration.PackageConfig{Operations: []configuration.Operation{
+		{Op: "move", Path: "/etc/app/app.conf.sample", Target: "/etc/app/app.conf.orig"},
+		{Op: "move", Path: "/etc/missing", Target: "/etc/other"},
+	}}
+	packagePlan := plan.NewPackagePlan("package.zip", true, "/")
+
+	removed := testCopier().planOperations(mountDir, &packageConfig, packagePlan)
+	if !removed.containsOrUnder(filepath.Join(mountDir, "etc/app/app.conf.sample")) {
+		t.Errorf("expected the moved file to be removed")
+	}
+	if len(packagePlan.Operations) != 2 {
+		t.Errorf("expected 2 planned operations, got %v", packagePlan.Operations)
+	}
+	if len(packagePlan.Conflicts) != 1 {
+		t.Fatalf("expected one conflict for the missing path, got %v", packagePlan.Conflicts)
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "etc/app/app.conf.sample")); err != nil {
+		t.Fatalf("expected the image not to be modified")
+	}
+}
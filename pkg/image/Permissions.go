@@ -0,0 +1,207 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/permissions"
+	"path/filepath"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+// entryPermissions are the permissions applied to one extracted file, directory or symlink.
+// The owner and group are -1 if they are not changed, the mode is applied only if hasMode is set.
+type entryPermissions struct {
+	uid          int
+	gid          int
+	mode         os.FileMode
+	hasMode      bool
+	capabilities []byte
+	xattrs       map[string]string
+}
+
+// permissionRule is a permission rule of the configuration with the owner, group, mode and capabilities resolved
+type permissionRule struct {
+	configuration.PermissionRule
+	uid          int
+	gid          int
+	mode         os.FileMode
+	capabilities []byte
+}
+
+// permissionResolver resolves the permissions of the entries of one package. A nil resolver changes no permissions.
+type permissionResolver struct {
+	uid              int
+	gid              int
+	directoryMode    os.FileMode
+	hasDirectoryMode bool
+	rules            []permissionRule
+}
+
+// newPermissionResolver resolves the permissions config of a package. Owners and groups are resolved from the accounts
+// of the image mounted to the mount directory. It returns nil if the package has no permissions config.
+func newPermissionResolver(config *configuration.PermissionsConfig, mountDir string) (*permissionResolver, error) {
+	if config == nil {
+		return nil, nil
+	}
+	accounts, err := permissions.LoadAccounts(mountDir)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &permissionResolver{}
+	resolver.uid, resolver.gid, err = resolveOwner(accounts, config.Owner, config.Group)
+	if err != nil {
+		return nil, err
+	}
+	if config.DirectoryMode != "" {
+		resolver.directoryMode, err = permissions.ParseMode(config.DirectoryMode)
+		if err != nil {
+			return nil, err
+		}
+		resolver.hasDirectoryMode = true
+	}
+	for _, configRule := range config.Rules {
+		rule := permissionRule{PermissionRule: configRule}
+		rule.uid, rule.gid, err = resolveOwner(accounts, configRule.Owner, configRule.Group)
+		if err != nil {
+			return nil, fmt.Errorf("permission rule %s: %w", configRule.Pattern, err)
+		}
+		if configRule.Mode != "" {
+			rule.mode, err = permissions.ParseMode(configRule.Mode)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %s: %w", configRule.Pattern, err)
+			}
+		}
+		if configRule.Capabilities != "" {
+			rule.capabilities, err = permissions.EncodeCapabilities(configRule.Capabilities)
+			if err != nil {
+				return nil, fmt.Errorf("permission rule %s: %w", configRule.Pattern, err)
+			}
+		}
+		resolver.rules = append(resolver.rules, rule)
+	}
+	return resolver, nil
+}
+
+// resolveOwner returns the IDs of the owner and group, -1 for those not set
+func resolveOwner(accounts *permissions.Accounts, owner string, group string) (int, int, error) {
+	uid, gid := -1, -1
+	var err error
+	if owner != "" {
+		uid, err = accounts.UserID(owner)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if group != "" {
+		gid, err = accounts.GroupID(group)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// permissionsOf returns the permissions of the entry with the name in the package: the defaults of the package
+// overridden by all matching rules in their order.
+func (resolver *permissionResolver) permissionsOf(name string, isDir bool) entryPermissions {
+	entry := entryPermissions{uid: resolver.uid, gid: resolver.gid, mode: resolver.directoryMode, hasMode: isDir && resolver.hasDirectoryMode}
+	for _, rule := range resolver.rules {
+		if !matchesPackagePattern(name, rule.Pattern) {
+			continue
+		}
+		if rule.uid >= 0 {
+			entry.uid = rule.uid
+		}
+		if rule.gid >= 0 {
+			entry.gid = rule.gid
+		}
+		if rule.Mode != "" {
+			entry.mode, entry.hasMode = rule.mode, true
+		}
+		if rule.capabilities != nil {
+			entry.capabilities = rule.capabilities
+		}
+		for key, value := range rule.Xattrs {
+			if entry.xattrs == nil {
+				entry.xattrs = map[string]string{}
+			}
+			entry.xattrs[key] = value
+		}
+	}
+	return entry
+}
+
+// apply applies the permissions of the entry with the name in the package to the extracted path.
+// The owner is changed first, because changing it clears the setuid bits and capabilities. Symlinks get only the owner.
+func (resolver *permissionResolver) apply(extractPath string, name string, isDir bool) error {
+	if resolver == nil {
+		return nil
+	}
+	info, err := os.Lstat(extractPath)
+	if err != nil {
+		return err
+	}
+	entry := resolver.permissionsOf(name, isDir)
+	if entry.uid >= 0 || entry.gid >= 0 {
+		if err := os.Lchown(extractPath, entry.uid, entry.gid); err != nil {
+			return fmt.Errorf("unable to change owner of %s: %v", extractPath, err)
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if entry.hasMode {
+		if err := os.Chmod(extractPath, entry.mode); err != nil {
+			return fmt.Errorf("unable to change mode of %s: %v", extractPath, err)
+		}
+	}
+	if entry.capabilities != nil && info.Mode().IsRegular() {
+		if err := unix.Lsetxattr(extractPath, permissions.CapabilityXattr, entry.capabilities, 0); err != nil {
+			return fmt.Errorf("unable to set capabilities of %s: %v", extractPath, err)
+		}
+	}
+	names := make([]string, 0, len(entry.xattrs))
+	for key := range entry.xattrs {
+		names = append(names, key)
+	}
+	slices.Sort(names)
+	for _, key := range names {
+		if err := unix.Lsetxattr(extractPath, key, []byte(entry.xattrs[key]), 0); err != nil {
+			return fmt.Errorf("unable to set extended attribute %s of %s: %v", key, extractPath, err)
+		}
+	}
+	return nil
+}
+
+// makeDirectories creates the directory and all its missing parents within the package directory.
+// The permissions are applied to the created directories only, directories already existing in the image are not changed.
+func (resolver *permissionResolver) makeDirectories(packageDir string, dir string) error {
+	var missing []string
+	for current := dir; helper.IsWithinRootDir(packageDir, current); current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); err == nil {
+			break
+		}
+		missing = append(missing, current)
+		if current == packageDir {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	slices.Reverse(missing)
+	for _, created := range missing {
+		name, err := filepath.Rel(packageDir, created)
+		if err != nil {
+			return err
+		}
+		if err := resolver.apply(created, name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
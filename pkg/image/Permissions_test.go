@@ -0,0 +1,114 @@
+package image
+
+import (
+	"bytes"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/permissions"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// permissionsTestMount creates a mount directory with the accounts of the image and an existing /opt directory
+func permissionsTestMount(t *testing.T) string {
+	mountDir := t.TempDir()
+	for _, dir := range []string{"etc", "opt"} {
+		if err := os.MkdirAll(filepath.Join(mountDir, dir), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/passwd"), []byte("root:x:0:0::/root:/bin/sh\nsvc:x:1001:1001::/:/bin/false\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/group"), []byte("root:x:0:\nsvc:x:1001:\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return mountDir
+}
+
+// assertOwnerAndMode checks the owner, group and mode of the file
+func assertOwnerAndMode(t *testing.T, filePath string, uid uint32, gid uint32, mode os.FileMode) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if stat.Uid != uid || stat.Gid != gid {
+		t.Errorf("expected %s owned by %d:%d, got %d:%d", filePath, uid, gid, stat.Uid, stat.Gid)
+	}
+	if actual := info.Mode() & (os.ModePerm | os.ModeSetuid); actual != mode {
+		t.Errorf("expected %s with mode %s, got %s", filePath, mode, actual)
+	}
+}
+
+func TestDecompressZipArchive_Permissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+	mountDir := permissionsTestMount(t)
+	zipReader := createCraftedZip(t, []craftedEntry{
+		{name: "bin/ping-tool", content: "binary", mode: 0700},
+		{name: "etc/secret.conf", content: "secret", mode: 0644},
+		{name: "share/doc/README", content: "readme", mode: 0644},
+	})
+	packageConfig := configuration.PackageConfig{
+		PackagePath:       "tools.zip",
+		TargetDirectory:   "opt",
+		IsStandardPackage: true,
+		Permissions: &configuration.PermissionsConfig{
+			Owner:         "root",
+			Group:         "root",
+			DirectoryMode: "0750",
+			Rules: []configuration.PermissionRule{
+				{Pattern: "/bin/*", Mode: "0755", Capabilities: "cap_net_raw+ep"},
+				{Pattern: "*.conf", Owner: "svc", Group: "svc", Mode: "0600", Xattrs: map[string]string{"user.origin": "tools"}},
+			},
+		},
+	}
+	packageDir := filepath.Join(mountDir, "opt/tools")
+	if err := os.MkdirAll(packageDir, 0777); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, packageDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	assertOwnerAndMode(t, filepath.Join(packageDir, "bin/ping-tool"), 0, 0, 0755)
+	assertOwnerAndMode(t, filepath.Join(packageDir, "etc/secret.conf"), 1001, 1001, 0600)
+	assertOwnerAndMode(t, filepath.Join(packageDir, "share/doc"), 0, 0, 0750)
+	assertOwnerAndMode(t, packageDir, 0, 0, 0750)
+	assertOwnerAndMode(t, filepath.Join(mountDir, "opt"), 0, 0, 0755)
+
+	expectedCapabilities, _ := permissions.EncodeCapabilities("cap_net_raw+ep")
+	capabilities := make([]byte, 64)
+	size, err := unix.Lgetxattr(filepath.Join(packageDir, "bin/ping-tool"), permissions.CapabilityXattr, capabilities)
+	if err != nil || !bytes.Equal(capabilities[:size], expectedCapabilities) {
+		t.Errorf("expected capabilities %x, got %x (%v)", expectedCapabilities, capabilities[:max(size, 0)], err)
+	}
+	origin := make([]byte, 64)
+	size, err = unix.Lgetxattr(filepath.Join(packageDir, "etc/secret.conf"), "user.origin", origin)
+	if err != nil || string(origin[:size]) != "tools" {
+		t.Errorf("expected extended attribute user.origin=tools, got %s (%v)", origin[:max(size, 0)], err)
+	}
+}
+
+func TestDecompressZipArchive_PermissionsUnknownOwner(t *testing.T) {
+	mountDir := permissionsTestMount(t)
+	zipReader := createCraftedZip(t, []craftedEntry{{name: "app.conf", content: "x", mode: 0644}})
+	packageConfig := configuration.PackageConfig{
+		PackagePath: "config.zip",
+		Permissions: &configuration.PermissionsConfig{Owner: "nobody"},
+	}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err == nil {
+		t.Fatalf("expected error for owner missing in the image, got nil")
+	}
+	if _, err := os.Lstat(filepath.Join(mountDir, "app.conf")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file extracted")
+	}
+}
@@ -0,0 +1,325 @@
+package image
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/merge"
+	"package-to-image-placer/pkg/plan"
+	"package-to-image-placer/pkg/selinux"
+	"package-to-image-placer/pkg/service"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// PlanPackagesToImagePartitions plans copying of the packages to the partitions of the target image without modifying it.
+// The partitions are mounted read-only one after another. Problems which would make the placement fail
+// are reported as conflicts in the plan; an error is returned only if the plan can't be made.
+func (copier *Copier) PlanPackagesToImagePartitions(ctx context.Context) (*plan.Plan, error) {
+	result := &plan.Plan{Image: copier.config.Target, Partitions: []*plan.PartitionPlan{}}
+	for _, partitionNumber := range copier.config.TargetPartitions() {
+		partitionCopier := copier.newPartitionCopier(ctx, partitionNumber, false, nil)
+		partitionPlan, err := partitionCopier.mountPartitionAndPlanPackages()
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", partitionNumber, err)
+		}
+		result.Partitions = append(result.Partitions, partitionPlan)
+	}
+	return result, nil
+}
+
+// mountPartitionAndPlanPackages mounts the partition read-only and plans copying of all packages to it.
+// The free space of the partition is projected from the uncompressed sizes of the packages.
+func (copier *partitionCopier) mountPartitionAndPlanPackages() (*plan.PartitionPlan, error) {
+	mountDir, unmount, err := copier.mount(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+
+	freeSpace, err := getFreeSpace(mountDir)
+	if err != nil {
+		return nil, err
+	}
+	// A squashfs is repacked, so the space it can grow to is free
+	limited := true
+	if copier.config.Volume(copier.partitionNumber) == nil {
+		squashfs, err := readSquashfsPartition(copier.config.Target, copier.partitionNumber)
+		if err != nil {
+			return nil, err
+		}
+		if squashfs != nil {
+			if freeSpace, limited, err = squashfsFreeSpace(copier.config.Target, copier.partitionNumber, squashfs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	partitionPlan := &plan.PartitionPlan{Number: copier.partitionNumber, FreeBytes: freeSpace, Packages: []*plan.PackagePlan{}, Conflicts: []string{}}
+
+	packageConfigs := copier.packageConfigs()
+	for i := range packageConfigs {
+		if err := copier.ctx.Err(); err != nil {
+			return nil, err
+		}
+		packagePlan, packageSize, err := copier.planPackage(mountDir, &packageConfigs[i])
+		if err != nil {
+			return nil, err
+		}
+		partitionPlan.Packages = append(partitionPlan.Packages, packagePlan)
+		partitionPlan.RequiredBytes += packageSize
+	}
+
+	if copier.config.SELinux == configuration.SELinuxRequired {
+		fileContexts, err := selinux.LoadFileContexts(mountDir)
+		if err != nil {
+			partitionPlan.Conflicts = append(partitionPlan.Conflicts, fmt.Sprintf("failed to load SELinux file contexts: %v", err))
+		} else if fileContexts == nil {
+			partitionPlan.Conflicts = append(partitionPlan.Conflicts, "partition has no SELinux policy, but SELinux labels are required")
+		}
+	}
+	partitionPlan.RemainingBytes = int64(partitionPlan.FreeBytes) - int64(partitionPlan.RequiredBytes)
+	if partitionPlan.RemainingBytes < 0 && limited {
+		partitionPlan.Conflicts = append(partitionPlan.Conflicts, fmt.Sprintf("not enough space to copy packages. Free space on partition: %dMB, packages size: %dMB", partitionPlan.FreeBytes/1024/1024, partitionPlan.RequiredBytes/1024/1024))
+	}
+	return partitionPlan, nil
+}
+
+// planPackage plans copying of the package to the mounted partition. Returns the plan and the uncompressed size of the package.
+func (copier *partitionCopier) planPackage(mountDir string, packageConfig *configuration.PackageConfig) (*plan.PackagePlan, uint64, error) {
+	copier.logger.Info("Planning package", "package", packageConfig.PackagePath)
+	packageFile, err := os.Open(packageConfig.PackagePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open zip file: %v", err)
+	}
+	defer packageFile.Close()
+	zipReader, err := newZipReader(packageFile)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targetDir := filepath.Join(mountDir, packageConfig.TargetDirectory)
+	packageDir := helper.GetTargetArchiveDirName(targetDir, packageConfig.PackagePath, packageConfig.IsStandardPackage)
+	packagePlan := plan.NewPackagePlan(packageConfig.PackagePath, !packageConfig.IsStandardPackage, pathInImage(mountDir, packageDir))
+	if err := copier.verifyPackageIntegrity(packageConfig, packageFile); err != nil {
+		packagePlan.AddConflict("%v", err)
+	}
+	if !helper.IsWithinRootDir(mountDir, targetDir) {
+		packagePlan.AddConflict("target directory is not within the mounted partition")
+		return packagePlan, getArchiveSize(zipReader), nil
+	}
+	if _, err := newPermissionResolver(packageConfig.Permissions, mountDir); err != nil {
+		packagePlan.AddConflict("%v", err)
+	}
+	extraction := copier.config.Extraction.WithDefaults()
+	if err := validateArchive(zipReader, extraction); err != nil {
+		packagePlan.AddConflict("%v", err)
+		return packagePlan, getArchiveSize(zipReader), nil
+	}
+	if err := findAllFilesInZip(zipReader, packageConfig.OverwriteFiles, packageConfig.TemplatePatterns); err != nil {
+		packagePlan.AddConflict("%v", err)
+	}
+
+	removedByOperations := copier.planOperations(mountDir, packageConfig, packagePlan)
+
+	plannedDirectories := map[string]bool{}
+	planDirectory := func(dir string) {
+		var missing []string
+		for ; helper.IsWithinRootDir(mountDir, dir) && dir != filepath.Clean(mountDir); dir = filepath.Dir(dir) {
+			if plannedDirectories[dir] || helper.DoesFileExists(dir) {
+				break
+			}
+			plannedDirectories[dir] = true
+			missing = append(missing, pathInImage(mountDir, dir))
+		}
+		slices.Reverse(missing)
+		packagePlan.DirectoriesCreated = append(packagePlan.DirectoriesCreated, missing...)
+	}
+
+	planDirectory(packageDir)
+	serviceFiles := 0
+	hasTemplates := false
+	for _, file := range zipReader.File {
+		name, isTemplate := templateTargetName(file.Name, packageConfig.TemplatePatterns)
+		targetFilePath := filepath.Join(packageDir, name)
+		if !helper.IsWithinRootDir(packageDir, targetFilePath) {
+			packagePlan.AddConflict("invalid file path %s", file.Name)
+			continue
+		}
+		if file.FileInfo().IsDir() {
+			planDirectory(targetFilePath)
+			continue
+		}
+		planDirectory(filepath.Dir(targetFilePath))
+		hasTemplates = hasTemplates || isTemplate
+
+		if _, err := os.Lstat(targetFilePath); err == nil && !removedByOperations.containsOrUnder(targetFilePath) {
+			destFilePathInPackage := helper.RemoveMountDirAndPackageName(targetFilePath, mountDir, packageConfig.TargetDirectory, packageConfig.PackagePath)
+			if rule := packageConfig.MergeRuleFor(destFilePathInPackage); rule != nil && file.Mode().IsRegular() {
+				packagePlan.FilesMerged = append(packagePlan.FilesMerged, pathInImage(mountDir, targetFilePath))
+				copier.planBackup(mountDir, targetFilePath, packagePlan)
+				if err := planMerge(targetFilePath, file, packageConfig, rule, isTemplate); err != nil {
+					packagePlan.AddConflict("failed to merge file %s: %v", destFilePathInPackage, err)
+				}
+				continue
+			}
+			switch packageConfig.OverwriteActionFor(destFilePathInPackage) {
+			case configuration.OverwriteReplace:
+				packagePlan.FilesOverwritten = append(packagePlan.FilesOverwritten, pathInImage(mountDir, targetFilePath))
+				copier.planBackup(mountDir, targetFilePath, packagePlan)
+			case configuration.OverwriteSkip:
+				packagePlan.FilesSkipped = append(packagePlan.FilesSkipped, pathInImage(mountDir, targetFilePath))
+				continue
+			default:
+				packagePlan.AddConflict("file %s already exists and is not marked for overwrite", destFilePathInPackage)
+			}
+		} else {
+			packagePlan.FilesCreated = append(packagePlan.FilesCreated, pathInImage(mountDir, targetFilePath))
+		}
+
+		if file.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := readZipFile(file)
+			if err != nil {
+				return nil, 0, err
+			}
+			packagePlan.Symlinks = append(packagePlan.Symlinks, plan.Symlink{Path: pathInImage(mountDir, targetFilePath), Target: string(linkTarget)})
+			if err := checkSymlinkTarget(targetFilePath, string(linkTarget), packageDir, mountDir, extraction.SymlinkPolicy); err != nil {
+				packagePlan.AddConflict("%v", err)
+			}
+		}
+		if strings.HasSuffix(name, ".service") {
+			serviceFiles++
+		}
+	}
+
+	if hook := packageConfig.PostInstallHook; hook != nil {
+		packagePlan.PostInstallHook = hook.Script
+		if hook.Script == "" {
+			packagePlan.PostInstallHook = "package:" + hook.PackageScript
+		}
+	}
+
+	planServices := packageConfig.IsStandardPackage && packageConfig.EnableServices
+	if planServices && serviceFiles == 0 {
+		packagePlan.AddConflict("package has no service file, but services are enabled")
+	}
+	if planServices {
+		if err := service.CheckSystemdRootfs(mountDir); err != nil {
+			packagePlan.AddConflict("%v", err)
+		}
+	}
+	if packageConfig.IsStandardPackage && serviceFiles > 1 {
+		packagePlan.AddConflict("multiple service files found in the package archive")
+	}
+	if hasTemplates || (planServices && serviceFiles == 1) {
+		err = copier.planStagedPackage(zipReader, mountDir, packageConfig, packagePlan, planServices && serviceFiles == 1)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return packagePlan, getArchiveSize(zipReader), nil
+}
+
+// planStagedPackage extracts the package to a staging directory on the host laid out as the image.
+// Templates are rendered, so errors in them are reported as conflicts, and the service activation is planned with paths rewritten as in the image.
+func (copier *partitionCopier) planStagedPackage(zipReader *zip.Reader, mountDir string, packageConfig *configuration.PackageConfig, packagePlan *plan.PackagePlan, planService bool) error {
+	stagingDir, err := os.MkdirTemp("", "plan-staging-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	stagingTargetDir := filepath.Join(stagingDir, packageConfig.TargetDirectory)
+	stagingPackageDir := helper.GetTargetArchiveDirName(stagingTargetDir, packageConfig.PackagePath, packageConfig.IsStandardPackage)
+	err = os.MkdirAll(stagingPackageDir, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	stagingConfig := *packageConfig
+	stagingConfig.OverwriteFiles = nil
+	stagingConfig.OverwritePolicy = ""
+	// The owners can't be resolved in the staging directory, they are checked against the image
+	stagingConfig.Permissions = nil
+	serviceFile, err := copier.decompressZipArchiveAndReturnService(zipReader, stagingPackageDir, stagingDir, &stagingConfig)
+	if err != nil {
+		packagePlan.AddConflict("%v", err)
+		return nil
+	}
+	if !planService || serviceFile == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(packageConfig.ServiceNameSuffix, "-") {
+		packagePlan.AddConflict("service name suffix should not start with a hyphen")
+	}
+	servicePlan, err := service.PlanService(serviceFile, stagingDir, stagingTargetDir, mountDir, packageConfig, copier.logger)
+	if err != nil {
+		packagePlan.AddConflict("%v", err)
+	}
+	if servicePlan.UnitName != "" {
+		packagePlan.Services = append(packagePlan.Services, plan.Service{
+			UnitName:          servicePlan.UnitName,
+			UnitPath:          servicePlan.UnitPath,
+			EnablementSymlink: servicePlan.SymlinkPath,
+			ExecStart:         servicePlan.ExecStart,
+			WorkingDirectory:  servicePlan.WorkingDirectory,
+		})
+	}
+	return nil
+}
+
+// planBackup adds the backup of the existing file to the plan, unless backups are disabled or the backup already exists.
+func (copier *partitionCopier) planBackup(mountDir string, existingPath string, packagePlan *plan.PackagePlan) {
+	target, err := backupPath(mountDir, existingPath, copier.config.Backup)
+	if err != nil {
+		packagePlan.AddConflict("%v", err)
+		return
+	}
+	if target == "" {
+		return
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return
+	}
+	packagePlan.Backups = append(packagePlan.Backups, plan.Backup{Path: pathInImage(mountDir, existingPath), BackupPath: pathInImage(mountDir, target)})
+}
+
+// planMerge checks that the file of the package can be merged into the existing file without modifying it.
+// Templates are rendered only in the staging directory, so merging them is not checked.
+func planMerge(existingPath string, file *zip.File, packageConfig *configuration.PackageConfig, rule *configuration.MergeRule, isTemplate bool) error {
+	info, err := os.Lstat(existingPath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("existing file is not a regular file")
+	}
+	if isTemplate {
+		return nil
+	}
+	existing, err := os.ReadFile(existingPath)
+	if err != nil {
+		return err
+	}
+	incoming, err := readZipFile(file)
+	if err != nil {
+		return err
+	}
+	_, err = merge.Merge(rule.Strategy, existing, incoming, mergeOptions(rule, packageConfig))
+	return err
+}
+
+// readZipFile reads the whole content of the file in the zip archive.
+func readZipFile(file *zip.File) ([]byte, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file %s: %v", file.Name, err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,147 @@
+package image
+
+import (
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanPackage_ConfigurationPackage(t *testing.T) {
+	packagePath := createTestZipFile(t, map[string]string{
+		"etc/app.conf":      "new\n",
+		"etc/other.conf":    "new\n",
+		"opt/new/file.conf": "new\n",
+	})
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"etc/app.conf", "etc/other.conf"} {
+		if err := os.WriteFile(filepath.Join(mountDir, name), []byte("old\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	packageConfig := configuration.PackageConfig{PackagePath: packagePath, OverwriteFiles: []string{"/etc/app.conf"}}
+
+	packagePlan, size, err := testCopier().planPackage(mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != 12 {
+		t.Fatalf("expected package size 12, got %d", size)
+	}
+	if !slices.Equal(packagePlan.FilesOverwritten, []string{"/etc/app.conf"}) {
+		t.Fatalf("expected /etc/app.conf planned as overwritten, got %v", packagePlan.FilesOverwritten)
+	}
+	if !slices.Equal(packagePlan.FilesCreated, []string{"/opt/new/file.conf"}) {
+		t.Fatalf("expected /opt/new/file.conf planned as created, got %v", packagePlan.FilesCreated)
+	}
+	if !slices.Equal(packagePlan.DirectoriesCreated, []string{"/opt", "/opt/new"}) {
+		t.Fatalf("expected /opt and /opt/new planned as created, got %v", packagePlan.DirectoriesCreated)
+	}
+	if len(packagePlan.Conflicts) != 1 {
+		t.Fatalf("expected one conflict for /etc/other.conf, got %v", packagePlan.Conflicts)
+	}
+	if _, err := os.Stat(filepath.Join(mountDir, "opt")); !os.IsNotExist(err) {
+		t.Fatalf("expected the mount directory not to be modified")
+	}
+}
+
+func TestPlanPackage_Service(t *testing.T) {
+	packagePath, _ := filepath.Abs("../../testdata/archives/example_with_service.zip")
+	mountDir := t.TempDir()
+	wantsDir := filepath.Join(mountDir, "etc/systemd/system/multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfig := configuration.PackageConfig{
+		PackagePath:       packagePath,
+		IsStandardPackage: true,
+		EnableServices:    true,
+		ServiceNameSuffix: "test",
+		TargetDirectory:   "/opt",
+	}
+
+	packagePlan, _, err := testCopier().planPackage(mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(packagePlan.Conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %v", packagePlan.Conflicts)
+	}
+	if len(packagePlan.Services) != 1 {
+		t.Fatalf("expected one service, got %v", packagePlan.Services)
+	}
+	service := packagePlan.Services[0]
+	if service.UnitPath != "/etc/systemd/system/valid-test.service" {
+		t.Fatalf("expected unit path /etc/systemd/system/valid-test.service, got %s", service.UnitPath)
+	}
+	if service.EnablementSymlink != "/etc/systemd/system/multi-user.target.wants/valid-test.service" {
+		t.Fatalf("unexpected enablement symlink %s", service.EnablementSymlink)
+	}
+	expectedExecStart := "/opt/example_with_service/example/a/b/c/file --argument=/opt/example_with_service/example/original-path/argument"
+	if service.ExecStart != expectedExecStart {
+		t.Fatalf("expected ExecStart %s, got %s", expectedExecStart, service.ExecStart)
+	}
+	if service.WorkingDirectory != "/opt/example_with_service/example/" {
+		t.Fatalf("expected WorkingDirectory /opt/example_with_service/example/, got %s", service.WorkingDirectory)
+	}
+	entries, err := os.ReadDir(mountDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected the mount directory not to be modified, got %v", entries)
+	}
+	entries, err = os.ReadDir(wantsDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no service to be enabled, got %v", entries)
+	}
+}
+
+func TestPlanPackage_ServiceNotSystemdRootfs(t *testing.T) {
+	packagePath, _ := filepath.Abs("../../testdata/archives/example_with_service.zip")
+	packageConfig := configuration.PackageConfig{PackagePath: packagePath, IsStandardPackage: true, EnableServices: true, TargetDirectory: "/opt"}
+
+	packagePlan, _, err := testCopier().planPackage(t.TempDir(), &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(packagePlan.Conflicts) != 1 || !strings.Contains(packagePlan.Conflicts[0], "systemd root filesystem") {
+		t.Fatalf("expected one conflict for the missing systemd directories, got %v", packagePlan.Conflicts)
+	}
+}
+
+func TestPlanPackage_ServiceExistsInImage(t *testing.T) {
+	packagePath, _ := filepath.Abs("../../testdata/archives/example_with_service.zip")
+	mountDir := t.TempDir()
+	unitDir := filepath.Join(mountDir, "etc/systemd/system")
+	if err := os.MkdirAll(filepath.Join(unitDir, "multi-user.target.wants"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, "valid.service"), []byte("[Service]\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfig := configuration.PackageConfig{PackagePath: packagePath, IsStandardPackage: true, EnableServices: true, TargetDirectory: "/opt"}
+
+	packagePlan, _, err := testCopier().planPackage(mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(packagePlan.Conflicts) != 1 {
+		t.Fatalf("expected one conflict for the existing unit, got %v", packagePlan.Conflicts)
+	}
+}
+
+func TestPlanPackage_ChecksumMismatch(t *testing.T) {
+	packagePath := createTestZipFile(t, map[string]string{"etc/app.conf": "new\n"})
+	packageConfig := configuration.PackageConfig{PackagePath: packagePath, SHA256: strings.Repeat("0", 64)}
+
+	packagePlan, _, err := testCopier().planPackage(t.TempDir(), &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(packagePlan.Conflicts) != 1 || !strings.Contains(packagePlan.Conflicts[0], "SHA256") {
+		t.Fatalf("expected checksum conflict, got %v", packagePlan.Conflicts)
+	}
+}
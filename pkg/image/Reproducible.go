@@ -0,0 +1,106 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+// entryVersion identifies the state of a file, directory or symlink. Every change of an entry, including the change of its metadata,
+// updates its inode change time, which unlike the modification time can't be set, so a changed entry always gets a new version.
+type entryVersion struct {
+	inode      uint64
+	changeTime syscall.Timespec
+}
+
+// entrySnapshot holds the versions of all entries under a root directory by their path.
+type entrySnapshot map[string]entryVersion
+
+// versionOf returns the version of the entry. The second value is false if the filesystem gives no inode information.
+func versionOf(info fs.FileInfo) (entryVersion, bool) {
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return entryVersion{}, false
+	}
+	return entryVersion{inode: stat.Ino, changeTime: stat.Ctim}, true
+}
+
+// snapshotEntries records the versions of all files, directories and symlinks under the root directory, including the root directory.
+// Symlinks are not followed.
+func snapshotEntries(ctx context.Context, rootDir string) (entrySnapshot, error) {
+	snapshot := entrySnapshot{}
+	err := walkEntries(ctx, rootDir, func(filePath string, info fs.FileInfo) error {
+		if version, known := versionOf(info); known {
+			snapshot[filePath] = version
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record files of %s: %w", rootDir, err)
+	}
+	return snapshot, nil
+}
+
+// reproducibleGUID derives a GUID from the GUID of the source partition table, the seed and the name of the GUID.
+// The same inputs always give the same GUID.
+func reproducibleGUID(sourceGUID string, seed string, name string) string {
+	namespace := uuid.NewSHA1(uuid.NameSpaceOID, []byte(sourceGUID+"/"+seed))
+	return uuid.NewSHA1(namespace, []byte(name)).String()
+}
+
+// walkEntries calls the function for all files, directories and symlinks under the root directory, including the root directory.
+// Symlinks are not followed.
+func walkEntries(ctx context.Context, rootDir string, fn func(filePath string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(rootDir, func(filePath string, dirEntry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(filePath, info)
+	})
+}
+
+// walkChangedEntries calls the function for all files, directories and symlinks under the root directory, including the root directory,
+// created or changed since the snapshot was taken. These are the entries written by the placement and the directories they were created in;
+// entries left untouched are skipped whatever their modification time is. Symlinks are not followed.
+func walkChangedEntries(ctx context.Context, rootDir string, snapshot entrySnapshot, fn func(filePath string, info fs.FileInfo) error) error {
+	return walkEntries(ctx, rootDir, func(filePath string, info fs.FileInfo) error {
+		version, known := versionOf(info)
+		if known && snapshot[filePath] == version {
+			return nil
+		}
+		return fn(filePath, info)
+	})
+}
+
+// normalizeTimestamps sets the access and modification time of all files, directories and symlinks under the root directory
+// created or changed since the snapshot was taken to the epoch, including the root directory. Symlinks are not followed.
+// It returns the number of normalized entries.
+func normalizeTimestamps(ctx context.Context, rootDir string, snapshot entrySnapshot, epoch time.Time) (int, error) {
+	timestamp := unix.NsecToTimespec(epoch.UnixNano())
+	normalized := 0
+	err := walkChangedEntries(ctx, rootDir, snapshot, func(filePath string, info fs.FileInfo) error {
+		err := unix.UtimesNanoAt(unix.AT_FDCWD, filePath, []unix.Timespec{timestamp, timestamp}, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return fmt.Errorf("unable to set timestamp of %s: %v", filePath, err)
+		}
+		normalized++
+		return nil
+	})
+	if err != nil {
+		return normalized, fmt.Errorf("failed to normalize timestamps: %w", err)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,82 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReproducibleGUID_Deterministic(t *testing.T) {
+	sourceGUID := "8F4E4B4D-2E0D-4B5C-9C3A-6E1D2F3A4B5C"
+	guid := reproducibleGUID(sourceGUID, "target.img", "partition-1")
+	if guid != reproducibleGUID(sourceGUID, "target.img", "partition-1") {
+		t.Fatalf("expected the same GUID for the same inputs")
+	}
+	if guid == reproducibleGUID(sourceGUID, "target.img", "partition-2") || guid == reproducibleGUID(sourceGUID, "other.img", "partition-1") {
+		t.Fatalf("expected different GUIDs for different inputs")
+	}
+}
+
+func TestNormalizeTimestamps_OnlyChanged(t *testing.T) {
+	rootDir := t.TempDir()
+	oldFile := filepath.Join(rootDir, "old")
+	newFile := filepath.Join(rootDir, "dir/new")
+	newLink := filepath.Join(rootDir, "dir/link")
+	if err := os.WriteFile(oldFile, []byte("old"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	futureFile := filepath.Join(rootDir, "future")
+	if err := os.WriteFile(futureFile, []byte("future"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+		t.Fatal(err.Error())
+	}
+	futureTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(futureFile, futureTime, futureTime); err != nil {
+		t.Fatal(err.Error())
+	}
+	snapshot, err := snapshotEntries(context.Background(), rootDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(newFile), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(newFile, []byte("new"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink("new", newLink); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	epoch := time.Unix(1700000000, 0)
+	normalized, err := normalizeTimestamps(context.Background(), rootDir, snapshot, epoch)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if normalized != 4 {
+		t.Errorf("expected 4 normalized entries, got %d", normalized)
+	}
+	for _, path := range []string{rootDir, filepath.Dir(newFile), newFile, newLink} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !info.ModTime().Equal(epoch) {
+			t.Errorf("expected %s to have modification time %v, got %v", path, epoch, info.ModTime())
+		}
+	}
+	for path, modTime := range map[string]time.Time{oldFile: oldTime, futureFile: futureTime} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("expected unchanged modification time of %s, got %v", path, info.ModTime())
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package image
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"package-to-image-placer/pkg/helper"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// squashfsMagic is the magic number at the start of the squashfs superblock, "hsqs" in little-endian
+	squashfsMagic = 0x73717368
+	// squashfsSuperblockSize is the size of the squashfs 4.0 superblock
+	squashfsSuperblockSize = 96
+	// squashfsCompressorOptionsSize is the maximal size of the compressor options following the superblock, without their 2-byte header
+	squashfsCompressorOptionsSize = 8
+	// squashfsCompressorOptionsFlag is set in the superblock flags if the compressor options follow the superblock
+	squashfsCompressorOptionsFlag = 0x0400
+	// squashfsNoXattrTable is the xattr table start of a squashfs without extended attributes
+	squashfsNoXattrTable = 0xFFFFFFFFFFFFFFFF
+	// imageGrowAlignment is the alignment of the image size when the image is grown for its last partition
+	imageGrowAlignment = 1024 * 1024
+)
+
+// squashfsCompressors are the mksquashfs names of the compression IDs of the squashfs superblock
+var squashfsCompressors = map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+
+// squashfsListingPattern matches a line of the numeric long listing of unsquashfs (-lln): type and permissions, uid/gid,
+// size or major,minor of devices, modification time and path
+var squashfsListingPattern = regexp.MustCompile(`^([-dlcbps])([rwxsStT-]{9})\s+(\d+)/(\d+)\s+(?:(\d+),\s*(\d+)|\d+)\s+\d{4}-\d{2}-\d{2} \d{2}:\d{2} (.*)$`)
+
+// squashfsGzipStrategies, squashfsXzFilters and squashfsLzoAlgorithms are the mksquashfs names of the compressor options
+// stored as bits or numbers after the superblock
+var (
+	squashfsGzipStrategies = []string{"default", "filtered", "huffman_only", "run_length_encoded", "fixed"}
+	squashfsXzFilters      = []string{"x86", "powerpc", "ia64", "arm", "armthumb", "sparc"}
+	squashfsLzoAlgorithms  = []string{"lzo1x_1", "lzo1x_1_11", "lzo1x_1_12", "lzo1x_1_15", "lzo1x_999"}
+)
+
+// squashfsPartition is a squashfs filesystem in a partition of the image.
+// Packages can't be written to squashfs, so the filesystem is unpacked, the packages are placed to the unpacked tree
+// and the tree is repacked with the same compressor, compressor options and block size and written back to the partition.
+type squashfsPartition struct {
+	// start and size are the offset and the size of the partition in the image in bytes
+	start int64
+	size  int64
+	// compressor, compressorOptions, blockSize, bytesUsed and hasXattrs are read from the superblock,
+	// compressorOptions are the mksquashfs options of the compressor, e.g. -Xdict-size 1048576
+	compressor        string
+	compressorOptions []string
+	blockSize         uint32
+	bytesUsed         int64
+	hasXattrs         bool
+	// workDir holds the filesystem extracted from the image and the unpacked tree
+	workDir string
+	// entries are the owners and modes of the original entries, restored by pseudo definitions when not running as root
+	entries []squashfsEntry
+}
+
+// squashfsEntry is an entry of the unsquashfs listing
+type squashfsEntry struct {
+	path         string
+	fileType     byte
+	mode         uint32
+	uid, gid     int
+	major, minor int
+}
+
+// readSquashfsPartition returns the squashfs filesystem in the partition of the image, or nil if the partition is not a squashfs.
+func readSquashfsPartition(imagePath string, partitionNumber int) (*squashfsPartition, error) {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer imageDisk.Close()
+	table, err := imageDisk.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+	partitions := table.GetPartitions()
+	if partitionNumber < 1 || partitionNumber > len(partitions) {
+		return nil, fmt.Errorf("partition %d does not exist", partitionNumber)
+	}
+	start, size := partitions[partitionNumber-1].GetStart(), partitions[partitionNumber-1].GetSize()
+	if size < squashfsSuperblockSize {
+		return nil, nil
+	}
+	imageFile, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer imageFile.Close()
+	superblock := make([]byte, min(size, squashfsSuperblockSize+2+squashfsCompressorOptionsSize))
+	if _, err := imageFile.ReadAt(superblock, start); err != nil {
+		return nil, fmt.Errorf("unable to read superblock of partition %d: %v", partitionNumber, err)
+	}
+	squashfs, err := parseSquashfsSuperblock(superblock)
+	if squashfs == nil || err != nil {
+		return nil, err
+	}
+	if squashfs.bytesUsed > size {
+		return nil, fmt.Errorf("squashfs of %d bytes is larger than its partition of %d bytes", squashfs.bytesUsed, size)
+	}
+	squashfs.start, squashfs.size = start, size
+	return squashfs, nil
+}
+
+// parseSquashfsSuperblock returns the squashfs with the compressor, block size and used bytes of the superblock,
+// or nil if the bytes are not a squashfs superblock. The compressor options are read from the bytes following the superblock.
+func parseSquashfsSuperblock(superblock []byte) (*squashfsPartition, error) {
+	if len(superblock) < squashfsSuperblockSize || binary.LittleEndian.Uint32(superblock[0:4]) != squashfsMagic {
+		return nil, nil
+	}
+	if major := binary.LittleEndian.Uint16(superblock[28:30]); major != 4 {
+		return nil, fmt.Errorf("unsupported squashfs version %d", major)
+	}
+	compressionID := binary.LittleEndian.Uint16(superblock[20:22])
+	compressor, found := squashfsCompressors[compressionID]
+	if !found {
+		return nil, fmt.Errorf("unknown squashfs compression %d", compressionID)
+	}
+	squashfs := &squashfsPartition{
+		compressor: compressor,
+		blockSize:  binary.LittleEndian.Uint32(superblock[12:16]),
+		bytesUsed:  int64(binary.LittleEndian.Uint64(superblock[40:48])),
+		hasXattrs:  binary.LittleEndian.Uint64(superblock[56:64]) != squashfsNoXattrTable,
+	}
+	if binary.LittleEndian.Uint16(superblock[24:26])&squashfsCompressorOptionsFlag != 0 {
+		options, err := readCompressorOptions(superblock[squashfsSuperblockSize:])
+		if err != nil {
+			return nil, err
+		}
+		if squashfs.compressorOptions, err = parseCompressorOptions(compressor, options); err != nil {
+			return nil, err
+		}
+	}
+	return squashfs, nil
+}
+
+// readCompressorOptions returns the compressor options from the metadata block following the superblock.
+// mksquashfs always stores the options uncompressed.
+func readCompressorOptions(block []byte) ([]byte, error) {
+	if len(block) < 2 {
+		return nil, fmt.Errorf("squashfs compressor options are missing")
+	}
+	header := binary.LittleEndian.Uint16(block[0:2])
+	size := int(header & 0x7FFF)
+	if header&0x8000 == 0 || size > len(block)-2 {
+		return nil, fmt.Errorf("unsupported squashfs compressor options of %d bytes", size)
+	}
+	return block[2 : 2+size], nil
+}
+
+// parseCompressorOptions returns the mksquashfs options of the compressor options stored in the squashfs.
+// Options mksquashfs can't set, so the repacked squashfs would differ from the original one, are rejected.
+func parseCompressorOptions(compressor string, options []byte) ([]string, error) {
+	expectedSize := map[string]int{"gzip": 8, "lzo": 8, "xz": 8, "lz4": 8, "zstd": 4}[compressor]
+	if expectedSize == 0 {
+		return nil, fmt.Errorf("squashfs compressor options of %s are not supported", compressor)
+	}
+	if len(options) != expectedSize {
+		return nil, fmt.Errorf("invalid squashfs %s compressor options of %d bytes", compressor, len(options))
+	}
+	first := binary.LittleEndian.Uint32(options[0:4])
+	switch compressor {
+	case "gzip":
+		arguments := []string{"-Xcompression-level", strconv.Itoa(int(first)), "-Xwindow-size", strconv.Itoa(int(binary.LittleEndian.Uint16(options[4:6])))}
+		strategies, err := optionNames(uint32(binary.LittleEndian.Uint16(options[6:8])), squashfsGzipStrategies)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported squashfs gzip strategies: %v", err)
+		}
+		if strategies != "" {
+			arguments = append(arguments, "-Xstrategy", strategies)
+		}
+		return arguments, nil
+	case "xz":
+		arguments := []string{"-Xdict-size", strconv.Itoa(int(first))}
+		filters, err := optionNames(binary.LittleEndian.Uint32(options[4:8]), squashfsXzFilters)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported squashfs xz filters: %v", err)
+		}
+		if filters != "" {
+			arguments = append(arguments, "-Xbcj", filters)
+		}
+		return arguments, nil
+	case "lz4":
+		flags := binary.LittleEndian.Uint32(options[4:8])
+		if first != 1 || flags&^1 != 0 {
+			return nil, fmt.Errorf("unsupported squashfs lz4 version %d or flags %#x", first, flags)
+		}
+		if flags == 1 {
+			return []string{"-Xhc"}, nil
+		}
+		return []string{}, nil
+	case "zstd":
+		return []string{"-Xcompression-level", strconv.Itoa(int(first))}, nil
+	default:
+		if int(first) >= len(squashfsLzoAlgorithms) {
+			return nil, fmt.Errorf("unsupported squashfs lzo algorithm %d", first)
+		}
+		arguments := []string{"-Xalgorithm", squashfsLzoAlgorithms[first]}
+		// Only lzo1x_999 has a compression level
+		if squashfsLzoAlgorithms[first] == "lzo1x_999" {
+			arguments = append(arguments, "-Xcompression-level", strconv.Itoa(int(binary.LittleEndian.Uint32(options[4:8]))))
+		}
+		return arguments, nil
+	}
+}
+
+// optionNames returns the comma separated names of the bits set in the value, the bits are numbered from the lowest one.
+// It fails for bits without a name.
+func optionNames(value uint32, names []string) (string, error) {
+	var set []string
+	for i, name := range names {
+		if value&(1<<i) != 0 {
+			set = append(set, name)
+		}
+	}
+	if value>>len(names) != 0 {
+		return "", fmt.Errorf("unknown bits %#x", value>>len(names)<<len(names))
+	}
+	return strings.Join(set, ","), nil
+}
+
+// unpackSquashfs extracts the squashfs of the partition from the image and unpacks it to a new temporary directory.
+// Without root, unsquashfs can't keep the owners, create device files and write extended attributes other than user.*, so the listing
+// of the filesystem is kept for the repacking and the devices are left out. A squashfs with extended attributes is unpacked without root
+// only if the configuration allows losing them, as they can't be restored.
+// The returned function removes the temporary directory.
+func (copier *partitionCopier) unpackSquashfs(squashfs *squashfsPartition) (string, func(), error) {
+	defer copier.report.StartPhase("unpack", copier.partitionNumber)()
+	copier.partitionReport.SetStep("unpack-squashfs")
+	for _, tool := range []string{"unsquashfs", "mksquashfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", nil, fmt.Errorf("partition is a squashfs, %s of squashfs-tools is needed to place packages to it", tool)
+		}
+	}
+	isRoot := unix.Geteuid() == 0
+	if !isRoot && squashfs.hasXattrs {
+		if !copier.config.AllowXattrLoss {
+			return "", nil, fmt.Errorf("squashfs has extended attributes (e.g. SELinux labels or file capabilities), which are lost when it is unpacked without root. " +
+				"Run as root to keep them, or set 'allow-xattr-loss' to keep only user.* attributes")
+		}
+		copier.logger.Warn("Squashfs is unpacked without root, extended attributes other than user.* are lost")
+	}
+	workDir, err := os.MkdirTemp("", "squashfs-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	squashfs.workDir = workDir
+	cleanup := func() { os.RemoveAll(workDir) }
+
+	filesystemPath := filepath.Join(workDir, "filesystem.squashfs")
+	if err := extractImageRange(copier.config.Target, squashfs.start, squashfs.bytesUsed, filesystemPath); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("unable to extract squashfs: %v", err)
+	}
+	unpackDir := filepath.Join(workDir, "root")
+	cmd := fmt.Sprintf("unsquashfs -no-progress -d %s %s", unpackDir, filesystemPath)
+	if !isRoot {
+		listing, err := helper.RunCommand(copier.ctx, fmt.Sprintf("unsquashfs -lln -d root %s", filesystemPath), false)
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("unable to list squashfs: %v", err)
+		}
+		squashfs.entries = parseSquashfsListing(listing, "root")
+		excludePath := filepath.Join(workDir, "exclude")
+		if err := os.WriteFile(excludePath, []byte(squashfsDeviceExcludes(squashfs.entries)), 0644); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("unable to write exclude file: %v", err)
+		}
+		cmd = fmt.Sprintf("unsquashfs -no-progress -user-xattrs -ef %s -d %s %s", excludePath, unpackDir, filesystemPath)
+	}
+	if _, err := helper.RunCommand(copier.ctx, cmd, false); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("unable to unpack squashfs: %v", err)
+	}
+	copier.logger.Info("Squashfs unpacked", "compressor", squashfs.compressor, "compressor-options", strings.Join(squashfs.compressorOptions, " "),
+		"block-size", squashfs.blockSize, "unpack-dir", unpackDir)
+	return unpackDir, cleanup, nil
+}
+
+// repackSquashfs packs the unpacked tree with the compressor, the compressor options and the block size of the original squashfs
+// and writes it back to the partition. The partition is grown if the new squashfs doesn't fit it.
+func (copier *partitionCopier) repackSquashfs(squashfs *squashfsPartition, unpackDir string) error {
+	defer copier.report.StartPhase("repack", copier.partitionNumber)()
+	copier.partitionReport.SetStep("repack-squashfs")
+	filesystemPath := filepath.Join(squashfs.workDir, "repacked.squashfs")
+	cmd := fmt.Sprintf("mksquashfs %s %s -noappend -no-progress -comp %s -b %d", unpackDir, filesystemPath, squashfs.compressor, squashfs.blockSize)
+	if len(squashfs.compressorOptions) > 0 {
+		cmd += " " + strings.Join(squashfs.compressorOptions, " ")
+	}
+	if copier.config.Reproducible {
+		cmd += fmt.Sprintf(" -mkfs-time %d", copier.config.SourceDateEpoch)
+	}
+	if unix.Geteuid() != 0 {
+		pseudoPath := filepath.Join(squashfs.workDir, "pseudo")
+		if err := os.WriteFile(pseudoPath, []byte(squashfsPseudoDefinitions(squashfs.entries, unpackDir)), 0644); err != nil {
+			return fmt.Errorf("unable to write pseudo file: %v", err)
+		}
+		cmd += " -all-root -pf " + pseudoPath
+	}
+	if _, err := helper.RunCommand(copier.ctx, cmd, false); err != nil {
+		return fmt.Errorf("unable to repack squashfs: %v", err)
+	}
+	info, err := os.Stat(filesystemPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > squashfs.size {
+		copier.logger.Info("Squashfs does not fit the partition, growing it", "squashfs-size", info.Size(), "partition-size", squashfs.size)
+		if squashfs.size, err = growPartition(copier.config.Target, copier.partitionNumber, info.Size()); err != nil {
+			return err
+		}
+		if info.Size() > squashfs.size {
+			return fmt.Errorf("repacked squashfs of %d bytes doesn't fit grown partition %d of %d bytes", info.Size(), copier.partitionNumber, squashfs.size)
+		}
+	}
+	if err := writeSquashfs(copier.config.Target, squashfs, filesystemPath, info.Size()); err != nil {
+		return fmt.Errorf("unable to write squashfs to partition: %v", err)
+	}
+	copier.logger.Info("Squashfs repacked", "original-size", squashfs.bytesUsed, "size", info.Size())
+	return nil
+}
+
+// extractImageRange copies the bytes of the image from the offset to a new file.
+func extractImageRange(imagePath string, offset int64, size int64, targetPath string) error {
+	imageFile, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer imageFile.Close()
+	targetFile, err := os.Create(targetPath)
+	if err != nil {
+		return err
+	}
+	defer targetFile.Close()
+	_, err = io.Copy(targetFile, io.NewSectionReader(imageFile, offset, size))
+	return err
+}
+
+// writeSquashfs writes the repacked squashfs to the partition. The rest of the original squashfs is zeroed.
+func writeSquashfs(imagePath string, squashfs *squashfsPartition, filesystemPath string, size int64) error {
+	filesystemFile, err := os.Open(filesystemPath)
+	if err != nil {
+		return err
+	}
+	defer filesystemFile.Close()
+	imageFile, err := os.OpenFile(imagePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer imageFile.Close()
+	if _, err := io.Copy(io.NewOffsetWriter(imageFile, squashfs.start), filesystemFile); err != nil {
+		return err
+	}
+	if size < squashfs.bytesUsed {
+		zeroes := io.LimitReader(zeroReader{}, squashfs.bytesUsed-size)
+		if _, err := io.Copy(io.NewOffsetWriter(imageFile, squashfs.start+size), zeroes); err != nil {
+			return err
+		}
+	}
+	return imageFile.Sync()
+}
+
+// zeroReader reads endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// growPartition grows the GPT partition to hold the size in bytes and returns its new size. The partition is grown into
+// the free space after it; the last partition is grown over the end of the image, which is enlarged. It fails if another partition
+// is in the way.
+func growPartition(imagePath string, partitionNumber int, size int64) (int64, error) {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { imageDisk.Close() }()
+	table, partition, err := gptPartition(imageDisk.GetPartitionTable, partitionNumber)
+	if err != nil {
+		return 0, fmt.Errorf("new squashfs of %d bytes doesn't fit partition %d: %v", size, partitionNumber, err)
+	}
+	sectorSize := int64(table.LogicalSectorSize)
+	newEnd := partition.Start + uint64((size+sectorSize-1)/sectorSize) - 1
+	if newEnd <= partition.End {
+		return partition.GetSize(), nil
+	}
+	if next := nextPartition(table, partition); next != nil && newEnd >= next.Start {
+		return 0, fmt.Errorf("new squashfs of %d bytes doesn't fit partition %d of %d bytes, it can grow only to %d bytes before the next partition",
+			size, partitionNumber, partition.GetSize(), int64(next.Start-partition.Start)*sectorSize)
+	}
+	if newEnd > table.LastDataSector() {
+		// The secondary partition array and GPT header follow the last data sector
+		gptSectors := table.TotalSize()/uint64(sectorSize) - 1 - table.LastDataSector()
+		imageSize := int64(newEnd+1+gptSectors) * sectorSize
+		imageSize = (imageSize + imageGrowAlignment - 1) / imageGrowAlignment * imageGrowAlignment
+		if err := growImage(imagePath, imageSize); err != nil {
+			return 0, fmt.Errorf("new squashfs of %d bytes doesn't fit partition %d of %d bytes before the end of the disk: %v",
+				size, partitionNumber, partition.GetSize(), err)
+		}
+		imageDisk.Close()
+		if imageDisk, err = diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadWrite)); err != nil {
+			return 0, err
+		}
+		table.Resize(uint64(imageSize))
+	}
+	partition.Expand(newEnd - partition.End)
+	if err := imageDisk.Partition(table); err != nil {
+		return 0, fmt.Errorf("unable to write grown partition table: %v", err)
+	}
+	return partition.GetSize(), nil
+}
+
+// gptPartition returns the GPT partition table and its partition with the number. Only GPT partitions can be grown.
+func gptPartition(getPartitionTable func() (partition.Table, error), partitionNumber int) (*gpt.Table, *gpt.Partition, error) {
+	partitionTable, err := getPartitionTable()
+	if err != nil {
+		return nil, nil, err
+	}
+	table, isGPT := partitionTable.(*gpt.Table)
+	if !isGPT {
+		return nil, nil, fmt.Errorf("only GPT partitions can be grown")
+	}
+	if partitionNumber < 1 || partitionNumber > len(table.Partitions) {
+		return nil, nil, fmt.Errorf("partition %d does not exist", partitionNumber)
+	}
+	return table, table.Partitions[partitionNumber-1], nil
+}
+
+// squashfsFreeSpace returns the space the squashfs in the partition can grow by: the free space of the partition and the free space
+// after it up to the next partition. It returns false if the partition is the last one, as the image is enlarged for it.
+func squashfsFreeSpace(imagePath string, partitionNumber int, squashfs *squashfsPartition) (uint64, bool, error) {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return 0, false, err
+	}
+	defer imageDisk.Close()
+	table, partition, err := gptPartition(imageDisk.GetPartitionTable, partitionNumber)
+	if err != nil {
+		return uint64(squashfs.size - squashfs.bytesUsed), true, nil
+	}
+	next := nextPartition(table, partition)
+	if next == nil {
+		return 0, false, nil
+	}
+	return uint64(int64(next.Start-partition.Start)*int64(table.LogicalSectorSize) - squashfs.bytesUsed), true, nil
+}
+
+// nextPartition returns the partition starting first after the partition, or nil if it is the last one
+func nextPartition(table *gpt.Table, partition *gpt.Partition) *gpt.Partition {
+	var next *gpt.Partition
+	for _, other := range table.Partitions {
+		if other.Type != gpt.Unused && other.Start > partition.Start && (next == nil || other.Start < next.Start) {
+			next = other
+		}
+	}
+	return next
+}
+
+// growImage enlarges the image file to the size. Only regular files can be enlarged, not block devices.
+func growImage(imagePath string, size int64) error {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not an image file and can't be enlarged", imagePath)
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return os.Truncate(imagePath, size)
+}
+
+// parseSquashfsListing parses the numeric long listing of unsquashfs. The paths are made absolute in the filesystem by removing the root directory.
+func parseSquashfsListing(listing string, rootDir string) []squashfsEntry {
+	var entries []squashfsEntry
+	scanner := bufio.NewScanner(strings.NewReader(listing))
+	for scanner.Scan() {
+		match := squashfsListingPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		entry := squashfsEntry{fileType: match[1][0], mode: parsePermissionString(match[2])}
+		entry.uid, _ = strconv.Atoi(match[3])
+		entry.gid, _ = strconv.Atoi(match[4])
+		entry.major, _ = strconv.Atoi(match[5])
+		entry.minor, _ = strconv.Atoi(match[6])
+		name := match[7]
+		if entry.fileType == 'l' {
+			name, _, _ = strings.Cut(name, " -> ")
+		}
+		name, found := strings.CutPrefix(name, rootDir)
+		if !found || (name != "" && !strings.HasPrefix(name, "/")) {
+			continue
+		}
+		entry.path = "/" + strings.TrimPrefix(name, "/")
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parsePermissionString returns the mode bits of the permission string of a listing, e.g. rwsr-xr-x is 4755
+func parsePermissionString(permissions string) uint32 {
+	var mode uint32
+	for i, char := range permissions {
+		bit := uint32(1) << (8 - i)
+		switch char {
+		case 'r', 'w', 'x':
+			mode |= bit
+		case 's', 't':
+			mode |= bit | uint32(1)<<(11-i/3)
+		case 'S', 'T':
+			mode |= uint32(1) << (11 - i/3)
+		}
+	}
+	return mode
+}
+
+// squashfsPseudoDefinitions returns the mksquashfs pseudo definitions restoring the owners and modes of the original entries still present
+// in the unpacked tree, and creating the devices unsquashfs couldn't create. Entries removed by the packages are left out.
+func squashfsPseudoDefinitions(entries []squashfsEntry, unpackDir string) string {
+	var definitions strings.Builder
+	for _, entry := range entries {
+		_, err := os.Lstat(filepath.Join(unpackDir, entry.path))
+		switch {
+		case entry.fileType == 'c' || entry.fileType == 'b':
+			if _, parentErr := os.Lstat(filepath.Join(unpackDir, filepath.Dir(entry.path))); err == nil || parentErr != nil {
+				continue
+			}
+			fmt.Fprintf(&definitions, "%s %c %o %d %d %d %d\n", quotePseudoPath(entry.path), entry.fileType, entry.mode, entry.uid, entry.gid, entry.major, entry.minor)
+		case err == nil:
+			fmt.Fprintf(&definitions, "%s m %o %d %d\n", quotePseudoPath(entry.path), entry.mode, entry.uid, entry.gid)
+		}
+	}
+	return definitions.String()
+}
+
+// squashfsDeviceExcludes returns the unsquashfs exclude file leaving out the device files, which can't be created without root.
+// They are created by the pseudo definitions when the squashfs is repacked.
+func squashfsDeviceExcludes(entries []squashfsEntry) string {
+	var excludes strings.Builder
+	for _, entry := range entries {
+		if entry.fileType == 'c' || entry.fileType == 'b' {
+			excludes.WriteString(strings.TrimPrefix(entry.path, "/") + "\n")
+		}
+	}
+	return excludes.String()
+}
+
+// quotePseudoPath quotes the path for the pseudo file, so it can contain spaces
+func quotePseudoPath(path string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
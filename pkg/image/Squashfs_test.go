@@ -0,0 +1,295 @@
+package image
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+const testSectorSize = 512
+
+// createGPTImage creates an image of the size in MiB with GPT partitions given by their start and end sectors
+func createGPTImage(t *testing.T, sizeMiB int64, partitions [][2]uint64) string {
+	imagePath := filepath.Join(t.TempDir(), "image.img")
+	imageDisk, err := diskfs.Create(imagePath, sizeMiB*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer imageDisk.Close()
+	table := &gpt.Table{LogicalSectorSize: testSectorSize, PhysicalSectorSize: testSectorSize, ProtectiveMBR: true}
+	for _, sectors := range partitions {
+		table.Partitions = append(table.Partitions, &gpt.Partition{Start: sectors[0], End: sectors[1], Type: gpt.LinuxFilesystem})
+	}
+	if err := imageDisk.Partition(table); err != nil {
+		t.Fatal(err.Error())
+	}
+	return imagePath
+}
+
+// squashfsSuperblock returns a squashfs superblock without extended attributes with the compression ID, block size and used bytes
+func squashfsSuperblock(compressionID uint16, blockSize uint32, bytesUsed uint64) []byte {
+	superblock := make([]byte, squashfsSuperblockSize)
+	binary.LittleEndian.PutUint32(superblock[0:4], squashfsMagic)
+	binary.LittleEndian.PutUint32(superblock[12:16], blockSize)
+	binary.LittleEndian.PutUint16(superblock[20:22], compressionID)
+	binary.LittleEndian.PutUint16(superblock[28:30], 4)
+	binary.LittleEndian.PutUint64(superblock[40:48], bytesUsed)
+	binary.LittleEndian.PutUint64(superblock[56:64], squashfsNoXattrTable)
+	return superblock
+}
+
+// withCompressorOptions sets the compressor options flag of the superblock and appends the uncompressed options
+func withCompressorOptions(superblock []byte, options ...uint32) []byte {
+	binary.LittleEndian.PutUint16(superblock[24:26], squashfsCompressorOptionsFlag)
+	superblock = binary.LittleEndian.AppendUint16(superblock, uint16(0x8000|4*len(options)))
+	for _, option := range options {
+		superblock = binary.LittleEndian.AppendUint32(superblock, option)
+	}
+	return superblock
+}
+
+func readPartitionTable(t *testing.T, imagePath string) *gpt.Table {
+	imageDisk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer imageDisk.Close()
+	table, err := imageDisk.GetPartitionTable()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return table.(*gpt.Table)
+}
+
+func TestParseSquashfsSuperblock(t *testing.T) {
+	squashfs, err := parseSquashfsSuperblock(squashfsSuperblock(4, 131072, 4096))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if squashfs.compressor != "xz" || squashfs.blockSize != 131072 || squashfs.bytesUsed != 4096 || squashfs.hasXattrs || squashfs.compressorOptions != nil {
+		t.Errorf("unexpected squashfs %+v", squashfs)
+	}
+	if squashfs, err := parseSquashfsSuperblock(make([]byte, squashfsSuperblockSize)); squashfs != nil || err != nil {
+		t.Errorf("expected no squashfs and no error for other content, got %+v, %v", squashfs, err)
+	}
+	if _, err := parseSquashfsSuperblock(squashfsSuperblock(9, 131072, 4096)); err == nil {
+		t.Errorf("expected error for unknown compression, got nil")
+	}
+}
+
+func TestParseSquashfsSuperblock_Xattrs(t *testing.T) {
+	superblock := squashfsSuperblock(4, 131072, 4096)
+	binary.LittleEndian.PutUint64(superblock[56:64], 2048)
+	squashfs, err := parseSquashfsSuperblock(superblock)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !squashfs.hasXattrs {
+		t.Errorf("expected squashfs with extended attributes")
+	}
+}
+
+func TestParseSquashfsSuperblock_CompressorOptions(t *testing.T) {
+	tests := []struct {
+		compressionID uint16
+		options       []uint32
+		expected      string
+	}{
+		{1, []uint32{6, 14 | 0x3<<16}, "-Xcompression-level 6 -Xwindow-size 14 -Xstrategy default,filtered"},
+		{3, []uint32{4, 8}, "-Xalgorithm lzo1x_999 -Xcompression-level 8"},
+		{3, []uint32{0, 8}, "-Xalgorithm lzo1x_1"},
+		{4, []uint32{1 << 20, 0x9}, "-Xdict-size 1048576 -Xbcj x86,arm"},
+		{5, []uint32{1, 1}, "-Xhc"},
+		{6, []uint32{19}, "-Xcompression-level 19"},
+	}
+	for _, test := range tests {
+		squashfs, err := parseSquashfsSuperblock(withCompressorOptions(squashfsSuperblock(test.compressionID, 131072, 4096), test.options...))
+		if err != nil {
+			t.Fatalf("expected no error for compression %d, got %v", test.compressionID, err)
+		}
+		if options := strings.Join(squashfs.compressorOptions, " "); options != test.expected {
+			t.Errorf("expected options %q for compression %d, got %q", test.expected, test.compressionID, options)
+		}
+	}
+}
+
+func TestParseSquashfsSuperblock_UnsupportedCompressorOptions(t *testing.T) {
+	superblocks := map[string][]byte{
+		"lzma":           withCompressorOptions(squashfsSuperblock(2, 131072, 4096), 1),
+		"unknown filter": withCompressorOptions(squashfsSuperblock(4, 131072, 4096), 1<<20, 0x40),
+		"invalid size":   withCompressorOptions(squashfsSuperblock(6, 131072, 4096), 19, 0),
+		"missing":        withCompressorOptions(squashfsSuperblock(6, 131072, 4096))[:squashfsSuperblockSize],
+	}
+	for name, superblock := range superblocks {
+		if _, err := parseSquashfsSuperblock(superblock); err == nil {
+			t.Errorf("expected error for %s compressor options, got nil", name)
+		}
+	}
+}
+
+func TestReadSquashfsPartition(t *testing.T) {
+	imagePath := createGPTImage(t, 4, [][2]uint64{{2048, 4095}, {4096, 6143}})
+	imageFile, err := os.OpenFile(imagePath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = imageFile.WriteAt(squashfsSuperblock(6, 65536, 8192), 4096*testSectorSize)
+	imageFile.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	squashfs, err := readSquashfsPartition(imagePath, 2)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if squashfs == nil || squashfs.compressor != "zstd" || squashfs.start != 4096*testSectorSize || squashfs.size != 2048*testSectorSize {
+		t.Fatalf("unexpected squashfs %+v", squashfs)
+	}
+	if squashfs, err := readSquashfsPartition(imagePath, 1); squashfs != nil || err != nil {
+		t.Errorf("expected no squashfs in partition 1, got %+v, %v", squashfs, err)
+	}
+}
+
+func TestSquashfsPartition(t *testing.T) {
+	imagePath := createGPTImage(t, 4, [][2]uint64{{2048, 4095}, {4096, 6143}})
+	copier := testCopier()
+	copier.config.Target = imagePath
+	if number, err := copier.squashfsPartition([]int{1, 2}); number != 0 || err != nil {
+		t.Fatalf("expected no squashfs partition, got %d, %v", number, err)
+	}
+	imageFile, err := os.OpenFile(imagePath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = imageFile.WriteAt(squashfsSuperblock(6, 65536, 8192), 4096*testSectorSize)
+	imageFile.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	number, err := copier.squashfsPartition([]int{1, 2})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if number != 2 {
+		t.Errorf("expected squashfs partition 2, got %d", number)
+	}
+}
+
+func TestGrowPartition_IntoFreeSpace(t *testing.T) {
+	imagePath := createGPTImage(t, 4, [][2]uint64{{2048, 3071}, {6144, 7167}})
+	size, err := growPartition(imagePath, 1, 1536*testSectorSize+1)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != 1537*testSectorSize {
+		t.Errorf("expected partition of %d bytes, got %d", 1537*testSectorSize, size)
+	}
+	table := readPartitionTable(t, imagePath)
+	if table.Partitions[0].End != 2048+1537-1 || table.Partitions[1].Start != 6144 {
+		t.Errorf("unexpected partitions %+v, %+v", table.Partitions[0], table.Partitions[1])
+	}
+
+	if _, err := growPartition(imagePath, 1, 5000*testSectorSize); err == nil || !strings.Contains(err.Error(), "next partition") {
+		t.Errorf("expected error for partition blocked by the next one, got %v", err)
+	}
+}
+
+func TestGrowPartition_EnlargesImage(t *testing.T) {
+	imagePath := createGPTImage(t, 4, [][2]uint64{{2048, 4095}, {4096, 6143}})
+	size, err := growPartition(imagePath, 2, 3*1024*1024)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if size != 3*1024*1024 {
+		t.Errorf("expected partition of %d bytes, got %d", 3*1024*1024, size)
+	}
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if info.Size() != 6*1024*1024 {
+		t.Errorf("expected image of 6 MiB, got %d bytes", info.Size())
+	}
+	table := readPartitionTable(t, imagePath)
+	if table.Partitions[1].End != 4096+6144-1 || table.LastDataSector() < table.Partitions[1].End {
+		t.Errorf("unexpected partition %+v with last data sector %d", table.Partitions[1], table.LastDataSector())
+	}
+}
+
+func TestGrowPartition_NotImageFile(t *testing.T) {
+	if err := growImage(os.DevNull, 1024*1024); err == nil {
+		t.Errorf("expected error for enlarging a device, got nil")
+	}
+}
+
+func TestParseSquashfsListing(t *testing.T) {
+	listing := strings.Join([]string{
+		"Parallel unsquashfs: Using 4 processors",
+		"drwxr-xr-x 0/0                   60 2024-01-01 00:00 root",
+		"-rwsr-xr-x 0/0                 1024 2024-01-01 00:00 root/usr/bin/sudo",
+		"-rw-r----- 0/42                  10 2024-01-01 00:00 root/etc/shadow file",
+		"lrwxrwxrwx 0/0                    7 2024-01-01 00:00 root/bin -> usr/bin",
+		"crw-rw-rw- 0/0               1,  3 2024-01-01 00:00 root/dev/null",
+		"drwxrwxrwt 0/0                    3 2024-01-01 00:00 root/tmp",
+	}, "\n")
+	entries := parseSquashfsListing(listing, "root")
+	expected := []squashfsEntry{
+		{path: "/", fileType: 'd', mode: 0755},
+		{path: "/usr/bin/sudo", fileType: '-', mode: 04755},
+		{path: "/etc/shadow file", fileType: '-', mode: 0640, gid: 42},
+		{path: "/bin", fileType: 'l', mode: 0777},
+		{path: "/dev/null", fileType: 'c', mode: 0666, major: 1, minor: 3},
+		{path: "/tmp", fileType: 'd', mode: 01777},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("expected entry %+v, got %+v", expected[i], entries[i])
+		}
+	}
+}
+
+func TestSquashfsPseudoDefinitions(t *testing.T) {
+	unpackDir := t.TempDir()
+	for _, dir := range []string{"etc", "dev"} {
+		if err := os.Mkdir(filepath.Join(unpackDir, dir), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := os.WriteFile(filepath.Join(unpackDir, "etc", "app conf"), []byte("a"), 0640); err != nil {
+		t.Fatal(err.Error())
+	}
+	entries := []squashfsEntry{
+		{path: "/", fileType: 'd', mode: 0755},
+		{path: "/etc/app conf", fileType: '-', mode: 0640, uid: 1000, gid: 42},
+		{path: "/etc/deleted", fileType: '-', mode: 0644},
+		{path: "/dev/null", fileType: 'c', mode: 0666, major: 1, minor: 3},
+		{path: "/removed/null", fileType: 'c', mode: 0666, major: 1, minor: 3},
+	}
+	definitions := squashfsPseudoDefinitions(entries, unpackDir)
+	expected := "\"/\" m 755 0 0\n\"/etc/app conf\" m 640 1000 42\n\"/dev/null\" c 666 0 0 1 3\n"
+	if definitions != expected {
+		t.Errorf("expected definitions %q, got %q", expected, definitions)
+	}
+}
+
+func TestSquashfsDeviceExcludes(t *testing.T) {
+	entries := []squashfsEntry{
+		{path: "/", fileType: 'd', mode: 0755},
+		{path: "/dev/null", fileType: 'c', mode: 0666, major: 1, minor: 3},
+		{path: "/dev/sda", fileType: 'b', mode: 0660, major: 8},
+		{path: "/etc/fstab", fileType: '-', mode: 0644},
+	}
+	if excludes := squashfsDeviceExcludes(entries); excludes != "dev/null\ndev/sda\n" {
+		t.Errorf("expected devices to be excluded, got %q", excludes)
+	}
+}
@@ -0,0 +1,78 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"golang.org/x/sys/unix"
+)
+
+const templateSuffix = ".tmpl"
+
+// templateTargetName checks if the file from the archive is a template and returns its name in the image.
+// Patterns containing a slash are matched against the whole path in the package (starting with '/'),
+// other patterns are matched against the file name only. The template suffix is stripped from templates.
+func templateTargetName(name string, patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if matchesPackagePattern(name, pattern) {
+			return strings.TrimSuffix(name, templateSuffix), true
+		}
+	}
+	return name, false
+}
+
+// matchesPackagePattern checks if the path of the file in the package matches the pattern.
+// Patterns containing a slash are matched against the whole path in the package (starting with '/'),
+// other patterns are matched against the file name only.
+func matchesPackagePattern(name string, pattern string) bool {
+	pathInPackage := "/" + strings.Trim(name, "/")
+	subject := path.Base(pathInPackage)
+	if strings.Contains(pattern, "/") {
+		subject = pathInPackage
+	}
+	matched, _ := path.Match(pattern, subject)
+	return matched
+}
+
+// renderTemplate renders the template read from src with the given variables and writes it to the destination path.
+// Referencing a variable which is not defined is an error.
+func renderTemplate(destFilePath string, src io.Reader, name string, variables map[string]string, fileMode os.FileMode) error {
+	rendered, err := renderTemplateContent(src, name, variables)
+	if err != nil {
+		return err
+	}
+	destFile, err := os.OpenFile(destFilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, fileMode)
+	if err != nil {
+		return fmt.Errorf("unable to create file %s: %v", destFilePath, err)
+	}
+	defer destFile.Close()
+	_, err = destFile.Write(rendered)
+	if err != nil {
+		return fmt.Errorf("unable to write file %s: %v", destFilePath, err)
+	}
+	return nil
+}
+
+// renderTemplateContent renders the template read from src with the given variables.
+// Referencing a variable which is not defined is an error.
+func renderTemplateContent(src io.Reader, name string, variables map[string]string) ([]byte, error) {
+	content, err := io.ReadAll(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read template %s: %v", name, err)
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template %s: %v", name, err)
+	}
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, variables)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render template %s: %v", name, err)
+	}
+	return rendered.Bytes(), nil
+}
@@ -0,0 +1,113 @@
+package image
+
+import (
+	"archive/zip"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"testing"
+)
+
+// createTestZip creates a zip archive with the given files (name -> content) and returns an opened reader.
+func createTestZip(t *testing.T, files map[string]string) *zip.ReadCloser {
+	zipReader, err := zip.OpenReader(createTestZipFile(t, files))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { zipReader.Close() })
+	return zipReader
+}
+
+// createTestZipFile creates a zip archive with the files in a temporary directory and returns its path.
+func createTestZipFile(t *testing.T, files map[string]string) string {
+	archivePath := filepath.Join(t.TempDir(), "package.zip")
+	archiveFile, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	writer := zip.NewWriter(archiveFile)
+	for name, content := range files {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(0644)
+		fileWriter, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := fileWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	archiveFile.Close()
+	return archivePath
+}
+
+func TestTemplateTargetName(t *testing.T) {
+	patterns := []string{"*.tmpl", "/etc/hostname"}
+	tests := []struct {
+		name         string
+		expectedName string
+		isTemplate   bool
+	}{
+		{"etc/hosts.tmpl", "etc/hosts", true},
+		{"etc/hostname", "etc/hostname", true},
+		{"opt/etc/hostname", "opt/etc/hostname", false},
+		{"etc/hosts", "etc/hosts", false},
+	}
+	for _, test := range tests {
+		name, isTemplate := templateTargetName(test.name, patterns)
+		if name != test.expectedName || isTemplate != test.isTemplate {
+			t.Errorf("%s: expected (%s, %v), got (%s, %v)", test.name, test.expectedName, test.isTemplate, name, isTemplate)
+		}
+	}
+}
+
+func TestDecompressZipArchive_RendersTemplates(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/hostname.tmpl": "{{ .hostname }}\n",
+		"etc/static.conf":   "{{ .hostname }}\n",
+	})
+	mountDir := t.TempDir()
+	packageConfig := configuration.PackageConfig{
+		PackagePath:       "package.zip",
+		TemplatePatterns:  []string{"*.tmpl"},
+		TemplateVariables: map[string]string{"hostname": "device-01"},
+	}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(mountDir, "etc/hostname"))
+	if err != nil {
+		t.Fatalf("expected rendered file, got %v", err)
+	}
+	if string(content) != "device-01\n" {
+		t.Fatalf("expected 'device-01', got '%s'", content)
+	}
+	content, err = os.ReadFile(filepath.Join(mountDir, "etc/static.conf"))
+	if err != nil {
+		t.Fatalf("expected copied file, got %v", err)
+	}
+	if string(content) != "{{ .hostname }}\n" {
+		t.Fatalf("expected file not to be rendered, got '%s'", content)
+	}
+}
+
+func TestDecompressZipArchive_MissingTemplateVariable(t *testing.T) {
+	zipReader := createTestZip(t, map[string]string{
+		"etc/hostname.tmpl": "{{ .hostname }}\n",
+	})
+	mountDir := t.TempDir()
+	packageConfig := configuration.PackageConfig{
+		PackagePath:      "package.zip",
+		TemplatePatterns: []string{"*.tmpl"},
+	}
+
+	_, err := testCopier().decompressZipArchiveAndReturnService(&zipReader.Reader, mountDir, mountDir, &packageConfig)
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
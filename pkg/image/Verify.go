@@ -0,0 +1,318 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/integrity"
+	"package-to-image-placer/pkg/service"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxReportedMismatches limits the number of mismatches returned by the verification of one partition
+const maxReportedMismatches = 20
+
+// expectedFile is an archive entry which should be extracted to the image
+type expectedFile struct {
+	// path is the path of the entry in the mounted partition
+	path string
+	// isDir, mode, size and crc32 are taken from the archive entry, linkTarget is the target of a symlink entry
+	isDir      bool
+	mode       os.FileMode
+	size       uint64
+	crc32      uint32
+	linkTarget string
+	// contentMayChange is set for files whose content is changed after the extraction,
+	// i.e. rendered templates, rewritten service files, merged files and files of packages with a post-install hook
+	contentMayChange bool
+	// permissions are the permissions set by the permission rules of the package
+	permissions entryPermissions
+	// mayBeKept is set for files which are not extracted if they already exist in the image (the skip-existing overwrite policy),
+	// only their presence is checked
+	mayBeKept bool
+}
+
+// expectedService is a service file which should be activated in the image
+type expectedService struct {
+	serviceFile   string
+	packageConfig configuration.PackageConfig
+}
+
+// VerifyPlacement remounts each partition of the target image read-only and checks that every file of the packages
+// was extracted correctly and the services are activated. Files overwritten by a later package are checked against that package.
+// It returns the mismatches of the first partition which has any.
+func (copier *Copier) VerifyPlacement(ctx context.Context) error {
+	for _, partitionNumber := range copier.config.TargetPartitions() {
+		partitionCopier := copier.newPartitionCopier(ctx, partitionNumber, false, nil)
+		err := partitionCopier.mountPartitionAndVerifyPackages()
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", partitionNumber, err)
+		}
+	}
+	return nil
+}
+
+// mountPartitionAndVerifyPackages mounts the partition read-only and verifies all packages placed to it.
+func (copier *partitionCopier) mountPartitionAndVerifyPackages() error {
+	mountDir, unmount, err := copier.mount(true)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	defer copier.report.StartPhase("verify", copier.partitionNumber)()
+	copier.logger.Info("Verifying placed packages")
+	return copier.verifyPackages(mountDir)
+}
+
+// verifyPackages verifies the packages of the configuration placed to the partition mounted to the mount directory.
+func (copier *partitionCopier) verifyPackages(mountDir string) error {
+	expectedFiles := map[string]expectedFile{}
+	var paths []string
+	var services []expectedService
+	for _, packageConfig := range copier.packageConfigs() {
+		// Files of the earlier packages deleted or moved away by the operations are not expected anymore
+		for _, operation := range packageConfig.Operations {
+			if operation.Op != configuration.OperationDelete && operation.Op != configuration.OperationMove {
+				continue
+			}
+			removed := pathSet{filepath.Join(mountDir, operation.Path): true}
+			for filePath := range expectedFiles {
+				if removed.containsOrUnder(filePath) {
+					delete(expectedFiles, filePath)
+				}
+			}
+		}
+		packageFiles, packageServices, err := copier.expectedPackageFiles(mountDir, packageConfig)
+		if err != nil {
+			return err
+		}
+		for _, expected := range packageFiles {
+			if _, found := expectedFiles[expected.path]; !found {
+				paths = append(paths, expected.path)
+			}
+			expectedFiles[expected.path] = expected
+		}
+		services = append(services, packageServices...)
+	}
+
+	var mismatches []error
+	for _, filePath := range paths {
+		if err := copier.ctx.Err(); err != nil {
+			return err
+		}
+		expected, found := expectedFiles[filePath]
+		if !found {
+			continue
+		}
+		err := copier.verifyFile(mountDir, filePath, expected)
+		if err != nil {
+			mismatches = append(mismatches, err)
+		}
+	}
+	for _, expected := range services {
+		err := service.VerifyService(mountDir, expected.serviceFile, &expected.packageConfig)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Errorf("%s: %w", pathInImage(mountDir, expected.serviceFile), err))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		copier.logger.Info("All placed files verified", "files", len(expectedFiles), "services", len(services))
+		return nil
+	}
+	for _, mismatch := range mismatches {
+		copier.logger.Error("Verification mismatch", "error", mismatch)
+	}
+	if len(mismatches) > maxReportedMismatches {
+		mismatches = append(mismatches[:maxReportedMismatches], fmt.Errorf("and %d more mismatches", len(mismatches)-maxReportedMismatches))
+	}
+	return fmt.Errorf("verification of placed packages failed: %w", errors.Join(mismatches...))
+}
+
+// expectedPackageFiles returns the files the package should have extracted to the partition mounted to the mount directory,
+// in the order of the archive, and the services it should have activated. The archive is closed before returning.
+func (copier *partitionCopier) expectedPackageFiles(mountDir string, packageConfig configuration.PackageConfig) ([]expectedFile, []expectedService, error) {
+	packageFile, err := copier.openPlacedPackage(packageConfig.PackagePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer packageFile.Close()
+	zipReader, err := newZipReader(packageFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	permissionResolver, err := newPermissionResolver(packageConfig.Permissions, mountDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []expectedFile
+	var services []expectedService
+	packageDir := helper.GetTargetArchiveDirName(filepath.Join(mountDir, packageConfig.TargetDirectory), packageConfig.PackagePath, packageConfig.IsStandardPackage)
+	activatesService := packageConfig.IsStandardPackage && packageConfig.EnableServices
+	for _, file := range zipReader.File {
+		name, isTemplate := templateTargetName(file.Name, packageConfig.TemplatePatterns)
+		targetFilePath := filepath.Join(packageDir, name)
+		isService := activatesService && strings.HasSuffix(name, ".service") && !file.FileInfo().IsDir()
+		if isService {
+			services = append(services, expectedService{serviceFile: targetFilePath, packageConfig: packageConfig})
+		}
+		expected := expectedFile{
+			path:             targetFilePath,
+			isDir:            file.FileInfo().IsDir(),
+			mode:             file.Mode(),
+			size:             file.UncompressedSize64,
+			crc32:            file.CRC32,
+			contentMayChange: isTemplate || isService || packageConfig.PostInstallHook != nil,
+			// Without permission rules no owner is set
+			permissions: entryPermissions{uid: -1, gid: -1},
+		}
+		if file.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := readZipFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			expected.linkTarget = string(linkTarget)
+		}
+		mayBeMerged := false
+		if !expected.isDir {
+			pathInPackage := helper.RemoveMountDirAndPackageName(targetFilePath, mountDir, packageConfig.TargetDirectory, packageConfig.PackagePath)
+			expected.mayBeKept = packageConfig.OverwriteActionFor(pathInPackage) == configuration.OverwriteSkip
+			mayBeMerged = packageConfig.MergeRuleFor(pathInPackage) != nil
+			expected.contentMayChange = expected.contentMayChange || mayBeMerged
+		}
+		// A merged file keeps the permissions of the file in the image
+		if permissionResolver != nil && !mayBeMerged {
+			expected.permissions = permissionResolver.permissionsOf(name, expected.isDir)
+		}
+		files = append(files, expected)
+	}
+	return files, services, nil
+}
+
+// openPlacedPackage opens the package and checks it still has the SHA256 digest recorded when it was placed,
+// so the placement is verified against the content which was extracted, not against a package replaced in the meantime.
+func (copier *partitionCopier) openPlacedPackage(packagePath string) (*os.File, error) {
+	copier.configMutex.Lock()
+	digest, recorded := copier.packageDigests[packagePath]
+	copier.configMutex.Unlock()
+	if !recorded {
+		return nil, fmt.Errorf("package %s was not verified during the placement", packagePath)
+	}
+	packageFile, err := os.Open(packagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip file: %v", err)
+	}
+	_, err = integrity.VerifyPackage(copier.ctx, packageFile, digest, "", "", false)
+	if err != nil {
+		packageFile.Close()
+		return nil, fmt.Errorf("package changed since its placement: %v", err)
+	}
+	return packageFile, nil
+}
+
+// verifyFile checks the file in the image against the archive entry: its type, size, permissions, owner, CRC32 checksum and symlink target.
+// A mode set by a permission rule must match exactly, otherwise group and other permission bits cleared by the umask are accepted. For files whose content may change,
+// only the type and the owner and mode set by the permission rules are checked, and only the presence for files which may be kept from the image.
+func (copier *partitionCopier) verifyFile(mountDir string, filePath string, expected expectedFile) error {
+	pathInImage := pathInImage(mountDir, filePath)
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return fmt.Errorf("%s is missing", pathInImage)
+	}
+	if expected.mayBeKept {
+		return nil
+	}
+	archiveMode := expected.mode
+	switch {
+	case expected.isDir:
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", pathInImage)
+		}
+		return nil
+	case archiveMode&os.ModeSymlink != 0:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s is not a symlink", pathInImage)
+		}
+		linkTarget, err := os.Readlink(filePath)
+		if err != nil {
+			return fmt.Errorf("unable to read symlink %s: %v", pathInImage, err)
+		}
+		if linkTarget != expected.linkTarget {
+			return fmt.Errorf("%s points to %s, expected %s", pathInImage, linkTarget, expected.linkTarget)
+		}
+		return verifyOwner(pathInImage, info, expected.permissions)
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", pathInImage)
+	}
+	if err := verifyOwner(pathInImage, info, expected.permissions); err != nil {
+		return err
+	}
+	if expected.permissions.hasMode {
+		mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if mode != expected.permissions.mode {
+			return fmt.Errorf("%s has mode %s, expected %s", pathInImage, mode, expected.permissions.mode)
+		}
+	}
+	if expected.contentMayChange {
+		return nil
+	}
+	if info.Size() != int64(expected.size) {
+		return fmt.Errorf("%s has size %d, expected %d", pathInImage, info.Size(), expected.size)
+	}
+	if !expected.permissions.hasMode {
+		mode := info.Mode().Perm()
+		if mode&^archiveMode.Perm() != 0 || mode&0700 != archiveMode.Perm()&0700 {
+			return fmt.Errorf("%s has mode %s, expected %s", pathInImage, mode, archiveMode.Perm())
+		}
+	}
+	checksum, err := fileChecksum(copier.ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if checksum != expected.crc32 {
+		return fmt.Errorf("%s has CRC32 %08x, expected %08x", pathInImage, checksum, expected.crc32)
+	}
+	return nil
+}
+
+// verifyOwner checks the owner and the group set by the permission rules, IDs not set by the rules are not checked.
+// Without root, the mounted partition shows all files owned by the invoking user, so the owners are not checked.
+func verifyOwner(pathInImage string, info os.FileInfo, permissions entryPermissions) error {
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat || !ownersVisible() {
+		return nil
+	}
+	if permissions.uid >= 0 && int(stat.Uid) != permissions.uid {
+		return fmt.Errorf("%s has owner %d, expected %d", pathInImage, stat.Uid, permissions.uid)
+	}
+	if permissions.gid >= 0 && int(stat.Gid) != permissions.gid {
+		return fmt.Errorf("%s has group %d, expected %d", pathInImage, stat.Gid, permissions.gid)
+	}
+	return nil
+}
+
+// fileChecksum computes the CRC32 (IEEE) checksum of the file, as stored in zip archives.
+func fileChecksum(ctx context.Context, filePath string) (uint32, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open file %s: %v", filePath, err)
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	_, err = io.Copy(hash, &contextReader{ctx: ctx, reader: file})
+	if err != nil {
+		return 0, fmt.Errorf("unable to read file %s: %v", filePath, err)
+	}
+	return hash.Sum32(), nil
+}
@@ -0,0 +1,173 @@
+package image
+
+import (
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// placeTestPackages copies the packages of the configuration to a temporary directory, which stands for the mounted partition.
+func placeTestPackages(t *testing.T, copier *partitionCopier) string {
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "etc/systemd/system/multi-user.target.wants"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	packageConfigs := copier.packageConfigs()
+	for i := range packageConfigs {
+		if err := copier.copyPackageActivateService(mountDir, &packageConfigs[i]); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	return mountDir
+}
+
+func verifyTestCopier(t *testing.T) *partitionCopier {
+	servicePackage, _ := filepath.Abs("../../testdata/archives/example_with_service.zip")
+	copier := testCopier()
+	copier.config.Packages = []configuration.PackageConfig{
+		{PackagePath: servicePackage, EnableServices: true, ServiceNameSuffix: "test", TargetDirectory: "opt"},
+	}
+	copier.config.ConfigurationPackages = []configuration.ConfigurationPackage{
+		{PackagePath: createTestZipFile(t, map[string]string{"etc/app.conf": "key=value\n"})},
+	}
+	return copier
+}
+
+func TestVerifyPackages_Success(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+
+	err := copier.verifyPackages(mountDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestVerifyPackages_ShortWrite(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+	if err := os.Truncate(filepath.Join(mountDir, "etc/app.conf"), 3); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/etc/app.conf has size 3") {
+		t.Fatalf("expected size mismatch of /etc/app.conf, got %v", err)
+	}
+}
+
+func TestVerifyPackages_ContentChanged(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+	if err := os.WriteFile(filepath.Join(mountDir, "etc/app.conf"), []byte("key=other\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/etc/app.conf has CRC32") {
+		t.Fatalf("expected checksum mismatch of /etc/app.conf, got %v", err)
+	}
+}
+
+func TestVerifyPackages_ServiceNotEnabled(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+	if err := os.Remove(filepath.Join(mountDir, "etc/systemd/system/multi-user.target.wants/valid-test.service")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "enablement symlink of unit valid-test.service is missing") {
+		t.Fatalf("expected missing enablement symlink, got %v", err)
+	}
+}
+
+func TestVerifyPackages_MissingFile(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+	if err := os.Remove(filepath.Join(mountDir, "opt/example_with_service/example/a/b/c/file")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/opt/example_with_service/example/a/b/c/file is missing") {
+		t.Fatalf("expected missing file, got %v", err)
+	}
+}
+
+func TestVerifyPackages_PermissionRuleMode(t *testing.T) {
+	copier := verifyTestCopier(t)
+	copier.config.ConfigurationPackages[0].Permissions = &configuration.PermissionsConfig{
+		Rules: []configuration.PermissionRule{{Pattern: "*.conf", Mode: "0600"}},
+	}
+	mountDir := placeTestPackages(t, copier)
+	if err := copier.verifyPackages(mountDir); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := os.Chmod(filepath.Join(mountDir, "etc/app.conf"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/etc/app.conf has mode -rw-r--r--, expected -rw-------") {
+		t.Fatalf("expected mode mismatch of /etc/app.conf, got %v", err)
+	}
+}
+
+func TestVerifyPackages_PermissionRuleOwner(t *testing.T) {
+	if !ownersVisible() {
+		t.Skip("changing the owner requires root")
+	}
+	copier := verifyTestCopier(t)
+	copier.config.ConfigurationPackages[0].Permissions = &configuration.PermissionsConfig{
+		Rules: []configuration.PermissionRule{{Pattern: "*.conf", Owner: "1234", Group: "4321"}},
+	}
+	mountDir := placeTestPackages(t, copier)
+	if err := copier.verifyPackages(mountDir); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := os.Lchown(filepath.Join(mountDir, "etc/app.conf"), 0, 4321); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/etc/app.conf has owner 0, expected 1234") {
+		t.Fatalf("expected owner mismatch of /etc/app.conf, got %v", err)
+	}
+}
+
+func TestVerifyPackages_PermissionRuleModeOfTemplate(t *testing.T) {
+	copier := verifyTestCopier(t)
+	copier.config.ConfigurationPackages[0].Templates = []string{"*.conf"}
+	copier.config.ConfigurationPackages[0].Permissions = &configuration.PermissionsConfig{
+		Rules: []configuration.PermissionRule{{Pattern: "*.conf", Mode: "0600"}},
+	}
+	mountDir := placeTestPackages(t, copier)
+	if err := copier.verifyPackages(mountDir); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := os.Chmod(filepath.Join(mountDir, "etc/app.conf"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "/etc/app.conf has mode -rw-r--r--, expected -rw-------") {
+		t.Fatalf("expected mode mismatch of template /etc/app.conf, got %v", err)
+	}
+}
+
+func TestVerifyPackages_PackageReplaced(t *testing.T) {
+	copier := verifyTestCopier(t)
+	mountDir := placeTestPackages(t, copier)
+	replacement := createTestZipFile(t, map[string]string{"etc/other.conf": "key=value\n"})
+	if err := os.Rename(replacement, copier.config.ConfigurationPackages[0].PackagePath); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err := copier.verifyPackages(mountDir)
+	if err == nil || !strings.Contains(err.Error(), "package changed since its placement") {
+		t.Fatalf("expected changed package, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// luksMapName is the device mapper name the LUKS volume is opened as in the libguestfs appliance
+const luksMapName = "placer-luks"
+
+// mountCommand returns the command mounting the partition or the volume of the copier from the image to the mount directory,
+// and the key file given to its standard input, which is empty if there is none.
+// Partitions and LVM logical volumes are mounted by guestmount. LUKS volumes are opened and mounted by guestfish, as guestmount
+// opens them only with inspection of the operating system. Image file volumes are mounted from the image file as a whole device.
+// Without root, all files are shown owned by the invoking user, so they can be accessed. Root sees the owners stored in the image.
+func (copier *partitionCopier) mountCommand(imagePath string, mountDir string, readOnly bool) (string, string) {
+	mode := "--rw"
+	if readOnly {
+		mode = "--ro"
+	}
+	guestmountOwner, guestfishOwner := "", ""
+	if !ownersVisible() {
+		guestmountOwner = fmt.Sprintf(" -o uid=%d -o gid=%d", unix.Getuid(), unix.Getgid())
+		guestfishOwner = fmt.Sprintf(" options:uid=%d,gid=%d", unix.Getuid(), unix.Getgid())
+	}
+	device := fmt.Sprintf("/dev/sda%d", copier.partitionNumber)
+	volume := copier.config.Volume(copier.partitionNumber)
+	switch {
+	case volume == nil:
+	case volume.LVM != "":
+		device = "/dev/" + volume.LVM
+	case volume.ImageFile != "":
+		device = "/dev/sda"
+	case volume.LUKSKeyFile != "":
+		mountCmd := "mount"
+		if readOnly {
+			mountCmd = "mount-ro"
+		}
+		return fmt.Sprintf("guestfish %s -a %s --keys-from-stdin run : cryptsetup-open /dev/sda%d %s : %s /dev/mapper/%s / : mount-local %s readonly:%t%s : mount-local-run",
+			mode, imagePath, volume.Partition, luksMapName, mountCmd, luksMapName, mountDir, readOnly, guestfishOwner), volume.LUKSKeyFile
+	}
+	return fmt.Sprintf("guestmount -a %s -m %s%s %s %s --no-fork", imagePath, device, guestmountOwner, mode, mountDir), ""
+}
+
+// ownersVisible returns true if the mounted partitions show the owners stored in the image, i.e. when running as root
+func ownersVisible() bool {
+	return unix.Geteuid() == 0
+}
+
+// runMountCommand runs the mount command with the content of the key file as its standard input, if the key file is set.
+func runMountCommand(ctx context.Context, cmd string, keyFile string) (string, error) {
+	if keyFile == "" {
+		return helper.RunCommand(ctx, cmd, false)
+	}
+	key, err := os.Open(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to open LUKS key file: %v", err)
+	}
+	defer key.Close()
+	return helper.RunCommandWithInput(ctx, cmd, key, false)
+}
+
+// mountImageFileVolume mounts the partition holding the image file of the volume first and then the image file itself.
+// The returned function unmounts them in reverse order.
+func (copier *partitionCopier) mountImageFileVolume(volume *configuration.Volume, readOnly bool) (string, func(), error) {
+	parentDir, unmountParent, err := copier.Copier.newPartitionCopier(copier.ctx, volume.Partition, false, nil).mount(readOnly)
+	if err != nil {
+		return "", nil, err
+	}
+	imageFile, err := volumeImageFile(parentDir, volume.ImageFile)
+	if err != nil {
+		unmountParent()
+		return "", nil, fmt.Errorf("volume %s: %v", volume.Name, err)
+	}
+	mountDir, unmount, err := copier.mountImage(imageFile, readOnly)
+	if err != nil {
+		unmountParent()
+		return "", nil, err
+	}
+	return mountDir, func() {
+		unmount()
+		unmountParent()
+	}, nil
+}
+
+// volumeImageFile returns the path of the image file in the mounted partition. Symlinks on the way are resolved within the partition,
+// the image file itself must be a regular file.
+func volumeImageFile(mountDir string, imageFile string) (string, error) {
+	fullPath := filepath.Join(mountDir, imageFile)
+	dir, err := resolveInImage(mountDir, filepath.Dir(fullPath))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, filepath.Base(fullPath))
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", fmt.Errorf("image file %s does not exist in partition", imageFile)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("image file %s is not a regular file", imageFile)
+	}
+	return path, nil
+}
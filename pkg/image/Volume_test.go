@@ -0,0 +1,74 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMountCommand(t *testing.T) {
+	copier := testCopier()
+	copier.config.Volumes = []configuration.Volume{
+		{Name: "root", LVM: "vg0/root"},
+		{Name: "app", Partition: 2, ImageFile: "/images/rootfs.ext4"},
+		{Name: "secure", Partition: 2, LUKSKeyFile: "secure.key"},
+	}
+	tests := []struct {
+		partitionNumber int
+		expectedDevice  string
+	}{
+		{partitionNumber, fmt.Sprintf("-m /dev/sda%d ", partitionNumber)},
+		{configuration.FirstVolumeNumber, "-m /dev/vg0/root "},
+		{configuration.FirstVolumeNumber + 1, "-m /dev/sda "},
+	}
+	for _, test := range tests {
+		copier.partitionNumber = test.partitionNumber
+		cmd, keyFile := copier.mountCommand("image.img", "/tmp/mount-dir", true)
+		if !strings.HasPrefix(cmd, "guestmount -a image.img ") || !strings.Contains(cmd, test.expectedDevice) || !strings.Contains(cmd, " --ro /tmp/mount-dir ") {
+			t.Errorf("unexpected mount command of partition %d: %s", test.partitionNumber, cmd)
+		}
+		if keyFile != "" {
+			t.Errorf("expected no key file, got %s", keyFile)
+		}
+	}
+
+	copier.partitionNumber = configuration.FirstVolumeNumber + 2
+	cmd, keyFile := copier.mountCommand("image.img", "/tmp/mount-dir", false)
+	if !strings.HasPrefix(cmd, "guestfish --rw -a image.img --keys-from-stdin run : cryptsetup-open /dev/sda2 ") ||
+		!strings.Contains(cmd, " : mount /dev/mapper/") || !strings.Contains(cmd, " : mount-local /tmp/mount-dir readonly:false ") {
+		t.Errorf("unexpected mount command of LUKS volume: %s", cmd)
+	}
+	if keyFile != "secure.key" {
+		t.Errorf("expected key file secure.key, got %s", keyFile)
+	}
+}
+
+func TestVolumeImageFile(t *testing.T) {
+	mountDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(mountDir, "images"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(mountDir, "images", "rootfs.ext4"), []byte("filesystem"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink("/images", filepath.Join(mountDir, "current")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	path, err := volumeImageFile(mountDir, "/current/rootfs.ext4")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if path != filepath.Join(mountDir, "images", "rootfs.ext4") {
+		t.Errorf("expected the image file resolved within the partition, got %s", path)
+	}
+	if _, err := volumeImageFile(mountDir, "/images"); err == nil {
+		t.Errorf("expected error for a directory, got nil")
+	}
+	if _, err := volumeImageFile(mountDir, "/images/missing.ext4"); err == nil {
+		t.Errorf("expected error for a missing image file, got nil")
+	}
+}
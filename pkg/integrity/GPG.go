@@ -0,0 +1,41 @@
+package integrity
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gpgKeyringExtension is the extension of GPG keyrings in the keyring directory, as exported by `gpg --export`
+const gpgKeyringExtension = ".gpg"
+
+// verifyGPGSignature verifies the detached GPG signature of the package by gpgv with all GPG keyrings of the keyring directory.
+// The package content is passed to gpgv on its standard input.
+func verifyGPGSignature(ctx context.Context, content *openedPackage, signaturePath string, keyringDir string) error {
+	keyrings, err := filepath.Glob(filepath.Join(keyringDir, "*"+gpgKeyringExtension))
+	if err != nil {
+		return err
+	}
+	if len(keyrings) == 0 {
+		return fmt.Errorf("no GPG keyring (*%s) in keyring %s", gpgKeyringExtension, keyringDir)
+	}
+	var args []string
+	for _, keyring := range keyrings {
+		absKeyring, err := filepath.Abs(keyring)
+		if err != nil {
+			return err
+		}
+		// gpgv looks up keyrings without a slash in its home directory
+		args = append(args, "--keyring", absKeyring)
+	}
+	args = append(args, "--", signaturePath, "-")
+	cmd := exec.CommandContext(ctx, "gpgv", args...)
+	cmd.Stdin = content.reader(ctx)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gpgv failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package integrity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"package-to-image-placer/pkg/helper"
+	"strings"
+)
+
+// signatureExtensions are the extensions of detached signatures found next to the package when no signature is configured
+var signatureExtensions = []string{".minisig", ".sig", ".asc"}
+
+// ValidateSHA256 checks that the checksum is a hex encoded SHA256 digest.
+func ValidateSHA256(checksum string) error {
+	decoded, err := hex.DecodeString(checksum)
+	if err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("invalid SHA256 checksum '%s', must be 64 hexadecimal characters", checksum)
+	}
+	return nil
+}
+
+// VerifyPackage verifies the integrity of the opened package and returns its hex encoded SHA256 digest.
+// The package is read through the file descriptor only, so the caller can extract the verified content from the same descriptor
+// even if the package path is replaced in the meantime.
+// The digest is compared with the expected checksum if it is not empty.
+// If the keyring directory is set, the package must have a valid detached signature made by one of the keys of the keyring.
+// The signature is read from the signature path, or from the package path with one of the signature extensions if the signature path is empty.
+// A signature path without a keyring directory is an error, because the signature can't be checked.
+// If integrity is required, a package with neither an expected checksum nor a signature is rejected.
+func VerifyPackage(ctx context.Context, packageFile *os.File, expectedSHA256 string, signaturePath string, keyringDir string, requireIntegrity bool) (string, error) {
+	packagePath := packageFile.Name()
+	info, err := packageFile.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to read package %s: %v", packagePath, err)
+	}
+	content := &openedPackage{file: packageFile, size: info.Size()}
+	digest, err := fileSHA256(ctx, content)
+	if err != nil {
+		return "", err
+	}
+	if expectedSHA256 != "" && !strings.EqualFold(digest, expectedSHA256) {
+		return "", fmt.Errorf("package %s has SHA256 %s, expected %s", packagePath, digest, strings.ToLower(expectedSHA256))
+	}
+
+	if signaturePath == "" && keyringDir != "" {
+		signaturePath = FindSignature(packagePath)
+		if signaturePath == "" {
+			return "", fmt.Errorf("package %s is not signed, no signature found", packagePath)
+		}
+	}
+	if signaturePath == "" {
+		if requireIntegrity && expectedSHA256 == "" {
+			return "", fmt.Errorf("package %s has neither a SHA256 checksum nor a signature, but integrity is required", packagePath)
+		}
+		return digest, nil
+	}
+	if keyringDir == "" {
+		return "", fmt.Errorf("package %s has a signature, but no keyring is configured", packagePath)
+	}
+	err = verifySignature(ctx, content, signaturePath, keyringDir)
+	if err != nil {
+		return "", fmt.Errorf("signature verification of package %s failed: %w", packagePath, err)
+	}
+	return digest, nil
+}
+
+// openedPackage is the content of an opened package, read from its start by every reader
+type openedPackage struct {
+	file *os.File
+	size int64
+}
+
+// reader returns a new reader of the content stopping when the context is cancelled
+func (content *openedPackage) reader(ctx context.Context) io.Reader {
+	return &contextReader{ctx: ctx, reader: io.NewSectionReader(content.file, 0, content.size)}
+}
+
+// FindSignature returns the path of the detached signature next to the package, or an empty string if there is none.
+func FindSignature(packagePath string) string {
+	for _, extension := range signatureExtensions {
+		if helper.DoesFileExists(packagePath + extension) {
+			return packagePath + extension
+		}
+	}
+	return ""
+}
+
+// verifySignature verifies the detached signature of the package. Minisign signatures are checked against the minisign
+// public keys of the keyring, any other signature is passed to gpgv with the GPG keyrings of the keyring directory.
+func verifySignature(ctx context.Context, content *openedPackage, signaturePath string, keyringDir string) error {
+	signature, err := os.ReadFile(signaturePath)
+	if err != nil {
+		return fmt.Errorf("unable to read signature %s: %v", signaturePath, err)
+	}
+	if isMinisignSignature(signature) {
+		return verifyMinisignSignature(ctx, content, signature, keyringDir)
+	}
+	return verifyGPGSignature(ctx, content, signaturePath, keyringDir)
+}
+
+// fileSHA256 returns the hex encoded SHA256 digest of the package content.
+func fileSHA256(ctx context.Context, content *openedPackage) (string, error) {
+	hash := sha256.New()
+	_, err := io.Copy(hash, content.reader(ctx))
+	if err != nil {
+		return "", fmt.Errorf("unable to read package %s: %v", content.file.Name(), err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contextReader is a reader which stops reading when the context is cancelled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
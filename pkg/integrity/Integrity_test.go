@@ -0,0 +1,219 @@
+package integrity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var packageContent = []byte("package content")
+
+// createTestPackage writes the package to a temporary directory and returns its path
+func createTestPackage(t *testing.T) string {
+	packagePath := filepath.Join(t.TempDir(), "package.zip")
+	if err := os.WriteFile(packagePath, packageContent, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return packagePath
+}
+
+// openTestPackage opens the package for verification, it is closed when the test ends
+func openTestPackage(t *testing.T, packagePath string) *os.File {
+	packageFile, err := os.Open(packagePath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { packageFile.Close() })
+	return packageFile
+}
+
+// createMinisignKey writes a new minisign public key with the key ID to the keyring directory and returns the private key
+func createMinisignKey(t *testing.T, keyringDir string, keyID uint64) ed25519.PrivateKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	encoded := append([]byte(minisignAlgorithm), binary.LittleEndian.AppendUint64(nil, keyID)...)
+	encoded = append(encoded, publicKey...)
+	content := "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(encoded) + "\n"
+	if err := os.WriteFile(filepath.Join(keyringDir, "test.pub"), []byte(content), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	return privateKey
+}
+
+// signMinisign writes the minisign signature of the package made by the algorithm next to the package
+func signMinisign(t *testing.T, packagePath string, privateKey ed25519.PrivateKey, keyID uint64, algorithm string) {
+	message := packageContent
+	if algorithm == minisignHashedAlgorithm {
+		hash := blake2b.Sum512(packageContent)
+		message = hash[:]
+	}
+	signature := ed25519.Sign(privateKey, message)
+	trustedComment := "timestamp:1700000000\tfile:package.zip"
+	globalSignature := ed25519.Sign(privateKey, append(append([]byte{}, signature...), trustedComment...))
+	encoded := append([]byte(algorithm), binary.LittleEndian.AppendUint64(nil, keyID)...)
+	encoded = append(encoded, signature...)
+	content := "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(encoded) + "\n" +
+		trustedCommentPrefix + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(globalSignature) + "\n"
+	if err := os.WriteFile(packagePath+".minisig", []byte(content), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestVerifyPackage_Checksum(t *testing.T) {
+	packagePath := createTestPackage(t)
+	sum := sha256.Sum256(packageContent)
+	expected := hex.EncodeToString(sum[:])
+
+	digest, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), strings.ToUpper(expected), "", "", false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if digest != expected {
+		t.Errorf("expected digest %s, got %s", expected, digest)
+	}
+}
+
+func TestVerifyPackage_ChecksumMismatch(t *testing.T) {
+	packagePath := createTestPackage(t)
+
+	_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), strings.Repeat("0", 64), "", "", false)
+	if err == nil || !strings.Contains(err.Error(), "expected "+strings.Repeat("0", 64)) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestVerifyPackage_Minisign(t *testing.T) {
+	for _, algorithm := range []string{minisignAlgorithm, minisignHashedAlgorithm} {
+		packagePath := createTestPackage(t)
+		keyringDir := t.TempDir()
+		privateKey := createMinisignKey(t, keyringDir, 42)
+		signMinisign(t, packagePath, privateKey, 42, algorithm)
+
+		_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", keyringDir, false)
+		if err != nil {
+			t.Fatalf("expected no error for algorithm %s, got %v", algorithm, err)
+		}
+	}
+}
+
+func TestVerifyPackage_MinisignTampered(t *testing.T) {
+	packagePath := createTestPackage(t)
+	keyringDir := t.TempDir()
+	privateKey := createMinisignKey(t, keyringDir, 42)
+	signMinisign(t, packagePath, privateKey, 42, minisignHashedAlgorithm)
+	if err := os.WriteFile(packagePath, []byte("tampered content"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", keyringDir, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid minisign signature") {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+}
+
+func TestVerifyPackage_MinisignUnknownKey(t *testing.T) {
+	packagePath := createTestPackage(t)
+	keyringDir := t.TempDir()
+	createMinisignKey(t, keyringDir, 42)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	signMinisign(t, packagePath, otherKey, 7, minisignHashedAlgorithm)
+
+	_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", keyringDir, false)
+	if err == nil || !strings.Contains(err.Error(), "no public key with ID") {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+}
+
+func TestVerifyPackage_Unsigned(t *testing.T) {
+	packagePath := createTestPackage(t)
+
+	_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", t.TempDir(), false)
+	if err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Fatalf("expected unsigned package, got %v", err)
+	}
+}
+
+func TestVerifyPackage_GPG(t *testing.T) {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	packagePath := createTestPackage(t)
+	keyringDir := t.TempDir()
+	homeDir, err := os.MkdirTemp("", "gnupg-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(homeDir)
+	gpg := func(args ...string) {
+		output, err := exec.Command("gpg", append([]string{"--homedir", homeDir, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("gpg %v failed: %v: %s", args, err, output)
+		}
+	}
+	gpg("--quick-gen-key", "Test <test@example.com>", "ed25519", "sign", "never")
+	gpg("--output", filepath.Join(keyringDir, "test.gpg"), "--export", "test@example.com")
+	gpg("--output", packagePath+".sig", "--detach-sign", packagePath)
+
+	_, err = VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", keyringDir, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := os.WriteFile(packagePath, []byte("tampered content"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", keyringDir, false)
+	if err == nil || !strings.Contains(err.Error(), "gpgv failed") {
+		t.Fatalf("expected gpgv failure, got %v", err)
+	}
+}
+
+func TestVerifyPackage_ReplacedAfterOpen(t *testing.T) {
+	packagePath := createTestPackage(t)
+	packageFile := openTestPackage(t, packagePath)
+	replacedPath := packagePath + ".new"
+	if err := os.WriteFile(replacedPath, []byte("replaced content"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Rename(replacedPath, packagePath); err != nil {
+		t.Fatal(err.Error())
+	}
+	hash := sha256.Sum256(packageContent)
+
+	digest, err := VerifyPackage(context.Background(), packageFile, hex.EncodeToString(hash[:]), "", "", false)
+	if err != nil {
+		t.Fatalf("expected the opened package to be verified, got %v", err)
+	}
+	if digest != hex.EncodeToString(hash[:]) {
+		t.Errorf("expected digest of the opened package, got %s", digest)
+	}
+}
+
+func TestVerifyPackage_IntegrityRequired(t *testing.T) {
+	packagePath := createTestPackage(t)
+
+	_, err := VerifyPackage(context.Background(), openTestPackage(t, packagePath), "", "", "", true)
+	if err == nil || !strings.Contains(err.Error(), "integrity is required") {
+		t.Fatalf("expected package without checksum and signature to be rejected, got %v", err)
+	}
+	hash := sha256.Sum256(packageContent)
+	_, err = VerifyPackage(context.Background(), openTestPackage(t, packagePath), hex.EncodeToString(hash[:]), "", "", true)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
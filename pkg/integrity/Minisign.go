@@ -0,0 +1,153 @@
+package integrity
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// minisignPublicKeyExtension is the extension of minisign public keys in the keyring directory
+	minisignPublicKeyExtension = ".pub"
+	untrustedCommentPrefix     = "untrusted comment:"
+	trustedCommentPrefix       = "trusted comment: "
+	// minisignAlgorithm signs the file itself (legacy signatures)
+	minisignAlgorithm = "Ed"
+	// minisignHashedAlgorithm signs the BLAKE2b-512 hash of the file (default of minisign)
+	minisignHashedAlgorithm = "ED"
+	minisignKeyIDSize       = 8
+)
+
+// minisignSignature is a parsed minisign signature file
+type minisignSignature struct {
+	algorithm       string
+	keyID           uint64
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+// isMinisignSignature reports whether the signature is in the minisign format
+func isMinisignSignature(signature []byte) bool {
+	return bytes.HasPrefix(signature, []byte(untrustedCommentPrefix))
+}
+
+// verifyMinisignSignature verifies the minisign signature of the package, including its trusted comment,
+// with the public key of the keyring directory whose key ID matches the signature.
+func verifyMinisignSignature(ctx context.Context, content *openedPackage, signatureContent []byte, keyringDir string) error {
+	signature, err := parseMinisignSignature(signatureContent)
+	if err != nil {
+		return err
+	}
+	publicKeys, err := loadMinisignPublicKeys(keyringDir)
+	if err != nil {
+		return err
+	}
+	publicKey, found := publicKeys[signature.keyID]
+	if !found {
+		return fmt.Errorf("no public key with ID %016X in keyring %s", signature.keyID, keyringDir)
+	}
+
+	message, err := minisignMessage(ctx, content, signature.algorithm)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, message, signature.signature) {
+		return fmt.Errorf("invalid minisign signature")
+	}
+	globalMessage := append(append([]byte{}, signature.signature...), signature.trustedComment...)
+	if !ed25519.Verify(publicKey, globalMessage, signature.globalSignature) {
+		return fmt.Errorf("invalid minisign signature of the trusted comment")
+	}
+	return nil
+}
+
+// minisignMessage returns the signed message: the package content itself or its BLAKE2b-512 hash, depending on the algorithm.
+func minisignMessage(ctx context.Context, content *openedPackage, algorithm string) ([]byte, error) {
+	reader := content.reader(ctx)
+	if algorithm == minisignAlgorithm {
+		message, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read package %s: %v", content.file.Name(), err)
+		}
+		return message, nil
+	}
+	hash, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(hash, reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read package %s: %v", content.file.Name(), err)
+	}
+	return hash.Sum(nil), nil
+}
+
+// parseMinisignSignature parses the content of a minisign signature file
+func parseMinisignSignature(content []byte) (*minisignSignature, error) {
+	lines := strings.Split(strings.TrimRight(string(content), "\r\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, fmt.Errorf("invalid minisign signature format")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(decoded) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid minisign signature encoding")
+	}
+	algorithm := string(decoded[:2])
+	if algorithm != minisignAlgorithm && algorithm != minisignHashedAlgorithm {
+		return nil, fmt.Errorf("unsupported minisign signature algorithm '%s'", algorithm)
+	}
+	globalSignature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid minisign global signature encoding")
+	}
+	return &minisignSignature{
+		algorithm:       algorithm,
+		keyID:           binary.LittleEndian.Uint64(decoded[2 : 2+minisignKeyIDSize]),
+		signature:       decoded[2+minisignKeyIDSize:],
+		trustedComment:  strings.TrimSuffix(strings.TrimPrefix(lines[2], trustedCommentPrefix), "\r"),
+		globalSignature: globalSignature,
+	}, nil
+}
+
+// loadMinisignPublicKeys loads all minisign public keys of the keyring directory by their key ID
+func loadMinisignPublicKeys(keyringDir string) (map[uint64]ed25519.PublicKey, error) {
+	keyFiles, err := filepath.Glob(filepath.Join(keyringDir, "*"+minisignPublicKeyExtension))
+	if err != nil {
+		return nil, err
+	}
+	publicKeys := map[uint64]ed25519.PublicKey{}
+	for _, keyFile := range keyFiles {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read public key %s: %v", keyFile, err)
+		}
+		keyID, publicKey, err := parseMinisignPublicKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("public key %s: %v", keyFile, err)
+		}
+		publicKeys[keyID] = publicKey
+	}
+	return publicKeys, nil
+}
+
+// parseMinisignPublicKey parses the content of a minisign public key file.
+// The untrusted comment line is optional, so the key can also be given as the bare base64 line.
+func parseMinisignPublicKey(content []byte) (uint64, ed25519.PublicKey, error) {
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	encoded := strings.TrimSpace(lines[len(lines)-1])
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != 2+minisignKeyIDSize+ed25519.PublicKeySize || string(decoded[:2]) != minisignAlgorithm {
+		return 0, nil, fmt.Errorf("invalid minisign public key")
+	}
+	return binary.LittleEndian.Uint64(decoded[2 : 2+minisignKeyIDSize]), ed25519.PublicKey(decoded[2+minisignKeyIDSize:]), nil
+}
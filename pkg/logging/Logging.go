@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// DefaultLevel is the log level used if none is given. Per-file events are logged only at the debug level.
+const DefaultLevel = "info"
+
+// RunIDKey is the attribute key of the run correlation ID
+const RunIDKey = "run-id"
+
+type runIDContextKey struct{}
+
+// NewLogger creates a structured logger writing to the writer.
+// Level is one of debug, info, warn and error; format is text or json.
+func NewLogger(writer io.Writer, level string, format string) (*slog.Logger, error) {
+	slogLevel, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: slogLevel}
+	switch format {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(writer, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(writer, options)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format '%s', must be %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// ParseLevel converts the name of the log level to slog.Level.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level '%s', must be one of debug, info, warn, error", level)
+	}
+}
+
+// NewRunID returns a random ID correlating all log records of one run.
+func NewRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithRunID returns a context carrying the run ID, so loggers created during the run can be correlated.
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDContextKey{}, runID)
+}
+
+// RunID returns the run ID carried by the context, or an empty string.
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDContextKey{}).(string)
+	return runID
+}
@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger_JSONFormat(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := NewLogger(&output, "info", FormatJSON)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	logger.Debug("Extracting file", "file", "etc/hostname")
+	logger.Info("Partition mounted", "partition", 1)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the info record, got %v", lines)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("expected JSON record, got %v", err)
+	}
+	if record["msg"] != "Partition mounted" || record["partition"] != float64(1) {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestNewLogger_DebugLevel(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := NewLogger(&output, "debug", FormatText)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	logger.Debug("Extracting file", "file", "etc/hostname")
+	if !strings.Contains(output.String(), "file=etc/hostname") {
+		t.Fatalf("expected debug record, got '%s'", output.String())
+	}
+}
+
+func TestNewLogger_InvalidOptions(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "verbose", FormatText); err == nil {
+		t.Fatalf("expected error for invalid level, got nil")
+	}
+	if _, err := NewLogger(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Fatalf("expected error for invalid format, got nil")
+	}
+}
+
+func TestRunID(t *testing.T) {
+	if RunID(context.Background()) != "" {
+		t.Fatalf("expected empty run ID")
+	}
+	runID := NewRunID()
+	if RunID(WithRunID(context.Background(), runID)) != runID {
+		t.Fatalf("expected run ID %s", runID)
+	}
+}
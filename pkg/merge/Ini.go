@@ -0,0 +1,126 @@
+package merge
+
+import (
+	"slices"
+	"strings"
+)
+
+// iniSection is a section of an INI file with its lines, without the header line.
+// The section with an empty name holds the lines before the first header.
+type iniSection struct {
+	name   string
+	header string
+	lines  []string
+	// added is set for sections added from the incoming content, they are separated by a blank line
+	added bool
+}
+
+// mergeIni merges the incoming INI or systemd-style content into the existing content.
+// The keys of the incoming sections replace all lines of the same key in the same existing section, so repeated keys
+// (e.g. ExecStart) are replaced as a whole. New keys are added at the end of their section and new sections at the end of the file.
+// Comments, blank lines and the order of the existing content are kept.
+func mergeIni(existing []byte, incoming []byte) []byte {
+	sections := parseIni(splitLines(existing))
+	for _, incomingSection := range parseIni(splitLines(incoming)) {
+		index := slices.IndexFunc(sections, func(section *iniSection) bool { return section.name == incomingSection.name })
+		if index == -1 {
+			lines := trimTrailingBlankLines(incomingSection.lines)
+			if len(lines) == 0 {
+				continue
+			}
+			sections = append(sections, &iniSection{name: incomingSection.name, header: incomingSection.header, lines: lines, added: true})
+			continue
+		}
+		section := sections[index]
+		keys, values := groupIniKeys(incomingSection.lines)
+		for _, key := range keys {
+			section.setKey(key, values[key])
+		}
+	}
+
+	var lines []string
+	for _, section := range sections {
+		if section.header != "" {
+			if section.added && len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+				lines = append(lines, "")
+			}
+			lines = append(lines, section.header)
+		}
+		lines = append(lines, section.lines...)
+	}
+	return joinLines(lines)
+}
+
+// setKey replaces all lines of the key by the given lines. The lines are added after the last non-blank line if the section has no such key.
+func (section *iniSection) setKey(key string, keyLines []string) {
+	first := -1
+	var lines []string
+	for _, line := range section.lines {
+		if lineKey, isKey := iniKey(line); isKey && lineKey == key {
+			if first == -1 {
+				first = len(lines)
+				lines = append(lines, keyLines...)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if first == -1 {
+		end := len(trimTrailingBlankLines(lines))
+		lines = slices.Concat(lines[:end:end], keyLines, lines[end:])
+	}
+	section.lines = lines
+}
+
+// parseIni splits the lines to sections. The first section is the section without a name.
+func parseIni(lines []string) []*iniSection {
+	sections := []*iniSection{{}}
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			sections = append(sections, &iniSection{name: strings.TrimSpace(trimmed[1 : len(trimmed)-1]), header: line})
+			continue
+		}
+		section := sections[len(sections)-1]
+		section.lines = append(section.lines, line)
+	}
+	return sections
+}
+
+// groupIniKeys returns the keys of the lines in the order of their first occurrence and all lines of every key.
+// Comments and blank lines are dropped.
+func groupIniKeys(lines []string) ([]string, map[string][]string) {
+	var keys []string
+	values := map[string][]string{}
+	for _, line := range lines {
+		key, isKey := iniKey(line)
+		if !isKey {
+			continue
+		}
+		if _, found := values[key]; !found {
+			keys = append(keys, key)
+		}
+		values[key] = append(values[key], line)
+	}
+	return keys, values
+}
+
+// iniKey returns the key of the line. Lines without a value (e.g. flags of my.cnf) are keys themselves.
+// It returns false for blank lines and comments.
+func iniKey(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+		return "", false
+	}
+	key, _, _ := strings.Cut(trimmed, "=")
+	return strings.TrimSpace(key), true
+}
+
+// trimTrailingBlankLines returns the lines without the blank lines at the end
+func trimTrailingBlankLines(lines []string) []string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return lines[:end]
+}
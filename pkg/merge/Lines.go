@@ -0,0 +1,66 @@
+package merge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// appendLines appends the incoming lines which are not in the existing content yet, ignoring trailing whitespace.
+// Empty lines are not appended.
+func appendLines(existing []byte, incoming []byte) []byte {
+	lines := splitLines(existing)
+	present := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		present[strings.TrimRight(line, " \t\r")] = true
+	}
+	for _, line := range splitLines(incoming) {
+		trimmed := strings.TrimRight(line, " \t\r")
+		if trimmed == "" || present[trimmed] {
+			continue
+		}
+		present[trimmed] = true
+		lines = append(lines, line)
+	}
+	return joinLines(lines)
+}
+
+// replaceBlock replaces the lines between the begin and end markers in the existing content, including the markers,
+// by the incoming content enclosed in the markers. The block is appended if the existing content has no markers.
+func replaceBlock(existing []byte, incoming []byte, options Options) ([]byte, error) {
+	if options.Marker == "" {
+		return nil, fmt.Errorf("block merge requires a marker")
+	}
+	comment := options.Comment
+	if comment == "" {
+		comment = "#"
+	}
+	beginMarker := comment + " BEGIN " + options.Marker
+	endMarker := comment + " END " + options.Marker
+
+	block := append([]string{beginMarker}, splitLines(incoming)...)
+	block = append(block, endMarker)
+
+	lines := splitLines(existing)
+	begin, end := -1, -1
+	for i, line := range lines {
+		switch strings.TrimSpace(line) {
+		case beginMarker:
+			if begin == -1 {
+				begin = i
+			}
+		case endMarker:
+			if begin != -1 && end == -1 {
+				end = i
+			}
+		}
+	}
+	if begin == -1 {
+		return joinLines(append(lines, block...)), nil
+	}
+	if end == -1 {
+		return nil, fmt.Errorf("block '%s' has no end marker", options.Marker)
+	}
+	merged := append(lines[:begin:begin], block...)
+	merged = append(merged, lines[end+1:]...)
+	return joinLines(merged), nil
+}
@@ -0,0 +1,76 @@
+package merge
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	// StrategyAppendLines appends the lines of the package file missing in the existing file
+	StrategyAppendLines = "append-lines"
+	// StrategyBlock replaces the block between the markers in the existing file, or appends it
+	StrategyBlock = "block"
+	// StrategyIni merges the keys of INI and systemd-style files section by section
+	StrategyIni = "ini"
+	// StrategyJSON deep merges JSON objects
+	StrategyJSON = "json"
+	// StrategyYAML deep merges YAML mappings
+	StrategyYAML = "yaml"
+)
+
+// Strategies are all supported merge strategies
+var Strategies = []string{StrategyAppendLines, StrategyBlock, StrategyIni, StrategyJSON, StrategyYAML}
+
+// Options are the options of the block strategy
+type Options struct {
+	// Marker names the block, the block is delimited by the "<comment> BEGIN <marker>" and "<comment> END <marker>" lines
+	Marker string
+	// Comment starts the comment lines of the markers
+	Comment string
+}
+
+// Merge merges the content of the package file into the content of the existing file using the strategy.
+// Merging is idempotent, merging the same content again gives the same result.
+func Merge(strategy string, existing []byte, incoming []byte, options Options) ([]byte, error) {
+	switch strategy {
+	case StrategyAppendLines:
+		return appendLines(existing, incoming), nil
+	case StrategyBlock:
+		return replaceBlock(existing, incoming, options)
+	case StrategyIni:
+		return mergeIni(existing, incoming), nil
+	case StrategyJSON:
+		return mergeJSON(existing, incoming)
+	case StrategyYAML:
+		return mergeYAML(existing, incoming)
+	default:
+		return nil, fmt.Errorf("unknown merge strategy '%s'", strategy)
+	}
+}
+
+// splitLines splits the content to lines without the line endings. A trailing newline doesn't add an empty line.
+func splitLines(content []byte) []string {
+	content = bytes.TrimSuffix(content, []byte("\n"))
+	if len(content) == 0 {
+		return nil
+	}
+	return bytesToStrings(bytes.Split(content, []byte("\n")))
+}
+
+// joinLines joins the lines to the content ending with a newline.
+func joinLines(lines []string) []byte {
+	var buffer bytes.Buffer
+	for _, line := range lines {
+		buffer.WriteString(line)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+func bytesToStrings(lines [][]byte) []string {
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		result[i] = string(line)
+	}
+	return result
+}
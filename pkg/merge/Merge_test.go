@@ -0,0 +1,91 @@
+package merge
+
+import "testing"
+
+func TestMerge_AppendLines(t *testing.T) {
+	existing := "UUID=1234 / ext4 defaults 0 1\nproc /proc proc defaults 0 0"
+	incoming := "proc /proc proc defaults 0 0  \n\n/dev/sdb1 /data ext4 defaults 0 2\n"
+	merged, err := Merge(StrategyAppendLines, []byte(existing), []byte(incoming), Options{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := "UUID=1234 / ext4 defaults 0 1\nproc /proc proc defaults 0 0\n/dev/sdb1 /data ext4 defaults 0 2\n"
+	if string(merged) != expected {
+		t.Fatalf("expected %q, got %q", expected, merged)
+	}
+}
+
+func TestMerge_BlockReplacedAndAppended(t *testing.T) {
+	options := Options{Marker: "app"}
+	appended, err := Merge(StrategyBlock, []byte("127.0.0.1 localhost\n"), []byte("10.0.0.1 server\n"), options)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := "127.0.0.1 localhost\n# BEGIN app\n10.0.0.1 server\n# END app\n"
+	if string(appended) != expected {
+		t.Fatalf("expected %q, got %q", expected, appended)
+	}
+	replaced, err := Merge(StrategyBlock, appended, []byte("10.0.0.2 server\n"), options)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected = "127.0.0.1 localhost\n# BEGIN app\n10.0.0.2 server\n# END app\n"
+	if string(replaced) != expected {
+		t.Fatalf("expected %q, got %q", expected, replaced)
+	}
+	if _, err := Merge(StrategyBlock, []byte("# BEGIN app\n"), []byte("x\n"), options); err == nil {
+		t.Fatalf("expected error for block without end marker, got nil")
+	}
+}
+
+func TestMerge_Ini(t *testing.T) {
+	existing := "# unit\n[Service]\nExecStart=/bin/old\nExecStart=/bin/old2\nRestart=no\n\n[Install]\nWantedBy=multi-user.target\n"
+	incoming := "[Service]\nExecStart=\nExecStart=/bin/new\nUser=app\n[Unit]\nDescription=App\n"
+	merged, err := Merge(StrategyIni, []byte(existing), []byte(incoming), Options{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := "# unit\n[Service]\nExecStart=\nExecStart=/bin/new\nRestart=no\nUser=app\n\n[Install]\nWantedBy=multi-user.target\n\n[Unit]\nDescription=App\n"
+	if string(merged) != expected {
+		t.Fatalf("expected %q, got %q", expected, merged)
+	}
+	again, _ := Merge(StrategyIni, merged, []byte(incoming), Options{})
+	if string(again) != expected {
+		t.Fatalf("expected merging to be idempotent, got %q", again)
+	}
+}
+
+func TestMerge_JSON(t *testing.T) {
+	existing := "{\n    \"name\": \"base\",\n    \"log\": {\"level\": \"info\", \"file\": \"/var/log/app\"},\n    \"ports\": [80, 443],\n    \"big\": 12345678901234567890\n}\n"
+	incoming := `{"log": {"level": "debug"}, "ports": [8080], "url": "http://a/<b>"}`
+	merged, err := Merge(StrategyJSON, []byte(existing), []byte(incoming), Options{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := "{\n    \"name\": \"base\",\n    \"log\": {\n        \"level\": \"debug\",\n        \"file\": \"/var/log/app\"\n    },\n    \"ports\": [\n        8080\n    ],\n    \"big\": 12345678901234567890,\n    \"url\": \"http://a/<b>\"\n}\n"
+	if string(merged) != expected {
+		t.Fatalf("expected %q, got %q", expected, merged)
+	}
+	if _, err := Merge(StrategyJSON, []byte("{"), []byte("{}"), Options{}); err == nil {
+		t.Fatalf("expected error for invalid JSON, got nil")
+	}
+}
+
+func TestMerge_YAML(t *testing.T) {
+	existing := "# settings\nname: base\nlog:\n  level: info # default\n  file: /var/log/app\nports: [80]\n"
+	incoming := "log:\n  level: debug\nports:\n  - 8080\nextra: true\n"
+	merged, err := Merge(StrategyYAML, []byte(existing), []byte(incoming), Options{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := "# settings\nname: base\nlog:\n  level: debug\n  file: /var/log/app\nports:\n  - 8080\nextra: true\n"
+	if string(merged) != expected {
+		t.Fatalf("expected %q, got %q", expected, merged)
+	}
+}
+
+func TestMerge_UnknownStrategy(t *testing.T) {
+	if _, err := Merge("replace", nil, nil, Options{}); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
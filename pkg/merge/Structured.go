@@ -0,0 +1,231 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jsonObject is a JSON object which keeps the order of its keys
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+// mergeJSON deep merges the incoming JSON into the existing JSON. Objects are merged key by key, other values
+// including arrays are replaced. The order of the existing keys is kept and new keys are added at the end.
+// The result is indented as the existing content.
+func mergeJSON(existing []byte, incoming []byte) ([]byte, error) {
+	incomingValue, err := decodeJSON(incoming)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON of the package file: %v", err)
+	}
+	if len(bytes.TrimSpace(existing)) == 0 {
+		return encodeJSON(incomingValue, "  ")
+	}
+	existingValue, err := decodeJSON(existing)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON of the existing file: %v", err)
+	}
+	return encodeJSON(mergeJSONValues(existingValue, incomingValue), detectIndent(existing))
+}
+
+// mergeJSONValues merges the overlay value into the base value
+func mergeJSONValues(base any, overlay any) any {
+	baseObject, baseIsObject := base.(*jsonObject)
+	overlayObject, overlayIsObject := overlay.(*jsonObject)
+	if !baseIsObject || !overlayIsObject {
+		return overlay
+	}
+	for _, key := range overlayObject.keys {
+		value, found := baseObject.values[key]
+		if !found {
+			baseObject.keys = append(baseObject.keys, key)
+			baseObject.values[key] = overlayObject.values[key]
+			continue
+		}
+		baseObject.values[key] = mergeJSONValues(value, overlayObject.values[key])
+	}
+	return baseObject
+}
+
+// decodeJSON decodes the JSON document, numbers are kept as written
+func decodeJSON(content []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	value, err := decodeJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected content after the JSON value")
+	}
+	return value, nil
+}
+
+func decodeJSONValue(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := &jsonObject{values: map[string]any{}}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyToken.(string)
+			value, err := decodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			if _, found := object.values[key]; !found {
+				object.keys = append(object.keys, key)
+			}
+			object.values[key] = value
+		}
+		_, err := decoder.Token()
+		return object, err
+	case json.Delim('['):
+		array := []any{}
+		for decoder.More() {
+			value, err := decodeJSONValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := decoder.Token()
+		return array, err
+	default:
+		return token, nil
+	}
+}
+
+// encodeJSON encodes the value indented by the indent, ending with a newline
+func encodeJSON(value any, indent string) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := writeJSONValue(&compact, value); err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, compact.Bytes(), "", indent); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+func writeJSONValue(buffer *bytes.Buffer, value any) error {
+	switch typed := value.(type) {
+	case *jsonObject:
+		buffer.WriteByte('{')
+		for i, key := range typed.keys {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeJSONValue(buffer, key); err != nil {
+				return err
+			}
+			buffer.WriteByte(':')
+			if err := writeJSONValue(buffer, typed.values[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+	case []any:
+		buffer.WriteByte('[')
+		for i, element := range typed {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeJSONValue(buffer, element); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+	default:
+		encoder := json.NewEncoder(buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(typed); err != nil {
+			return err
+		}
+		// Encode adds a newline
+		buffer.Truncate(buffer.Len() - 1)
+	}
+	return nil
+}
+
+// detectIndent returns the leading whitespace of the first indented line, or two spaces
+func detectIndent(content []byte) string {
+	for _, line := range splitLines(content) {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+// mergeYAML deep merges the incoming YAML into the existing YAML. Mappings are merged key by key, other values
+// including sequences are replaced. The order of the existing keys and their comments are kept, new keys are added at the end.
+func mergeYAML(existing []byte, incoming []byte) ([]byte, error) {
+	var incomingDocument yaml.Node
+	if err := yaml.Unmarshal(incoming, &incomingDocument); err != nil {
+		return nil, fmt.Errorf("invalid YAML of the package file: %v", err)
+	}
+	var existingDocument yaml.Node
+	if err := yaml.Unmarshal(existing, &existingDocument); err != nil {
+		return nil, fmt.Errorf("invalid YAML of the existing file: %v", err)
+	}
+	document := &incomingDocument
+	if len(existingDocument.Content) > 0 && len(incomingDocument.Content) > 0 {
+		existingDocument.Content[0] = mergeYAMLNodes(existingDocument.Content[0], incomingDocument.Content[0])
+		document = &existingDocument
+	} else if len(incomingDocument.Content) == 0 {
+		document = &existingDocument
+	}
+	if len(document.Content) == 0 {
+		return []byte{}, nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return nil, fmt.Errorf("failed to encode merged YAML: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode merged YAML: %v", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// mergeYAMLNodes merges the overlay node into the base node
+func mergeYAMLNodes(base *yaml.Node, overlay *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || overlay.Kind != yaml.MappingNode {
+		return overlay
+	}
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Kind == yaml.ScalarNode && key.Kind == yaml.ScalarNode && base.Content[j].Value == key.Value {
+				base.Content[j+1] = mergeYAMLNodes(base.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			base.Content = append(base.Content, key, value)
+		}
+	}
+	return base
+}
@@ -0,0 +1,82 @@
+package permissions
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Accounts resolves the user and group names of an image from its /etc/passwd and /etc/group.
+// The accounts of the host are never used, as they may differ from the image.
+type Accounts struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+// LoadAccounts reads the users and groups of the image mounted to the root directory.
+// Missing account files are treated as empty, so only numeric IDs can be resolved.
+func LoadAccounts(rootDir string) (*Accounts, error) {
+	users, err := readAccountFile(filepath.Join(rootDir, "etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+	groups, err := readAccountFile(filepath.Join(rootDir, "etc/group"))
+	if err != nil {
+		return nil, err
+	}
+	return &Accounts{users: users, groups: groups}, nil
+}
+
+// UserID returns the ID of the user given by name or number.
+func (accounts *Accounts) UserID(user string) (int, error) {
+	return lookupID(accounts.users, user, "user")
+}
+
+// GroupID returns the ID of the group given by name or number.
+func (accounts *Accounts) GroupID(group string) (int, error) {
+	return lookupID(accounts.groups, group, "group")
+}
+
+// lookupID returns the ID of the account, which is either a number or a name from the accounts
+func lookupID(accounts map[string]int, account string, kind string) (int, error) {
+	if id, err := strconv.Atoi(account); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, found := accounts[account]
+	if !found {
+		return 0, fmt.Errorf("%s %s does not exist in the image", kind, account)
+	}
+	return id, nil
+}
+
+// readAccountFile reads the names and IDs (the first and third field) of a passwd or group file
+func readAccountFile(path string) (map[string]int, error) {
+	accounts := map[string]int{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return accounts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %v", path, err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		accounts[fields[0]] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	return accounts, nil
+}
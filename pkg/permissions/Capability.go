@@ -0,0 +1,76 @@
+package permissions
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CapabilityXattr is the extended attribute holding the file capabilities
+const CapabilityXattr = "security.capability"
+
+const (
+	// vfsCapRevision2 is the revision of the capability xattr format supporting 64 capabilities
+	vfsCapRevision2 = 0x02000000
+	// vfsCapFlagEffective marks the permitted capabilities as effective when the file is executed
+	vfsCapFlagEffective = 0x000001
+)
+
+// capabilityNumbers maps the names of the capabilities, without the cap_ prefix, to their numbers (see capabilities(7))
+var capabilityNumbers = map[string]uint{
+	"chown": 0, "dac_override": 1, "dac_read_search": 2, "fowner": 3, "fsetid": 4, "kill": 5, "setgid": 6, "setuid": 7,
+	"setpcap": 8, "linux_immutable": 9, "net_bind_service": 10, "net_broadcast": 11, "net_admin": 12, "net_raw": 13,
+	"ipc_lock": 14, "ipc_owner": 15, "sys_module": 16, "sys_rawio": 17, "sys_chroot": 18, "sys_ptrace": 19, "sys_pacct": 20,
+	"sys_admin": 21, "sys_boot": 22, "sys_nice": 23, "sys_resource": 24, "sys_time": 25, "sys_tty_config": 26, "mknod": 27,
+	"lease": 28, "audit_write": 29, "audit_control": 30, "setfcap": 31, "mac_override": 32, "mac_admin": 33, "syslog": 34,
+	"wake_alarm": 35, "block_suspend": 36, "audit_read": 37, "perfmon": 38, "bpf": 39, "checkpoint_restore": 40,
+}
+
+// EncodeCapabilities converts the capabilities in the text form of setcap(8), e.g. "cap_net_raw,cap_net_admin+ep",
+// to the value of the CapabilityXattr extended attribute. Clauses are separated by spaces, each clause is a comma separated
+// list of capabilities followed by '+' or '=' and the flags 'e' (effective), 'i' (inheritable) and 'p' (permitted).
+func EncodeCapabilities(text string) ([]byte, error) {
+	var permitted, inheritable uint64
+	effective := false
+	clauses := strings.Fields(text)
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("no capabilities given")
+	}
+	for _, clause := range clauses {
+		operatorIndex := strings.IndexAny(clause, "+=")
+		if operatorIndex <= 0 {
+			return nil, fmt.Errorf("invalid capability clause '%s', expected <capabilities>+<flags>", clause)
+		}
+		var capabilities uint64
+		for _, name := range strings.Split(clause[:operatorIndex], ",") {
+			number, found := capabilityNumbers[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+			if !found {
+				return nil, fmt.Errorf("unknown capability '%s'", name)
+			}
+			capabilities |= 1 << number
+		}
+		for _, flag := range clause[operatorIndex+1:] {
+			switch flag {
+			case 'e':
+				effective = true
+			case 'i':
+				inheritable |= capabilities
+			case 'p':
+				permitted |= capabilities
+			default:
+				return nil, fmt.Errorf("invalid capability flag '%c' in '%s', must be e, i or p", flag, clause)
+			}
+		}
+	}
+
+	magic := uint32(vfsCapRevision2)
+	if effective {
+		magic |= vfsCapFlagEffective
+	}
+	value := binary.LittleEndian.AppendUint32(nil, magic)
+	value = binary.LittleEndian.AppendUint32(value, uint32(permitted))
+	value = binary.LittleEndian.AppendUint32(value, uint32(inheritable))
+	value = binary.LittleEndian.AppendUint32(value, uint32(permitted>>32))
+	value = binary.LittleEndian.AppendUint32(value, uint32(inheritable>>32))
+	return value, nil
+}
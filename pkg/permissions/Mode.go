@@ -0,0 +1,26 @@
+package permissions
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ParseMode parses the octal permission mode, e.g. "0755". Setuid, setgid and sticky bits are allowed.
+func ParseMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 07777 {
+		return 0, fmt.Errorf("invalid mode '%s', must be an octal number up to 7777", mode)
+	}
+	fileMode := os.FileMode(value & 0777)
+	if value&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if value&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if value&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode, nil
+}
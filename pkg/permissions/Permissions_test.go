@@ -0,0 +1,70 @@
+package permissions
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeCapabilities_NetRaw(t *testing.T) {
+	value, err := EncodeCapabilities("cap_net_raw+ep")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []byte{0x01, 0, 0, 0x02, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(value, expected) {
+		t.Fatalf("expected %x, got %x", expected, value)
+	}
+}
+
+func TestEncodeCapabilities_Invalid(t *testing.T) {
+	for _, text := range []string{"", "cap_net_raw", "cap_unknown+ep", "cap_net_raw+x"} {
+		if _, err := EncodeCapabilities(text); err == nil {
+			t.Errorf("expected error for '%s', got nil", text)
+		}
+	}
+}
+
+func TestLoadAccounts_ImageAccounts(t *testing.T) {
+	rootDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootDir, "etc"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\nsvc:x:1001:1002::/home/svc:/bin/false\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "etc/group"), []byte("root:x:0:\nsvc:x:1002:\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	accounts, err := LoadAccounts(rootDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if uid, err := accounts.UserID("svc"); err != nil || uid != 1001 {
+		t.Errorf("expected user svc with ID 1001, got %d (%v)", uid, err)
+	}
+	if gid, err := accounts.GroupID("svc"); err != nil || gid != 1002 {
+		t.Errorf("expected group svc with ID 1002, got %d (%v)", gid, err)
+	}
+	if uid, err := accounts.UserID("4242"); err != nil || uid != 4242 {
+		t.Errorf("expected numeric user ID 4242, got %d (%v)", uid, err)
+	}
+	if _, err := accounts.UserID("nobody"); err == nil {
+		t.Errorf("expected error for user missing in the image, got nil")
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("4755")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if mode != os.ModeSetuid|0755 {
+		t.Errorf("expected mode %s, got %s", os.ModeSetuid|0755, mode)
+	}
+	if _, err := ParseMode("0999"); err == nil {
+		t.Errorf("expected error for invalid mode, got nil")
+	}
+}
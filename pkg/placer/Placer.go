@@ -0,0 +1,358 @@
+package placer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/image"
+	"package-to-image-placer/pkg/plan"
+	"package-to-image-placer/pkg/report"
+	"package-to-image-placer/pkg/user"
+	"strings"
+)
+
+// Placer places packages to a system image as described by its configuration.
+// It holds no global state, so multiple placements can run in one process.
+type Placer struct {
+	config   *configuration.Configuration
+	prompter user.Prompter
+	logger   *slog.Logger
+	report   *report.Report
+	// copier places the packages and verifies the placement, it keeps the digests of the placed packages in between
+	copier *image.Copier
+	// partitionsResolved is set once the partition selectors are resolved, so the partitions are not detected again
+	partitionsResolved bool
+}
+
+// NewPlacer creates a Placer for the given configuration.
+// The prompter is used only in interactive mode and may be nil otherwise.
+// Answers of the user given in interactive mode are stored to the configuration.
+func NewPlacer(config *configuration.Configuration, prompter user.Prompter, logger *slog.Logger) *Placer {
+	runReport := report.NewReport()
+	return &Placer{config: config, prompter: prompter, logger: logger, report: runReport, copier: image.NewCopier(config, prompter, logger, runReport)}
+}
+
+// Report returns the report of the placement. It is written to the report path of the configuration at the end of Run.
+func (placer *Placer) Report() *report.Report {
+	return placer.report
+}
+
+// Verify checks the configuration and that all dependencies needed for the placement are installed.
+func (placer *Placer) Verify() error {
+	placer.report.SetStep("verify")
+	err := placer.config.Validate()
+	if err != nil {
+		return fmt.Errorf("configuration validation error: %w", err)
+	}
+	placer.logger.Debug("Checking if all dependencies are installed")
+	return helper.AllDepsInstalled()
+}
+
+// Clone clones the source image to the target image. Does nothing if no-clone is set.
+// An existing target image is deleted; in interactive mode the user is asked first.
+func (placer *Placer) Clone(ctx context.Context) error {
+	if placer.config.NoClone {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	placer.report.SetStep("clone")
+	defer placer.report.StartPhase("clone", 0)()
+	if helper.DoesFileExists(placer.config.Target) {
+		askUser := fmt.Sprintf("File %s already exists. Do you want to delete it?", placer.config.Target)
+		if placer.config.InteractiveRun && !placer.prompter.Confirm(askUser) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("file already exists and user chose not to delete it")
+		}
+		if err := os.Remove(placer.config.Target); err != nil {
+			return fmt.Errorf("unable to delete existing file: %s", err)
+		}
+	}
+	return image.CloneImage(ctx, placer.config.Source, placer.config.Target, placer.config.Reproducible, placer.logger)
+}
+
+// Place copies the packages to the partitions of the target image.
+// When the context is cancelled, the copying is stopped and all mounted partitions are unmounted.
+func (placer *Placer) Place(ctx context.Context) error {
+	placer.report.SetStep("place")
+	err := placer.resolvePartitions(ctx, placer.config.Target)
+	if err != nil {
+		return err
+	}
+	return placer.copier.CopyPackagesToImagePartitions(ctx)
+}
+
+// VerifyPlacement remounts the partitions of the target image read-only and checks that the packages were placed correctly.
+// Any mismatch between the placed files and the package archives, or a service which is not activated, is returned as an error.
+func (placer *Placer) VerifyPlacement(ctx context.Context) error {
+	placer.report.SetStep("verify-placement")
+	return placer.copier.VerifyPlacement(ctx)
+}
+
+// DryRun plans the placement without modifying any image and returns the plan.
+// The image is not cloned; unless no-clone is set, the packages are planned against the source image,
+// which the target image would be a copy of. Partitions are mounted read-only.
+func (placer *Placer) DryRun(ctx context.Context) (*plan.Plan, error) {
+	placer.report.SetStep("plan")
+	defer placer.report.StartPhase("plan", 0)()
+	imagePath := placer.config.Target
+	if !placer.config.NoClone {
+		imagePath = placer.config.Source
+	}
+	err := placer.resolvePartitions(ctx, imagePath)
+	if err != nil {
+		return nil, err
+	}
+	config := *placer.config
+	config.Target = imagePath
+	return image.NewCopier(&config, nil, placer.logger, nil).PlanPackagesToImagePartitions(ctx)
+}
+
+// Run verifies the configuration, lets the user select packages and partitions in interactive mode,
+// clones the image, places the packages to it and verifies the placement. If the placement or its verification fails, the invalid target image is removed.
+// In interactive mode, the user can save the configuration, which is updated with the answers given during the placement.
+// When the context is cancelled, the placement is stopped, the invalid target image is removed and the context error is returned.
+// If the report path is set in the configuration, the report of the run is written to it, also when the run fails.
+// In dry-run mode, only the plan is made and written to the standard output; Run fails if the plan has conflicts.
+func (placer *Placer) Run(ctx context.Context) error {
+	err := placer.run(ctx)
+	if placer.config.ReportPath == "" {
+		return err
+	}
+	placer.report.Finish(placer.config, err)
+	reportErr := placer.report.Write(placer.config.ReportPath)
+	if reportErr != nil {
+		placer.logger.Error("Failed to write report", "error", reportErr)
+	} else {
+		placer.logger.Info("Report written", "path", placer.config.ReportPath)
+	}
+	return err
+}
+
+// run runs all steps of the placement, see Run.
+func (placer *Placer) run(ctx context.Context) error {
+	err := placer.Verify()
+	if err != nil {
+		return err
+	}
+
+	placer.report.SetStep("resolve-partitions")
+	imagePath := placer.config.Source
+	if placer.config.NoClone {
+		imagePath = placer.config.Target
+	}
+	err = placer.resolvePartitions(ctx, imagePath)
+	if err != nil {
+		return err
+	}
+
+	if placer.config.DryRun {
+		return placer.dryRun(ctx)
+	}
+
+	newConfigFilePath := ""
+	if placer.config.InteractiveRun {
+		selected, err := placer.selectPackages()
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !selected {
+			placer.logger.Info("No packages selected, exiting")
+			return nil
+		}
+
+		err = placer.selectPartitions(ctx)
+		if err != nil {
+			helper.RemoveInvalidOutputImage(placer.config.Target, placer.config.NoClone)
+			return err
+		}
+
+		if placer.prompter.Confirm("Do you want to save the configuration?") {
+			newConfigFilePath, err = configuration.CreateConfigurationFile(*placer.config, placer.prompter)
+			if err != nil {
+				placer.logger.Error("Failed to save configuration", "error", err)
+			}
+		}
+	}
+
+	placer.logSummary()
+
+	if placer.config.InteractiveRun && !placer.prompter.Confirm("Do you want to continue?") {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		placer.logger.Info("Operation cancelled by user")
+		return nil
+	}
+
+	if placer.config.ReportPath != "" && !placer.config.NoClone {
+		placer.report.SetStep("hash-source")
+		err = placer.report.SetSourceImage(placer.config.Source)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = placer.Clone(ctx)
+	if err != nil {
+		helper.RemoveInvalidOutputImage(placer.config.Target, placer.config.NoClone)
+		return err
+	}
+
+	err = placer.Place(ctx)
+	if err != nil {
+		helper.RemoveInvalidOutputImage(placer.config.Target, placer.config.NoClone)
+		return err
+	}
+
+	placer.logger.Info("All packages copied successfully", "target", placer.config.Target)
+
+	err = placer.VerifyPlacement(ctx)
+	if err != nil {
+		helper.RemoveInvalidOutputImage(placer.config.Target, placer.config.NoClone)
+		return err
+	}
+	placer.logger.Info("Placement verified", "target", placer.config.Target)
+
+	if placer.config.ReportPath != "" {
+		placer.report.SetStep("hash-target")
+		err = placer.report.SetTargetImage(placer.config.Target)
+		if err != nil {
+			return err
+		}
+	}
+
+	if newConfigFilePath != "" {
+		placer.report.SetStep("update-configuration")
+		placer.logger.Info("Updating configuration file", "path", newConfigFilePath)
+		err = configuration.UpdateConfigurationFile(*placer.config, newConfigFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dryRun makes the plan, writes it to the standard output and adds it to the report.
+func (placer *Placer) dryRun(ctx context.Context) error {
+	placer.logSummary()
+	placementPlan, err := placer.DryRun(ctx)
+	if err != nil {
+		return err
+	}
+	placer.report.SetPlan(placementPlan)
+	err = placementPlan.Write(os.Stdout)
+	if err != nil {
+		return fmt.Errorf("failed to write plan: %v", err)
+	}
+	conflicts := placementPlan.Conflicts()
+	if len(conflicts) != 0 {
+		return fmt.Errorf("placement plan has %d conflicts:\n%s", len(conflicts), strings.Join(conflicts, "\n"))
+	}
+	placer.logger.Info("Placement plan has no conflicts")
+	return nil
+}
+
+// selectPackages lets the user select standard and configuration packages.
+// Returns false if no package was selected.
+func (placer *Placer) selectPackages() (bool, error) {
+	placer.logger.Debug("Selecting standard packages")
+	packages, err := placer.prompter.SelectFiles(placer.config.PackageDir, "Choose standard package to copy.")
+	placer.logger.Debug("Selected standard packages", "packages", packages)
+	if err != nil {
+		return false, err
+	}
+	for _, pkg := range packages {
+		placer.config.Packages = append(placer.config.Packages, configuration.PackageConfig{PackagePath: pkg})
+	}
+
+	placer.logger.Debug("Selecting configuration packages")
+	packages, err = placer.prompter.SelectFiles(placer.config.PackageDir, "Choose configuration package to copy.")
+	placer.logger.Debug("Selected configuration packages", "packages", packages)
+	if err != nil {
+		return false, err
+	}
+	for _, pkg := range packages {
+		placer.config.ConfigurationPackages = append(placer.config.ConfigurationPackages, configuration.ConfigurationPackage{PackagePath: pkg})
+	}
+
+	return len(placer.config.Packages) != 0 || len(placer.config.ConfigurationPackages) != 0, nil
+}
+
+// resolvePartitions resolves the partition selectors of the configuration to the partition numbers of the image.
+// Nothing is read from the image if the configuration has no selectors. The roles of the partitions are detected,
+// which mounts them, only if some selector needs them. The selectors are resolved only once, Place and DryRun called
+// by Run use the partitions resolved before.
+func (placer *Placer) resolvePartitions(ctx context.Context, imagePath string) error {
+	if placer.partitionsResolved || !placer.config.HasPartitionSelectors() {
+		return nil
+	}
+	var partitions []user.PartitionInfo
+	var err error
+	if placer.config.HasRoleSelectors() {
+		partitions, err = image.DetectPartitions(ctx, imagePath, placer.logger)
+	} else {
+		partitions, err = user.GetPartitionInfo(imagePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %v", imagePath, err)
+	}
+	err = placer.config.ResolvePartitionSelectors(partitions)
+	if err != nil {
+		return err
+	}
+	placer.partitionsResolved = true
+	placer.logger.Debug("Partition selectors resolved", "partitions", placer.config.TargetPartitions())
+	return nil
+}
+
+// selectPartitions lets the user select the partitions of the image the packages are copied to.
+// The partitions are shown with their roles detected from their content.
+func (placer *Placer) selectPartitions(ctx context.Context) error {
+	imagePath := placer.config.Source
+	if placer.config.NoClone {
+		imagePath = placer.config.Target
+	}
+
+	err := helper.ValidSourceImage(imagePath)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := image.DetectPartitions(ctx, imagePath, placer.logger)
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %v", imagePath, err)
+	}
+	placer.config.PartitionNumbers, err = placer.prompter.SelectPartitions(partitions)
+	if err != nil {
+		return fmt.Errorf("error while selecting partitions: %s", err)
+	}
+	return nil
+}
+
+// logSummary logs the packages and partitions of the placement.
+func (placer *Placer) logSummary() {
+	var standardPackagePaths []string
+	var configurationPackagePaths []string
+
+	for _, pkg := range placer.config.Packages {
+		standardPackagePaths = append(standardPackagePaths, pkg.PackagePath)
+	}
+	for _, pkg := range placer.config.ConfigurationPackages {
+		configurationPackagePaths = append(configurationPackagePaths, pkg.PackagePath)
+	}
+	placer.logger.Info("Placement summary",
+		"standard-packages", standardPackagePaths,
+		"configuration-packages", configurationPackagePaths,
+		"partitions", placer.config.TargetPartitions(),
+	)
+}
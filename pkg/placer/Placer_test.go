@@ -0,0 +1,156 @@
+package placer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/helper"
+	"package-to-image-placer/pkg/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// testPrompter is a Prompter returning predefined answers
+type testPrompter struct {
+	confirm bool
+}
+
+func (prompter *testPrompter) Confirm(message string) bool {
+	return prompter.confirm
+}
+
+func (prompter *testPrompter) ReadString(prompt string) (string, error) {
+	return "", nil
+}
+
+func (prompter *testPrompter) SelectFiles(dir string, header string) ([]string, error) {
+	return nil, nil
+}
+
+func (prompter *testPrompter) SelectPartitions(partitions []user.PartitionInfo) ([]int, error) {
+	return []int{1}, nil
+}
+
+func (prompter *testPrompter) SelectTargetDirectory(rootDir string, searchDir string, packagePath string) (string, error) {
+	return rootDir, nil
+}
+
+func TestVerify_InvalidConfiguration(t *testing.T) {
+	config := configuration.NewConfiguration()
+	placer := NewPlacer(config, &testPrompter{}, slog.Default())
+
+	err := placer.Verify()
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
+
+func TestClone_NoClone(t *testing.T) {
+	config := configuration.NewConfiguration()
+	config.NoClone = true
+	config.Target = filepath.Join(t.TempDir(), "target.img")
+	placer := NewPlacer(config, nil, slog.Default())
+
+	err := placer.Clone(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if helper.DoesFileExists(config.Target) {
+		t.Fatalf("expected target not to be created")
+	}
+}
+
+func TestClone_UserRefusesToDeleteTarget(t *testing.T) {
+	config := configuration.NewConfiguration()
+	config.Source = "source.img"
+	config.Target = filepath.Join(t.TempDir(), "target.img")
+	if err := os.WriteFile(config.Target, []byte("image"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	placer := NewPlacer(config, &testPrompter{confirm: false}, slog.Default())
+
+	err := placer.Clone(context.Background())
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !helper.DoesFileExists(config.Target) {
+		t.Fatalf("expected target to be kept")
+	}
+}
+
+func TestClone_Cancelled(t *testing.T) {
+	config := configuration.NewConfiguration()
+	config.Source = "source.img"
+	config.Target = filepath.Join(t.TempDir(), "target.img")
+	placer := NewPlacer(config, nil, slog.Default())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := placer.Clone(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if helper.DoesFileExists(config.Target) {
+		t.Fatalf("expected target not to be created")
+	}
+}
+
+func TestRun_WritesReportOnFailure(t *testing.T) {
+	config := configuration.NewConfiguration()
+	config.InteractiveRun = false
+	config.ReportPath = filepath.Join(t.TempDir(), "report.json")
+	placer := NewPlacer(config, nil, slog.Default())
+
+	err := placer.Run(context.Background())
+	if err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if !helper.DoesFileExists(config.ReportPath) {
+		t.Fatalf("expected report to be written")
+	}
+	failure := placer.Report().Failure
+	if failure == nil || failure.Step != "verify" || len(failure.ErrorChain) < 2 {
+		t.Fatalf("expected failure in step verify with error chain, got %+v", failure)
+	}
+}
+
+func TestResolvePartitions_Once(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image.img")
+	imageDisk, err := diskfs.Create(imagePath, 4*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	table := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true, Partitions: []*gpt.Partition{
+		{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem, Name: "rootfs"},
+	}}
+	err = imageDisk.Partition(table)
+	imageDisk.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config := configuration.NewConfiguration()
+	config.Partitions = configuration.PartitionSelectors{{Name: "rootfs"}}
+	placer := NewPlacer(config, nil, slog.Default())
+
+	err = placer.resolvePartitions(context.Background(), imagePath)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(config.PartitionNumbers) != 1 || config.PartitionNumbers[0] != 1 {
+		t.Fatalf("expected partition 1, got %v", config.PartitionNumbers)
+	}
+	// The image is not read again, so its removal doesn't matter
+	if err := os.Remove(imagePath); err != nil {
+		t.Fatal(err.Error())
+	}
+	config.Partitions = configuration.PartitionSelectors{{Name: "rootfs"}}
+	err = placer.resolvePartitions(context.Background(), imagePath)
+	if err != nil {
+		t.Fatalf("expected partitions not to be resolved again, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package plan
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Plan describes the changes a placement would make to the image, without making them.
+// Paths are absolute paths inside the image.
+type Plan struct {
+	Image      string           `json:"image"`
+	Partitions []*PartitionPlan `json:"partitions"`
+}
+
+// PartitionPlan describes the changes on one partition and projects its free space.
+type PartitionPlan struct {
+	Number         int            `json:"number"`
+	FreeBytes      uint64         `json:"free-bytes"`
+	RequiredBytes  uint64         `json:"required-bytes"`
+	RemainingBytes int64          `json:"remaining-bytes"`
+	Packages       []*PackagePlan `json:"packages"`
+	Conflicts      []string       `json:"conflicts"`
+}
+
+// PackagePlan describes the changes made by one package.
+// Conflicts are the problems which would make the placement fail.
+type PackagePlan struct {
+	PackagePath          string    `json:"package-path"`
+	ConfigurationPackage bool      `json:"configuration-package"`
+	TargetDirectory      string    `json:"target-directory"`
+	Operations           []string  `json:"operations"`
+	DirectoriesCreated   []string  `json:"directories-created"`
+	FilesCreated         []string  `json:"files-created"`
+	FilesOverwritten     []string  `json:"files-overwritten"`
+	FilesSkipped         []string  `json:"files-skipped"`
+	FilesMerged          []string  `json:"files-merged"`
+	Backups              []Backup  `json:"backups"`
+	Symlinks             []Symlink `json:"symlinks"`
+	Services             []Service `json:"services"`
+	PostInstallHook      string    `json:"post-install-hook,omitempty"`
+	Conflicts            []string  `json:"conflicts"`
+}
+
+// Symlink describes a symlink created by a package.
+type Symlink struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+}
+
+// Backup describes the backup of a file overwritten or merged by a package.
+type Backup struct {
+	Path       string `json:"path"`
+	BackupPath string `json:"backup-path"`
+}
+
+// Service describes a service which would be enabled, with its rewritten paths.
+type Service struct {
+	UnitName          string `json:"unit-name"`
+	UnitPath          string `json:"unit-path"`
+	EnablementSymlink string `json:"enablement-symlink"`
+	ExecStart         string `json:"exec-start"`
+	WorkingDirectory  string `json:"working-directory"`
+}
+
+// NewPackagePlan creates an empty plan of the package.
+func NewPackagePlan(packagePath string, configurationPackage bool, targetDirectory string) *PackagePlan {
+	return &PackagePlan{
+		PackagePath:          packagePath,
+		ConfigurationPackage: configurationPackage,
+		TargetDirectory:      targetDirectory,
+		Operations:           []string{},
+		DirectoriesCreated:   []string{},
+		FilesCreated:         []string{},
+		FilesOverwritten:     []string{},
+		FilesSkipped:         []string{},
+		FilesMerged:          []string{},
+		Backups:              []Backup{},
+		Symlinks:             []Symlink{},
+		Services:             []Service{},
+		Conflicts:            []string{},
+	}
+}
+
+// AddConflict records a problem which would make the placement fail. A problem already recorded is not added again.
+func (pkg *PackagePlan) AddConflict(format string, args ...any) {
+	conflict := fmt.Sprintf(format, args...)
+	if !slices.Contains(pkg.Conflicts, conflict) {
+		pkg.Conflicts = append(pkg.Conflicts, conflict)
+	}
+}
+
+// Conflicts returns all conflicts of the plan prefixed by the partition and package they belong to.
+func (plan *Plan) Conflicts() []string {
+	var conflicts []string
+	for _, partition := range plan.Partitions {
+		for _, conflict := range partition.Conflicts {
+			conflicts = append(conflicts, fmt.Sprintf("partition %d: %s", partition.Number, conflict))
+		}
+		for _, pkg := range partition.Packages {
+			for _, conflict := range pkg.Conflicts {
+				conflicts = append(conflicts, fmt.Sprintf("partition %d: %s: %s", partition.Number, pkg.PackagePath, conflict))
+			}
+		}
+	}
+	return conflicts
+}
+
+// Write writes the plan in human-readable form.
+func (plan *Plan) Write(writer io.Writer) error {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Plan for image %s\n", plan.Image)
+	for _, partition := range plan.Partitions {
+		fmt.Fprintf(&builder, "\nPartition %d: free %dMB, required %dMB, remaining %dMB\n",
+			partition.Number, partition.FreeBytes/1024/1024, partition.RequiredBytes/1024/1024, partition.RemainingBytes/1024/1024)
+		writeList(&builder, "\t", "CONFLICT", partition.Conflicts)
+		for _, pkg := range partition.Packages {
+			fmt.Fprintf(&builder, "\tPackage %s to %s\n", pkg.PackagePath, pkg.TargetDirectory)
+			writeList(&builder, "\t\t", "operation", pkg.Operations)
+			writeList(&builder, "\t\t", "mkdir", pkg.DirectoriesCreated)
+			writeList(&builder, "\t\t", "create", pkg.FilesCreated)
+			writeList(&builder, "\t\t", "overwrite", pkg.FilesOverwritten)
+			writeList(&builder, "\t\t", "keep", pkg.FilesSkipped)
+			writeList(&builder, "\t\t", "merge", pkg.FilesMerged)
+			for _, backup := range pkg.Backups {
+				fmt.Fprintf(&builder, "\t\tbackup %s to %s\n", backup.Path, backup.BackupPath)
+			}
+			for _, symlink := range pkg.Symlinks {
+				fmt.Fprintf(&builder, "\t\tsymlink %s -> %s\n", symlink.Path, symlink.Target)
+			}
+			for _, service := range pkg.Services {
+				fmt.Fprintf(&builder, "\t\tservice %s at %s\n", service.UnitName, service.UnitPath)
+				fmt.Fprintf(&builder, "\t\t\tExecStart=%s\n\t\t\tWorkingDirectory=%s\n", service.ExecStart, service.WorkingDirectory)
+				fmt.Fprintf(&builder, "\t\t\tenabled by symlink %s\n", service.EnablementSymlink)
+			}
+			if pkg.PostInstallHook != "" {
+				fmt.Fprintf(&builder, "\t\tpost-install hook %s\n", pkg.PostInstallHook)
+			}
+			writeList(&builder, "\t\t", "CONFLICT", pkg.Conflicts)
+		}
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
+
+func writeList(builder *strings.Builder, indent string, action string, items []string) {
+	for _, item := range items {
+		fmt.Fprintf(builder, "%s%s %s\n", indent, action, item)
+	}
+}
@@ -0,0 +1,53 @@
+package plan
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testPlan() *Plan {
+	pkg := NewPackagePlan("package.zip", false, "/opt/package")
+	pkg.FilesCreated = append(pkg.FilesCreated, "/opt/package/file")
+	pkg.AddConflict("file %s already exists and is not marked for overwrite", "/etc/app.conf")
+	return &Plan{
+		Image: "image.img",
+		Partitions: []*PartitionPlan{
+			{Number: 1, Packages: []*PackagePlan{pkg}, Conflicts: []string{"not enough space"}},
+			{Number: 2, Packages: []*PackagePlan{NewPackagePlan("other.zip", true, "/")}, Conflicts: []string{}},
+		},
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	conflicts := testPlan().Conflicts()
+	expected := []string{
+		"partition 1: not enough space",
+		"partition 1: package.zip: file /etc/app.conf already exists and is not marked for overwrite",
+	}
+	if !slices.Equal(conflicts, expected) {
+		t.Fatalf("expected conflicts %v, got %v", expected, conflicts)
+	}
+}
+
+func TestConflicts_None(t *testing.T) {
+	plan := &Plan{Partitions: []*PartitionPlan{{Number: 1, Packages: []*PackagePlan{NewPackagePlan("package.zip", false, "/")}}}}
+	if conflicts := plan.Conflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %v", conflicts)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var buffer bytes.Buffer
+	err := testPlan().Write(&buffer)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	output := buffer.String()
+	for _, line := range []string{"Partition 1:", "create /opt/package/file", "CONFLICT not enough space", "Partition 2:"} {
+		if !strings.Contains(output, line) {
+			t.Fatalf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package report
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"package-to-image-placer/pkg/plan"
+	"sync"
+	"time"
+)
+
+// Report collects the results of a placement, so they can be written as JSON at the end of the run.
+// All methods are safe for concurrent use and can be called on nil, in which case nothing is recorded.
+type Report struct {
+	mutex sync.Mutex
+	// step is the step of the placement currently running
+	step string
+
+	Success       bool                         `json:"success"`
+	Configuration *configuration.Configuration `json:"configuration,omitempty"`
+	SourceImage   *ImageReport                 `json:"source-image,omitempty"`
+	TargetImage   *ImageReport                 `json:"target-image,omitempty"`
+	Phases        []Phase                      `json:"phases"`
+	Partitions    []*PartitionReport           `json:"partitions"`
+	Plan          *plan.Plan                   `json:"plan,omitempty"`
+	Failure       *Failure                     `json:"failure,omitempty"`
+}
+
+// ImageReport identifies an image by its path and content hash.
+type ImageReport struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Phase holds the timing of one phase of the placement. Partition is set for the phases done per partition.
+type Phase struct {
+	Name            string    `json:"name"`
+	Partition       int       `json:"partition,omitempty"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration-seconds"`
+}
+
+// PartitionReport holds the results of copying the packages to one partition.
+type PartitionReport struct {
+	report *Report
+	// step is the step currently running on the partition
+	step string
+
+	Number   int              `json:"number"`
+	Success  bool             `json:"success"`
+	Error    string           `json:"error,omitempty"`
+	Packages []*PackageReport `json:"packages"`
+}
+
+// PackageReport holds the results of copying one package to a partition.
+// Paths of the files are absolute paths inside the image.
+type PackageReport struct {
+	report *Report
+
+	PackagePath          string    `json:"package-path"`
+	ConfigurationPackage bool      `json:"configuration-package"`
+	Success              bool      `json:"success"`
+	Error                string    `json:"error,omitempty"`
+	FilesWritten         []string  `json:"files-written"`
+	FilesOverwritten     []string  `json:"files-overwritten"`
+	FilesSkipped         []string  `json:"files-skipped,omitempty"`
+	FilesMerged          []string  `json:"files-merged,omitempty"`
+	Backups              []Backup  `json:"backups,omitempty"`
+	Operations           []string  `json:"operations,omitempty"`
+	Services             []Service `json:"services,omitempty"`
+}
+
+// Backup describes the backup of a file overwritten or merged by the package, the paths are absolute paths inside the image.
+type Backup struct {
+	Path       string `json:"path"`
+	BackupPath string `json:"backup-path"`
+}
+
+// Service describes a service enabled in the image.
+type Service struct {
+	ServiceFile string `json:"service-file"`
+	UnitName    string `json:"unit-name"`
+}
+
+// Failure describes where the placement failed. ErrorChain holds the error and all errors wrapped by it.
+type Failure struct {
+	Step       string   `json:"step"`
+	Partition  int      `json:"partition,omitempty"`
+	Package    string   `json:"package,omitempty"`
+	ErrorChain []string `json:"error-chain"`
+}
+
+// NewReport creates an empty report.
+func NewReport() *Report {
+	return &Report{Phases: []Phase{}, Partitions: []*PartitionReport{}}
+}
+
+// SetStep sets the step of the placement currently running. It is reported if the placement fails.
+func (report *Report) SetStep(step string) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.step = step
+}
+
+// StartPhase starts timing of the phase. The returned function ends the phase and records it.
+// Partition is 0 for phases not related to a partition.
+func (report *Report) StartPhase(name string, partition int) func() {
+	if report == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		report.mutex.Lock()
+		defer report.mutex.Unlock()
+		report.Phases = append(report.Phases, Phase{Name: name, Partition: partition, Start: start, DurationSeconds: time.Since(start).Seconds()})
+	}
+}
+
+// SetSourceImage records the source image and computes its hash.
+func (report *Report) SetSourceImage(path string) error {
+	if report == nil {
+		return nil
+	}
+	image, err := newImageReport(path)
+	if err != nil {
+		return err
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.SourceImage = image
+	return nil
+}
+
+// SetTargetImage records the target image and computes its hash.
+func (report *Report) SetTargetImage(path string) error {
+	if report == nil {
+		return nil
+	}
+	image, err := newImageReport(path)
+	if err != nil {
+		return err
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.TargetImage = image
+	return nil
+}
+
+// SetPlan records the plan made by a dry run.
+func (report *Report) SetPlan(plan *plan.Plan) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Plan = plan
+}
+
+// Partition adds a report of the partition with the given number.
+func (report *Report) Partition(number int) *PartitionReport {
+	if report == nil {
+		return nil
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	partition := &PartitionReport{report: report, Number: number, Packages: []*PackageReport{}}
+	report.Partitions = append(report.Partitions, partition)
+	return partition
+}
+
+// Finish records the resolved configuration and the result of the placement.
+// If the placement failed on a partition, the failure points to the step, partition and package which failed.
+func (report *Report) Finish(config *configuration.Configuration, err error) {
+	if report == nil {
+		return
+	}
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Configuration = config
+	report.Success = err == nil
+	if err == nil {
+		return
+	}
+	report.Failure = &Failure{Step: report.step, ErrorChain: errorChain(err)}
+	for _, partition := range report.Partitions {
+		if partition.Success || partition.step == "" {
+			continue
+		}
+		report.Failure.Step = partition.step
+		report.Failure.Partition = partition.Number
+		for _, pkg := range partition.Packages {
+			if !pkg.Success {
+				report.Failure.Package = pkg.PackagePath
+				break
+			}
+		}
+		break
+	}
+}
+
+// Write writes the report as JSON to the file.
+func (report *Report) Write(path string) error {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	return nil
+}
+
+// SetStep sets the step currently running on the partition.
+func (partition *PartitionReport) SetStep(step string) {
+	if partition == nil {
+		return
+	}
+	partition.report.mutex.Lock()
+	defer partition.report.mutex.Unlock()
+	partition.step = step
+}
+
+// Package adds a report of the package copied to the partition.
+func (partition *PartitionReport) Package(packagePath string, configurationPackage bool) *PackageReport {
+	if partition == nil {
+		return nil
+	}
+	partition.report.mutex.Lock()
+	defer partition.report.mutex.Unlock()
+	pkg := &PackageReport{report: partition.report, PackagePath: packagePath, ConfigurationPackage: configurationPackage, FilesWritten: []string{}, FilesOverwritten: []string{}}
+	partition.Packages = append(partition.Packages, pkg)
+	return pkg
+}
+
+// Finish records the result of copying to the partition.
+func (partition *PartitionReport) Finish(err error) {
+	if partition == nil {
+		return
+	}
+	partition.report.mutex.Lock()
+	defer partition.report.mutex.Unlock()
+	partition.Success = err == nil
+	if err != nil {
+		partition.Error = err.Error()
+	}
+}
+
+// AddFileWritten records a file written to the image.
+func (pkg *PackageReport) AddFileWritten(path string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.FilesWritten = append(pkg.FilesWritten, path)
+}
+
+// AddFileOverwritten records a file of the image overwritten by the package.
+func (pkg *PackageReport) AddFileOverwritten(path string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.FilesOverwritten = append(pkg.FilesOverwritten, path)
+}
+
+// AddFileSkipped records a file of the image kept by the skip-existing overwrite policy instead of the file of the package.
+func (pkg *PackageReport) AddFileSkipped(path string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.FilesSkipped = append(pkg.FilesSkipped, path)
+}
+
+// AddFileMerged records a file of the image merged with the file of the package.
+func (pkg *PackageReport) AddFileMerged(path string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.FilesMerged = append(pkg.FilesMerged, path)
+}
+
+// AddBackup records the backup of a file of the image made before it was overwritten or merged.
+func (pkg *PackageReport) AddBackup(path string, backupPath string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.Backups = append(pkg.Backups, Backup{Path: path, BackupPath: backupPath})
+}
+
+// AddOperation records an operation of the configuration package done in the image.
+func (pkg *PackageReport) AddOperation(description string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.Operations = append(pkg.Operations, description)
+}
+
+// AddService records a service enabled in the image.
+func (pkg *PackageReport) AddService(serviceFile string, unitName string) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.Services = append(pkg.Services, Service{ServiceFile: serviceFile, UnitName: unitName})
+}
+
+// Finish records the result of copying the package.
+func (pkg *PackageReport) Finish(err error) {
+	if pkg == nil {
+		return
+	}
+	pkg.report.mutex.Lock()
+	defer pkg.report.mutex.Unlock()
+	pkg.Success = err == nil
+	if err != nil {
+		pkg.Error = err.Error()
+	}
+}
+
+// newImageReport computes the SHA256 hash of the image.
+func newImageReport(path string) (*ImageReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute hash of image %s: %v", path, err)
+	}
+	return &ImageReport{Path: path, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// errorChain returns the messages of the error and of all errors wrapped by it, outermost first.
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		chain = append(chain, err.Error())
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, inner := range joined.Unwrap() {
+				chain = append(chain, errorChain(inner)...)
+			}
+			break
+		}
+		err = errors.Unwrap(err)
+	}
+	return chain
+}
@@ -0,0 +1,121 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"package-to-image-placer/pkg/configuration"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestFinish_Success(t *testing.T) {
+	report := NewReport()
+	report.SetStep("place")
+	report.Partition(1).Finish(nil)
+
+	report.Finish(configuration.NewConfiguration(), nil)
+	if !report.Success || report.Failure != nil {
+		t.Fatalf("expected successful report, got failure %v", report.Failure)
+	}
+}
+
+func TestFinish_FailedPartition(t *testing.T) {
+	report := NewReport()
+	report.SetStep("place")
+	partition := report.Partition(2)
+	partition.Package("ok.zip", false).Finish(nil)
+	partition.SetStep("service")
+	partitionErr := errors.New("invalid service file")
+	partition.Package("failing.zip", false).Finish(partitionErr)
+	partition.Finish(partitionErr)
+
+	report.Finish(configuration.NewConfiguration(), fmt.Errorf("partition 2: %w", partitionErr))
+	if report.Success || report.Failure == nil {
+		t.Fatalf("expected failure, got success")
+	}
+	failure := report.Failure
+	if failure.Step != "service" || failure.Partition != 2 || failure.Package != "failing.zip" {
+		t.Fatalf("expected failure in step service of failing.zip on partition 2, got %+v", failure)
+	}
+	expectedChain := []string{"partition 2: invalid service file", "invalid service file"}
+	if !slices.Equal(failure.ErrorChain, expectedChain) {
+		t.Fatalf("expected error chain %v, got %v", expectedChain, failure.ErrorChain)
+	}
+}
+
+func TestFinish_FailedStep(t *testing.T) {
+	report := NewReport()
+	report.SetStep("clone")
+
+	report.Finish(configuration.NewConfiguration(), errors.New("clone failed"))
+	if report.Failure == nil || report.Failure.Step != "clone" {
+		t.Fatalf("expected failure in step clone, got %+v", report.Failure)
+	}
+}
+
+func TestErrorChain_JoinedErrors(t *testing.T) {
+	err := errors.Join(errors.New("partition 2 failed"), fmt.Errorf("partition 3: %w", errors.New("mount failed")))
+
+	chain := errorChain(err)
+	expectedChain := []string{err.Error(), "partition 2 failed", "partition 3: mount failed", "mount failed"}
+	if !slices.Equal(chain, expectedChain) {
+		t.Fatalf("expected error chain %v, got %v", expectedChain, chain)
+	}
+}
+
+func TestNilReport(t *testing.T) {
+	var report *Report
+	report.SetStep("place")
+	report.StartPhase("clone", 0)()
+	partition := report.Partition(1)
+	pkg := partition.Package("package.zip", false)
+	pkg.AddFileWritten("/file")
+	pkg.Finish(nil)
+	partition.Finish(nil)
+	if err := report.SetTargetImage("does-not-exist.img"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "target.img")
+	if err := os.WriteFile(imagePath, []byte("image"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	report := NewReport()
+	if err := report.SetTargetImage(imagePath); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	report.StartPhase("clone", 0)()
+	pkg := report.Partition(1).Package("package.zip", false)
+	pkg.AddFileWritten("/opt/package/file")
+	pkg.AddService("/opt/package/app.service", "app-suffix.service")
+	report.Finish(configuration.NewConfiguration(), nil)
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	if err := report.Write(reportPath); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var written Report
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("expected valid JSON, got %v", err)
+	}
+	// SHA256 of "image"
+	if written.TargetImage == nil || written.TargetImage.SHA256 != "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d" {
+		t.Fatalf("expected target image hash, got %+v", written.TargetImage)
+	}
+	if len(written.Phases) != 1 || written.Phases[0].Name != "clone" {
+		t.Fatalf("expected clone phase, got %+v", written.Phases)
+	}
+	services := written.Partitions[0].Packages[0].Services
+	if len(services) != 1 || services[0].UnitName != "app-suffix.service" {
+		t.Fatalf("expected service app-suffix.service, got %+v", services)
+	}
+}
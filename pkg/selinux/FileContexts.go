@@ -0,0 +1,223 @@
+package selinux
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// LabelXattr is the extended attribute holding the SELinux label of a file
+const LabelXattr = "security.selinux"
+
+// noLabel is the context of file_contexts entries whose files must not be labeled
+const noLabel = "<<none>>"
+
+// fileTypes maps the file type field of file_contexts entries to the file type bits of the mode
+var fileTypes = map[string]os.FileMode{
+	"--": 0,
+	"-d": os.ModeDir,
+	"-l": os.ModeSymlink,
+	"-c": os.ModeDevice | os.ModeCharDevice,
+	"-b": os.ModeDevice,
+	"-s": os.ModeSocket,
+	"-p": os.ModeNamedPipe,
+}
+
+// fileContextSpec is one entry of the file_contexts file
+type fileContextSpec struct {
+	regex    *regexp.Regexp
+	fileType string
+	context  string
+	hasMeta  bool
+}
+
+// FileContexts is the file labeling policy of an image, read from the file_contexts files of its SELinux policy.
+type FileContexts struct {
+	specs []fileContextSpec
+	// substitutions map path prefixes to the equivalent paths the labels are looked up by (file_contexts.subs)
+	substitutions [][2]string
+	// Skipped is the number of entries with regular expressions not supported by Go
+	Skipped int
+}
+
+// LoadFileContexts reads the file labeling policy of the image mounted to the root directory.
+// The policy type is read from /etc/selinux/config. It returns nil if the image has no SELinux policy.
+func LoadFileContexts(rootDir string) (*FileContexts, error) {
+	policyType, err := readPolicyType(filepath.Join(rootDir, "etc/selinux/config"))
+	if err != nil || policyType == "" {
+		return nil, err
+	}
+	contextsDir := filepath.Join(rootDir, "etc/selinux", policyType, "contexts/files")
+	mainFile := filepath.Join(contextsDir, "file_contexts")
+	if _, err := os.Stat(mainFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	fileContexts := &FileContexts{}
+	for _, name := range []string{"file_contexts", "file_contexts.homedirs", "file_contexts.local"} {
+		if err := fileContexts.readSpecs(filepath.Join(contextsDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{"file_contexts.subs", "file_contexts.subs_dist"} {
+		if err := fileContexts.readSubstitutions(filepath.Join(contextsDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	// As libselinux does, entries without regular expression metacharacters take precedence over the others
+	slices.SortStableFunc(fileContexts.specs, func(a, b fileContextSpec) int {
+		switch {
+		case a.hasMeta == b.hasMeta:
+			return 0
+		case a.hasMeta:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return fileContexts, nil
+}
+
+// Lookup returns the SELinux context of the file with the path in the image and the mode.
+// The last matching entry is used. It returns false if no entry matches or the file must not be labeled.
+func (fileContexts *FileContexts) Lookup(path string, mode os.FileMode) (string, bool) {
+	path = fileContexts.substitute(path)
+	for i := len(fileContexts.specs) - 1; i >= 0; i-- {
+		spec := fileContexts.specs[i]
+		if spec.fileType != "" && fileTypes[spec.fileType] != mode.Type() {
+			continue
+		}
+		if spec.regex.MatchString(path) {
+			if spec.context == noLabel {
+				return "", false
+			}
+			return spec.context, true
+		}
+	}
+	return "", false
+}
+
+// substitute replaces the first matching path prefix by its substitution
+func (fileContexts *FileContexts) substitute(path string) string {
+	for _, substitution := range fileContexts.substitutions {
+		alias := substitution[0]
+		if path == alias || strings.HasPrefix(path, alias+"/") {
+			return substitution[1] + strings.TrimPrefix(path, alias)
+		}
+	}
+	return path
+}
+
+// readPolicyType returns SELINUXTYPE of the SELinux config, or an empty string if SELinux is not configured or is disabled.
+func readPolicyType(configPath string) (string, error) {
+	lines, err := readLines(configPath)
+	if err != nil {
+		return "", err
+	}
+	policyType := ""
+	for _, line := range lines {
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "SELINUX":
+			if strings.TrimSpace(value) == "disabled" {
+				return "", nil
+			}
+		case "SELINUXTYPE":
+			policyType = strings.TrimSpace(value)
+		}
+	}
+	return policyType, nil
+}
+
+// readSpecs appends the entries of the file_contexts file. A missing file is skipped.
+func (fileContexts *FileContexts) readSpecs(path string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		spec := fileContextSpec{}
+		switch len(fields) {
+		case 2:
+			spec.context = fields[1]
+		case 3:
+			if _, known := fileTypes[fields[1]]; !known {
+				return fmt.Errorf("invalid file type '%s' in %s", fields[1], path)
+			}
+			spec.fileType = fields[1]
+			spec.context = fields[2]
+		default:
+			return fmt.Errorf("invalid line '%s' in %s", line, path)
+		}
+		spec.regex, err = regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			fileContexts.Skipped++
+			continue
+		}
+		spec.hasMeta = hasMetacharacters(fields[0])
+		fileContexts.specs = append(fileContexts.specs, spec)
+	}
+	return nil
+}
+
+// readSubstitutions appends the path substitutions of the file_contexts.subs file. A missing file is skipped.
+func (fileContexts *FileContexts) readSubstitutions(path string) error {
+	lines, err := readLines(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid line '%s' in %s", line, path)
+		}
+		fileContexts.substitutions = append(fileContexts.substitutions, [2]string{strings.TrimSuffix(fields[0], "/"), strings.TrimSuffix(fields[1], "/")})
+	}
+	return nil
+}
+
+// hasMetacharacters reports whether the regular expression contains unescaped metacharacters
+func hasMetacharacters(regex string) bool {
+	for i := 0; i < len(regex); i++ {
+		switch regex[i] {
+		case '\\':
+			i++
+		case '.', '^', '$', '?', '*', '+', '|', '[', '(', '{':
+			return true
+		}
+	}
+	return false
+}
+
+// readLines returns the lines of the file without empty lines and comments. A missing file has no lines.
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %v", path, err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", path, err)
+	}
+	return lines, nil
+}
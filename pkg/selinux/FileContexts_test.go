@@ -0,0 +1,101 @@
+package selinux
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePolicy creates an image root with the targeted SELinux policy and the given file_contexts files
+func writePolicy(t *testing.T, selinuxConfig string, files map[string]string) string {
+	rootDir := t.TempDir()
+	contextsDir := filepath.Join(rootDir, "etc/selinux/targeted/contexts/files")
+	if err := os.MkdirAll(contextsDir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "etc/selinux/config"), []byte(selinuxConfig), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(contextsDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return rootDir
+}
+
+func TestLoadFileContexts_Lookup(t *testing.T) {
+	rootDir := writePolicy(t, "SELINUX=enforcing\nSELINUXTYPE=targeted\n", map[string]string{
+		"file_contexts": "# comment\n" +
+			"/.*\tsystem_u:object_r:default_t:s0\n" +
+			"/usr/bin(/.*)?\tsystem_u:object_r:bin_t:s0\n" +
+			"/usr/bin/special\tsystem_u:object_r:special_t:s0\n" +
+			"/var/run(/.*)?\t-d\tsystem_u:object_r:var_run_t:s0\n" +
+			"/proc(/.*)?\t<<none>>\n",
+		"file_contexts.local": "/usr/bin/local-tool\tsystem_u:object_r:local_t:s0\n",
+		"file_contexts.subs":  "/usr/local/bin /usr/bin\n",
+	})
+	fileContexts, err := LoadFileContexts(rootDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if fileContexts == nil {
+		t.Fatalf("expected file contexts, got nil")
+	}
+	tests := []struct {
+		path     string
+		mode     os.FileMode
+		context  string
+		expected bool
+	}{
+		{"/usr/bin/tool", 0, "system_u:object_r:bin_t:s0", true},
+		{"/usr/bin/special", 0, "system_u:object_r:special_t:s0", true},
+		{"/usr/bin/local-tool", 0, "system_u:object_r:local_t:s0", true},
+		{"/usr/local/bin/tool", 0, "system_u:object_r:bin_t:s0", true},
+		{"/var/run/app", os.ModeDir, "system_u:object_r:var_run_t:s0", true},
+		{"/var/run/app.pid", 0, "system_u:object_r:default_t:s0", true},
+		{"/proc/1", os.ModeDir, "", false},
+	}
+	for _, test := range tests {
+		context, found := fileContexts.Lookup(test.path, test.mode)
+		if found != test.expected || context != test.context {
+			t.Errorf("expected %s to have context '%s' (%v), got '%s' (%v)", test.path, test.context, test.expected, context, found)
+		}
+	}
+}
+
+func TestLoadFileContexts_UnsupportedRegexSkipped(t *testing.T) {
+	rootDir := writePolicy(t, "SELINUXTYPE=targeted\n", map[string]string{
+		"file_contexts": "/opt/(?!skip).*\tsystem_u:object_r:opt_t:s0\n/opt(/.*)?\tsystem_u:object_r:usr_t:s0\n",
+	})
+	fileContexts, err := LoadFileContexts(rootDir)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if fileContexts.Skipped != 1 {
+		t.Errorf("expected 1 skipped entry, got %d", fileContexts.Skipped)
+	}
+	if context, _ := fileContexts.Lookup("/opt/app", 0); context != "system_u:object_r:usr_t:s0" {
+		t.Errorf("expected usr_t context, got '%s'", context)
+	}
+}
+
+func TestLoadFileContexts_NoPolicy(t *testing.T) {
+	disabledRoot := writePolicy(t, "SELINUX=disabled\nSELINUXTYPE=targeted\n", map[string]string{"file_contexts": "/.*\tsystem_u:object_r:default_t:s0\n"})
+	for _, rootDir := range []string{t.TempDir(), disabledRoot} {
+		fileContexts, err := LoadFileContexts(rootDir)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if fileContexts != nil {
+			t.Errorf("expected no file contexts for %s", rootDir)
+		}
+	}
+}
+
+func TestLoadFileContexts_InvalidFileType(t *testing.T) {
+	rootDir := writePolicy(t, "SELINUXTYPE=targeted\n", map[string]string{"file_contexts": "/.*\t-x\tsystem_u:object_r:default_t:s0\n"})
+	if _, err := LoadFileContexts(rootDir); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
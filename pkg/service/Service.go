@@ -1,9 +1,11 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"package-to-image-placer/pkg/configuration"
 	"package-to-image-placer/pkg/helper"
@@ -15,6 +17,18 @@ import (
 	"github.com/coreos/go-systemd/v22/unit"
 )
 
+const unitDir = "/etc/systemd/system"
+const wantsDir = "/etc/systemd/system/multi-user.target.wants"
+
+// ServicePlan describes how a service would be activated in the image. Paths are absolute paths inside the image.
+type ServicePlan struct {
+	UnitName         string
+	UnitPath         string
+	SymlinkPath      string
+	ExecStart        string
+	WorkingDirectory string
+}
+
 // AddService adds the serviceFile to /etc/systemd/system in image
 // update paths based on packageDir (removes mountDir prefix) in it and activates the service.
 // It returns an error if the service file is missing required fields: ExecStart, Type, User, RestartSec, WorkingDirectory
@@ -22,49 +36,129 @@ import (
 // serviceFile: full path to the service file in the target image
 // mountDir: path to the target image mount point
 // packageDir: path to the package directory in the target image
-func AddService(serviceFile string, mountDir string, packageDir string, packageConfig *configuration.PackageConfig) error {
-	log.Printf("Activating service %s", filepath.Base(serviceFile))
-	opts, err := parseServiceFile(serviceFile)
+// prompter: used to ask the user whether to overwrite existing service files, nil in non-interactive mode
+// logger: logger used for the messages of the service activation
+// The service file is not modified nor activated once the context is cancelled.
+// Returns the name of the activated unit, which includes the service name suffix.
+func AddService(ctx context.Context, serviceFile string, mountDir string, packageDir string, packageConfig *configuration.PackageConfig, prompter user.Prompter, logger *slog.Logger) (string, error) {
+	logger.Debug("Activating service", "service-file", serviceFile)
+	opts, err := parseServiceFile(serviceFile, logger)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	err = checkServiceFileContent(opts)
 	if err != nil {
-		return fmt.Errorf("invalid service file: %s\n%v", serviceFile, err)
+		return "", fmt.Errorf("invalid service file: %s\n%v", serviceFile, err)
 	}
 
-	err = updatePathsInServiceFile(opts, mountDir, packageDir, serviceFile)
+	err = updatePathsInServiceFile(opts, mountDir, packageDir, serviceFile, logger)
 	if err != nil {
-		return fmt.Errorf("failed to update paths in service file: %v", err)
+		return "", fmt.Errorf("failed to update paths in service file: %v", err)
 	}
 
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	err = writeOptsToFile(serviceFile, opts)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	destPath, err := activateService(mountDir, serviceFile, packageConfig, prompter)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("Service activated", "unit", filepath.Base(destPath), "path", destPath)
+	return filepath.Base(destPath), nil
+}
+
+// PlanService computes how the service would be activated without changing the image.
+// The package must be extracted to the staging directory laid out as the image, so the paths in the service file can be rewritten.
+// serviceFile, packageDir: the service file and the package directory in the staging directory
+// mountDir: path to the target image mount point, used to check whether the unit would overwrite an existing one
+// It returns an error if the service file is invalid or the unit exists in the image and is not in the overwrite list.
+func PlanService(serviceFile string, stagingDir string, packageDir string, mountDir string, packageConfig *configuration.PackageConfig, logger *slog.Logger) (ServicePlan, error) {
+	opts, err := parseServiceFile(serviceFile, logger)
+	if err != nil {
+		return ServicePlan{}, err
+	}
+	err = checkServiceFileContent(opts)
+	if err != nil {
+		return ServicePlan{}, fmt.Errorf("invalid service file: %s\n%v", serviceFile, err)
+	}
+	err = updatePathsInServiceFile(opts, stagingDir, packageDir, serviceFile, logger)
+	if err != nil {
+		return ServicePlan{}, fmt.Errorf("failed to update paths in service file: %v", err)
+	}
+
+	unitName := UnitName(serviceFile, packageConfig)
+	servicePlan := ServicePlan{
+		UnitName:         unitName,
+		UnitPath:         filepath.Join(unitDir, unitName),
+		SymlinkPath:      filepath.Join(wantsDir, unitName),
+		ExecStart:        opts["ExecStart"].Value,
+		WorkingDirectory: opts["WorkingDirectory"].Value,
+	}
+	destFilePathInPackage := helper.RemoveMountDirAndPackageName(serviceFile, stagingDir, packageConfig.TargetDirectory, packageConfig.PackagePath)
+	exists := helper.DoesFileExists(filepath.Join(mountDir, servicePlan.UnitPath)) || helper.DoesFileExists(filepath.Join(mountDir, servicePlan.SymlinkPath))
+	if exists && packageConfig.OverwriteActionFor(destFilePathInPackage) != configuration.OverwriteReplace {
+		return servicePlan, fmt.Errorf("file %s already exists and is not in the overwrite list", destFilePathInPackage)
 	}
+	return servicePlan, nil
+}
 
-	destPath, err := activateService(mountDir, serviceFile, packageConfig)
+// UnitName returns the name of the unit the service file is activated as, which includes the service name suffix.
+func UnitName(serviceFile string, packageConfig *configuration.PackageConfig) string {
+	unitName := filepath.Base(serviceFile)
+	if packageConfig.ServiceNameSuffix != "" {
+		unitName = strings.TrimSuffix(unitName, ".service") + "-" + packageConfig.ServiceNameSuffix + ".service"
+	}
+	return unitName
+}
+
+// VerifyService checks that the service file in the image is activated: the unit is a copy of the service file
+// and it is enabled by the symlink in the multi-user.target.wants directory.
+func VerifyService(mountDir string, serviceFile string, packageConfig *configuration.PackageConfig) error {
+	unitName := UnitName(serviceFile, packageConfig)
+	serviceContent, err := os.ReadFile(serviceFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service file: %v", err)
+	}
+	unitContent, err := os.ReadFile(filepath.Join(mountDir, unitDir, unitName))
 	if err != nil {
-		return err
+		return fmt.Errorf("unit %s is missing: %v", unitName, err)
+	}
+	if !bytes.Equal(serviceContent, unitContent) {
+		return fmt.Errorf("unit %s differs from the service file", unitName)
+	}
+	linkTarget, err := os.Readlink(filepath.Join(mountDir, wantsDir, unitName))
+	if err != nil {
+		return fmt.Errorf("enablement symlink of unit %s is missing: %v", unitName, err)
+	}
+	if linkTarget != filepath.Join("..", unitName) {
+		return fmt.Errorf("enablement symlink of unit %s points to %s", unitName, linkTarget)
 	}
-	fmt.Println("Activated service file:", destPath)
 	return nil
 }
 
 // checkAndHandleServiceFileOverwrite checks if the file or symlink exists and handles overwriting based on user input or configuration.
-func checkAndHandleServiceFileOverwrite(destPath string, symlinkPath string, serviceFile string, mountDir string, packageConfig *configuration.PackageConfig) error {
+// The user is asked only if the prompter is not nil.
+func checkAndHandleServiceFileOverwrite(destPath string, symlinkPath string, serviceFile string, mountDir string, packageConfig *configuration.PackageConfig, prompter user.Prompter) error {
 	destFilePathInPackage := helper.RemoveMountDirAndPackageName(serviceFile, mountDir, packageConfig.TargetDirectory, packageConfig.PackagePath)
 
-	if (helper.DoesFileExists(destPath) || helper.DoesFileExists(symlinkPath)) && !slices.Contains(packageConfig.OverwriteFiles, destFilePathInPackage) {
-		if configuration.Config.InteractiveRun {
-			if user.GetUserConfirmation("Service file " + destFilePathInPackage + " already exists. Do you want to overwrite it?") {
+	if (helper.DoesFileExists(destPath) || helper.DoesFileExists(symlinkPath)) && packageConfig.OverwriteActionFor(destFilePathInPackage) != configuration.OverwriteReplace {
+		if prompter != nil {
+			if prompter.Confirm("Service file " + destFilePathInPackage + " already exists. Do you want to overwrite it?") {
 				packageConfig.OverwriteFiles = append(packageConfig.OverwriteFiles, destFilePathInPackage)
 
 			} else {
 				return fmt.Errorf("file %s already exists and user chose not to overwrite it", destFilePathInPackage)
 			}
-		} else if !slices.Contains(packageConfig.OverwriteFiles, destFilePathInPackage) {
+		} else {
 			return fmt.Errorf("file %s already exists and is not in the overwrite list", destFilePathInPackage)
 		}
 	}
@@ -72,16 +166,12 @@ func checkAndHandleServiceFileOverwrite(destPath string, symlinkPath string, ser
 }
 
 // activateService copies the service file to the image and creates a symlink to it in the multi-user.target.wants directory
-func activateService(mountDir string, serviceFile string, packageConfig *configuration.PackageConfig) (string, error) {
-	serviceDestFile := serviceFile
-	if packageConfig.ServiceNameSuffix != "" {
-		serviceDestFile = strings.TrimSuffix(serviceFile, ".service") + "-" + packageConfig.ServiceNameSuffix + ".service"
-	}
-
-	destPath := filepath.Join(mountDir, "/etc/systemd/system", filepath.Base(serviceDestFile))
-	symlinkPath := filepath.Join(mountDir, "/etc/systemd/system/multi-user.target.wants", filepath.Base(serviceDestFile))
+func activateService(mountDir string, serviceFile string, packageConfig *configuration.PackageConfig, prompter user.Prompter) (string, error) {
+	unitName := UnitName(serviceFile, packageConfig)
+	destPath := filepath.Join(mountDir, unitDir, unitName)
+	symlinkPath := filepath.Join(mountDir, wantsDir, unitName)
 
-	err := checkAndHandleServiceFileOverwrite(destPath, symlinkPath, serviceFile, mountDir, packageConfig)
+	err := checkAndHandleServiceFileOverwrite(destPath, symlinkPath, serviceFile, mountDir, packageConfig, prompter)
 	if err != nil {
 		return "", err
 	}
@@ -90,7 +180,7 @@ func activateService(mountDir string, serviceFile string, packageConfig *configu
 	if err != nil {
 		return "", fmt.Errorf("failed to copy service file: %v", err)
 	}
-	err = os.Symlink(filepath.Join("..", filepath.Base(serviceDestFile)), symlinkPath)
+	err = os.Symlink(filepath.Join("..", unitName), symlinkPath)
 	if err != nil && !os.IsExist(err) {
 		return "", fmt.Errorf("failed to create symlink: %v", err)
 	}
@@ -140,7 +230,7 @@ func checkServiceFileContent(optsMap map[string]unit.UnitOption) error {
 	return nil
 }
 
-func parseServiceFile(serviceFile string) (map[string]unit.UnitOption, error) {
+func parseServiceFile(serviceFile string, logger *slog.Logger) (map[string]unit.UnitOption, error) {
 	file, err := os.Open(serviceFile)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open service file: %v", err)
@@ -150,7 +240,7 @@ func parseServiceFile(serviceFile string) (map[string]unit.UnitOption, error) {
 	opts, err := unit.DeserializeOptions(file)
 	if err != nil {
 		if err.Error() == "unexpected newline encountered while parsing option name" {
-			log.Printf("WARNING: Service file %s has an unexpected newline. This may cause issues.\n", serviceFile)
+			logger.Warn("Service file has an unexpected newline. This may cause issues", "service-file", serviceFile)
 		} else {
 			return nil, fmt.Errorf("error parsing service file: %v", err)
 		}
@@ -166,8 +256,8 @@ func parseServiceFile(serviceFile string) (map[string]unit.UnitOption, error) {
 // updatePathsInServiceFile updates the paths in the service file to point to the package directory
 // It updates working directory and ExecStart path in the service file to point to the package directory based on the original paths.
 // It returns an error if the executable is not found in the package directory
-func updatePathsInServiceFile(optsMap map[string]unit.UnitOption, mountDir, packageDir, serviceFile string) error {
-	log.Printf("Updating paths in service file %s", serviceFile)
+func updatePathsInServiceFile(optsMap map[string]unit.UnitOption, mountDir, packageDir, serviceFile string, logger *slog.Logger) error {
+	logger.Debug("Updating paths in service file", "service-file", serviceFile)
 	workingDirOpt := optsMap["WorkingDirectory"]
 	workingDir := workingDirOpt.Value
 	execOpt := optsMap["ExecStart"]
@@ -194,7 +284,7 @@ func updatePathsInServiceFile(optsMap map[string]unit.UnitOption, mountDir, pack
 		newExecStartCommand = strings.Join([]string{newExecStartCommand, replaced}, " ")
 	}
 
-	log.Printf("Updated ExecStart path from: %s to: %s", execStart, newExecutablePath)
+	logger.Debug("Updated ExecStart path", "from", execStart, "to", newExecutablePath)
 
 	optsMap["ExecStart"] = unit.UnitOption{
 		Section: execOpt.Section,
@@ -248,16 +338,40 @@ func findExecutableInPath(startPath, executable, packageDir string) (string, err
 	return searchInPath(startPath, true)
 }
 
+// sectionOrder is the order of the well-known sections of a unit file. Other sections follow in alphabetical order.
+var sectionOrder = []string{"Unit", "Service", "Install"}
+
 // createUnitOptionsSlice converts a map of unit options to a slice of unit options.
+// The options are sorted by their section and name, so the same service file is always written the same way.
 func createUnitOptionsSlice(optsMap map[string]unit.UnitOption) []*unit.UnitOption {
 	var unitOptions []*unit.UnitOption
 	for _, opt := range optsMap {
-		//optCopy := opt // create a copy to get a unique address
 		unitOptions = append(unitOptions, &opt)
 	}
+	slices.SortFunc(unitOptions, func(a, b *unit.UnitOption) int {
+		if a.Section != b.Section {
+			return compareSections(a.Section, b.Section)
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
 	return unitOptions
 }
 
+// compareSections compares the sections by sectionOrder
+func compareSections(a, b string) int {
+	aIndex, bIndex := slices.Index(sectionOrder, a), slices.Index(sectionOrder, b)
+	switch {
+	case aIndex >= 0 && bIndex >= 0:
+		return aIndex - bIndex
+	case aIndex >= 0:
+		return -1
+	case bIndex >= 0:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
 // IsServiceFileInList checks if the service file is listed in the slice.
 func IsServiceFileInList(serviceFile string, configServiceFiles []string) bool {
 	for _, file := range configServiceFiles {
@@ -283,9 +397,21 @@ func AreAllServiceFromConfigPresent(serviceFiles []string, configServiceNames []
 	return true
 }
 
+// CheckSystemdRootfs checks that the partition mounted to the mount directory looks like a root filesystem with systemd,
+// i.e. it has the unit directory and the multi-user.target.wants directory services are activated in.
+func CheckSystemdRootfs(mountDir string) error {
+	for _, dir := range []string{unitDir, wantsDir} {
+		info, err := os.Stat(filepath.Join(mountDir, dir))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("partition does not look like a systemd root filesystem, directory %s is missing", dir)
+		}
+	}
+	return nil
+}
+
 // CheckRequiredServicesEnabled checks if the required services of the newly added services are enabled.
 func CheckRequiredServicesEnabled(mountDir string, serviceNames []string) error {
-	log.Printf("Checking if the required services of the newly added services are enabled.")
+	slog.Debug("Checking if the required services of the newly added services are enabled")
 	for _, serviceName := range serviceNames {
 		servicePath := filepath.Join(mountDir, "etc/systemd/system", serviceName)
 		requiredServices, err := parseRequiredOption(servicePath)
@@ -356,7 +482,7 @@ func isTargetEnabled(mountDir, targetName string) bool {
 
 // parseRequiredOption parses the Requires option from the service file and returns a slice of required services.
 func parseRequiredOption(serviceFile string) ([]string, error) {
-	opts, err := parseServiceFile(serviceFile)
+	opts, err := parseServiceFile(serviceFile, slog.Default())
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse service file %s", serviceFile)
 	}
@@ -1,11 +1,16 @@
 package service
 
 import (
+	"context"
+	"log/slog"
 	"os"
 	"package-to-image-placer/pkg/configuration"
 	"package-to-image-placer/pkg/helper"
 	"path/filepath"
+	"slices"
 	"testing"
+
+	"github.com/coreos/go-systemd/v22/unit"
 )
 
 var packageConfig = configuration.PackageConfig{
@@ -28,10 +33,13 @@ func TestAddService_Success(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 
-	err = AddService(serviceFile, mountDir, packageDir, &packageConfig)
+	unitName, err := AddService(context.Background(), serviceFile, mountDir, packageDir, &packageConfig, nil, slog.Default())
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
+	if unitName != "valid.service" {
+		t.Fatalf("expected unit name valid.service, got %s", unitName)
+	}
 
 	if enabled, err := isServiceEnabled(mountDir, filepath.Base("valid.service")); !enabled || err != nil {
 		t.Fatalf("expected service to be enabled, got disabled")
@@ -48,7 +56,7 @@ func TestAddService_MissingRequiredFields(t *testing.T) {
 	mountDir := "../../testdata/service-mount"
 	packageDir := "../../testdata/service-mount/package"
 
-	err := AddService(serviceFile, mountDir, packageDir, &packageConfig)
+	_, err := AddService(context.Background(), serviceFile, mountDir, packageDir, &packageConfig, nil, slog.Default())
 	if err == nil {
 		t.Fatalf("expected error, got nil")
 	}
@@ -73,3 +81,30 @@ func TestCheckRequiredServicesEnabled_False(t *testing.T) {
 	}
 	println(err.Error())
 }
+
+func TestCreateUnitOptionsSlice_Sorted(t *testing.T) {
+	opts := map[string]unit.UnitOption{
+		"WantedBy":    {Section: "Install", Name: "WantedBy", Value: "multi-user.target"},
+		"User":        {Section: "Service", Name: "User", Value: "root"},
+		"ExecStart":   {Section: "Service", Name: "ExecStart", Value: "/bin/true"},
+		"Description": {Section: "Unit", Name: "Description", Value: "Test"},
+		"Options":     {Section: "Mount", Name: "Options", Value: "ro"},
+	}
+	var names []string
+	for _, opt := range createUnitOptionsSlice(opts) {
+		names = append(names, opt.Name)
+	}
+	expected := []string{"Description", "ExecStart", "User", "WantedBy", "Options"}
+	if !slices.Equal(names, expected) {
+		t.Fatalf("expected options in order %v, got %v", expected, names)
+	}
+}
+
+func TestCheckSystemdRootfs(t *testing.T) {
+	if err := CheckSystemdRootfs("../../testdata/service-mount"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := CheckSystemdRootfs(t.TempDir()); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+}
@@ -2,19 +2,21 @@ package user
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
-	"os/signal"
 	"package-to-image-placer/pkg/helper"
 	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/koki-develop/go-fzf"
 	"golang.org/x/term"
 )
@@ -27,7 +29,7 @@ const colorReset = "\033[0m"
 // SelectFilesInDir allows the user to select multiple files in a directory.
 // It repeatedly prompts the user to select files until they choose to stop.
 // Returns a slice of selected file paths.
-func SelectFilesInDir(dir string, header_base string) ([]string, error) {
+func SelectFilesInDir(ctx context.Context, dir string, header_base string) ([]string, error) {
 	var selectedFiles []string
 	chooseAnotherFile := true
 	for chooseAnotherFile {
@@ -41,7 +43,7 @@ func SelectFilesInDir(dir string, header_base string) ([]string, error) {
 		selectedFiles = append(selectedFiles, selectedFile)
 
 		printCurrentlySelected(selectedFiles)
-		chooseAnotherFile = GetUserConfirmation("Do you want to select another file?")
+		chooseAnotherFile = GetUserConfirmation(ctx, "Do you want to select another file?")
 	}
 	selectedFiles = removeDuplicates(selectedFiles).([]string)
 	if len(selectedFiles) == 0 {
@@ -144,24 +146,40 @@ func removeDuplicates(slice interface{}) interface{} {
 	return uniqueSlice.Interface()
 }
 
-type partitionInfo struct {
-	partitionNumber int
-	partitionUUID   string
-	filesystemType  string
-	filesystemLabel string
+// UnknownFilesystem is the filesystem type and label of partitions whose filesystem can't be read
+const UnknownFilesystem = "Unknown"
+
+// Roles of partitions detected from their content
+const (
+	PartitionRoleRootfs  = "rootfs"
+	PartitionRoleBoot    = "boot"
+	PartitionRoleData    = "data"
+	PartitionRoleUnknown = "unknown"
+)
+
+// PartitionInfo describes a partition of a disk image and its filesystem.
+// Name and TypeGUID are set only for partitions of a GPT partition table.
+// Role is set only if the partitions are detected from their content, it is empty otherwise.
+type PartitionInfo struct {
+	Number          int
+	UUID            string
+	Name            string
+	TypeGUID        string
+	FilesystemType  string
+	FilesystemLabel string
+	Role            string
 }
 
-// SelectPartitions allows the user to select multiple partitions from a disk image.
+// SelectPartitions allows the user to select multiple partitions from the partitions of a disk image.
 // It repeatedly prompts the user to select partitions until they choose to stop.
 // Returns a slice of selected partition numbers.
-func SelectPartitions(diskPath string) ([]int, error) {
-	allPartitions, err := getPartitionInfo(diskPath)
-	if err != nil {
-		return nil, err
-	}
+func SelectPartitions(ctx context.Context, allPartitions []PartitionInfo) ([]int, error) {
 	partitionInfo := make([]string, len(allPartitions))
 	for index, partition := range allPartitions {
-		partitionInfo[index] = fmt.Sprintf("Partition %d: %s\n\tFilesystem: '%s' Type: %s", partition.partitionNumber, partition.partitionUUID, partition.filesystemLabel, partition.filesystemType)
+		partitionInfo[index] = fmt.Sprintf("Partition %d: %s '%s'\n\tFilesystem: '%s' Type: %s", partition.Number, partition.UUID, partition.Name, partition.FilesystemLabel, partition.FilesystemType)
+		if partition.Role != "" {
+			partitionInfo[index] += " Detected: " + partition.Role
+		}
 	}
 
 	var partitionsNumbers []int
@@ -185,11 +203,11 @@ func SelectPartitions(diskPath string) ([]int, error) {
 			}
 			return nil, err
 		}
-		partitionsNumbers = append(partitionsNumbers, allPartitions[selectedPartitionIndex].partitionNumber)
+		partitionsNumbers = append(partitionsNumbers, allPartitions[selectedPartitionIndex].Number)
 		selectedPartitionsInfo = append(selectedPartitionsInfo, partitionInfo[selectedPartitionIndex])
 		// printSelectedPartitions(partitionsNumbers)
 		printCurrentlySelected(selectedPartitionsInfo)
-		chooseAnotherPartition = GetUserConfirmation("Do you want to select another partition?")
+		chooseAnotherPartition = GetUserConfirmation(ctx, "Do you want to select another partition?")
 	}
 	partitionsNumbers = removeDuplicates(partitionsNumbers).([]int)
 	if len(partitionsNumbers) == 0 {
@@ -208,7 +226,7 @@ func printSelectedPartitions(selectedPartitions []int) {
 // SelectTargetDirectory allows the user to select a directory to copy the package to.
 // The user can also create a new directory.
 // Returns the selected directory.
-func SelectTargetDirectory(rootDir, searchDir string, packagePath string) (string, error) {
+func SelectTargetDirectory(ctx context.Context, rootDir, searchDir string, packagePath string) (string, error) {
 	// Validate that searchDir is within the rootDir
 	if !helper.IsWithinRootDir(rootDir, searchDir) {
 		return "", fmt.Errorf("attempt to navigate outside the allowed root directory")
@@ -234,7 +252,7 @@ func SelectTargetDirectory(rootDir, searchDir string, packagePath string) (strin
 	if selectedDir == "Select current directory" {
 		return searchDir, nil
 	} else if selectedDir == "Create new directory" {
-		newDir, err := ReadStringFromUser("Enter new directory name: ")
+		newDir, err := ReadStringFromUser(ctx, "Enter new directory name: ")
 		if err != nil {
 			return "", err
 		}
@@ -250,23 +268,49 @@ func SelectTargetDirectory(rootDir, searchDir string, packagePath string) (strin
 	} else {
 		// Recurse into the selected directory
 		nextDir := filepath.Join(searchDir, selectedDir)
-		return SelectTargetDirectory(rootDir, nextDir, packagePath)
+		return SelectTargetDirectory(ctx, rootDir, nextDir, packagePath)
 	}
 }
 
+// promptMutex serializes prompts of partitions processed in parallel
+var promptMutex sync.Mutex
+
 // ReadStringFromUser reads a string input from the user.
-// Returns the input string.
-func ReadStringFromUser(prompt string) (string, error) {
+// Returns the input string or the context error if the context is cancelled while waiting for the input.
+func ReadStringFromUser(ctx context.Context, prompt string) (string, error) {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
 	reader := bufio.NewReader(os.Stdin)
 
 	fmt.Printf(interactionTextColor + prompt + colorReset)
-	path, err := reader.ReadString('\n')
+	var path string
+	err := readStdin(ctx, func() error {
+		var err error
+		path, err = reader.ReadString('\n')
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(path), nil
 }
 
+// readStdin runs the read from the standard input and waits until it finishes or the context is cancelled.
+// On cancellation the read is abandoned, its result is dropped.
+func readStdin(ctx context.Context, read func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- read()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // getDirectories returns a list of directories in the provided path.
 func getDirectories(path string, rootDir string) ([]string, error) {
 	var dirs []string
@@ -288,24 +332,21 @@ func getDirectories(path string, rootDir string) ([]string, error) {
 }
 
 // GetUserConfirmation asks the user for confirmation. The message is displayed to the user.
+// Returns false if the context is cancelled while waiting for the answer.
 // Returns true if the user confirms, false otherwise.
-func GetUserConfirmation(message string) bool {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	defer signal.Stop(c)
-
-	go func() {
-		<-c
-		CleanUpCommandLine()
-		os.Exit(1)
-	}()
+func GetUserConfirmation(ctx context.Context, message string) bool {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
 
 	SetUpCommandline()
 	defer CleanUpCommandLine()
 
 	var b = make([]byte, 1)
 	fmt.Print(interactionTextColor + message + colorReset + " [Y|y to confirm, any other key to cancel]\n")
-	_, err := os.Stdin.Read(b)
+	err := readStdin(ctx, func() error {
+		_, err := os.Stdin.Read(b)
+		return err
+	})
 	if err != nil {
 		return false
 	}
@@ -317,7 +358,7 @@ func GetUserConfirmation(message string) bool {
 // It configures the terminal to not cache characters.
 func SetUpCommandline() {
 	if !term.IsTerminal(int(os.Stdout.Fd())) {
-		log.Printf("Warning: /dev/tty not available, skipping terminal setup")
+		slog.Warn("/dev/tty not available, skipping terminal setup")
 		return
 	}
 	//do not cache characters
@@ -328,7 +369,7 @@ func SetUpCommandline() {
 // CleanUpCommandLine reverts the terminal settings to their default state.
 func CleanUpCommandLine() {
 	if !term.IsTerminal(int(os.Stdout.Fd())) {
-		log.Printf("Warning: /dev/tty not available, skipping terminal cleanup")
+		slog.Warn("/dev/tty not available, skipping terminal cleanup")
 		return
 	}
 	CleanUpCommandLineSilent()
@@ -358,39 +399,50 @@ func fuzzySelectOne(prompt string, items []string) (int, error) {
 	return selectedIndex[0], nil
 }
 
-// getPartitionInfo retrieves partition information from a disk image.
-// Returns a slice of partitionInfo structs.
-func getPartitionInfo(imagePath string) ([]partitionInfo, error) {
-	disk, _ := diskfs.Open(imagePath)
+// GetPartitionInfo retrieves partition information from a disk image.
+// Returns a slice of PartitionInfo structs.
+func GetPartitionInfo(imagePath string) ([]PartitionInfo, error) {
+	disk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return nil, err
+	}
 	defer disk.Close()
 	table, err := disk.GetPartitionTable()
 	if err != nil {
 		return nil, err
 	}
-	var partitions []partitionInfo
+	var partitions []PartitionInfo
 	for index, p := range table.GetPartitions() {
 		partitionNumber := index + 1
+		if p.GetSize() == 0 {
+			// Unused entry of the partition table
+			continue
+		}
 		fs, err := disk.GetFilesystem(partitionNumber)
 		if err != nil {
-			log.Printf("Error getting filesystem on partition %d: %s\n", partitionNumber, err)
+			slog.Warn("Unable to get filesystem of partition", "partition", partitionNumber, "error", err)
 			fs = nil
 		}
-		partition := partitionInfo{
-			partitionNumber: partitionNumber,
-			partitionUUID:   p.UUID(),
-			filesystemType: func() string {
+		partition := PartitionInfo{
+			Number: partitionNumber,
+			UUID:   p.UUID(),
+			FilesystemType: func() string {
 				if fs != nil {
 					return typeToString(fs.Type())
 				}
-				return "Unknown"
+				return UnknownFilesystem
 			}(),
-			filesystemLabel: func() string {
+			FilesystemLabel: func() string {
 				if fs != nil {
 					return fs.Label()
 				}
-				return "Unknown"
+				return UnknownFilesystem
 			}(),
 		}
+		if gptPartition, isGPT := p.(*gpt.Partition); isGPT {
+			partition.Name = gptPartition.Name
+			partition.TypeGUID = string(gptPartition.Type)
+		}
 		partitions = append(partitions, partition)
 	}
 	return partitions, nil
@@ -409,6 +461,6 @@ func typeToString(t filesystem.Type) string {
 	case filesystem.TypeExt4:
 		return "Ext4"
 	default:
-		return "Unknown"
+		return UnknownFilesystem
 	}
 }
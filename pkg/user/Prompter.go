@@ -0,0 +1,49 @@
+package user
+
+import "context"
+
+// Prompter asks the user for decisions during an interactive run.
+// It allows the tool to be used as a library with a custom user interface.
+type Prompter interface {
+	// Confirm asks the user for confirmation. Returns true if the user confirms.
+	Confirm(message string) bool
+	// ReadString reads a string input from the user.
+	ReadString(prompt string) (string, error)
+	// SelectFiles lets the user select multiple package files, starting in the given directory.
+	SelectFiles(dir string, header string) ([]string, error)
+	// SelectPartitions lets the user select some of the partitions of the disk image.
+	SelectPartitions(partitions []PartitionInfo) ([]int, error)
+	// SelectTargetDirectory lets the user select a directory within rootDir to copy the package to.
+	SelectTargetDirectory(rootDir string, searchDir string, packagePath string) (string, error)
+}
+
+// TerminalPrompter is a Prompter interacting with the user in the terminal.
+// Pending prompts are abandoned when its context is cancelled, so the program can be interrupted while waiting for the user.
+type TerminalPrompter struct {
+	ctx context.Context
+}
+
+// NewTerminalPrompter creates a Prompter interacting with the user in the terminal.
+func NewTerminalPrompter(ctx context.Context) *TerminalPrompter {
+	return &TerminalPrompter{ctx: ctx}
+}
+
+func (prompter *TerminalPrompter) Confirm(message string) bool {
+	return GetUserConfirmation(prompter.ctx, message)
+}
+
+func (prompter *TerminalPrompter) ReadString(prompt string) (string, error) {
+	return ReadStringFromUser(prompter.ctx, prompt)
+}
+
+func (prompter *TerminalPrompter) SelectFiles(dir string, header string) ([]string, error) {
+	return SelectFilesInDir(prompter.ctx, dir, header)
+}
+
+func (prompter *TerminalPrompter) SelectPartitions(partitions []PartitionInfo) ([]int, error) {
+	return SelectPartitions(prompter.ctx, partitions)
+}
+
+func (prompter *TerminalPrompter) SelectTargetDirectory(rootDir string, searchDir string, packagePath string) (string, error) {
+	return SelectTargetDirectory(prompter.ctx, rootDir, searchDir, packagePath)
+}